@@ -0,0 +1,106 @@
+package agent
+
+import (
+	"container/list"
+	"os"
+	"sync"
+
+	"github.com/blastbao/whisper/common"
+	"github.com/blastbao/whisper/mediator"
+)
+
+// 块分配
+//
+// agent 定时上报数据目录的容量(CMD_DISK_REPORT)，mediator 创建块后发送 CMD_ALLOC_BLOCK ，
+// agent 创建块文件并预分配空间(preallocate)，加入块注册表后回复 CMD_ALLOC_BLOCK_DONE 。
+// 块在 mediator 确认并刷新块列表后才可写入，只读或退役的块只用于读取。
+
+// 创建块文件并预分配空间，块已存在时只补充预分配，用于 mediator 重发
+func (n *Node) AllocBlock(block mediator.Block) error {
+	if e := os.MkdirAll(block.Dir, 0755); e != nil {
+		return e
+	}
+
+	bs := &BlockInServer{block, new(sync.Mutex), false}
+	file, e := os.OpenFile(bs.GetFilePath(), os.O_WRONLY|os.O_CREATE, 0666)
+	if e != nil {
+		return e
+	}
+	e = preallocate(file, int64(block.Size))
+	if e2 := file.Close(); e == nil {
+		e = e2
+	}
+	if e != nil {
+		return e
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.Blocks == nil {
+		n.Blocks = list.New()
+	}
+	for e := n.Blocks.Front(); e != nil; e = e.Next() {
+		if e.Value.(*BlockInServer).BlockId == block.BlockId {
+			return nil
+		}
+	}
+	n.Blocks.PushBack(bs)
+	return nil
+}
+
+// 所有数据目录的容量
+func (n *Node) DiskInfos() []mediator.DiskInfo {
+	n.mutex.Lock()
+	dirs := append([]string{}, n.Dirs...)
+	n.mutex.Unlock()
+
+	var disks []mediator.DiskInfo
+	for _, dir := range dirs {
+		disk, e := diskInfo(dir)
+		if e != nil {
+			common.Log.Warning("node disk info error", dir, e)
+			continue
+		}
+		disks = append(disks, disk)
+	}
+	return disks
+}
+
+// 上报数据目录的容量
+func (ns *NodeServer) reportDisks() {
+	disks := ns.node.DiskInfos()
+	if len(disks) == 0 {
+		return
+	}
+	body, e := common.Enc(&mediator.DiskReport{Addr: ns.host, Disks: disks})
+	if e != nil {
+		common.Log.Error("node server disk report encode error", e)
+		return
+	}
+	if e := ns.mc.Send(mediator.Pack{Command: mediator.CMD_DISK_REPORT, Body: body}); e != nil {
+		common.Log.Warning("node server disk report error", e)
+	}
+}
+
+// 预分配 mediator 创建的块并回复结果
+func (ns *NodeServer) allocBlock(block mediator.Block) {
+	r := mediator.BlockAllocResult{BlockId: block.BlockId}
+	if e := ns.node.AllocBlock(block); e != nil {
+		common.Log.Error("node server alloc block error", block.BlockId, e)
+		r.Msg = e.Error()
+	} else if e := ns.node.PersistRegistry(); e != nil {
+		common.Log.Error("node server persist block registry error", e)
+		r.Msg = e.Error()
+	} else {
+		common.Log.Info("node server alloc block done", block.BlockId, block.Dir)
+		r.Flag = true
+	}
+
+	body, e := common.Enc(&r)
+	if e != nil {
+		common.Log.Error("node server alloc result encode error", e)
+		return
+	}
+	ns.mc.Send(mediator.Pack{Command: mediator.CMD_ALLOC_BLOCK_DONE, Body: body})
+}
@@ -0,0 +1,52 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blastbao/whisper/mediator"
+)
+
+// 预分配不改变文件长度，块确认可写前不写入
+func TestNodeAllocBlock(t *testing.T) {
+	n, dir := newTestNode(t)
+	defer os.RemoveAll(dir)
+	n.Dirs = []string{dir}
+
+	block := mediator.Block{BlockId: 2, Addr: "localhost", Dir: filepath.Join(dir, "disk2"), Size: 1024, Status: mediator.BLOCK_STATUS_ALLOCATING}
+	for i := 0; i < 2; i++ {
+		if e := n.AllocBlock(block); e != nil {
+			t.Fatal(e)
+		}
+	}
+	fi, e := os.Stat(filepath.Join(block.Dir, BLOCK_FILE_NAME_PRE+"2"))
+	if e != nil || fi.Size() != 0 {
+		t.Fatal("block file error", fi, e)
+	}
+	if blocks := n.ListBlocks(); len(blocks) != 2 {
+		t.Fatal("allocated block not added", blocks)
+	}
+
+	// block 1 is full, block 2 not acknowledged
+	n.MergeBlocks([]mediator.Block{
+		{BlockId: 1, Addr: "localhost", Dir: dir, Size: 1024, End: 1024},
+		block,
+	})
+	if _, e := n.SaveLocal("a", []byte("abc")); e == nil {
+		t.Fatal("allocating block should not be written")
+	}
+	if n.FreeBytes() != 0 {
+		t.Fatal("allocating block should not count as free", n.FreeBytes())
+	}
+
+	block.Status = mediator.BLOCK_STATUS_OK
+	n.MergeBlocks([]mediator.Block{block})
+	if rec, e := n.SaveLocal("a", []byte("abc")); e != nil || rec.BlockId != 2 || rec.Offset != 0 {
+		t.Fatal("save to allocated block error", rec, e)
+	}
+
+	if disks := n.DiskInfos(); len(disks) != 1 || disks[0].Dir != dir || disks[0].Free <= 0 {
+		t.Fatal("disk info error", disks)
+	}
+}
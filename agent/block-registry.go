@@ -0,0 +1,319 @@
+package agent
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blastbao/whisper/common"
+	"github.com/blastbao/whisper/mediator"
+)
+
+// 块注册表
+//
+// agent 在每个数据目录下保存本机块的元数据(BLOCK_REGISTRY_FILE)，启动时加载，mediator 不可用时仍可写入。
+// 块的 End 以块文件为准：加载时取记录值与文件长度的较大者，合并 mediator 推送的块列表时 End 不回退，
+// 避免覆盖已写入的数据。agent 定时将 End 上报给 mediator(CMD_BLOCK_REPORT)。
+//
+// 注册表格式：REGISTRY_MAGIC + REGISTRY_VERSION ，之后每个块 [4 字节长度][序列化的 Block]，
+// 每个块单独解码，Block 末尾新增的字段只影响该块。
+// 旧版本将 []Block 整体序列化，没有 header ，按各版本的 Block 结构严格解码。
+
+const (
+	BLOCK_REGISTRY_FILE = "blocks.registry"
+	REGISTRY_VERSION    = 1
+)
+
+var REGISTRY_MAGIC []byte = []byte{0xF7, 'W', 'B', 'R'}
+
+// report block ends to mediator and persist the registry every interval
+var BlockReportIntervalSec int = 30
+
+// 块文件长度，文件不存在时为 0
+func blockFileEnd(block mediator.Block) int {
+	bs := &BlockInServer{Block: block}
+	fi, e := os.Stat(bs.GetFilePath())
+	if e != nil {
+		return 0
+	}
+	return int(fi.Size())
+}
+
+// 加载数据目录下的注册表，没有注册表的目录忽略
+func (n *Node) LoadRegistry(dirs []string) error {
+	var blocks []mediator.Block
+	for _, dir := range dirs {
+		bb, e := ioutil.ReadFile(filepath.Join(dir, BLOCK_REGISTRY_FILE))
+		if e != nil {
+			if os.IsNotExist(e) {
+				continue
+			}
+			return e
+		}
+
+		one, e := decRegistry(bb)
+		if e != nil {
+			return e
+		}
+		blocks = append(blocks, one...)
+	}
+
+	l := list.New()
+	for _, block := range blocks {
+		if end := blockFileEnd(block); end > block.End {
+			common.Log.Warning("node registry block end behind file", block.BlockId, block.End, end)
+			block.End = end
+		}
+		l.PushBack(&BlockInServer{block, new(sync.Mutex), false})
+	}
+
+	n.mutex.Lock()
+	n.Dirs = dirs
+	n.Blocks = l
+	n.mutex.Unlock()
+
+	common.Log.Info("node registry loaded blocks", len(blocks), dirs)
+	return nil
+}
+
+// 合并 mediator 推送的本机块，已有的块保留写锁，End 取较大值
+func (n *Node) MergeBlocks(blocks []mediator.Block) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	old := make(map[int]*BlockInServer)
+	if n.Blocks != nil {
+		for e := n.Blocks.Front(); e != nil; e = e.Next() {
+			block := e.Value.(*BlockInServer)
+			old[block.BlockId] = block
+		}
+	}
+
+	l := list.New()
+	for _, block := range blocks {
+		if bs, ok := old[block.BlockId]; ok {
+			bs.mutex.Lock()
+			end := bs.End
+			bs.Block = block
+			if end > bs.End {
+				bs.End = end
+			}
+			bs.mutex.Unlock()
+			l.PushBack(bs)
+			continue
+		}
+
+		if end := blockFileEnd(block); end > block.End {
+			common.Log.Warning("node block end behind file", block.BlockId, block.End, end)
+			block.End = end
+		}
+		l.PushBack(&BlockInServer{block, new(sync.Mutex), false})
+	}
+	n.Blocks = l
+}
+
+// 当前所有块
+func (n *Node) ListBlocks() []mediator.Block {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	var blocks []mediator.Block
+	if n.Blocks == nil {
+		return blocks
+	}
+	for e := n.Blocks.Front(); e != nil; e = e.Next() {
+		blocks = append(blocks, e.Value.(*BlockInServer).Block)
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].BlockId < blocks[j].BlockId })
+	return blocks
+}
+
+// 按目录保存注册表，目录中已没有块时删除
+func (n *Node) PersistRegistry() error {
+	n.persistMutex.Lock()
+	defer n.persistMutex.Unlock()
+
+	byDir := make(map[string][]mediator.Block)
+	for _, block := range n.ListBlocks() {
+		byDir[block.Dir] = append(byDir[block.Dir], block)
+	}
+
+	n.mutex.Lock()
+	dirs := append([]string{}, n.Dirs...)
+	n.mutex.Unlock()
+	for dir := range byDir {
+		if !common.ContainsStr(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+
+	for _, dir := range dirs {
+		fn := filepath.Join(dir, BLOCK_REGISTRY_FILE)
+		blocks := byDir[dir]
+		if len(blocks) == 0 {
+			if e := os.Remove(fn); e != nil && !os.IsNotExist(e) {
+				return e
+			}
+			continue
+		}
+
+		bb, e := encRegistry(blocks)
+		if e != nil {
+			return e
+		}
+		if e := common.WriteFileSync(bb, fn); e != nil {
+			return e
+		}
+	}
+
+	n.mutex.Lock()
+	n.Dirs = dirs
+	n.mutex.Unlock()
+	return nil
+}
+
+// 上报给 mediator 的块位置及自上次上报以来的读取频率
+func (n *Node) BlockEnds() []mediator.BlockEnd {
+	visits := n.visitAvgs(time.Now())
+
+	var ends []mediator.BlockEnd
+	for _, block := range n.ListBlocks() {
+		ends = append(ends, mediator.BlockEnd{BlockId: block.BlockId, End: block.End, VisitAvg: visits[block.BlockId]})
+	}
+	return ends
+}
+
+func encRegistry(blocks []mediator.Block) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	buf.Write(REGISTRY_MAGIC)
+	buf.WriteByte(REGISTRY_VERSION)
+
+	head := make([]byte, 4)
+	for _, block := range blocks {
+		bb, e := common.Enc(&block)
+		if e != nil {
+			return nil, e
+		}
+		binary.BigEndian.PutUint32(head, uint32(len(bb)))
+		buf.Write(head)
+		buf.Write(bb)
+	}
+	return buf.Bytes(), nil
+}
+
+func decRegistry(bb []byte) ([]mediator.Block, error) {
+	if !bytes.HasPrefix(bb, REGISTRY_MAGIC) {
+		return decLegacyRegistry(bb)
+	}
+	pos := len(REGISTRY_MAGIC)
+	if len(bb) <= pos || bb[pos] != REGISTRY_VERSION {
+		return nil, errors.New("node registry version not supported")
+	}
+	pos++
+
+	var blocks []mediator.Block
+	for pos < len(bb) {
+		if len(bb)-pos < 4 {
+			return nil, errors.New("node registry truncated")
+		}
+		size := int(binary.BigEndian.Uint32(bb[pos:]))
+		pos += 4
+		if len(bb)-pos < size {
+			return nil, errors.New("node registry truncated")
+		}
+
+		var block mediator.Block
+		if e := common.DecCompat(bb[pos:pos+size], &block); e != nil {
+			return nil, e
+		}
+		blocks = append(blocks, block)
+		pos += size
+	}
+	return blocks, nil
+}
+
+// 旧版本注册表中各版本的 Block
+type registryBlockV0 struct {
+	BlockId int
+	DataId  int
+	Dir     string
+	Addr    string
+	Size    int
+	End     int
+}
+
+type registryBlockV1 struct {
+	BlockId int
+	DataId  int
+	Dir     string
+	Addr    string
+	Size    int
+	End     int
+	Status  int
+}
+
+type registryBlockV2 struct {
+	BlockId  int
+	DataId   int
+	Dir      string
+	Addr     string
+	Size     int
+	End      int
+	Status   int
+	VisitAvg int
+}
+
+// 依次按新到旧的结构严格解码，必须用完所有字节且重新序列化后一致
+func decLegacyRegistry(bb []byte) ([]mediator.Block, error) {
+	var v3 []mediator.Block
+	if decStrict(bb, &v3) {
+		return v3, nil
+	}
+
+	var v2 []registryBlockV2
+	if decStrict(bb, &v2) {
+		var blocks []mediator.Block
+		for _, b := range v2 {
+			blocks = append(blocks, mediator.Block{BlockId: b.BlockId, DataId: b.DataId, Dir: b.Dir, Addr: b.Addr,
+				Size: b.Size, End: b.End, Status: b.Status, VisitAvg: b.VisitAvg})
+		}
+		return blocks, nil
+	}
+
+	var v1 []registryBlockV1
+	if decStrict(bb, &v1) {
+		var blocks []mediator.Block
+		for _, b := range v1 {
+			blocks = append(blocks, mediator.Block{BlockId: b.BlockId, DataId: b.DataId, Dir: b.Dir, Addr: b.Addr,
+				Size: b.Size, End: b.End, Status: b.Status})
+		}
+		return blocks, nil
+	}
+
+	var v0 []registryBlockV0
+	if decStrict(bb, &v0) {
+		var blocks []mediator.Block
+		for _, b := range v0 {
+			blocks = append(blocks, mediator.Block{BlockId: b.BlockId, DataId: b.DataId, Dir: b.Dir, Addr: b.Addr,
+				Size: b.Size, End: b.End})
+		}
+		return blocks, nil
+	}
+
+	return nil, errors.New("node registry legacy format not recognized")
+}
+
+func decStrict(bb []byte, v interface{}) bool {
+	if e := common.Dec(bb, v); e != nil {
+		return false
+	}
+	again, e := common.Enc(v)
+	return e == nil && bytes.Equal(again, bb)
+}
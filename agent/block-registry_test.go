@@ -0,0 +1,101 @@
+package agent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blastbao/whisper/common"
+	"github.com/blastbao/whisper/mediator"
+)
+
+// 重启后从注册表加载块，End 以文件长度为准
+func TestNodeRegistry(t *testing.T) {
+	n, dir := newTestNode(t)
+	defer os.RemoveAll(dir)
+	n.Dirs = []string{dir}
+
+	if _, e := n.SaveLocal("a", []byte("0123456789")); e != nil {
+		t.Fatal(e)
+	}
+	if e := n.PersistRegistry(); e != nil {
+		t.Fatal(e)
+	}
+	// written after the registry is saved
+	if _, e := n.SaveLocal("b", []byte("abcde")); e != nil {
+		t.Fatal(e)
+	}
+
+	n2 := &Node{}
+	if e := n2.LoadRegistry([]string{dir}); e != nil {
+		t.Fatal(e)
+	}
+	blocks := n2.ListBlocks()
+	if len(blocks) != 1 || blocks[0].BlockId != 1 || blocks[0].End != 15 {
+		t.Fatal("registry load error", blocks)
+	}
+
+	// stale end from mediator does not move back, new block added
+	n2.MergeBlocks([]mediator.Block{
+		{BlockId: 1, Addr: "localhost", Dir: dir, Size: 1024 * 1024, End: 10},
+		{BlockId: 2, Addr: "localhost", Dir: dir, Size: 1024 * 1024},
+	})
+	rec, e := n2.SaveLocal("c", []byte("xyz"))
+	if e != nil || rec.BlockId != 1 || rec.Offset != 15 {
+		t.Fatal("save after merge error", rec, e)
+	}
+	if ends := n2.BlockEnds(); len(ends) != 2 || ends[0] != (mediator.BlockEnd{BlockId: 1, End: 18}) || ends[1].End != 0 {
+		t.Fatal("block ends error", ends)
+	}
+
+	// dir without blocks
+	n2.MergeBlocks(nil)
+	if e := n2.PersistRegistry(); e != nil {
+		t.Fatal(e)
+	}
+	n3 := &Node{}
+	if e := n3.LoadRegistry([]string{dir}); e != nil || len(n3.ListBlocks()) != 0 {
+		t.Fatal("empty registry error", n3.ListBlocks(), e)
+	}
+}
+
+// 旧版本整体序列化的注册表，多个块时不能按新的 Block 结构解码
+func TestNodeRegistryLegacy(t *testing.T) {
+	dir, e := ioutil.TempDir("", "test-whisper-registry")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	olds := []interface{}{
+		[]registryBlockV0{{BlockId: 1, DataId: 1, Dir: dir, Addr: "localhost", Size: 1024, End: 10}, {BlockId: 2, DataId: 1, Dir: dir, Addr: "localhost", Size: 1024, End: 20}},
+		[]registryBlockV1{{BlockId: 1, DataId: 1, Dir: dir, Addr: "localhost", Size: 1024, End: 10}, {BlockId: 2, DataId: 1, Dir: dir, Addr: "localhost", Size: 1024, End: 20, Status: mediator.BLOCK_STATUS_READONLY}},
+		[]registryBlockV2{{BlockId: 1, DataId: 1, Dir: dir, Addr: "localhost", Size: 1024, End: 10}, {BlockId: 2, DataId: 1, Dir: dir, Addr: "localhost", Size: 1024, End: 20, VisitAvg: 3}},
+	}
+	for i, old := range olds {
+		bb, _ := common.Enc(old)
+		if e := ioutil.WriteFile(filepath.Join(dir, BLOCK_REGISTRY_FILE), bb, 0666); e != nil {
+			t.Fatal(e)
+		}
+
+		n := &Node{}
+		if e := n.LoadRegistry([]string{dir}); e != nil {
+			t.Fatal(i, e)
+		}
+		blocks := n.ListBlocks()
+		if len(blocks) != 2 || blocks[0].End != 10 || blocks[1].End != 20 || blocks[1].Dir != dir || blocks[1].Size != 1024 {
+			t.Fatal("legacy registry load error", i, blocks)
+		}
+
+		// rewritten in the new format
+		if e := n.PersistRegistry(); e != nil {
+			t.Fatal(e)
+		}
+		bb, _ = ioutil.ReadFile(filepath.Join(dir, BLOCK_REGISTRY_FILE))
+		if blocks2, e := decRegistry(bb); e != nil || !bytes.HasPrefix(bb, REGISTRY_MAGIC) || len(blocks2) != 2 || blocks2[1] != blocks[1] {
+			t.Fatal("registry rewrite error", blocks2, e)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package agent
+
+import (
+	"errors"
+
+	"github.com/blastbao/whisper/mediator"
+)
+
+func diskInfo(dir string) (mediator.DiskInfo, error) {
+	return mediator.DiskInfo{}, errors.New("node disk info not supported")
+}
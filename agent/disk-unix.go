@@ -0,0 +1,23 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package agent
+
+import (
+	"syscall"
+
+	"github.com/blastbao/whisper/mediator"
+)
+
+// 目录所在磁盘的容量
+func diskInfo(dir string) (mediator.DiskInfo, error) {
+	var st syscall.Statfs_t
+	if e := syscall.Statfs(dir, &st); e != nil {
+		return mediator.DiskInfo{}, e
+	}
+	return mediator.DiskInfo{
+		Dir:   dir,
+		Free:  int64(st.Bavail) * int64(st.Bsize),
+		Total: int64(st.Blocks) * int64(st.Bsize),
+	}, nil
+}
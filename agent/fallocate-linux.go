@@ -0,0 +1,22 @@
+//go:build linux
+// +build linux
+
+package agent
+
+import (
+	"os"
+	"syscall"
+)
+
+// FALLOC_FL_KEEP_SIZE, file length stays as the block end
+const fallocKeepSize = 0x1
+
+// 预留块文件的磁盘空间，不改变文件长度
+func preallocate(file *os.File, size int64) error {
+	e := syscall.Fallocate(int(file.Fd()), fallocKeepSize, 0, size)
+	if e == syscall.EOPNOTSUPP || e == syscall.ENOSYS {
+		// 文件系统不支持时写入时再分配
+		return nil
+	}
+	return e
+}
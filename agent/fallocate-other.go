@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package agent
+
+import (
+	"os"
+)
+
+// 没有 fallocate ，写入时再分配空间
+func preallocate(file *os.File, size int64) error {
+	return nil
+}
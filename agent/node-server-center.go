@@ -0,0 +1,147 @@
+package agent
+
+import (
+	"errors"
+
+	"github.com/blastbao/whisper/center"
+	"github.com/blastbao/whisper/common"
+	"github.com/blastbao/whisper/mediator"
+	"github.com/valyala/gorpc"
+)
+
+// center 分片
+//
+// mediator 将所有分组的拓扑写入 KEY_CENTER_SHARDS ，agent 连接每个分组的 master ，
+// 记录按 oid 中的 IndexId 上报给负责的分组，没有分组信息时使用默认 master(ns.c)。
+// 块内的记录可能属于任何分组，块压缩时向每个 master 查询并更新。
+
+// 按分片拓扑连接各分组 master ，已有的连接保留
+func (ns *NodeServer) ConnectToShards(shards mediator.CenterShards) {
+	var addrs []string
+	for _, role := range shards.Groups {
+		if role.Master != "" && !common.ContainsStr(addrs, role.Master) {
+			addrs = append(addrs, role.Master)
+		}
+	}
+	common.Log.Info("node server center masters ready to connect", addrs)
+
+	ns.centerMutex.Lock()
+	defer ns.centerMutex.Unlock()
+
+	masters := make(map[string]*gorpc.Client)
+	for addr, cl := range ns.masters {
+		if common.ContainsStr(addrs, addr) {
+			masters[addr] = cl
+		} else {
+			common.Log.Info("node server center master is disconnecting - " + addr)
+			cl.Stop()
+		}
+	}
+	for _, addr := range addrs {
+		if _, ok := masters[addr]; !ok {
+			common.Log.Info("node server center master is connecting - " + addr)
+			cl := gorpc.NewTCPClient(addr)
+			cl.Start()
+			masters[addr] = cl
+		}
+	}
+	ns.masters = masters
+	ns.shards = shards
+}
+
+// 负责 indexId 的分组 master ，没有分组信息时为默认 master
+func (ns *NodeServer) centerFor(indexId int) *gorpc.Client {
+	ns.centerMutex.Lock()
+	defer ns.centerMutex.Unlock()
+
+	if role, ok := ns.shards.GroupOf(indexId); ok {
+		if cl, ok := ns.masters[role.Master]; ok {
+			return cl
+		}
+	}
+	return ns.c
+}
+
+// 所有分组的 master
+func (ns *NodeServer) centerMasters() []*gorpc.Client {
+	ns.centerMutex.Lock()
+	defer ns.centerMutex.Unlock()
+
+	var r []*gorpc.Client
+	for _, cl := range ns.masters {
+		r = append(r, cl)
+	}
+	if len(r) == 0 && ns.c != nil {
+		r = append(r, ns.c)
+	}
+	return r
+}
+
+func (ns *NodeServer) closeMasters() {
+	ns.centerMutex.Lock()
+	defer ns.centerMutex.Unlock()
+
+	for _, cl := range ns.masters {
+		cl.Stop()
+	}
+	ns.masters = nil
+}
+
+// 从所有分组获取块内仍需保留的数据段
+func (ns *NodeServer) getLiveRegions(blockId int) (center.RecordList, error) {
+	masters := ns.centerMasters()
+	if len(masters) == 0 {
+		return nil, errors.New("node server center not connected")
+	}
+
+	var records center.RecordList
+	offsets := make(map[int]bool)
+	for _, cl := range masters {
+		resp, e := cl.Call(center.PackRecord{Command: center.CMD_GET_LIVE_REGIONS, Rec: center.Record{BlockId: blockId}})
+		if e != nil {
+			return nil, e
+		}
+		packReturn := resp.(center.PackRecord)
+		if !packReturn.Flag {
+			return nil, errors.New(packReturn.Msg)
+		}
+
+		var one center.RecordList
+		if e = common.Dec(packReturn.Body, &one); e != nil {
+			return nil, e
+		}
+		for _, rec := range one {
+			if !offsets[rec.Offset] {
+				offsets[rec.Offset] = true
+				records = append(records, rec)
+			}
+		}
+	}
+	return records, nil
+}
+
+// 通知所有分组更新记录位置，分组只更新自己的记录
+func (ns *NodeServer) moveRecords(moves []center.RecordMove) error {
+	if len(moves) == 0 {
+		return nil
+	}
+	masters := ns.centerMasters()
+	if len(masters) == 0 {
+		return errors.New("node server center not connected")
+	}
+
+	body, e := common.Enc(moves)
+	if e != nil {
+		return e
+	}
+	for _, cl := range masters {
+		resp, e := cl.Call(center.PackRecord{Command: center.CMD_MOVE_RECORDS, Body: body})
+		if e != nil {
+			return e
+		}
+		if packReturn := resp.(center.PackRecord); !packReturn.Flag {
+			return errors.New(packReturn.Msg)
+		}
+	}
+	return nil
+}
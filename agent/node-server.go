@@ -2,10 +2,11 @@ package agent
 
 import (
 	"bytes"
-	"container/list"
 	"encoding/gob"
+	"errors"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/blastbao/whisper/center"
 	"github.com/blastbao/whisper/common"
@@ -24,6 +25,17 @@ type NodeServer struct {
 	c    *gorpc.Client       // to center server
 	mc   *mediator.NetClient // to mediator
 	node *Node
+	host string // node host, same as block addr
+
+	DataDirs []string // dirs holding the block registry, loaded before mediator is connected
+	Zone     string   // failure domain labels registered to mediator
+	Rack     string
+	chClose  chan bool
+
+	// masters of center groups, see node-server-center.go
+	shards      mediator.CenterShards
+	masters     map[string]*gorpc.Client // addr -> client
+	centerMutex sync.Mutex
 }
 
 //
@@ -40,40 +52,66 @@ func (ns *NodeServer) handler(clientAddr string, request interface{}) interface{
 
 		record := pack.Rec
 
-		// 把 record 数据保存到本地，得到存储的详情 recSaved 。
-		recSaved, e := ns.node.SaveLocal(record.Oid, pack.Body)
+		// 把 record 数据保存到本地，优先使用 client 选择的块，得到存储的详情 recSaved 。
+		// 上报 center 完成前块不会被压缩。
+		recSaved, e := ns.node.SaveAndReport(record.BlockId, record.Oid, pack.Body, func(recSaved *center.Record) error {
+
+			// 填充信息
+			recSaved.Oid = record.Oid
+			recSaved.Mime = record.Mime
+			recSaved.Created = time.Now().Unix()
+			recSaved.Expired = record.Expired
+			recSaved.EcData = record.EcData
+			recSaved.EcParity = record.EcParity
+			recSaved.EcFrom = record.EcFrom
+			recSaved.EcLen = record.EcLen
+			recSaved.EcMd5 = record.EcMd5
+
+			// 把存储详情 recSaved 上报到 Center ，Center 会维护相关索引。
+			packReq := center.PackRecord{Command: center.CMD_PUT_RECORD, Rec: *recSaved}
+			cl := ns.centerFor(center.GetOidInfo(record.Oid).IndexId)
+			if cl == nil {
+				packReturn.Msg = "node server center not connected"
+				return errors.New(packReturn.Msg)
+			}
+			resp, e := cl.Call(packReq)
+			if e != nil {
+				// reset local, monitor check is better
+				//ns.Node.ResetLocal(recSaved)
+				packReturn.Msg = "node server put rec error - " + e.Error()
+				return e
+			}
+			if packCenter := resp.(center.PackRecord); !packCenter.Flag {
+				packReturn.Msg = "node server put rec fail - " + packCenter.Msg
+				return errors.New(packReturn.Msg)
+			} else {
+				// 写入序号，client 用于 read-your-writes
+				packReturn.Seq = packCenter.Seq
+			}
+			return nil
+		})
 		if e != nil {
 			packReturn.Flag = false
-			packReturn.Msg = "node server save local error - " + e.Error()
+			if packReturn.Msg == "" {
+				packReturn.Msg = "node server save local error - " + e.Error()
+			}
 			return packReturn
 		}
 
-		// 填充信息
-		recSaved.Oid = record.Oid
-		recSaved.Mime = record.Mime
-
-		// 把存储详情 recSaved 上报到 Center ，Center 会维护相关索引。
-		packReq := center.PackRecord{Command: center.CMD_PUT_RECORD, Rec: recSaved}
-		_, e = ns.c.Call(packReq)
-		if e != nil {
-			// reset local, monitor check is better
-			//ns.Node.ResetLocal(recSaved)
-			packReturn.Flag = false
-			packReturn.Msg = "node server put rec error - " + e.Error()
-			return packReturn
-		}
+		// 存储位置，client 用于批量写入时为其它文件创建共享数据的记录
+		packReturn.Rec = recSaved
 
 		// 返回成功
 		packReturn.Flag = true
 
 
 	// 从 NodeSvr 下载数据
-	// (1) 去指定块 record.BlockId 读取 record 的数据。
+	// (1) 去指定块 record.BlockId 读取 record 的数据，pack.RangeFrom/RangeLen 指定读取范围。
 	} else if AGENT_SERVER_COMMAND_GET == pack.Command {
 
 		record := pack.Rec
 		// 去指定块 record.BlockId 读取 record 的数据
-		body, error := ns.node.Get(record)
+		body, error := ns.node.GetRange(record, pack.RangeFrom, pack.RangeLen)
 		if error != nil {
 			packReturn.Flag = false
 			packReturn.Msg = error.Error()
@@ -95,6 +133,19 @@ func (ns *NodeServer) handler(clientAddr string, request interface{}) interface{
 }
 
 func (ns *NodeServer) Start(mediatorHost, nodeHost string) {
+	if e := ns.Listen(nodeHost); e != nil {
+		return
+	}
+
+	ns.LetMediate(mediatorHost)
+
+	ns.chClose = make(chan bool)
+	go ns.reportBlocks()
+	go ns.reportDisks()
+}
+
+// 加载块注册表并启动 rpc 服务，不连接 mediator 时由 ConnectToCenter 指定 center
+func (ns *NodeServer) Listen(nodeHost string) error {
 
 	rec := center.Record{
 		BlockId: 0,
@@ -111,21 +162,26 @@ func (ns *NodeServer) Start(mediatorHost, nodeHost string) {
 	)
 
 	ns.node = &Node{}
+	ns.host = nodeHost
+
+	// mediator 不可用时使用本地注册的块
+	if e := ns.node.LoadRegistry(ns.DataDirs); e != nil {
+		common.Log.Error("node server load block registry error", e)
+	}
 
 	addr := nodeHost + ":" + strconv.Itoa(common.SERVER_PORT_AGENT)
 	ns.s = gorpc.NewTCPServer(addr, ns.handler)
 	if e := ns.s.Start(); e != nil {
 		common.Log.Error("node server started failed", e)
-		return
-	} else {
-		common.Log.Info("node server started - " + addr)
+		return e
 	}
-
-	ns.LetMediate(mediatorHost)
+	common.Log.Info("node server started - " + addr)
+	return nil
 }
 
 func (ns *NodeServer) LetMediate(mediatorHost string) {
 	ns.mc = &mediator.NetClient{}
+	ns.mc.OnStateChange = ns.onMediatorState
 
 	if e := ns.mc.Start(mediatorHost + ":" + strconv.Itoa(common.SERVER_PORT_MEDIATOR)); e != nil {
 		common.Log.Error("node server mediator client started failed", e)
@@ -134,9 +190,43 @@ func (ns *NodeServer) LetMediate(mediatorHost string) {
 		common.Log.Info("node server mediator client started")
 	}
 
+	// mediator notifies by block addr
+	ns.mc.MappingHost(ns.host)
+	ns.register()
+
+	// compact one block, reply result to mediator when done
+	ns.mc.AddHandler(
+		mediator.CMD_COMPACT_BLOCK,
+		func(p mediator.Pack) mediator.Pack {
+			var task mediator.CompactTask
+			if e := common.DecCompat(p.Body, &task); e != nil {
+				common.Log.Error("node server compact task decode error", e)
+				return mediator.PACK_NO_RETURN
+			}
+
+			go ns.compact(task)
+			return mediator.PACK_NO_RETURN
+		},
+	)
+
+	// preallocate block created by mediator
+	ns.mc.AddHandler(
+		mediator.CMD_ALLOC_BLOCK,
+		func(p mediator.Pack) mediator.Pack {
+			var block mediator.Block
+			if e := common.DecCompat(p.Body, &block); e != nil {
+				common.Log.Error("node server alloc block decode error", e)
+				return mediator.PACK_NO_RETURN
+			}
+
+			go ns.allocBlock(block)
+			return mediator.PACK_NO_RETURN
+		},
+	)
+
 	// connect to center server
 	ns.mc.Watch(
-		"node-server-connect-to-center",
+		mediator.KEY_NODE_SERVER_CENTER_ADDR,
 		func(value, valueOld []byte) {
 
 			centerServerAddr := string(value)
@@ -155,6 +245,19 @@ func (ns *NodeServer) LetMediate(mediatorHost string) {
 		},
 	)
 
+	// connect to masters of all center groups
+	ns.mc.Watch(
+		mediator.KEY_CENTER_SHARDS,
+		func(value, valueOld []byte) {
+			var shards mediator.CenterShards
+			if e := common.DecCompat(value, &shards); e != nil {
+				common.Log.Error("node server center shards decode error", e)
+				return
+			}
+			ns.ConnectToShards(shards)
+		},
+	)
+
 	// refresh latest block info
 	ns.mc.Watch(
 		"node-server-block-refresh",
@@ -163,29 +266,124 @@ func (ns *NodeServer) LetMediate(mediatorHost string) {
 
 			arr := bytes.Split(value, common.SP)
 
-			blocks := list.New()
+			var blocks []mediator.Block
 			for _, b := range arr {
 				if len(b) == 0 {
 					continue
 				}
 				var block mediator.Block
-				e := common.Dec(b, &block)
+				e := common.DecCompat(b, &block)
 				if e != nil {
 					common.Log.Error("node server block refresh decode error", e)
 					return
 				}
 
+				// 只保留本机的块
+				if block.Addr != ns.host {
+					continue
+				}
 				common.Log.Info("node server block refresh get block", block)
+				blocks = append(blocks, block)
+			}
 
-				blockWrapper := &BlockInServer{block, new(sync.Mutex), false}
-				blocks.PushBack(blockWrapper)
+			// 本地的 End 不回退
+			ns.node.MergeBlocks(blocks)
+			if e := ns.node.PersistRegistry(); e != nil {
+				common.Log.Error("node server persist block registry error", e)
 			}
 
-			ns.node.Blocks = blocks
+			// 容量变化
+			ns.register()
 		},
 	)
 }
 
+func (ns *NodeServer) compact(task mediator.CompactTask) {
+	r := mediator.CompactResult{BlockId: task.BlockId, NewBlockId: task.NewBlock.BlockId}
+
+	end, e := ns.node.Compact(task.BlockId, task.NewBlock, ns.getLiveRegions, ns.moveRecords)
+	if e != nil {
+		common.Log.Error("node server compact block error", task.BlockId, e)
+		r.Msg = e.Error()
+	} else {
+		r.End = end
+		r.Flag = true
+		if e := ns.node.PersistRegistry(); e != nil {
+			common.Log.Error("node server persist block registry error", e)
+		}
+	}
+
+	body, e := common.Enc(&r)
+	if e != nil {
+		common.Log.Error("node server compact result encode error", e)
+		return
+	}
+	ns.mc.Send(mediator.Pack{Command: mediator.CMD_COMPACT_BLOCK_DONE, Body: body})
+}
+
+// 定时持久化块注册表，上报块位置及磁盘容量
+func (ns *NodeServer) reportBlocks() {
+	ticker := time.NewTicker(time.Duration(BlockReportIntervalSec) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ns.chClose:
+			common.Log.Info("node server block report is stopping")
+			return
+		case <-ticker.C:
+			ns.reportBlockEnds()
+			ns.reportDisks()
+		}
+	}
+}
+
+func (ns *NodeServer) reportBlockEnds() {
+	if e := ns.node.PersistRegistry(); e != nil {
+		common.Log.Error("node server persist block registry error", e)
+	}
+
+	ends := ns.node.BlockEnds()
+	if len(ends) == 0 {
+		return
+	}
+	body, e := common.Enc(ends)
+	if e != nil {
+		common.Log.Error("node server block report encode error", e)
+		return
+	}
+	if e := ns.mc.Send(mediator.Pack{Command: mediator.CMD_BLOCK_REPORT, Body: body}); e != nil {
+		common.Log.Warning("node server block report error", e)
+	}
+}
+
+// 注册为 mediator 的 agent 成员，client 据此连接
+func (ns *NodeServer) register() {
+	member := mediator.Member{
+		Role:     common.ROLE_AGENT,
+		Addr:     ns.host + ":" + strconv.Itoa(common.SERVER_PORT_AGENT),
+		Capacity: ns.node.FreeBytes(),
+		Zone:     ns.Zone,
+		Rack:     ns.Rack,
+	}
+	if e := ns.mc.Register(member); e != nil {
+		common.Log.Error("node server register member error", e)
+	}
+}
+
+// mediator 断开或重连，重连后 host 映射和 watcher 由 NetClient 重新注册
+func (ns *NodeServer) onMediatorState(state int) {
+	if state == mediator.NetClientConnected {
+		common.Log.Info("node server mediator reconnected", ns.host)
+		go func() {
+			ns.reportBlockEnds()
+			ns.reportDisks()
+		}()
+	} else {
+		common.Log.Warning("node server mediator disconnected, reconnecting", ns.host)
+	}
+}
+
 func (ns *NodeServer) ConnectToCenter(addr string) {
 	ns.c = gorpc.NewTCPClient(addr)
 	ns.c.Start()
@@ -193,6 +391,10 @@ func (ns *NodeServer) ConnectToCenter(addr string) {
 }
 
 func (ns *NodeServer) Close() {
+	if ns.chClose != nil {
+		close(ns.chClose)
+		ns.chClose = nil
+	}
 	if ns.s != nil {
 		common.Log.Info("node server stoped")
 		ns.s.Stop()
@@ -201,6 +403,7 @@ func (ns *NodeServer) Close() {
 		common.Log.Info("node server center client stoped")
 		ns.c.Stop()
 	}
+	ns.closeMasters()
 	if ns.mc != nil {
 		common.Log.Info("node server mediator client stoped")
 		ns.mc.Close()
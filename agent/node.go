@@ -4,6 +4,7 @@ import (
 	"container/list"
 	"errors"
 	"os"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -19,6 +20,12 @@ const (
 	GET_BLOCK_LOCK_PAUSE     = 1e6
 )
 
+// compaction waits at most this long for saves not yet acknowledged by the center
+var CompactWaitSaveSec int = 30
+
+// the replaced block file stays readable this long after compaction, for in-flight reads and stale block lists
+var CompactRemoveDelaySec int = 10 * 60
+
 
 type BlockInServer struct {
 	// 匿名包含
@@ -42,6 +49,19 @@ type Node struct {
 	// 10 * 4 * 1024 * 1024 / 64 ~= 655360, change data structure if necessary
 	Blocks *list.List
 	Status string
+
+	Dirs         []string   // data dirs holding the block registry, see block-registry.go
+	mutex        sync.Mutex // guards Blocks replacement and Dirs
+	persistMutex sync.Mutex // serializes registry writes
+
+	visits     map[int]int // block id -> reads since the last report
+	lastReport time.Time
+	visitMutex sync.Mutex
+
+	saving    map[int]int            // block id -> saves written but not yet acknowledged by the center
+	frozen    map[int]bool           // block id -> compacting or compacted, no more writes
+	compacted map[int]*BlockInServer // block id -> replaced by compaction, read only until the file is removed
+	saveMutex sync.Mutex             // guards saving, frozen and compacted, taken after block.mutex
 }
 
 
@@ -60,7 +80,7 @@ func (n *Node) getFitBlock(oid string, len int, beginLoop int) *BlockInServer {
 
 		block := e.Value.(*BlockInServer)
 		left := block.Size - block.End
-		if left < len {
+		if left < len || !block.IsWritable() || n.isFrozen(block.BlockId) {
 			continue
 		}
 
@@ -80,6 +100,127 @@ func (n *Node) getFitBlock(oid string, len int, beginLoop int) *BlockInServer {
 	return nil
 }
 
+// 所有可写块的剩余空间，注册到 mediator
+func (n *Node) FreeBytes() int64 {
+	if n.Blocks == nil {
+		return 0
+	}
+
+	var free int64
+	for e := n.Blocks.Front(); e != nil; e = e.Next() {
+		block := e.Value.(*BlockInServer)
+		if block.IsWritable() && block.Size > block.End {
+			free += int64(block.Size - block.End)
+		}
+	}
+	return free
+}
+
+// client 选择的块，可写、空间足够且没有在写入时使用
+func (n *Node) getPreferredBlock(blockId int, len int) *BlockInServer {
+	if blockId <= 0 {
+		return nil
+	}
+	block, e := n.getBlock(blockId)
+	if e != nil || !block.IsWritable() || block.Size-block.End < len || block.isWriting || n.isFrozen(blockId) {
+		return nil
+	}
+	return block
+}
+
+// 压缩中或已压缩的块
+func (n *Node) isFrozen(blockId int) bool {
+	n.saveMutex.Lock()
+	defer n.saveMutex.Unlock()
+	return n.frozen[blockId]
+}
+
+// 持有块的写锁时调用，块已冻结时返回 false
+func (n *Node) beginSave(blockId int) bool {
+	n.saveMutex.Lock()
+	defer n.saveMutex.Unlock()
+
+	if n.frozen[blockId] {
+		return false
+	}
+	if n.saving == nil {
+		n.saving = make(map[int]int)
+	}
+	n.saving[blockId]++
+	return true
+}
+
+// center 确认(或失败)后调用
+func (n *Node) endSave(blockId int) {
+	n.saveMutex.Lock()
+	defer n.saveMutex.Unlock()
+
+	if n.saving[blockId]--; n.saving[blockId] <= 0 {
+		delete(n.saving, blockId)
+	}
+}
+
+// 冻结块，不再接受新的写入，等待已写入的数据被 center 确认
+func (n *Node) freeze(blockId int) error {
+	n.saveMutex.Lock()
+	if n.frozen == nil {
+		n.frozen = make(map[int]bool)
+	}
+	n.frozen[blockId] = true
+	n.saveMutex.Unlock()
+
+	deadline := time.Now().Add(time.Duration(CompactWaitSaveSec) * time.Second)
+	for {
+		n.saveMutex.Lock()
+		saving := n.saving[blockId]
+		n.saveMutex.Unlock()
+		if saving == 0 {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			n.unfreeze(blockId)
+			return errors.New("node compact error as saves not acknowledged - " + strconv.Itoa(blockId))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (n *Node) unfreeze(blockId int) {
+	n.saveMutex.Lock()
+	defer n.saveMutex.Unlock()
+	delete(n.frozen, blockId)
+}
+
+// 记录块的读取次数
+func (n *Node) addVisit(blockId int) {
+	n.visitMutex.Lock()
+	defer n.visitMutex.Unlock()
+
+	if n.visits == nil {
+		n.visits = make(map[int]int)
+	}
+	n.visits[blockId]++
+}
+
+// 自上次调用以来每个块每分钟的读取次数，调用后清零
+func (n *Node) visitAvgs(now time.Time) map[int]int {
+	n.visitMutex.Lock()
+	defer n.visitMutex.Unlock()
+
+	elapsed := now.Sub(n.lastReport).Seconds()
+	if n.lastReport.IsZero() || elapsed <= 0 {
+		elapsed = float64(BlockReportIntervalSec)
+	}
+	r := make(map[int]int)
+	for blockId, visits := range n.visits {
+		r[blockId] = int(float64(visits)*60/elapsed + 0.5)
+	}
+	n.visits = nil
+	n.lastReport = now
+	return r
+}
+
 func (n *Node) getBlock(blockId int) (b *BlockInServer, err error) {
 	for e := n.Blocks.Front(); e != nil; e = e.Next() {
 		block := e.Value.(*BlockInServer)
@@ -87,11 +228,31 @@ func (n *Node) getBlock(blockId int) (b *BlockInServer, err error) {
 			return block, nil
 		}
 	}
+
+	// 压缩后的旧块在删除前仍可读
+	n.saveMutex.Lock()
+	b, ok := n.compacted[blockId]
+	n.saveMutex.Unlock()
+	if ok {
+		return b, nil
+	}
 	return nil, errors.New("node error as block not found")
 }
 
 func (n *Node) Get(rec center.Record) (b []byte, err error) {
+	return n.GetRange(rec, 0, rec.Len)
+}
 
+// 读取 record 中 [from, from+length) 范围的数据，length 为 0 表示读到末尾
+func (n *Node) GetRange(rec center.Record, from, length int) (b []byte, err error) {
+
+	if length == 0 {
+		length = rec.Len - from
+	}
+	if from < 0 || length < 0 || from+length > rec.Len {
+		err = errors.New("node get error as range out of record - " + strconv.Itoa(from) + "," + strconv.Itoa(length))
+		return
+	}
 
 	// 查找块信息
 	block, error := n.getBlock(rec.BlockId)
@@ -99,6 +260,7 @@ func (n *Node) Get(rec center.Record) (b []byte, err error) {
 		err = error
 		return
 	}
+	n.addVisit(block.BlockId)
 
 	// 打开块文件
 	fn := block.GetFilePath()
@@ -116,39 +278,86 @@ func (n *Node) Get(rec center.Record) (b []byte, err error) {
 	}
 	defer file.Close()
 
-	// 从 rec.Offset 开始读取 rec.Len 字节的数据
-
-	// read fully one time?
-	bb := make([]byte, rec.Len)
-	_, error = file.ReadAt(bb, int64(rec.Offset))
+	// 从 rec.Offset+from 开始读取 length 字节的数据
+	bb := make([]byte, length)
+	_, error = file.ReadAt(bb, int64(rec.Offset+from))
 	if error != nil {
 		err = error
 		return
 	}
 
+	// 读取全部数据时校验
+	if from == 0 && length == rec.Len && len(rec.Md5) > 0 && !common.CheckHash(bb, rec.Md5, rec.HashAlg) {
+		err = errors.New("node get error as checksum mismatch - " + rec.Oid)
+		return
+	}
+
 	// 返回已读数据
 	return bb, nil
 }
 
 func (n *Node) SaveLocal(oid string, b []byte) (rec center.Record, err error) {
+	return n.SaveLocalTo(0, oid, b)
+}
+
+// 优先保存到 client 按放置策略选择的块 blockId ，不可用时由 agent 选择
+func (n *Node) SaveLocalTo(blockId int, oid string, b []byte) (rec center.Record, err error) {
+	return n.SaveAndReport(blockId, oid, b, nil)
+}
+
+// 同 SaveLocalTo ，写入后调用 report 将 rec 上报到 center ，report 返回前块不会被压缩，
+// 避免压缩时遗漏尚未上报的记录
+func (n *Node) SaveAndReport(blockId int, oid string, b []byte, report func(rec *center.Record) error) (rec center.Record, err error) {
 
 	// 数据长度
 	len := len(b)
 
-	//
-	block := n.getFitBlock(oid, len, 0)
-	if block == nil {
-		err = errors.New("node save error as no block space left")
-		return
-	}
+	var block *BlockInServer
+	for i := 0; ; i++ {
+		if i == 0 {
+			block = n.getPreferredBlock(blockId, len)
+		}
+		if block == nil {
+			block = n.getFitBlock(oid, len, 0)
+		}
+		if block == nil {
+			err = errors.New("node save error as no block space left")
+			return
+		}
 
-	// 设置正在写入状态
-	block.isWriting = true
-	block.mutex.Lock()
-	defer func() {
+		// 设置正在写入状态
+		block.isWriting = true
+		block.mutex.Lock()
+		if n.beginSave(block.BlockId) {
+			break
+		}
+
+		// 等待写锁期间块被冻结，重新选择
 		block.mutex.Unlock()
 		block.isWriting = false
-	}()
+		block = nil
+		if i >= GET_BLOCK_MAX_LOOP_TIMES {
+			err = errors.New("node save error as blocks are compacting")
+			return
+		}
+	}
+	defer n.endSave(block.BlockId)
+
+	rec, err = n.writeBlock(block, b)
+	block.mutex.Unlock()
+	block.isWriting = false
+
+	if err == nil && report != nil {
+		err = report(&rec)
+	}
+	return
+}
+
+// 写入块末尾，need lock first
+func (n *Node) writeBlock(block *BlockInServer, b []byte) (rec center.Record, err error) {
+
+	// 数据长度
+	len := len(b)
 
 	// 获取块数据文件地址
 	fn := block.GetFilePath()
@@ -189,6 +398,7 @@ func (n *Node) SaveLocal(oid string, b []byte) (rec center.Record, err error) {
 	rec = center.Record{
 		BlockId: block.BlockId,	// 归属的块
 		Md5: common.GenMd5(b),	// 校验码
+		HashAlg: common.HASH_MD5,
 		Offset: block.End,		// 块偏移
 		Len: len,				// 块大小
 	}
@@ -256,3 +466,124 @@ func (n *Node) ReadFull(blockId int) (b []byte, err error) {
 
 	return bb, nil
 }
+
+// 块压缩，将 blockId 中仍需保留的数据拷贝到 newBlock ，然后用 newBlock 替换旧块
+//
+// 旧块先被冻结不再写入，等待已写入的记录被 center 确认后 getRegions 获取需保留的数据段，
+// commit 通知 center 更新记录位置，失败时删除新块文件，旧块保持不变并解冻。
+// 压缩成功后旧块保持冻结，等待写锁的写入会重新选择块。
+func (n *Node) Compact(blockId int, newBlock mediator.Block,
+	getRegions func(blockId int) (center.RecordList, error), commit func([]center.RecordMove) error) (end int, err error) {
+
+	var elem *list.Element
+	for e := n.Blocks.Front(); e != nil; e = e.Next() {
+		if e.Value.(*BlockInServer).BlockId == blockId {
+			elem = e
+			break
+		}
+	}
+	if elem == nil {
+		err = errors.New("node compact error as block not found - " + strconv.Itoa(blockId))
+		return
+	}
+	block := elem.Value.(*BlockInServer)
+
+	// 冻结旧块，等待未确认的写入
+	if err = n.freeze(blockId); err != nil {
+		return
+	}
+	isDone := false
+	defer func() {
+		if !isDone {
+			n.unfreeze(blockId)
+		}
+	}()
+
+	regions, e := getRegions(blockId)
+	if e != nil {
+		err = e
+		return
+	}
+
+	src, e := os.OpenFile(block.GetFilePath(), os.O_RDONLY, 0666)
+	if e != nil {
+		err = e
+		return
+	}
+
+	newBlockInServer := &BlockInServer{newBlock, new(sync.Mutex), false}
+	fn := newBlockInServer.GetFilePath()
+	dst, e := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if e != nil {
+		src.Close()
+		err = e
+		return
+	}
+
+	// 按 offset 顺序拷贝
+	sort.Slice(regions, func(i, j int) bool { return regions[i].Offset < regions[j].Offset })
+	var moves []center.RecordMove
+	for _, rec := range regions {
+		bb := make([]byte, rec.Len)
+		if _, e = src.ReadAt(bb, int64(rec.Offset)); e == nil {
+			_, e = dst.WriteAt(bb, int64(end))
+		}
+		if e != nil {
+			break
+		}
+
+		moves = append(moves, center.RecordMove{BlockId: blockId, Offset: rec.Offset, NewBlockId: newBlock.BlockId, NewOffset: end})
+		end += rec.Len
+	}
+	src.Close()
+	if e == nil {
+		e = dst.Sync()
+	}
+	if e2 := dst.Close(); e == nil {
+		e = e2
+	}
+	if e == nil {
+		e = commit(moves)
+	}
+	if e != nil {
+		os.Remove(fn)
+		err = e
+		return
+	}
+
+	// 新块替换旧块，旧块文件已无记录引用
+	newBlockInServer.End = end
+	n.mutex.Lock()
+	elem.Value = newBlockInServer
+	n.mutex.Unlock()
+	isDone = true
+
+	// 旧块文件已无记录引用，延迟删除
+	n.saveMutex.Lock()
+	if n.compacted == nil {
+		n.compacted = make(map[int]*BlockInServer)
+	}
+	n.compacted[blockId] = block
+	n.saveMutex.Unlock()
+	time.AfterFunc(time.Duration(CompactRemoveDelaySec)*time.Second, func() {
+		n.removeCompacted(blockId)
+	})
+
+	common.Log.Info("node compact block done", blockId, newBlock.BlockId, len(moves), end)
+	return end, nil
+}
+
+// 删除压缩后的旧块文件
+func (n *Node) removeCompacted(blockId int) {
+	n.saveMutex.Lock()
+	block, ok := n.compacted[blockId]
+	delete(n.compacted, blockId)
+	n.saveMutex.Unlock()
+	if !ok {
+		return
+	}
+
+	if e := os.Remove(block.GetFilePath()); e != nil {
+		common.Log.Warning("node compact remove old block file error", blockId, e)
+	}
+}
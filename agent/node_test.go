@@ -0,0 +1,277 @@
+package agent
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blastbao/whisper/center"
+	"github.com/blastbao/whisper/mediator"
+)
+
+func newTestNode(t *testing.T) (*Node, string) {
+	dir, e := ioutil.TempDir("", "test-whisper-node")
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	blocks := list.New()
+	block := mediator.Block{BlockId: 1, DataId: 1, Addr: "localhost", Dir: dir, Size: 1024 * 1024}
+	blocks.PushBack(&BlockInServer{block, new(sync.Mutex), false})
+
+	return &Node{Blocks: blocks}, dir
+}
+
+func TestNodeGetRange(t *testing.T) {
+	n, dir := newTestNode(t)
+	defer os.RemoveAll(dir)
+
+	if _, e := n.SaveLocal("a", []byte("0123456789")); e != nil {
+		t.Fatal(e)
+	}
+	rec, e := n.SaveLocal("b", []byte("abcdefghij"))
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	b, e := n.GetRange(rec, 2, 3)
+	if e != nil || !bytes.Equal(b, []byte("cde")) {
+		t.Fatal("get range error", string(b), e)
+	}
+
+	b, e = n.GetRange(rec, 7, 0)
+	if e != nil || !bytes.Equal(b, []byte("hij")) {
+		t.Fatal("get range to end error", string(b), e)
+	}
+
+	if _, e = n.GetRange(rec, 8, 5); e == nil {
+		t.Fatal("get range out of record should fail")
+	}
+}
+
+func TestNodeGetChecksum(t *testing.T) {
+	n, dir := newTestNode(t)
+	defer os.RemoveAll(dir)
+
+	rec, e := n.SaveLocal("a", []byte("0123456789"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, e = n.Get(rec); e != nil {
+		t.Fatal(e)
+	}
+
+	// corrupt one byte
+	block, _ := n.getBlock(rec.BlockId)
+	f, e := os.OpenFile(block.GetFilePath(), os.O_WRONLY, 0666)
+	if e != nil {
+		t.Fatal(e)
+	}
+	f.WriteAt([]byte{'x'}, 5)
+	f.Close()
+
+	if _, e = n.Get(rec); e == nil {
+		t.Fatal("get should fail as checksum mismatch")
+	}
+
+	// range read is not verified
+	if _, e = n.GetRange(rec, 0, 5); e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestNodeCompact(t *testing.T) {
+	n, dir := newTestNode(t)
+	defer os.RemoveAll(dir)
+
+	recA, _ := n.SaveLocal("a", []byte("0123456789"))
+	recB, _ := n.SaveLocal("b", []byte("abcdefghij"))
+	recC, _ := n.SaveLocal("c", []byte("ABCDEFGHIJ"))
+	oldBlock, _ := n.getBlock(1)
+	oldFile := oldBlock.GetFilePath()
+
+	newBlock := mediator.Block{BlockId: 2, DataId: 1, Addr: "localhost", Dir: dir, Size: 1024 * 1024}
+	getRegions := func(blockId int) (center.RecordList, error) {
+		return center.RecordList{recC, recA}, nil
+	}
+
+	// commit fail keeps the old block
+	_, e := n.Compact(1, newBlock, getRegions, func(moves []center.RecordMove) error {
+		return errors.New("center down")
+	})
+	if e == nil {
+		t.Fatal("compact should fail")
+	}
+	if _, e = n.Get(recB); e != nil {
+		t.Fatal("old block should be kept", e)
+	}
+
+	var committed []center.RecordMove
+	end, e := n.Compact(1, newBlock, getRegions, func(moves []center.RecordMove) error {
+		committed = moves
+		return nil
+	})
+	if e != nil || end != 20 || len(committed) != 2 {
+		t.Fatal("compact error", end, committed, e)
+	}
+
+	// old block still readable until removed
+	if _, e = n.Get(recB); e != nil {
+		t.Fatal("old block should be readable after compact", e)
+	}
+	n.removeCompacted(1)
+	if _, e = os.Stat(oldFile); !os.IsNotExist(e) {
+		t.Fatal("old block file should be removed", e)
+	}
+	if _, e = n.Get(recB); e == nil {
+		t.Fatal("removed block should not be readable")
+	}
+
+	for _, rec := range []center.Record{recA, recC} {
+		for _, m := range committed {
+			if m.Offset == rec.Offset {
+				rec.BlockId, rec.Offset = m.NewBlockId, m.NewOffset
+			}
+		}
+		if _, e = n.Get(rec); e != nil || rec.BlockId != 2 {
+			t.Fatal("get moved record error", rec, e)
+		}
+	}
+
+	// new writes go to the new block
+	rec, e := n.SaveLocal("d", []byte("xyz"))
+	if e != nil || rec.BlockId != 2 || rec.Offset != 20 {
+		t.Fatal("save after compact error", rec, e)
+	}
+}
+
+func TestNodeSaveLocalTo(t *testing.T) {
+	n, dir := newTestNode(t)
+	defer os.RemoveAll(dir)
+
+	block := mediator.Block{BlockId: 2, DataId: 1, Addr: "localhost", Dir: dir, Size: 1024 * 1024}
+	n.Blocks.PushBack(&BlockInServer{block, new(sync.Mutex), false})
+
+	rec, e := n.SaveLocalTo(2, "a", []byte("0123456789"))
+	if e != nil || rec.BlockId != 2 {
+		t.Fatal("save to preferred block error", rec.BlockId, e)
+	}
+
+	// 不存在的块由 agent 选择
+	if rec, e = n.SaveLocalTo(9, "b", []byte("abcdefghij")); e != nil || rec.BlockId == 9 {
+		t.Fatal("save to missing block error", rec.BlockId, e)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, e := n.GetRange(rec, 0, 0); e != nil {
+			t.Fatal(e)
+		}
+	}
+	n.lastReport = time.Now().Add(-time.Minute)
+	for _, end := range n.BlockEnds() {
+		if end.BlockId == rec.BlockId && end.VisitAvg != 3 {
+			t.Fatal("visit avg error", end.VisitAvg)
+		}
+	}
+	for _, end := range n.BlockEnds() {
+		if end.VisitAvg != 0 {
+			t.Fatal("visits should be reset", end.VisitAvg)
+		}
+	}
+}
+
+func TestNodeCompactConcurrentSave(t *testing.T) {
+	n, dir := newTestNode(t)
+	defer os.RemoveAll(dir)
+
+	other := mediator.Block{BlockId: 3, DataId: 1, Addr: "localhost", Dir: dir, Size: 1024 * 1024}
+	n.Blocks.PushBack(&BlockInServer{other, new(sync.Mutex), false})
+
+	// records acknowledged by the center
+	var mutex sync.Mutex
+	var recs center.RecordList
+	put := func(rec *center.Record) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		recs = append(recs, *rec)
+		return nil
+	}
+
+	// save is written but not yet acknowledged
+	release := make(chan bool)
+	saved := make(chan center.Record)
+	go func() {
+		rec, e := n.SaveAndReport(1, "a", []byte("0123456789"), func(rec *center.Record) error {
+			<-release
+			return put(rec)
+		})
+		if e != nil {
+			t.Error(e)
+		}
+		saved <- rec
+	}()
+	for {
+		n.saveMutex.Lock()
+		saving := n.saving[1]
+		n.saveMutex.Unlock()
+		if saving > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	newBlock := mediator.Block{BlockId: 2, DataId: 1, Addr: "localhost", Dir: dir, Size: 1024 * 1024}
+	done := make(chan []center.RecordMove)
+	go func() {
+		var committed []center.RecordMove
+		_, e := n.Compact(1, newBlock, func(blockId int) (center.RecordList, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			var regions center.RecordList
+			for _, rec := range recs {
+				if rec.BlockId == blockId {
+					regions = append(regions, rec)
+				}
+			}
+			return regions, nil
+		}, func(moves []center.RecordMove) error {
+			committed = moves
+			return nil
+		})
+		if e != nil {
+			t.Error(e)
+		}
+		done <- committed
+	}()
+	for !n.isFrozen(1) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// frozen block takes no more writes
+	rec, e := n.SaveAndReport(1, "b", []byte("abcdefghij"), put)
+	if e != nil || rec.BlockId != 3 {
+		t.Fatal("save during compact error", rec.BlockId, e)
+	}
+
+	select {
+	case <-done:
+		t.Fatal("compact should wait for unacknowledged saves")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	rec = <-saved
+	committed := <-done
+	if len(committed) != 1 || committed[0].Offset != rec.Offset || committed[0].NewBlockId != 2 {
+		t.Fatal("pending record should be moved", committed)
+	}
+	rec.BlockId, rec.Offset = committed[0].NewBlockId, committed[0].NewOffset
+	if b, e := n.Get(rec); e != nil || string(b) != "0123456789" {
+		t.Fatal("get moved record error", string(b), e)
+	}
+}
@@ -0,0 +1,112 @@
+package center
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/alecthomas/binary"
+	"github.com/blastbao/whisper/common"
+)
+
+// put back 日志重放
+//
+// 旧版本 master 处理失败而 slave 已成功时，向 slaves 发送 putback- 命令，
+// 发送失败的命令依次以 Enc(PackRecord) 追加到 PUT_BACK_LOG_FILE ，没有分隔。
+// 现在写命令经 raft 复制，不再产生该日志，升级后用 ReplayPutbackLog 将遗留的命令重新提交给 center 。
+
+// 旧版本 Record 的格式
+type putbackLogRecord struct {
+	Oid     string
+	BlockId int
+	Md5     []byte
+	Offset  int
+	Len     int
+	Mime    int
+	Created int64
+	Expired int64
+	Status  int
+}
+
+// 旧版本 PackRecord 的格式
+type putbackLogPack struct {
+	Command string
+	Body    []byte
+	Oid     string
+	Status  int
+	Rec     putbackLogRecord
+	Flag    bool
+	Msg     string
+}
+
+func (lp putbackLogPack) toPackRecord() PackRecord {
+	return PackRecord{
+		Command: lp.Command,
+		Body:    lp.Body,
+		Oid:     lp.Oid,
+		Status:  lp.Status,
+		Rec: Record{
+			Oid:     lp.Rec.Oid,
+			BlockId: lp.Rec.BlockId,
+			Md5:     lp.Rec.Md5,
+			Offset:  lp.Rec.Offset,
+			Len:     lp.Rec.Len,
+			Mime:    lp.Rec.Mime,
+			Created: lp.Rec.Created,
+			Expired: lp.Rec.Expired,
+			Status:  lp.Rec.Status,
+		},
+	}
+}
+
+// 读取 put back 日志，最后一条不完整时返回之前的命令及错误
+func ReadPutbackLog(fn string) ([]PackRecord, error) {
+	bb, e := ioutil.ReadFile(fn)
+	if e != nil {
+		return nil, e
+	}
+
+	var packs []PackRecord
+	reader := bytes.NewReader(bb)
+	dec := binary.NewDecoder(reader)
+	for reader.Len() > 0 {
+		offset := len(bb) - reader.Len()
+		var lp putbackLogPack
+		e := dec.Decode(&lp)
+		// 最后一条的 Msg 为空时读到末尾也返回 EOF ，重新编码长度一致时是完整的
+		if e == io.EOF && reader.Len() == 0 {
+			if enc, _ := common.Enc(lp); len(enc) == len(bb)-offset {
+				e = nil
+			}
+		}
+		if e != nil {
+			return packs, errors.New("put back log torn at " + strconv.Itoa(offset) + " - " + e.Error())
+		}
+		packs = append(packs, lp.toPackRecord())
+	}
+	return packs, nil
+}
+
+// 依次提交 put back 日志中的命令，全部成功后将日志重命名为 fn.replayed.{unix seconds} ，返回成功的条数
+func ReplayPutbackLog(fn string, call func(p PackRecord) (PackRecord, error)) (int, error) {
+	packs, e := ReadPutbackLog(fn)
+	if e != nil {
+		return 0, e
+	}
+
+	for i, p := range packs {
+		r, e := call(p)
+		if e != nil {
+			return i, e
+		}
+		if !r.Flag {
+			return i, errors.New("put back replay fail - " + p.Command + " " + p.Rec.Oid + " " + r.Msg)
+		}
+	}
+
+	return len(packs), os.Rename(fn, fn+".replayed."+strconv.FormatInt(time.Now().Unix(), 10))
+}
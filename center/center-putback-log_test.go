@@ -0,0 +1,97 @@
+package center
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blastbao/whisper/common"
+)
+
+// 按旧版本的方式追加 put back 日志
+func writeTestPutbackLog(t *testing.T, fn string, packs []putbackLogPack) {
+	for _, lp := range packs {
+		bb, e := common.Enc(lp)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if e := common.Write2File(bb, fn, os.O_APPEND); e != nil {
+			t.Fatal(e)
+		}
+	}
+}
+
+func TestReplayPutbackLog(t *testing.T) {
+	dir, e := ioutil.TempDir("", "test-whisper-putback")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := dir + "/" + PUT_BACK_LOG_FILE
+	oids := []string{GenOid(1, 1), GenOid(1, 1), GenOid(1, 1)}
+	var packs []putbackLogPack
+	for i, oid := range oids {
+		packs = append(packs, putbackLogPack{
+			Command: CMD_PUTBACK_PREFIX + CMD_PUT_RECORD,
+			Rec:     putbackLogRecord{Oid: oid, BlockId: 1, Offset: i * 10, Len: 10},
+		})
+	}
+	writeTestPutbackLog(t, fn, packs)
+
+	read, e := ReadPutbackLog(fn)
+	if e != nil || len(read) != 3 {
+		t.Fatal("read put back log error", len(read), e)
+	}
+	for i, p := range read {
+		if p.Command != CMD_PUTBACK_PREFIX+CMD_PUT_RECORD || p.Rec.Oid != oids[i] || p.Rec.Offset != i*10 {
+			t.Fatal("put back pack error", i, p)
+		}
+	}
+
+	// replayed to a center, records are marked deleted
+	c := newTestCenter(t)
+	defer os.RemoveAll(c.Dir)
+	cs := &CenterServer{Center: c}
+	AddHandler2CenterServer(cs)
+
+	n, e := ReplayPutbackLog(fn, func(p PackRecord) (PackRecord, error) {
+		return callHandler(cs, p), nil
+	})
+	if e != nil || n != 3 {
+		t.Fatal("replay error", n, e)
+	}
+	for _, oid := range oids {
+		if rec, e := c.Get(1, oid); e != nil || rec.Status != common.STATUS_RECORD_DEL {
+			t.Fatal("put back record not deleted", oid, rec, e)
+		}
+	}
+	if _, e := os.Stat(fn); !os.IsNotExist(e) {
+		t.Fatal("replayed log should be renamed")
+	}
+	if matches, _ := filepath.Glob(fn + ".replayed.*"); len(matches) != 1 {
+		t.Fatal("replayed log not found", matches)
+	}
+}
+
+func TestReadPutbackLogTorn(t *testing.T) {
+	dir, e := ioutil.TempDir("", "test-whisper-putback")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := dir + "/" + PUT_BACK_LOG_FILE
+	lp := putbackLogPack{Command: CMD_PUTBACK_PREFIX + CMD_PUT_RECORD, Rec: putbackLogRecord{Oid: GenOid(1, 1)}, Msg: "x"}
+	writeTestPutbackLog(t, fn, []putbackLogPack{lp, lp})
+
+	bb, _ := ioutil.ReadFile(fn)
+	if e := ioutil.WriteFile(fn, bb[:len(bb)-3], 0644); e != nil {
+		t.Fatal(e)
+	}
+	packs, e := ReadPutbackLog(fn)
+	if e == nil || len(packs) != 1 {
+		t.Fatal("torn put back log should return the complete packs and error", len(packs), e)
+	}
+}
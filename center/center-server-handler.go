@@ -1,6 +1,9 @@
 package center
 
 import (
+	"strconv"
+	"time"
+
 	"github.com/blastbao/whisper/common"
 )
 
@@ -11,8 +14,12 @@ import (
 //
 // CMD_CLOSE: 关闭 CenterServer
 // CMD_PUT_RECORD: 根据 indexId 查询 index ，然后把新 record 保存到 index 中。
-// CMD_GET_OID_META: 根据 indexId 查询 index ，然后从 index 中取出 oid 对应的 record 。
+// CMD_GET_OID_META: 根据 indexId 查询 index ，然后从 index 中取出 oid 对应的 record ，已过期视为不存在。
 // CMD_CHANGE_OID_STATUS: 根据 indexId 查询 index ，然后更新其中 record 的 status。
+// CMD_PUT_REF: 去重，根据 md5 查找已有数据，为新 oid 创建引用记录。
+// CMD_GET_LIVE_REGIONS: 块压缩，获取块 p.Rec.BlockId 内仍需保留的数据段。
+// CMD_MOVE_RECORDS: 块压缩，数据拷贝到新块后更新记录的 BlockId/Offset 。
+// CMD_CREATE_INDEX: 创建 mediator 分配的索引，p.Body 为 IndexId 。
 //
 func AddHandler2CenterServer(this *CenterServer) {
 
@@ -68,6 +75,10 @@ func AddHandler2CenterServer(this *CenterServer) {
 			if e != nil {
 				r.Flag = false
 				r.Msg = "center get error - " + e.Error()
+			} else if rec.IsExpired(time.Now().Unix()) {
+				// 已过期但还未被清理
+				r.Flag = false
+				r.Msg = "center get error - expired so not found " + oid
 			} else {
 				// 设置返回值
 				r.Rec = rec
@@ -87,23 +98,98 @@ func AddHandler2CenterServer(this *CenterServer) {
 			r := PackRecord{}
 			oid := p.Oid
 			oidInfo := GetOidInfo(oid)
-			// (1) 根据 indexId 查询 index ，然后从 index 中取出 oid 对应的 record 。
-			rec, e := this.Center.Get(oidInfo.IndexId, oid)
+			// 根据 indexId 查询 index ，然后更新其中 record 的 status ，引用记录失效时同时更新被引用记录。
+			e := this.Center.ChangeStatus(oidInfo.IndexId, oid, p.Status)
+			if e != nil {
+				r.Flag = false
+				r.Msg = "center update status error - " + e.Error()
+			} else {
+				// status next process queue TODO
+				r.Flag = true
+			}
+			return r
+		},
+	}
+	this.Handlers = append(this.Handlers, h)
+	common.Log.Info("center server handler added - "+h.Command+" and handlers' len is ", len(this.Handlers))
+
+	// *** put ref
+	h = &CenterServerHandler{
+		Command: CMD_PUT_REF,
+		Fn: func(p PackRecord) PackRecord {
+			r := PackRecord{}
+			// p.Oid 不含副本号，存在 md5 相同的数据时为每个副本创建引用记录，返回被引用的 oid 。
+			ref, e := this.Center.PutRef(p.Oid, p.Rec)
+			if e != nil {
+				r.Flag = false
+				r.Msg = "center put ref error - " + e.Error()
+			} else {
+				r.Oid = ref
+				r.Flag = true
+			}
+			return r
+		},
+	}
+	this.Handlers = append(this.Handlers, h)
+	common.Log.Info("center server handler added - "+h.Command+" and handlers' len is ", len(this.Handlers))
+
+	// *** get live regions
+	h = &CenterServerHandler{
+		Command: CMD_GET_LIVE_REGIONS,
+		Fn: func(p PackRecord) PackRecord {
+			r := PackRecord{}
+			records, e := this.Center.GetLiveRegionsByBlockId(p.Rec.BlockId)
+			if e == nil {
+				r.Body, e = common.Enc(records)
+			}
 			if e != nil {
 				r.Flag = false
-				r.Msg = "center update status disable get error - " + e.Error()
+				r.Msg = "center get live regions error - " + e.Error()
 			} else {
-				// (2) 更新 record 的 status
-				rec.Status = p.Status
-				// (3) 根据 indexId 查询 index ，然后把新 record 保存到 index 中。
-				e := this.Center.Set(oidInfo.IndexId, rec)
-				if e != nil {
-					r.Flag = false
-					r.Msg = "center update status disable set error - " + e.Error()
-				} else {
-					// status next process queue TODO
-					r.Flag = true
-				}
+				r.Flag = true
+			}
+			return r
+		},
+	}
+	this.Handlers = append(this.Handlers, h)
+	common.Log.Info("center server handler added - "+h.Command+" and handlers' len is ", len(this.Handlers))
+
+	// *** move records
+	h = &CenterServerHandler{
+		Command: CMD_MOVE_RECORDS,
+		Fn: func(p PackRecord) PackRecord {
+			r := PackRecord{}
+			var moves []RecordMove
+			e := common.Dec(p.Body, &moves)
+			if e == nil {
+				_, e = this.Center.MoveRecords(moves)
+			}
+			if e != nil {
+				r.Flag = false
+				r.Msg = "center move records error - " + e.Error()
+			} else {
+				r.Flag = true
+			}
+			return r
+		},
+	}
+	this.Handlers = append(this.Handlers, h)
+	common.Log.Info("center server handler added - "+h.Command+" and handlers' len is ", len(this.Handlers))
+
+	// *** create index
+	h = &CenterServerHandler{
+		Command: CMD_CREATE_INDEX,
+		Fn: func(p PackRecord) PackRecord {
+			r := PackRecord{}
+			id, e := strconv.Atoi(string(p.Body))
+			if e == nil {
+				e = this.Center.CreateIndex(id)
+			}
+			if e != nil {
+				r.Flag = false
+				r.Msg = "center create index error - " + e.Error()
+			} else {
+				r.Flag = true
 			}
 			return r
 		},
@@ -9,15 +9,19 @@ import (
 
 // Center 同 Mediator 建立长连接，当接收到 Mediator 的请求时，会执行下面的 Handler 。
 //
-// CMD_MED_NEW_INDEX: 创建新的 Index 对象
-// CMD_MED_INDEX_INFO: 遍历所有 c.indexes ，取出所含数据条数
+// CMD_MED_NEW_INDEX: 创建新的 Index 对象，Body 为 mediator 分配的 IndexId 时经 raft 在组内所有 center 创建，否则为旧版本的目录
+// CMD_MED_INDEX_INFO: 遍历所有 c.indexes ，取出所含数据条数、上次快照时间等，返回 []IndexInfo
 // CMD_MED_PERSIST_INDEX:  将 c.indexes 索引持久化到索引文件
-// CMD_MED_SET_MASTER:
+// CMD_MED_SET_MASTER: 手动设置主从，raft 运行时忽略
 // CMD_MED_CONNECT_OTHER_CENTER: 创建 rpc client 并添加到 cs.clientList2OtherCenter 中。
+// CMD_CENTER_STATE: 回复数据位置，用于 mediator 选举 master
+// CMD_CENTER_ROLE: mediator 下发的拓扑，所有 center 作为 raft peers
+// CMD_BLOCK_USAGE: 统计每个块的有效数据量，用于块压缩
 //
 //
 func (cs *CenterServer) LetMediate(mediatorHost string) {
 	cs.mc = &mediator.NetClient{}
+	cs.mc.OnStateChange = cs.onMediatorState
 
 	// new-index
 	cs.mc.AddHandler(
@@ -26,6 +30,19 @@ func (cs *CenterServer) LetMediate(mediatorHost string) {
 			// 回包
 			r := mediator.Pack{}
 			r.Command = CMD_MED_NEW_INDEX
+
+			// 分片后由 mediator 分配 id ，复制到组内所有 center ，异步回复避免阻塞 mediator 连接
+			if _, e := strconv.Atoi(string(p.Body)); e == nil {
+				go func() {
+					res := cs.propose(PackRecord{Command: CMD_CREATE_INDEX, Body: p.Body}, true)
+					r.Flag = res.Flag
+					r.Msg = res.Msg
+					r.Body = p.Body
+					cs.mc.Send(r)
+				}()
+				return mediator.PACK_NO_RETURN
+			}
+
 			dir := string(p.Body)
 			// 创建新的 Index 对象
 			newIndexId, e := cs.Center.NewIndex(dir)
@@ -49,11 +66,11 @@ func (cs *CenterServer) LetMediate(mediatorHost string) {
 			r := mediator.Pack{}
 			r.Command = CMD_MED_INDEX_INFO
 
-			// 遍历所有 indexes ，取出所含数据条数
-			m := cs.Center.RecordCounts()
+			// 遍历所有 indexes ，取出所含数据条数及上次快照时间
+			infos := cs.Center.IndexInfos()
 
 			// 序列化返回值
-			body, e := common.Enc(m)
+			body, e := common.Enc(infos)
 			if e != nil {
 				r.Flag = false
 				r.Msg = e.Error()
@@ -92,26 +109,7 @@ func (cs *CenterServer) LetMediate(mediatorHost string) {
 		func(p mediator.Pack) mediator.Pack {
 
 			// 判断是否为主节点
-			cs.IsMaster = "true" == string(p.Body)
-
-			// 主节点
-			if cs.IsMaster {
-				// 如果未在执行 PutBack，需启动协程来处理
-				if !cs.isRunningPutback {
-					cs.chPackRecordPutback = make(chan PackRecord)
-					go cs.putback2Slave()
-					common.Log.Info("center server put back is running")
-				// 如果正在执行 PutBack，无需启动
-				} else {
-					common.Log.Info("center server put back is already running")
-				}
-			// 从节点
-			} else {
-				// 如果正在执行 PutBack ，则关闭 chPackRecordPutback 管道。
-				if cs.isRunningPutback {
-					close(cs.chPackRecordPutback)
-				}
-			}
+			cs.SetMaster("true" == string(p.Body))
 
 			// 回包
 			r := mediator.Pack{}
@@ -136,6 +134,62 @@ func (cs *CenterServer) LetMediate(mediatorHost string) {
 		},
 	)
 
+	// 选举时回复状态
+	cs.mc.AddHandler(
+		mediator.CMD_CENTER_STATE,
+		func(p mediator.Pack) mediator.Pack {
+			r := mediator.Pack{Command: mediator.CMD_CENTER_STATE}
+
+			state := cs.State()
+			body, e := common.Enc(&state)
+			if e != nil {
+				r.Msg = e.Error()
+				return r
+			}
+			r.Body = body
+			r.Flag = true
+			return r
+		},
+	)
+
+	// mediator 选举的拓扑
+	cs.mc.AddHandler(
+		mediator.CMD_CENTER_ROLE,
+		func(p mediator.Pack) mediator.Pack {
+			var role mediator.CenterRole
+			if e := common.DecCompat(p.Body, &role); e != nil {
+				common.Log.Error("center server role decode error", e)
+				return mediator.PACK_NO_RETURN
+			}
+
+			cs.SetRole(role)
+			return mediator.PACK_NO_RETURN
+		},
+	)
+
+	// 块使用情况，只由 master 回复，避免 mediator 重复压缩
+	cs.mc.AddHandler(
+		mediator.CMD_BLOCK_USAGE,
+		func(p mediator.Pack) mediator.Pack {
+			if !cs.isMaster() {
+				return mediator.PACK_NO_RETURN
+			}
+
+			r := mediator.Pack{}
+			r.Command = mediator.CMD_BLOCK_USAGE
+
+			body, e := common.Enc(cs.Center.BlockUsage())
+			if e != nil {
+				r.Flag = false
+				r.Msg = e.Error()
+			} else {
+				r.Body = body
+				r.Flag = true
+			}
+			return r
+		},
+	)
+
 	if e := cs.mc.Start(mediatorHost + ":" + strconv.Itoa(common.SERVER_PORT_MEDIATOR)); e != nil {
 		// 如果启动失败，打印日志后退出。
 		common.Log.Error("center server mediator client started failed", e)
@@ -143,6 +197,16 @@ func (cs *CenterServer) LetMediate(mediatorHost string) {
 	} else {
 		// 如果启动成功，把本地地址和 CenterHost 映射关系知会到 mediator 。
 		common.Log.Info("center server mediator client started")
-		cs.mc.Send(mediator.Pack{Command: mediator.CMD_MAPPING_HOST, Body: []byte(cs.CenterHost)})
+		cs.mc.MappingHost(cs.CenterHost)
+		cs.mc.Register(mediator.Member{Role: common.ROLE_CENTER, Addr: cs.CenterHost, Group: cs.Group})
+	}
+}
+
+// mediator 断开或重连，重连后 host 映射和 watcher 由 NetClient 重新注册
+func (cs *CenterServer) onMediatorState(state int) {
+	if state == mediator.NetClientConnected {
+		common.Log.Info("center server mediator reconnected", cs.CenterHost)
+	} else {
+		common.Log.Warning("center server mediator disconnected, reconnecting", cs.CenterHost)
 	}
 }
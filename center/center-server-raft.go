@@ -0,0 +1,385 @@
+package center
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blastbao/whisper/common"
+	"github.com/blastbao/whisper/raft"
+	"github.com/valyala/gorpc"
+)
+
+// center 元数据经 raft 复制
+//
+// 写命令(need2SyncSlaveCmd 及 put back)由 raft leader 追加到日志，复制到多数 center 后，
+// 每个 center 按日志顺序执行对应的 handler ，leader 将执行结果返回给调用方，Seq 为日志中的序号。
+// 写入的记录保存该序号(Record.Seq)，重启后重放已写入索引日志的条目时跳过这些记录。
+// 离线的 center 重新连上后，leader 从其最后的序号之后发送日志，已丢弃的部分以全部记录分块发送。
+// 读命令可在任意 center 执行，请求的 Seq 大于 0 时等待本地应用到该序号(read-your-writes)。
+// 非 leader 收到的写命令加上 CMD_RAFT_FORWARD_PREFIX 转发给 leader ，只转发一次。
+//
+// raft 的 peers 为 mediator 下发的拓扑中的所有 center ，保存在 {Center.Dir}/raft 中，重启后沿用。
+// leader 由 raft 选出，作为 master 清理过期记录及回复块使用情况。
+// 日志压缩时调用 Index.Persist 为所有索引生成快照，落后太多的 center 从 leader 获取全部记录。
+
+const (
+	RAFT_DIR = "raft"
+
+	CMD_RAFT_PREFIX         = "raft-"
+	CMD_RAFT_VOTE           = "raft-vote"
+	CMD_RAFT_APPEND         = "raft-append"
+	CMD_RAFT_SNAPSHOT       = "raft-snapshot"
+	CMD_RAFT_FORWARD_PREFIX = "raft-forward-"
+)
+
+// timeout of vote and append rpc between centers
+var RaftRpcTimeoutMs int = 1000
+
+// read waits for the requested seq to be applied
+var ReadWaitMs int = 200
+
+// 启动 raft ，dir 为空时只保存在内存中
+//
+// 没有 peers 也没有保存的 peers 时不参与选举，拒绝写入，等待 mediator 下发拓扑后从同一组 peers 开始；
+// 否则各自成为 leader 的 center 会在相同的 (index, term) 写入不同的条目，合并后无法发现。
+// 只有配置为 Standalone 的 center 作为单节点集群运行。
+func (cs *CenterServer) startRaft(dir string, trans raft.Transport, peers []string) error {
+	node := raft.NewNode(cs.CenterHost, dir, &centerFSM{cs: cs}, trans)
+	node.OnLeaderChange = cs.onRaftLeader
+	if e := node.Start(peers); e != nil {
+		return e
+	}
+	if len(node.Peers()) == 0 && cs.Standalone {
+		if e := node.SetPeers([]string{cs.CenterHost}); e != nil {
+			node.Stop()
+			return e
+		}
+	}
+	cs.raft = node
+	return nil
+}
+
+func (cs *CenterServer) onRaftLeader(leader string) {
+	common.Log.Info("center server raft leader changed", cs.CenterHost, leader)
+}
+
+// raft 运行时 leader 为 master
+func (cs *CenterServer) isMaster() bool {
+	if cs.raft != nil {
+		return cs.raft.IsLeader()
+	}
+	return cs.IsMaster
+}
+
+// 等待已应用到 seq ，超时返回 false
+func (cs *CenterServer) waitApplied(seq int64) bool {
+	if cs.raft == nil {
+		return true
+	}
+	deadline := time.Now().Add(time.Duration(ReadWaitMs) * time.Millisecond)
+	for cs.raft.Applied() < seq {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return true
+}
+
+// 是否需要经 raft 复制
+func isReplicatedCmd(cmd string) bool {
+	return common.ContainsStr(need2SyncSlaveCmd, cmd) || strings.HasPrefix(cmd, CMD_PUTBACK_PREFIX)
+}
+
+// 写命令经 raft 提交后返回 leader 上的执行结果，isForward 为 true 时非 leader 转发给 leader
+func (cs *CenterServer) propose(p PackRecord, isForward bool) PackRecord {
+	if cs.raft == nil {
+		return cs.apply(p)
+	}
+
+	body, e := common.Enc(&p)
+	if e != nil {
+		return PackRecord{Msg: "center raft encode error - " + e.Error()}
+	}
+
+	result, e := cs.raft.Propose(body)
+	if e == raft.ErrNotLeader && isForward {
+		if leader := cs.raft.Leader(); leader != "" && leader != cs.CenterHost {
+			return cs.forward(leader, p)
+		}
+	}
+	if e != nil {
+		return PackRecord{Msg: "center raft propose error - " + e.Error()}
+	}
+	return result.(PackRecord)
+}
+
+func (cs *CenterServer) forward(leader string, p PackRecord) PackRecord {
+	common.Log.Debug("center server forward to leader", leader, p.Command)
+
+	p.Command = CMD_RAFT_FORWARD_PREFIX + p.Command
+	resp, e := cs.peerClient(leader).Call(p)
+	if e != nil {
+		return PackRecord{Msg: "center forward to leader error - " + e.Error()}
+	}
+	return resp.(PackRecord)
+}
+
+// 处理其它 center 的 raft 请求
+func (cs *CenterServer) handleRaft(p PackRecord) PackRecord {
+	if strings.HasPrefix(p.Command, CMD_RAFT_FORWARD_PREFIX) {
+		p.Command = p.Command[len(CMD_RAFT_FORWARD_PREFIX):]
+		return cs.propose(p, false)
+	}
+
+	r := PackRecord{}
+	if cs.raft == nil {
+		r.Msg = "center raft not started"
+		return r
+	}
+
+	var reply interface{}
+	var e error
+	switch p.Command {
+	case CMD_RAFT_VOTE:
+		var args raft.VoteArgs
+		if e = common.DecCompat(p.Body, &args); e == nil {
+			reply = cs.raft.HandleRequestVote(args)
+		}
+	case CMD_RAFT_APPEND:
+		var args raft.AppendArgs
+		if e = common.DecCompat(p.Body, &args); e == nil {
+			reply = cs.raft.HandleAppendEntries(args)
+		}
+	case CMD_RAFT_SNAPSHOT:
+		var args raft.SnapshotArgs
+		if e = common.DecCompat(p.Body, &args); e == nil {
+			reply = cs.raft.HandleInstallSnapshot(args)
+		}
+	default:
+		e = errors.New("unknown command " + p.Command)
+	}
+	if e == nil {
+		r.Body, e = common.Enc(reply)
+	}
+
+	if e != nil {
+		r.Msg = "center raft error - " + e.Error()
+	} else {
+		r.Flag = true
+	}
+	return r
+}
+
+// raft 状态机，按日志顺序执行写命令
+type centerFSM struct {
+	cs *CenterServer
+}
+
+func (f *centerFSM) Apply(entry raft.Entry) interface{} {
+	var p PackRecord
+	if e := common.DecCompat(entry.Data, &p); e != nil {
+		common.Log.Error("center raft entry decode error", entry.Index, e)
+		return PackRecord{Msg: "center raft entry decode error - " + e.Error(), Seq: entry.Index}
+	}
+	f.cs.Center.setApplying(entry.Index)
+	r := f.cs.apply(p)
+	f.cs.Center.setApplying(0)
+	r.Seq = entry.Index
+	return r
+}
+
+// 为所有已加载的索引生成快照
+func (f *centerFSM) Snapshot() error {
+	for _, d := range f.cs.Center.listIndexes() {
+		if d.IndexTree == nil {
+			continue
+		}
+		if e := d.Persist(); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func (f *centerFSM) SnapshotData() ([]byte, error) {
+	return f.cs.Center.SnapshotData()
+}
+
+func (f *centerFSM) Restore(data []byte) error {
+	return f.cs.Center.Restore(data)
+}
+
+// 经 gorpc 发送 raft 请求
+type centerTransport struct {
+	cs *CenterServer
+}
+
+func (t *centerTransport) call(peer, cmd string, args interface{}, reply interface{}, timeout time.Duration) error {
+	body, e := common.Enc(args)
+	if e != nil {
+		return e
+	}
+
+	resp, e := t.cs.peerClient(peer).CallTimeout(PackRecord{Command: cmd, Body: body}, timeout)
+	if e != nil {
+		return e
+	}
+	r := resp.(PackRecord)
+	if !r.Flag {
+		return errors.New(r.Msg)
+	}
+	return common.DecCompat(r.Body, reply)
+}
+
+func (t *centerTransport) RequestVote(peer string, args raft.VoteArgs) (reply raft.VoteReply, err error) {
+	err = t.call(peer, CMD_RAFT_VOTE, &args, &reply, time.Duration(RaftRpcTimeoutMs)*time.Millisecond)
+	return
+}
+
+func (t *centerTransport) AppendEntries(peer string, args raft.AppendArgs) (reply raft.AppendReply, err error) {
+	err = t.call(peer, CMD_RAFT_APPEND, &args, &reply, time.Duration(RaftRpcTimeoutMs)*time.Millisecond)
+	return
+}
+
+func (t *centerTransport) InstallSnapshot(peer string, args raft.SnapshotArgs) (reply raft.SnapshotReply, err error) {
+	err = t.call(peer, CMD_RAFT_SNAPSHOT, &args, &reply, gorpc.DefaultRequestTimeout)
+	return
+}
+
+// 一个索引的全部记录
+type indexSnapshot struct {
+	Id      int
+	Records []Record
+}
+
+// 所有索引的全部记录
+func (c *Center) SnapshotData() ([]byte, error) {
+	var snapshots []indexSnapshot
+	for _, d := range c.listIndexes() {
+		recs, e := d.allRecords()
+		if e != nil {
+			return nil, e
+		}
+		snapshots = append(snapshots, indexSnapshot{Id: d.Id, Records: recs})
+	}
+	return common.Enc(snapshots)
+}
+
+// 以 leader 的记录替换所有索引并持久化，本地没有的索引创建在 Dir/data_{id}
+func (c *Center) Restore(data []byte) error {
+	var snapshots []indexSnapshot
+	if e := common.DecCompat(data, &snapshots); e != nil {
+		return e
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	restored := make(map[int]bool)
+	for _, s := range snapshots {
+		d := c.getIndex(s.Id)
+		if d == nil {
+			if c.Dir == "" {
+				return errors.New("center restore error as dir not set for new index " + strconv.Itoa(s.Id))
+			}
+			dir := c.Dir + "/data_" + strconv.Itoa(s.Id)
+			if e := os.MkdirAll(dir, 0755); e != nil {
+				return e
+			}
+			d = &Index{}
+			if e := d.Init(s.Id, dir); e != nil {
+				return e
+			}
+			c.indexes = append(c.indexes, d)
+		}
+		if e := d.restore(s.Records); e != nil {
+			return e
+		}
+		restored[s.Id] = true
+	}
+
+	// leader 没有的索引清空
+	for _, d := range c.indexes {
+		if !restored[d.Id] {
+			if e := d.restore(nil); e != nil {
+				return e
+			}
+		}
+	}
+
+	common.Log.Info("center restored from snapshot", len(snapshots))
+	return nil
+}
+
+// 复制索引列表，索引可能被 CreateIndex 等并发添加
+func (c *Center) listIndexes() []*Index {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]*Index{}, c.indexes...)
+}
+
+// 应用 raft 日志条目 seq 期间写入的记录带上 seq ，重放时据此保证幂等，0 表示结束
+func (c *Center) setApplying(seq int64) {
+	for _, d := range c.listIndexes() {
+		d.mutex.Lock()
+		d.applying = seq
+		d.mutex.Unlock()
+	}
+}
+
+// need lock first
+func (c *Center) getIndex(idxId int) *Index {
+	for _, d := range c.indexes {
+		if d.Id == idxId {
+			return d
+		}
+	}
+	return nil
+}
+
+// 全部记录
+func (index *Index) allRecords() ([]Record, error) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	if index.IndexTree == nil {
+		return nil, nil
+	}
+
+	var recs []Record
+	en, e := index.IndexTree.SeekFirst()
+	if e != nil {
+		// empty tree
+		return nil, nil
+	}
+	for {
+		_, v, e := en.Next()
+		if e != nil {
+			if e != io.EOF {
+				return nil, e
+			}
+			break
+		}
+		recs = append(recs, v.(Record))
+	}
+	return recs, nil
+}
+
+// 以 recs 替换全部记录，然后生成快照
+func (index *Index) restore(recs []Record) error {
+	index.mutex.Lock()
+	t := newTrees()
+	for _, rec := range recs {
+		t.set(rec)
+	}
+	index.setTrees(t)
+	index.LastModifyMillis = time.Now()
+	index.mutex.Unlock()
+
+	return index.Persist()
+}
@@ -0,0 +1,375 @@
+package center
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/blastbao/whisper/common"
+	"github.com/blastbao/whisper/mediator"
+	"github.com/blastbao/whisper/raft"
+)
+
+// 目录 base/data_1 中有一个空索引
+func newTestCenter(t *testing.T) *Center {
+	base, e := ioutil.TempDir("", "test-whisper-center")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e := os.MkdirAll(base+"/data_1", 0755); e != nil {
+		t.Fatal(e)
+	}
+
+	c := &Center{}
+	if e := c.Load(base); e != nil {
+		t.Fatal(e)
+	}
+	return c
+}
+
+func newTestRaftCenters(t *testing.T, network *raft.LocalNetwork, num int) []*CenterServer {
+	var peers []string
+	for i := 0; i < num; i++ {
+		peers = append(peers, "center-"+strconv.Itoa(i))
+	}
+
+	var servers []*CenterServer
+	for _, id := range peers {
+		cs := &CenterServer{CenterHost: id, Center: newTestCenter(t)}
+		AddHandler2CenterServer(cs)
+		if e := cs.startRaft(cs.Center.Dir+"/"+RAFT_DIR, network.Transport(id), peers); e != nil {
+			t.Fatal(e)
+		}
+		network.Add(cs.raft)
+		servers = append(servers, cs)
+	}
+	return servers
+}
+
+func waitRaftLeader(t *testing.T, servers []*CenterServer) *CenterServer {
+	for i := 0; i < 500; i++ {
+		for _, cs := range servers {
+			if cs.raft.IsLeader() {
+				return cs
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no center leader elected")
+	return nil
+}
+
+func waitRecord(t *testing.T, cs *CenterServer, oid string, status int) {
+	for i := 0; i < 200; i++ {
+		if rec, e := cs.Center.Get(1, oid); e == nil && rec.Status == status {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("record not replicated", cs.CenterHost, oid)
+}
+
+func TestCenterServerRaft(t *testing.T) {
+	old := []int{raft.HeartbeatMs, raft.ElectionTimeoutMs, raft.TickMs}
+	oldSnapshot := raft.SnapshotEntries
+	defer func() {
+		raft.HeartbeatMs, raft.ElectionTimeoutMs, raft.TickMs = old[0], old[1], old[2]
+		raft.SnapshotEntries = oldSnapshot
+	}()
+	raft.HeartbeatMs, raft.ElectionTimeoutMs, raft.TickMs = 20, 150, 5
+	raft.SnapshotEntries = 4
+
+	network := raft.NewLocalNetwork()
+	servers := newTestRaftCenters(t, network, 3)
+	defer func() {
+		for _, cs := range servers {
+			cs.raft.Stop()
+			cs.Center.Close()
+			os.RemoveAll(cs.Center.Dir)
+		}
+	}()
+
+	leader := waitRaftLeader(t, servers)
+	if !leader.isMaster() || !leader.State().IsMaster {
+		t.Fatal("raft leader should be master")
+	}
+
+	// write on leader is applied on all centers
+	oid := GenOid(1, 1)
+	put := callHandler(leader, PackRecord{Command: CMD_PUT_RECORD, Rec: Record{Oid: oid, BlockId: 1, Len: 10}})
+	if !put.Flag {
+		t.Fatal(put.Msg)
+	}
+	r := callHandler(leader, PackRecord{Command: CMD_CHANGE_OID_STATUS, Oid: oid, Status: common.STATUS_RECORD_DEL})
+	if !r.Flag {
+		t.Fatal(r.Msg)
+	}
+	if put.Seq == 0 || r.Seq != put.Seq+1 {
+		t.Fatal("write sequence error", put.Seq, r.Seq)
+	}
+	for _, cs := range servers {
+		waitRecord(t, cs, oid, common.STATUS_RECORD_DEL)
+	}
+
+	// reads on a follower wait for the requested seq
+	for _, cs := range servers {
+		if cs == leader {
+			continue
+		}
+		if g := callHandler(cs, PackRecord{Command: CMD_GET_OID_META, Oid: oid, Seq: r.Seq}); !g.Flag || g.Rec.Status != common.STATUS_RECORD_DEL {
+			t.Fatal("read your writes on follower error", g.Msg)
+		}
+		if g := callHandler(cs, PackRecord{Command: CMD_GET_OID_META, Oid: oid, Seq: r.Seq + 100}); g.Flag {
+			t.Fatal("read beyond applied seq should fail")
+		}
+	}
+
+	// handler failure is returned from the leader
+	if r := callHandler(leader, PackRecord{Command: CMD_PUT_RECORD, Rec: Record{Oid: GenOid(9, 1)}}); r.Flag {
+		t.Fatal("put to a missing index should fail")
+	}
+
+	// a lagging center is restored from the leader's records after compaction
+	var lagging *CenterServer
+	for _, cs := range servers {
+		if cs != leader {
+			lagging = cs
+			break
+		}
+	}
+	network.Disconnect(lagging.CenterHost)
+
+	var oids []string
+	for i := 0; i < 10; i++ {
+		oid := GenOid(1, 1)
+		if r := callHandler(leader, PackRecord{Command: CMD_PUT_RECORD, Rec: Record{Oid: oid, BlockId: 2, Offset: i * 10, Len: 10}}); !r.Flag {
+			t.Fatal(r.Msg)
+		}
+		oids = append(oids, oid)
+	}
+	if leader.Center.indexes[0].generation == 0 {
+		t.Fatal("leader index not persisted when compacting raft log")
+	}
+
+	network.Connect(lagging.CenterHost)
+	for _, oid := range oids {
+		waitRecord(t, lagging, oid, 0)
+	}
+	waitRecord(t, lagging, oid, common.STATUS_RECORD_DEL)
+
+	// restored index is persisted and loads from disk
+	d := lagging.Center.indexes[0]
+	for i := 0; i < 100 && d.generation == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	loaded := loadTestIndex(t, d.Dir)
+	if loaded.Len() != 11 {
+		t.Fatal("restored index not persisted", loaded.Len())
+	}
+}
+
+func TestCenterServerRaftStandalone(t *testing.T) {
+	old := []int{raft.HeartbeatMs, raft.ElectionTimeoutMs, raft.TickMs}
+	defer func() { raft.HeartbeatMs, raft.ElectionTimeoutMs, raft.TickMs = old[0], old[1], old[2] }()
+	raft.HeartbeatMs, raft.ElectionTimeoutMs, raft.TickMs = 20, 150, 5
+
+	network := raft.NewLocalNetwork()
+	cs := &CenterServer{CenterHost: "center-0", Center: newTestCenter(t), Standalone: true}
+	AddHandler2CenterServer(cs)
+	if e := cs.startRaft(cs.Center.Dir+"/"+RAFT_DIR, network.Transport(cs.CenterHost), nil); e != nil {
+		t.Fatal(e)
+	}
+	network.Add(cs.raft)
+	defer func() {
+		cs.raft.Stop()
+		cs.Center.Close()
+		os.RemoveAll(cs.Center.Dir)
+	}()
+
+	waitRaftLeader(t, []*CenterServer{cs})
+	oid := GenOid(1, 1)
+	if r := callHandler(cs, PackRecord{Command: CMD_PUT_RECORD, Rec: Record{Oid: oid, BlockId: 1, Len: 10}}); !r.Flag {
+		t.Fatal("standalone center should accept writes", r.Msg)
+	}
+	waitRecord(t, cs, oid, 0)
+}
+
+func TestCenterServerRaftJoinPeerless(t *testing.T) {
+	old := []int{raft.HeartbeatMs, raft.ElectionTimeoutMs, raft.TickMs}
+	defer func() { raft.HeartbeatMs, raft.ElectionTimeoutMs, raft.TickMs = old[0], old[1], old[2] }()
+	raft.HeartbeatMs, raft.ElectionTimeoutMs, raft.TickMs = 20, 150, 5
+
+	// no peers before the mediator sends the topology
+	network := raft.NewLocalNetwork()
+	var servers []*CenterServer
+	for i := 0; i < 2; i++ {
+		cs := &CenterServer{CenterHost: "center-" + strconv.Itoa(i), Center: newTestCenter(t)}
+		AddHandler2CenterServer(cs)
+		if e := cs.startRaft(cs.Center.Dir+"/"+RAFT_DIR, network.Transport(cs.CenterHost), nil); e != nil {
+			t.Fatal(e)
+		}
+		network.Add(cs.raft)
+		servers = append(servers, cs)
+	}
+	defer func() {
+		for _, cs := range servers {
+			cs.raft.Stop()
+			cs.Center.Close()
+			os.RemoveAll(cs.Center.Dir)
+		}
+	}()
+
+	time.Sleep(time.Duration(2*raft.ElectionTimeoutMs) * time.Millisecond)
+	for i, cs := range servers {
+		rec := Record{Oid: GenOid(1, 1), BlockId: i + 1, Len: 10}
+		if r := callHandler(cs, PackRecord{Command: CMD_PUT_RECORD, Rec: rec}); r.Flag {
+			t.Fatal("center without peers should refuse writes", cs.CenterHost)
+		}
+	}
+
+	// join with the same peers
+	role := mediator.CenterRole{Epoch: 1, Master: servers[0].CenterHost, Slaves: []string{servers[1].CenterHost}}
+	for _, cs := range servers {
+		if !cs.SetRole(role) {
+			t.Fatal("set role error", cs.CenterHost)
+		}
+	}
+	leader := waitRaftLeader(t, servers)
+	var oids []string
+	for i := 0; i < 3; i++ {
+		oid := GenOid(1, 1)
+		if r := callHandler(leader, PackRecord{Command: CMD_PUT_RECORD, Rec: Record{Oid: oid, BlockId: 1, Offset: i * 10, Len: 10}}); !r.Flag {
+			t.Fatal(r.Msg)
+		}
+		oids = append(oids, oid)
+	}
+	for _, cs := range servers {
+		for _, oid := range oids {
+			waitRecord(t, cs, oid, 0)
+		}
+	}
+
+	a, _ := servers[0].Center.indexes[0].allRecords()
+	b, _ := servers[1].Center.indexes[0].allRecords()
+	if len(a) != len(oids) || !reflect.DeepEqual(a, b) {
+		t.Fatal("indexes differ after join", a, b)
+	}
+}
+
+func TestCenterServerRaftReplayPutRef(t *testing.T) {
+	old := []int{raft.HeartbeatMs, raft.ElectionTimeoutMs, raft.TickMs}
+	oldSnapshot := raft.SnapshotEntries
+	defer func() {
+		raft.HeartbeatMs, raft.ElectionTimeoutMs, raft.TickMs = old[0], old[1], old[2]
+		raft.SnapshotEntries = oldSnapshot
+	}()
+	raft.HeartbeatMs, raft.ElectionTimeoutMs, raft.TickMs = 20, 150, 5
+
+	network := raft.NewLocalNetwork()
+	servers := newTestRaftCenters(t, network, 1)
+	cs := servers[0]
+	base := cs.Center.Dir
+	defer os.RemoveAll(base)
+	waitRaftLeader(t, servers)
+
+	// snapshot after the owner is saved, put ref is replayed after restart
+	body := []byte("the same avatar")
+	oid := GenOidNoSuffix(1, 1)
+	for i := 0; i < 100 && cs.raft.Applied() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	raft.SnapshotEntries = cs.raft.Applied() + int64(len(GetOidSiblings(oid+"_0")))
+	for i, oidCopy := range GetOidSiblings(oid + "_0") {
+		rec := Record{Oid: oidCopy, BlockId: i + 1, Len: len(body), Md5: common.GenMd5(body), HashAlg: common.HASH_MD5}
+		if r := callHandler(cs, PackRecord{Command: CMD_PUT_RECORD, Rec: rec}); !r.Flag {
+			t.Fatal(r.Msg)
+		}
+	}
+	for i := 0; i < 100 && cs.Center.indexes[0].generation == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	oidRef := GenOidNoSuffix(1, 1)
+	r := callHandler(cs, PackRecord{Command: CMD_PUT_REF, Oid: oidRef, Rec: Record{Md5: common.GenMd5(body), HashAlg: common.HASH_MD5, Len: len(body)}})
+	if !r.Flag || r.Oid != oid {
+		t.Fatal("put ref error", r.Oid, r.Msg)
+	}
+	applied := cs.raft.Applied()
+	cs.raft.Stop()
+	cs.Center.Close()
+
+	// entries already in the index log are applied again after restart
+	c := &Center{}
+	if e := c.Load(base); e != nil {
+		t.Fatal(e)
+	}
+	cs = &CenterServer{CenterHost: cs.CenterHost, Center: c}
+	AddHandler2CenterServer(cs)
+	if e := cs.startRaft(base+"/"+RAFT_DIR, network.Transport(cs.CenterHost), nil); e != nil {
+		t.Fatal(e)
+	}
+	network.Add(cs.raft)
+	defer func() {
+		cs.raft.Stop()
+		cs.Center.Close()
+	}()
+	waitRaftLeader(t, []*CenterServer{cs})
+	for i := 0; i < 100 && cs.raft.Applied() < applied; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if cs.raft.Applied() < applied {
+		t.Fatal("log not replayed", cs.raft.Applied(), applied)
+	}
+
+	for _, oidCopy := range GetOidSiblings(oid + "_0") {
+		if owner, e := c.Get(1, oidCopy); e != nil || owner.RefCount != 1 {
+			t.Fatal("ref count changed by replay", owner, e)
+		}
+	}
+}
+
+func TestCenterRestoreNewIndex(t *testing.T) {
+	c := newTestCenter(t)
+	defer os.RemoveAll(c.Dir)
+	setTestRecords(t, c.indexes[0], 0, 5)
+
+	data, e := c.SnapshotData()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	// the other center has no index 1 but an index 2 not on the leader
+	base, e := ioutil.TempDir("", "test-whisper-center")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(base)
+	if e := os.MkdirAll(base+"/data_2", 0755); e != nil {
+		t.Fatal(e)
+	}
+	c2 := &Center{}
+	if e := c2.Load(base); e != nil {
+		t.Fatal(e)
+	}
+	if e := c2.Set(2, Record{Oid: GenOid(2, 1)}); e != nil {
+		t.Fatal(e)
+	}
+
+	if e := c2.Restore(data); e != nil {
+		t.Fatal(e)
+	}
+	if counts := c2.RecordCounts(); counts[1] != 5 || counts[2] != 0 {
+		t.Fatal("restore error", counts)
+	}
+	c2.Close()
+
+	c3 := &Center{}
+	if e := c3.Load(base); e != nil {
+		t.Fatal(e)
+	}
+	if counts := c3.RecordCounts(); counts[1] != 5 || counts[2] != 0 {
+		t.Fatal("restored center load error", counts)
+	}
+}
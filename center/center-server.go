@@ -2,13 +2,15 @@ package center
 
 import (
 	"encoding/gob"
-	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/blastbao/whisper/common"
 	"github.com/blastbao/whisper/mediator"
+	"github.com/blastbao/whisper/raft"
 	"github.com/valyala/gorpc"
 )
 
@@ -20,6 +22,14 @@ const (
 
 	CMD_GET_OID_META      = "get-oid-meta"
 	CMD_CHANGE_OID_STATUS = "change-oid-status"
+	CMD_PUT_REF           = "put-ref" // dedup by md5
+
+	// block compaction, from agent
+	CMD_GET_LIVE_REGIONS = "get-live-regions"
+	CMD_MOVE_RECORDS     = "move-records"
+
+	// index id assigned by mediator, body is the id
+	CMD_CREATE_INDEX = "create-index"
 
 	// command from mediator server
 	CMD_MED_CONNECT_OTHER_CENTER = "connect-2-other-center"
@@ -29,8 +39,15 @@ const (
 	CMD_MED_INDEX_INFO           = "data-info"
 )
 
-// TODO, add other command if need slaves to keep the same
-var need2SyncSlaveCmd []string = []string{CMD_PUT_RECORD, CMD_CHANGE_OID_STATUS}
+// master marks expired records deleted every interval, at most batch each index
+var ExpireSweepIntervalSec int = 60
+var ExpireSweepBatch int = 1000
+
+// check every interval whether indexes need a snapshot, see AutoPersistLogBytes etc.
+var PersistCheckIntervalSec int = 60
+
+// commands replicated to all centers through raft, add other command if need slaves to keep the same
+var need2SyncSlaveCmd []string = []string{CMD_PUT_RECORD, CMD_CHANGE_OID_STATUS, CMD_PUT_REF, CMD_MOVE_RECORDS, CMD_CREATE_INDEX}
 
 type PackRecord struct {
 	// 命令字
@@ -43,10 +60,15 @@ type PackRecord struct {
 	Status int // for update status
 	// Record
 	Rec Record // set input / get output
+	// 读取范围，相对 record 起始位置，RangeLen 为 0 表示读到末尾
+	RangeFrom int
+	RangeLen  int
 	// 返回码 成功/失败
 	Flag bool
 	// 返回信息
 	Msg string
+	// 写命令返回在 raft 日志中的序号，读命令请求时为需要已应用的序号
+	Seq int64
 }
 
 // command dispatch
@@ -57,94 +79,72 @@ type CenterServerHandler struct {
 	Fn      CenterServerHandlerFn // 函数
 }
 
-// master/slave model, raft is better
+// metadata is replicated by raft, see center-server-raft.go
 type CenterServer struct {
-	IsMaster bool
+	IsMaster bool // set by SetMaster when raft is not running, see isMaster
 
 	// 存储了一组索引对象
 	Center     *Center
 	CenterHost string
+	Group      string // shard group, centers of a group replicate the same indexes
+	Standalone bool   // runs raft as a single-node cluster, topology from mediator is ignored
 
-	// 同其它 Center Svr 的连接，如果本节点为 master 则其它截节点为 slave 。
+	// 同其它 Center Svr 的连接，用于 raft 复制及转发写请求
 	clientList2OtherCenter []*gorpc.Client // connect to other center instance
+	mutexOtherCenter       sync.Mutex      // guards clientList2OtherCenter
+	epoch                  int             // epoch of the topology set by mediator
 
-	s  *gorpc.Server      // 服务对象
-	mc *mediator.NetClient // to mediator
+	s    *gorpc.Server      // 服务对象
+	mc   *mediator.NetClient // to mediator
+	raft *raft.Node          // nil if not started, then commands are applied locally
 
-	Handlers                   []*CenterServerHandler
-	chPackRecordPutback        chan PackRecord
-	mutexWriteLog4SlaveRecover *sync.Mutex // write log when notify slave to recover failed
-	closeWg                    sync.WaitGroup
-	isRunningPutback           bool
+	Handlers []*CenterServerHandler
+	chClose  chan bool
 }
 
 // rpc main handler
 func (cs *CenterServer) handler(clientAddr string, request interface{}) interface{} {
 
-	// from node server / client / mediator
+	// from node server / client / mediator / other centers
 	p := request.(PackRecord)
 
-	// make sure other slave center server handle ok
+	// raft 请求及转发给 leader 的写命令
+	if strings.HasPrefix(p.Command, CMD_RAFT_PREFIX) {
+		return cs.handleRaft(p)
+	}
 
-	// 如果当前为主节点，且 p.Command 在命令列表中
-	if cs.IsMaster && common.ContainsStr(need2SyncSlaveCmd, p.Command) {
-		// 逐个 rpc 调用 slave 从节点
-		for _, c := range cs.clientList2OtherCenter {
+	// 写命令经 raft 复制到所有 center 后执行
+	if isReplicatedCmd(p.Command) {
+		return cs.propose(p, true)
+	}
 
-			common.Log.Info("center server sync master to slave pack", cs.CenterHost, c.Addr, p)
+	// 读命令在本地执行，落后于请求的序号时由 client 换其它 center
+	if p.Seq > 0 && !cs.waitApplied(p.Seq) {
+		return PackRecord{Msg: "center lagging behind seq " + strconv.FormatInt(p.Seq, 10)}
+	}
 
-			// 调用 rpc
-			resp, err := c.Call(p)
-			if err != nil {
-				// 出错回包
-				packReturn := PackRecord{}
-				packReturn.Flag = false
-				packReturn.Msg = err.Error()
-				return packReturn
-			}
+	return cs.apply(p)
+}
 
-			respPack := resp.(PackRecord)
-			if !respPack.Flag {
-				// 失败回包
-				return respPack
-			}
-
-			// 成功，do nothing
-		}
-	}
+// 执行命令，写命令由 raft 按日志顺序调用
+func (cs *CenterServer) apply(p PackRecord) PackRecord {
 
 	// 如果命令是 "putback-xxx"，则把 p.Record 保存到对应的 Index 中。
 	if strings.HasPrefix(p.Command, CMD_PUTBACK_PREFIX) {
 		return cs.putback(p)
 	}
 
-	//
-	var packReturn PackRecord
 	for _, h := range cs.Handlers {
-
-		// 忽略
-		if h.Command != p.Command {
-			continue
+		if h.Command == p.Command {
+			common.Log.Debug("center server handler match - " + p.Command)
+			return h.Fn(p)
 		}
-
-		// 处理
-		packReturn = h.Fn(p)
-		common.Log.Debug("center server handler match - " + p.Command)
-		break
-	}
-
-	// slave ok but master not ok
-
-	// 运行至此，意味着 Slaves 都已执行成功，如果 Master 执行失败，则应该放到管道里面。
-	if cs.IsMaster && !packReturn.Flag {
-		cs.chPackRecordPutback <- p
 	}
-
-	return packReturn
+	return PackRecord{}
 }
 
-// recover, usually it's a slave, because master process failed so need slave to "rollback"
-// 恢复，通常是一个从机，因为主进程失败了，所以需要从机来 "回滚"
+// recover, mark the record deleted, sent by masters of old versions when they failed after slaves succeeded
+// 恢复，旧版本的 master 处理失败时通知 slaves "回滚"
 func (cs *CenterServer) putback(p PackRecord) PackRecord {
 
 	r := PackRecord{}
@@ -198,8 +198,6 @@ func (cs *CenterServer) Start(mediatorHost, centerHost string) {
 		return
 	}
 
-	cs.mutexWriteLog4SlaveRecover = new(sync.Mutex)
-
 	// if not including port, add default
 	// 设置 CenterSvr 服务监听地址
 	addr := centerHost
@@ -216,85 +214,91 @@ func (cs *CenterServer) Start(mediatorHost, centerHost string) {
 		common.Log.Info("center server started - " + addr)
 	}
 
+	// raft 日志保存在索引目录下，peers 由 mediator 下发
+	raftDir := ""
+	if cs.Center.Dir != "" {
+		raftDir = cs.Center.Dir + "/" + RAFT_DIR
+	}
+	if e := cs.startRaft(raftDir, &centerTransport{cs: cs}, nil); e != nil {
+		common.Log.Error("center server raft start failed", e)
+	}
+
+	// 后台清理过期记录，定时快照
+	cs.chClose = make(chan bool)
+	go cs.sweepExpired()
+	go cs.autoPersist()
+
 	// 同 Mediator 建立长连接，当接收到 Mediator 的请求时，会执行相应的 Handler 。
 	cs.LetMediate(mediatorHost)
 }
 
-func (cs *CenterServer) putback2Slave() {
-	cs.isRunningPutback = true
-	cs.closeWg.Add(1)
+// 定时将过期记录标记为删除，只在 master 上执行，经由 raft 同步到 slaves 。
+func (cs *CenterServer) sweepExpired() {
+	ticker := time.NewTicker(time.Duration(ExpireSweepIntervalSec) * time.Second)
+	defer ticker.Stop()
 
 	for {
-
-		pack, ok := <-cs.chPackRecordPutback
-
-		// 收到有效数据，需要同步给 slaves
-		if ok {
-
-			pack.Command = CMD_PUTBACK_PREFIX + pack.Command
-
-			for _, c := range cs.clientList2OtherCenter {
-
-				resp, e := c.Call(pack)
-
-				// 调用出错，写入执行日志
-				if e != nil {
-					common.Log.Error("center server put back 2 slave error", e, pack)
-					cs.writePutbackLog(pack)
-				} else {
-					// 调用成功，但是执行失败，写入执行日志
-					packReturn := resp.(PackRecord)
-					if !packReturn.Flag {
-						common.Log.Error("center server put back 2 slave fail", packReturn.Msg, pack)
-						cs.writePutbackLog(pack)
-					}
-				}
+		select {
+		case <-cs.chClose:
+			common.Log.Info("center server expire sweep is stopping")
+			return
+		case <-ticker.C:
+			if !cs.isMaster() {
+				continue
 			}
-
-			// 管道已关闭，则应该退出循环，结束协程。
-		} else {
-			common.Log.Info("center server put back is stopping")
-			// 退出前更新状态
-			cs.closeWg.Done()
-			cs.isRunningPutback = false
-			break
+			cs.SweepExpired(time.Now().Unix())
 		}
 	}
 }
 
-func (cs *CenterServer) writePutbackLog(pack PackRecord) error {
-
-	cs.mutexWriteLog4SlaveRecover.Lock()
-	defer cs.mutexWriteLog4SlaveRecover.Unlock()
+// 定时检查并快照索引，master 及 slaves 各自持久化自己的索引
+func (cs *CenterServer) autoPersist() {
+	ticker := time.NewTicker(time.Duration(PersistCheckIntervalSec) * time.Second)
+	defer ticker.Stop()
 
-	// 获取 home 目录下的 "center-server-put-back.log" 文件路径。
-	fn := common.GetUserHomeFile(PUT_BACK_LOG_FILE)
-	bb, e := common.Enc(pack)
-	if e != nil {
-		common.Log.Error("center server put back 2 slave write log error when encode", e, pack)
-		return e
+	for {
+		select {
+		case <-cs.chClose:
+			common.Log.Info("center server auto persist is stopping")
+			return
+		case <-ticker.C:
+			if n := cs.Center.AutoPersist(time.Now()); n > 0 {
+				common.Log.Info("center server auto persisted", n)
+			}
+		}
 	}
+}
 
-	// 把 PackRecord 写入到该文件。
-	e = common.Write2File(bb, fn, os.O_APPEND)
-	if e != nil {
-		common.Log.Error("center server put back 2 slave write log error", e, pack)
+// 将 now 之前过期的记录标记为删除，返回处理的记录数
+func (cs *CenterServer) SweepExpired(now int64) int {
+	oids := cs.Center.ExpiredOids(now, ExpireSweepBatch)
+	for _, oid := range oids {
+		r := cs.handler("", PackRecord{Command: CMD_CHANGE_OID_STATUS, Oid: oid, Status: common.STATUS_RECORD_DEL}).(PackRecord)
+		if !r.Flag {
+			common.Log.Error("center server sweep expired error", oid, r.Msg)
+		}
 	}
 
-	return e
+	if len(oids) > 0 {
+		common.Log.Info("center server sweep expired", len(oids))
+	}
+	return len(oids)
 }
 
 func (cs *CenterServer) Close() {
 
-	// 停止后台协程
-	if cs.isRunningPutback && cs.chPackRecordPutback != nil {
-		close(cs.chPackRecordPutback)
+	if cs.chClose != nil {
+		close(cs.chClose)
+		cs.chClose = nil
 	}
 
-	cs.closeWg.Wait()
+	// 停止 raft ，之后不再执行写命令
+	if cs.raft != nil {
+		cs.raft.Stop()
+	}
 
 	// 关闭所有的 client
-	for _, c := range cs.clientList2OtherCenter {
+	for _, c := range cs.otherCenters() {
 		common.Log.Info("center server client to other closed - " + c.Addr)
 		c.Stop()
 	}
@@ -304,13 +308,127 @@ func (cs *CenterServer) Close() {
 		common.Log.Info("center server closed")
 		cs.s.Stop()
 	}
+
+	// 同步并关闭索引日志
+	if cs.Center != nil {
+		cs.Center.Close()
+	}
 }
 
 // 创建 rpc client 并添加到 cs.clientList2OtherCenter 中。
 func (cs *CenterServer) connect2OtherCenter(addr string) {
+	cs.peerClient(addr)
+}
+
+// 到 addr 的 rpc client ，没有时创建
+func (cs *CenterServer) peerClient(addr string) *gorpc.Client {
+	cs.mutexOtherCenter.Lock()
+	defer cs.mutexOtherCenter.Unlock()
+
+	for _, c := range cs.clientList2OtherCenter {
+		if c.Addr == addr {
+			return c
+		}
+	}
+
 	c := gorpc.NewTCPClient(addr)
 	c.Start()
 	cs.clientList2OtherCenter = append(cs.clientList2OtherCenter, c)
-
 	common.Log.Info("center server client to other server connected - " + addr)
+	return c
+}
+
+// 连接到其它 center 的 client 列表的副本
+func (cs *CenterServer) otherCenters() []*gorpc.Client {
+	cs.mutexOtherCenter.Lock()
+	defer cs.mutexOtherCenter.Unlock()
+	return append([]*gorpc.Client{}, cs.clientList2OtherCenter...)
+}
+
+// 只保留到 addrs 的连接，关闭其它连接
+func (cs *CenterServer) setOtherCenters(addrs []string) {
+	var keep []*gorpc.Client
+	var connected []string
+
+	cs.mutexOtherCenter.Lock()
+	for _, c := range cs.clientList2OtherCenter {
+		if common.ContainsStr(addrs, c.Addr) && !common.ContainsStr(connected, c.Addr) {
+			keep = append(keep, c)
+			connected = append(connected, c.Addr)
+		} else {
+			common.Log.Info("center server client to other closed - " + c.Addr)
+			c.Stop()
+		}
+	}
+	cs.clientList2OtherCenter = keep
+	cs.mutexOtherCenter.Unlock()
+
+	for _, addr := range addrs {
+		if !common.ContainsStr(connected, addr) {
+			cs.peerClient(addr)
+		}
+	}
+}
+
+// 手动切换主从角色，raft 运行时由 raft 选出 leader ，忽略
+func (cs *CenterServer) SetMaster(isMaster bool) {
+	if cs.raft != nil {
+		common.Log.Warning("center server ignore set master as leader is elected by raft", isMaster)
+		return
+	}
+	cs.IsMaster = isMaster
+}
+
+// 按 mediator 下发的拓扑更新 raft peers ，旧 epoch 的拓扑被忽略
+func (cs *CenterServer) SetRole(role mediator.CenterRole) bool {
+	if role.Group != cs.Group {
+		common.Log.Warning("center server ignore role of other group", role.Group, cs.Group)
+		return false
+	}
+	if role.Epoch < cs.epoch {
+		common.Log.Warning("center server ignore stale role", role.Epoch, cs.epoch)
+		return false
+	}
+	if cs.Standalone {
+		common.Log.Warning("center server ignore role as standalone", role.Master, role.Slaves)
+		return false
+	}
+	cs.epoch = role.Epoch
+	common.Log.Info("center server role changed", cs.CenterHost, role.Master, role.Slaves, role.Epoch)
+
+	if cs.raft == nil {
+		cs.SetMaster(role.Master == cs.CenterHost)
+		return true
+	}
+
+	peers := append([]string{role.Master}, role.Slaves...)
+	sort.Strings(peers)
+	var others []string
+	for _, peer := range peers {
+		if peer != cs.CenterHost {
+			others = append(others, peer)
+		}
+	}
+	cs.setOtherCenters(others)
+	if e := cs.raft.SetPeers(peers); e != nil {
+		common.Log.Error("center server set raft peers error", e)
+	}
+	return true
+}
+
+// 状态，用于 mediator 选举，raft 运行时位置为已应用的序号
+func (cs *CenterServer) State() mediator.CenterState {
+	position, records := cs.Center.Position()
+	if cs.raft != nil {
+		position = cs.raft.Applied()
+	}
+	return mediator.CenterState{
+		Addr:     cs.CenterHost,
+		IsMaster: cs.isMaster(),
+		Epoch:    cs.epoch,
+		Position: position,
+		Records:  records,
+		Group:    cs.Group,
+		IndexIds: cs.Center.IndexIds(),
+	}
 }
@@ -4,6 +4,10 @@ import (
 	"github.com/blastbao/whisper/common"
 	"github.com/valyala/gorpc"
 	"github.com/blastbao/whisper/mediator"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -83,3 +87,95 @@ func TestCenterServer(t *testing.T) {
 		time.Sleep(2 * time.Second)
 	}
 }
+
+func callHandler(cs *CenterServer, p PackRecord) PackRecord {
+	return cs.handler("", p).(PackRecord)
+}
+
+func TestCenterServerExpire(t *testing.T) {
+	d := newTestIndex(t)
+	defer os.RemoveAll(d.Dir)
+
+	s := &CenterServer{Center: &Center{indexes: []*Index{d}, mutex: new(sync.Mutex)}}
+	AddHandler2CenterServer(s)
+
+	now := time.Now().Unix()
+	oid := GenOid(1, 1)
+	r := callHandler(s, PackRecord{Command: CMD_PUT_RECORD, Rec: Record{Oid: oid, Created: now - 10, Expired: now - 1}})
+	if !r.Flag {
+		t.Fatal(r.Msg)
+	}
+
+	r = callHandler(s, PackRecord{Command: CMD_GET_OID_META, Oid: oid})
+	if r.Flag || !strings.Contains(r.Msg, "not found") {
+		t.Fatal("expired record should be not found", r)
+	}
+
+	if n := s.SweepExpired(now); n != 1 {
+		t.Fatal("sweep expired number error", n)
+	}
+	rec, _ := d.Get(oid)
+	if rec.Status != common.STATUS_RECORD_DEL {
+		t.Fatal("expired record should be deleted", rec)
+	}
+	if n := s.SweepExpired(now); n != 0 {
+		t.Fatal("sweep expired twice error", n)
+	}
+}
+
+func TestCenterServerSetRole(t *testing.T) {
+	d := newTestIndex(t)
+	defer os.RemoveAll(d.Dir)
+
+	s := &CenterServer{CenterHost: "center-1", Center: &Center{indexes: []*Index{d}, mutex: new(sync.Mutex)}}
+
+	if !s.SetRole(mediator.CenterRole{Epoch: 2, Master: "center-2", Slaves: []string{"center-1"}}) {
+		t.Fatal("role should be accepted")
+	}
+	if s.IsMaster || len(s.otherCenters()) != 0 {
+		t.Fatal("slave should not connect to other centers")
+	}
+
+	// stale epoch from the old topology
+	if s.SetRole(mediator.CenterRole{Epoch: 1, Master: "center-1"}) || s.IsMaster {
+		t.Fatal("stale role should be ignored")
+	}
+	if state := s.State(); state.Epoch != 2 || state.Addr != "center-1" || state.IsMaster {
+		t.Fatal("center state error", state)
+	}
+
+	// role of other group
+	if s.SetRole(mediator.CenterRole{Epoch: 3, Master: "center-1", Group: "g1"}) || s.IsMaster {
+		t.Fatal("role of other group should be ignored")
+	}
+}
+
+func TestCenterServerCreateIndex(t *testing.T) {
+	d := newTestIndex(t)
+	defer os.RemoveAll(d.Dir)
+
+	s := &CenterServer{CenterHost: "center-1", Group: "g1", Center: &Center{Dir: d.Dir, indexes: []*Index{d}, mutex: new(sync.Mutex)}}
+	AddHandler2CenterServer(s)
+
+	for i := 0; i < 2; i++ {
+		if r := callHandler(s, PackRecord{Command: CMD_CREATE_INDEX, Body: []byte("5")}); !r.Flag {
+			t.Fatal(r.Msg)
+		}
+	}
+	if r := callHandler(s, PackRecord{Command: CMD_CREATE_INDEX, Body: []byte("x")}); r.Flag {
+		t.Fatal("invalid index id should fail")
+	}
+
+	state := s.State()
+	if state.Group != "g1" || len(state.IndexIds) != 2 || state.IndexIds[1] != 5 {
+		t.Fatal("center state error", state)
+	}
+
+	oid := GenOid(5, 1)
+	if r := callHandler(s, PackRecord{Command: CMD_PUT_RECORD, Rec: Record{Oid: oid}}); !r.Flag {
+		t.Fatal(r.Msg)
+	}
+	if _, e := os.Stat(filepath.Join(d.Dir, "data_5")); e != nil {
+		t.Fatal("index dir not created", e)
+	}
+}
@@ -7,8 +7,10 @@ import (
 	"regexp"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/blastbao/whisper/common"
+	"github.com/blastbao/whisper/mediator"
 )
 
 
@@ -19,17 +21,26 @@ type Center struct {
 	// suppose 100, memory cost 100 * 200M(100w records each data) = 20G
 	indexes []*Index
 	mutex   *sync.Mutex
+	// 加载索引的目录
+	Dir string
 }
 
 // 加载索引
 func (c *Center) Load(dir string) error {
 	common.Log.Info("center load index data from " + dir)
 
+	c.Dir = dir
 	c.indexes = []*Index{}
+	if c.mutex == nil {
+		c.mutex = new(sync.Mutex)
+	}
 	reg := regexp.MustCompile("data_(\\d+)$")
 
 	// 遍历目录 dir 下所有文件
 	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
 
 		// 如果是 data_xxx 目录
 		if info.IsDir() && reg.MatchString(path) {
@@ -133,6 +144,87 @@ func (c *Center) Get(idxId int, oid string) (rec Record, err error) {
 	return
 }
 
+// 去重，oid 不含副本号，返回被引用的 oid
+func (c *Center) PutRef(oid string, rec Record) (ref string, err error) {
+	idxId := GetOidInfo(oid + "_0").IndexId
+	for _, d := range c.indexes {
+		if d.Id == idxId {
+			return d.PutRef(oid, rec)
+		}
+	}
+
+	err = errors.New("center target index id not found" + strconv.Itoa(idxId))
+	return
+}
+
+func (c *Center) ChangeStatus(idxId int, oid string, status int) error {
+	for _, d := range c.indexes {
+		if d.Id == idxId {
+			return d.ChangeStatus(oid, status)
+		}
+	}
+
+	return errors.New("center target index id not found" + strconv.Itoa(idxId))
+}
+
+// 所有索引中已过期的记录，每个索引最多 limit 个
+func (c *Center) ExpiredOids(now int64, limit int) []string {
+	var r []string
+	for _, d := range c.indexes {
+		oids, e := d.ExpiredOids(now, limit)
+		if e != nil {
+			common.Log.Error("center get expired oids error", d.Id, e)
+			continue
+		}
+		r = append(r, oids...)
+	}
+	return r
+}
+
+// 所有索引中每个块的使用情况，用于块压缩
+func (c *Center) BlockUsage() []mediator.BlockUsage {
+	live := make(map[int]int)
+	total := make(map[int]int)
+	for _, d := range c.indexes {
+		d.BlockUsage(live, total)
+	}
+
+	var r []mediator.BlockUsage
+	for blockId, t := range total {
+		r = append(r, mediator.BlockUsage{BlockId: blockId, Live: live[blockId], Total: t})
+	}
+	return r
+}
+
+// 块内仍需保留的数据段
+func (c *Center) GetLiveRegionsByBlockId(blockId int) (RecordList, error) {
+	if c.indexes == nil {
+		return nil, errors.New("center data list is nil")
+	}
+
+	var res RecordList
+	for _, index := range c.indexes {
+		records, err := index.GetLiveRegionsByBlockId(blockId)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, records...)
+	}
+	return res, nil
+}
+
+// 压缩后更新记录的 BlockId/Offset ，返回更新的记录数
+func (c *Center) MoveRecords(moves []RecordMove) (int, error) {
+	n := 0
+	for _, index := range c.indexes {
+		m, err := index.MoveRecords(moves)
+		if err != nil {
+			return n, err
+		}
+		n += m
+	}
+	return n, nil
+}
 
 // 创建新的 Index 对象，指定保存到 dir 目录中。
 func (c *Center) NewIndex(dir string) (int, error) {
@@ -155,9 +247,92 @@ func (c *Center) NewIndex(dir string) (int, error) {
 	if err := d.Init(maxIdxId, dir); err != nil {
 		return 0, err
 	}
+	c.indexes = append(c.indexes, d)
 	return maxIdxId, nil
 }
 
+// 创建指定 id 的索引，保存到 Dir/data_{id} ，已存在时忽略，由 mediator 分配 id
+func (c *Center) CreateIndex(id int) error {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, d := range c.indexes {
+		if d.Id == id {
+			return nil
+		}
+	}
+
+	dir := filepath.Join(c.Dir, "data_"+strconv.Itoa(id))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	d := &Index{}
+	if err := d.Init(id, dir); err != nil {
+		return err
+	}
+	c.indexes = append(c.indexes, d)
+	common.Log.Info("center index created", id, dir)
+	return nil
+}
+
+// 所有索引的 id
+func (c *Center) IndexIds() []int {
+	var r []int
+	for _, d := range c.indexes {
+		r = append(r, d.Id)
+	}
+	return r
+}
+
+// 每个索引的状态
+func (c *Center) IndexInfos() []IndexInfo {
+	var r []IndexInfo
+	for _, d := range c.indexes {
+		r = append(r, d.Info())
+	}
+	return r
+}
+
+// 数据位置，用于选举，最近修改时间越新、记录越多表示数据越新
+func (c *Center) Position() (lastModify int64, records int) {
+	for _, info := range c.IndexInfos() {
+		if info.LastModify > lastModify {
+			lastModify = info.LastModify
+		}
+		records += info.Records
+	}
+	return
+}
+
+// 对满足条件的索引执行快照，并清理旧日志，返回快照的索引数
+func (c *Center) AutoPersist(now time.Time) int {
+	n := 0
+	for _, d := range c.indexes {
+		if d.NeedPersist(now) {
+			if e := d.Persist(); e != nil {
+				common.Log.Error("center auto persist index error", d.Id, e)
+				continue
+			}
+			n++
+		}
+		d.RemoveBakLogs(now)
+	}
+	return n
+}
+
+// 关闭所有索引的日志
+func (c *Center) Close() error {
+	var err error
+	for _, d := range c.indexes {
+		if e := d.Close(); e != nil {
+			common.Log.Error("center close index error", d.Id, e)
+			err = e
+		}
+	}
+	return err
+}
+
 // 持久化
 func (c *Center) Persist() error {
 	for _, d := range c.indexes {
@@ -0,0 +1,137 @@
+package center
+
+import (
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/blastbao/whisper/common"
+)
+
+// 自动快照
+//
+// 有未快照的修改，且满足以下任一条件时执行 Persist：
+// 日志大小超过 AutoPersistLogBytes ，日志记录数超过 AutoPersistLogRecords ，
+// 距最近修改(LastModifyMillis)超过 AutoPersistIdleSec ，距上次快照超过 AutoPersistMaxAgeSec 。
+// 0 表示不使用该条件。
+
+var AutoPersistLogBytes int64 = 64 * 1024 * 1024
+var AutoPersistLogRecords int = 100 * 1000
+var AutoPersistIdleSec int = 10 * 60
+var AutoPersistMaxAgeSec int = 6 * 60 * 60
+
+// 已包含在快照中的日志段(index_log_{id}_bak_*)，保留最新的 LogBakRetainNum 个，
+// 且删除早于 LogBakRetainSec 的，0 表示不按时间删除
+var LogBakRetainNum int = 3
+var LogBakRetainSec int = 7 * 24 * 60 * 60
+
+// 索引状态，CMD_MED_INDEX_INFO 返回
+type IndexInfo struct {
+	Id          int
+	Records     int
+	LogRecords  int   // records written to log since last snapshot
+	LastModify  int64 // unix seconds
+	LastPersist int64 // unix seconds of last snapshot, 0 if none
+}
+
+func (index *Index) Info() IndexInfo {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	info := IndexInfo{Id: index.Id, Records: index.Len(), LogRecords: index.logRecords, LastModify: index.LastModifyMillis.Unix()}
+	if !index.lastPersist.IsZero() {
+		info.LastPersist = index.lastPersist.Unix()
+	}
+	return info
+}
+
+// 当前日志大小
+func (index *Index) logBytes() int64 {
+	fi, e := os.Stat(index.getWriteLogFile())
+	if e != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// 是否需要自动快照
+func (index *Index) NeedPersist(now time.Time) bool {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	// 没有未快照的修改
+	if index.IndexTree == nil || index.logRecords == 0 {
+		return false
+	}
+
+	if AutoPersistLogRecords > 0 && index.logRecords >= AutoPersistLogRecords {
+		return true
+	}
+	if AutoPersistLogBytes > 0 && index.logBytes() >= AutoPersistLogBytes {
+		return true
+	}
+	if AutoPersistIdleSec > 0 && now.Sub(index.LastModifyMillis) >= time.Duration(AutoPersistIdleSec)*time.Second {
+		return true
+	}
+	if AutoPersistMaxAgeSec > 0 && now.Sub(index.lastPersist) >= time.Duration(AutoPersistMaxAgeSec)*time.Second {
+		return true
+	}
+	return false
+}
+
+// 按保留策略删除已包含在快照中的日志段，返回删除的文件数
+//
+// 比当前快照新的日志段还未被快照包含，不会被删除。
+func (index *Index) RemoveBakLogs(now time.Time) int {
+	index.mutex.Lock()
+	gen := index.generation
+	index.mutex.Unlock()
+
+	fis, e := ioutil.ReadDir(index.Dir)
+	if e != nil {
+		common.Log.Error("center index remove bak logs error", index.Id, e)
+		return 0
+	}
+
+	// index_log_{id}_bak_gen{G} 或旧版本的 index_log_{id}_bak_{timestamp}
+	reg := regexp.MustCompile("^" + INDEX_LOG_FILE_PRE + strconv.Itoa(index.Id) + "_bak_(gen)?(\\d+)$")
+
+	var baks []os.FileInfo
+	for _, fi := range fis {
+		arr := reg.FindStringSubmatch(fi.Name())
+		if arr == nil || fi.IsDir() {
+			continue
+		}
+		if arr[1] != "" {
+			if g, _ := strconv.Atoi(arr[2]); g > gen {
+				continue
+			}
+		}
+		baks = append(baks, fi)
+	}
+
+	// 从新到旧
+	sort.Slice(baks, func(i, j int) bool { return baks[i].ModTime().After(baks[j].ModTime()) })
+
+	n := 0
+	for i, fi := range baks {
+		expired := LogBakRetainSec > 0 && now.Sub(fi.ModTime()) >= time.Duration(LogBakRetainSec)*time.Second
+		if i < LogBakRetainNum && !expired {
+			continue
+		}
+
+		if e := os.Remove(index.Dir + "/" + fi.Name()); e != nil {
+			common.Log.Error("center index remove bak log error", fi.Name(), e)
+			continue
+		}
+		n++
+	}
+
+	if n > 0 {
+		common.Log.Info("center index bak logs removed", index.Id, n)
+	}
+	return n
+}
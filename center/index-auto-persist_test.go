@@ -0,0 +1,109 @@
+package center
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestIndexNeedPersist(t *testing.T) {
+	d := newTestIndex(t)
+	defer os.RemoveAll(d.Dir)
+	defer d.Close()
+
+	oldBytes, oldRecords, oldIdle, oldAge := AutoPersistLogBytes, AutoPersistLogRecords, AutoPersistIdleSec, AutoPersistMaxAgeSec
+	defer func() {
+		AutoPersistLogBytes, AutoPersistLogRecords, AutoPersistIdleSec, AutoPersistMaxAgeSec = oldBytes, oldRecords, oldIdle, oldAge
+	}()
+	AutoPersistLogBytes, AutoPersistLogRecords, AutoPersistIdleSec, AutoPersistMaxAgeSec = 0, 3, 60, 0
+
+	now := time.Now()
+	if d.NeedPersist(now) {
+		t.Fatal("nothing to persist")
+	}
+
+	setTestRecords(t, d, 0, 2)
+	now = time.Now()
+	if d.NeedPersist(now) {
+		t.Fatal("should not persist below limits")
+	}
+	// idle
+	if !d.NeedPersist(now.Add(time.Minute)) {
+		t.Fatal("should persist when idle")
+	}
+
+	// record number
+	setTestRecords(t, d, 2, 3)
+	if !d.NeedPersist(now) {
+		t.Fatal("should persist by record number")
+	}
+
+	// log size
+	AutoPersistLogRecords, AutoPersistLogBytes = 0, 10
+	if !d.NeedPersist(now) {
+		t.Fatal("should persist by log size")
+	}
+
+	if e := d.Persist(); e != nil {
+		t.Fatal(e)
+	}
+	if d.NeedPersist(now.Add(time.Hour)) {
+		t.Fatal("nothing to persist after snapshot")
+	}
+
+	info := d.Info()
+	if info.Records != 3 || info.LogRecords != 0 || info.LastPersist == 0 {
+		t.Fatal("index info error", info)
+	}
+
+	// the log records since last snapshot are counted again after load
+	setTestRecords(t, d, 3, 5)
+	d.Close()
+	d2 := loadTestIndex(t, d.Dir)
+	defer d2.Close()
+	if info := d2.Info(); info.LogRecords != 2 || info.LastPersist == 0 {
+		t.Fatal("index info after load error", info)
+	}
+}
+
+func TestIndexRemoveBakLogs(t *testing.T) {
+	d := newTestIndex(t)
+	defer os.RemoveAll(d.Dir)
+
+	oldNum, oldSec := LogBakRetainNum, LogBakRetainSec
+	defer func() { LogBakRetainNum, LogBakRetainSec = oldNum, oldSec }()
+	LogBakRetainNum, LogBakRetainSec = 2, 3600
+
+	now := time.Now()
+	files := map[string]time.Time{
+		"index_log_1_bak_1500000000": now.Add(-2 * time.Hour), // legacy, too old
+		"index_log_1_bak_gen1":       now.Add(-3 * time.Minute),
+		"index_log_1_bak_gen2":       now.Add(-2 * time.Minute),
+		"index_log_1_bak_gen3":       now.Add(-1 * time.Minute),
+		"index_log_1_bak_gen5":       now.Add(-3 * time.Hour), // not included in snapshot yet
+		"index_log_12_bak_gen1":      now.Add(-3 * time.Hour), // other index
+	}
+	for name, mtime := range files {
+		fn := d.Dir + "/" + name
+		ioutil.WriteFile(fn, []byte{}, 0666)
+		os.Chtimes(fn, mtime, mtime)
+	}
+	d.generation = 4
+
+	if n := d.RemoveBakLogs(now); n != 2 {
+		t.Fatal("remove bak logs error", n)
+	}
+	for name, kept := range map[string]bool{
+		"index_log_1_bak_1500000000": false,
+		"index_log_1_bak_gen1":       false,
+		"index_log_1_bak_gen2":       true,
+		"index_log_1_bak_gen3":       true,
+		"index_log_1_bak_gen5":       true,
+		"index_log_12_bak_gen1":      true,
+	} {
+		if exists(d.Dir+"/"+name) != kept {
+			t.Fatal("remove bak logs error", name, kept)
+		}
+	}
+}
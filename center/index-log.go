@@ -0,0 +1,355 @@
+package center
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/blastbao/whisper/common"
+)
+
+// 索引日志格式
+//
+// header: LOG_MAGIC + LOG_VERSION
+// frame:  [4 字节 payload 长度][4 字节 payload crc32][payload]，payload 为一条序列化的 Record
+//
+// 旧格式没有 header ，记录之间以 common.SP 分隔，加载时识别并迁移为新格式。
+// 崩溃时最后一个 frame 可能不完整，加载时截断不完整的尾部；
+// 中间的 frame 校验失败说明文件损坏，返回错误而不截断其后的有效数据。
+
+const (
+	LOG_VERSION      = 1
+	LOG_FRAME_HEADER = 8
+
+	LOG_SYNC_ALWAYS   = 0 // fsync every write
+	LOG_SYNC_BATCH    = 1 // fsync every LogSyncBatch records
+	LOG_SYNC_INTERVAL = 2 // fsync every LogSyncIntervalMs in background
+)
+
+// 0xF7 can not be the first byte of a marshalled Record, whose oid length is a small uvarint
+var LOG_MAGIC []byte = []byte{0xF7, 'W', 'L', 'G'}
+
+// max payload length of one frame, a larger length means a torn or corrupt frame
+var LOG_MAX_FRAME int = 1024 * 1024
+
+var LogSyncPolicy int = LOG_SYNC_ALWAYS
+var LogSyncBatch int = 100
+var LogSyncIntervalMs int = 1000
+
+// always / batch / interval
+func SetLogSyncPolicy(name string) error {
+	switch name {
+	case "", "always":
+		LogSyncPolicy = LOG_SYNC_ALWAYS
+	case "batch":
+		LogSyncPolicy = LOG_SYNC_BATCH
+	case "interval":
+		LogSyncPolicy = LOG_SYNC_INTERVAL
+	default:
+		return errors.New("center index log sync policy should be always, batch or interval - " + name)
+	}
+	return nil
+}
+
+func logHeader() []byte {
+	return append(append([]byte{}, LOG_MAGIC...), LOG_VERSION)
+}
+
+func isFramedLog(bb []byte) bool {
+	return len(bb) >= len(LOG_MAGIC)+1 && bytes.Equal(bb[:len(LOG_MAGIC)], LOG_MAGIC)
+}
+
+// 将 recs 编码为 frames
+func encLogFrames(recs []Record) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	head := make([]byte, LOG_FRAME_HEADER)
+	for _, rec := range recs {
+		body, e := ConvIndexTo(rec)
+		if e != nil {
+			return nil, e
+		}
+		binary.BigEndian.PutUint32(head[0:4], uint32(len(body)))
+		binary.BigEndian.PutUint32(head[4:8], crc32.ChecksumIEEE(body))
+		buf.Write(head)
+		buf.Write(body)
+	}
+	return buf.Bytes(), nil
+}
+
+// 解析新格式日志，返回有效记录及有效长度，有效长度小于 len(bb) 表示尾部不完整
+func decLogFrames(bb []byte) (recs []Record, valid int, err error) {
+	if !isFramedLog(bb) {
+		err = errors.New("center index log header invalid")
+		return
+	}
+	if v := bb[len(LOG_MAGIC)]; v != LOG_VERSION {
+		err = errors.New("center index log version not supported - " + strconv.Itoa(int(v)))
+		return
+	}
+
+	pos := len(LOG_MAGIC) + 1
+	recs, valid, err = decFrames(bb[pos:])
+	valid += pos
+	return
+}
+
+// 解析连续的 frames ，遇到不完整的尾部时停止，中间的 frame 损坏时返回错误
+func decFrames(bb []byte) (recs []Record, valid int, err error) {
+	pos := 0
+	for pos < len(bb) {
+		// 最后一个 frame 不完整
+		if len(bb)-pos < LOG_FRAME_HEADER {
+			break
+		}
+		size := int(binary.BigEndian.Uint32(bb[pos : pos+4]))
+		sum := binary.BigEndian.Uint32(bb[pos+4 : pos+8])
+		if len(bb)-pos-LOG_FRAME_HEADER < size {
+			break
+		}
+
+		end := pos + LOG_FRAME_HEADER + size
+		if size == 0 || size > LOG_MAX_FRAME || crc32.ChecksumIEEE(bb[pos+LOG_FRAME_HEADER:end]) != sum {
+			// 最后一个 frame 写了一半，或尾部是文件系统填充的 0
+			if end == len(bb) || isZeros(bb[pos:]) {
+				break
+			}
+			err = errors.New("center index log corrupt frame at offset " + strconv.Itoa(pos))
+			return
+		}
+
+		body := bb[pos+LOG_FRAME_HEADER : end]
+
+		var rec Record
+		if e := GetIndexFrom(body, &rec); e != nil {
+			err = e
+			return
+		}
+		recs = append(recs, rec)
+
+		pos += LOG_FRAME_HEADER + size
+		valid = pos
+	}
+	return
+}
+
+func isZeros(bb []byte) bool {
+	for _, b := range bb {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// 解析旧格式日志
+//
+// 分隔符可能出现在 Record 内部，解码失败时与下一段拼接后重试。
+// 先严格解码，避免被切断的片段在字段边界处被当作缺少新字段的旧记录；
+// 严格解码不出任何记录时说明日志由旧版本 Record 写入，再按兼容方式解码。
+// 每条记录后都写入分隔符，最后一条记录不完整时丢弃，保留之前的记录。
+func decLegacyLog(bb []byte) ([]Record, error) {
+	var torn []byte
+	if !bytes.HasSuffix(bb, common.SP) {
+		i := 0
+		if j := bytes.LastIndex(bb, common.SP); j >= 0 {
+			i = j + len(common.SP)
+		}
+		bb, torn = bb[:i], bb[i:]
+	}
+
+	recs, tail := decLegacyLogWith(bb, decRecordStrict)
+	if tail != nil && len(recs) == 0 {
+		recs, tail = decLegacyLogWith(bb, GetIndexFrom)
+	}
+	if tail = append(tail, torn...); len(tail) > 0 {
+		common.Log.Warning("center index legacy log torn tail dropped", len(recs), len(tail))
+	}
+	return recs, nil
+}
+
+// 严格解码，必须用完所有字节，否则拼接的多条旧记录可能被解码为一条新记录
+func decRecordStrict(b []byte, rec *Record) error {
+	if e := common.Dec(b, rec); e != nil {
+		return e
+	}
+	bb, e := common.Enc(rec)
+	if e != nil {
+		return e
+	}
+	if !bytes.Equal(bb, b) {
+		return errors.New("center record has trailing bytes")
+	}
+	return nil
+}
+
+// 返回解码的记录及无法解码的尾部
+func decLegacyLogWith(bb []byte, dec func([]byte, *Record) error) ([]Record, []byte) {
+	var recs []Record
+	var pending []byte
+	for _, one := range bytes.Split(bb, common.SP) {
+		if pending != nil {
+			joined := make([]byte, 0, len(pending)+len(common.SP)+len(one))
+			joined = append(append(append(joined, pending...), common.SP...), one...)
+			one = joined
+		}
+		// 0 means it's the last one
+		if len(one) == 0 {
+			continue
+		}
+
+		var rec Record
+		if e := dec(one, &rec); e != nil {
+			pending = one
+			continue
+		}
+		pending = nil
+		recs = append(recs, rec)
+	}
+
+	return recs, pending
+}
+
+// 读取日志文件，旧格式迁移为新格式，尾部不完整时截断
+func readLogFile(fn string) ([]Record, error) {
+	bb, e := ioutil.ReadFile(fn)
+	if e != nil {
+		return nil, e
+	}
+	if len(bb) == 0 {
+		return nil, nil
+	}
+
+	if !isFramedLog(bb) {
+		common.Log.Info("center index log is legacy format, migrating " + fn)
+		recs, e := decLegacyLog(bb)
+		if e != nil {
+			return nil, e
+		}
+		return recs, migrateLogFile(fn, recs)
+	}
+
+	recs, valid, e := decLogFrames(bb)
+	if e != nil {
+		return nil, e
+	}
+	if valid < len(bb) {
+		common.Log.Warning("center index log torn tail truncated", fn, valid, len(bb))
+		if e := os.Truncate(fn, int64(valid)); e != nil {
+			return nil, e
+		}
+	}
+	return recs, nil
+}
+
+// 先写临时文件再替换，迁移过程中崩溃时旧日志仍然完整
+func migrateLogFile(fn string, recs []Record) error {
+	frames, e := encLogFrames(recs)
+	if e != nil {
+		return e
+	}
+	return common.WriteFileSync(append(logHeader(), frames...), fn)
+}
+
+// 日志写入，文件保持打开，按 LogSyncPolicy 执行 fsync
+type logWriter struct {
+	file    *os.File
+	pending int // records written but not synced
+	mutex   *sync.Mutex
+	chClose chan bool
+}
+
+func openLogWriter(fn string) (*logWriter, error) {
+	file, e := os.OpenFile(fn, os.O_APPEND|os.O_WRONLY, 0666)
+	if e != nil {
+		return nil, e
+	}
+
+	// 新建的空日志写入 header
+	fi, e := file.Stat()
+	if e == nil && fi.Size() == 0 {
+		_, e = file.Write(logHeader())
+	}
+	if e != nil {
+		file.Close()
+		return nil, e
+	}
+
+	w := &logWriter{file: file, mutex: new(sync.Mutex)}
+	if LogSyncPolicy == LOG_SYNC_INTERVAL {
+		w.chClose = make(chan bool)
+		go w.syncLoop()
+	}
+	return w, nil
+}
+
+func (w *logWriter) write(recs []Record) error {
+	frames, e := encLogFrames(recs)
+	if e != nil {
+		return e
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if _, e = w.file.Write(frames); e != nil {
+		return e
+	}
+	w.pending += len(recs)
+
+	if LogSyncPolicy == LOG_SYNC_ALWAYS || (LogSyncPolicy == LOG_SYNC_BATCH && w.pending >= LogSyncBatch) {
+		return w.sync()
+	}
+	return nil
+}
+
+// need lock first
+func (w *logWriter) sync() error {
+	if w.pending == 0 {
+		return nil
+	}
+	if e := w.file.Sync(); e != nil {
+		return e
+	}
+	w.pending = 0
+	return nil
+}
+
+func (w *logWriter) syncLoop() {
+	ticker := time.NewTicker(time.Duration(LogSyncIntervalMs) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.chClose:
+			return
+		case <-ticker.C:
+			w.mutex.Lock()
+			if e := w.sync(); e != nil {
+				common.Log.Error("center index log sync error", w.file.Name(), e)
+			}
+			w.mutex.Unlock()
+		}
+	}
+}
+
+// 关闭前 fsync 未同步的记录
+func (w *logWriter) close() error {
+	if w.chClose != nil {
+		close(w.chClose)
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	e := w.sync()
+	if e2 := w.file.Close(); e == nil {
+		e = e2
+	}
+	return e
+}
@@ -0,0 +1,200 @@
+package center
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/blastbao/whisper/common"
+)
+
+func TestIndexLogTornTail(t *testing.T) {
+	d := newTestIndex(t)
+	defer os.RemoveAll(d.Dir)
+
+	for i := 0; i < 3; i++ {
+		if e := d.Set(Record{Oid: "oid_" + strconv.Itoa(i), BlockId: 1, Len: 10}); e != nil {
+			t.Fatal(e)
+		}
+	}
+	d.Close()
+
+	fn := d.getWriteLogFile()
+	fi, _ := os.Stat(fn)
+	size := fi.Size()
+
+	// half written frame
+	frames, _ := encLogFrames([]Record{{Oid: "oid_torn"}})
+	f, _ := os.OpenFile(fn, os.O_APPEND|os.O_WRONLY, 0666)
+	f.Write(frames[:len(frames)-2])
+	f.Close()
+
+	d2 := &Index{}
+	d2.Init(1, d.Dir)
+	if e := d2.Load(); e != nil {
+		t.Fatal(e)
+	}
+	if d2.Len() != 3 {
+		t.Fatal("load length error", d2.Len())
+	}
+	if fi, _ = os.Stat(fn); fi.Size() != size {
+		t.Fatal("torn tail should be truncated", fi.Size(), size)
+	}
+
+	// writes after recovery are readable
+	d2.Set(Record{Oid: "oid_3"})
+	d2.Close()
+
+	// corrupt the crc of the last frame
+	bb, _ := ioutil.ReadFile(fn)
+	bb[len(bb)-1] ^= 0xFF
+	ioutil.WriteFile(fn, bb, 0666)
+
+	d3 := &Index{}
+	d3.Init(1, d.Dir)
+	if e := d3.Load(); e != nil {
+		t.Fatal(e)
+	}
+	if _, e := d3.Get("oid_2"); e != nil || d3.Len() != 3 {
+		t.Fatal("load after crc mismatch error", d3.Len(), e)
+	}
+	d3.Close()
+}
+
+func TestIndexLogCorruptMiddle(t *testing.T) {
+	d := newTestIndex(t)
+	defer os.RemoveAll(d.Dir)
+
+	for i := 0; i < 3; i++ {
+		if e := d.Set(Record{Oid: "oid_" + strconv.Itoa(i), BlockId: 1, Len: 10}); e != nil {
+			t.Fatal(e)
+		}
+	}
+	d.Close()
+
+	// corrupt the payload of the first frame
+	fn := d.getWriteLogFile()
+	bb, _ := ioutil.ReadFile(fn)
+	bb[len(LOG_MAGIC)+1+LOG_FRAME_HEADER] ^= 0xFF
+	ioutil.WriteFile(fn, bb, 0666)
+
+	d2 := &Index{}
+	d2.Init(1, d.Dir)
+	if e := d2.Load(); e == nil {
+		t.Fatal("load should fail on a corrupt frame in the middle")
+	}
+	if fi, _ := os.Stat(fn); fi.Size() != int64(len(bb)) {
+		t.Fatal("valid data should not be truncated", fi.Size(), len(bb))
+	}
+
+	// zero filled tail is torn
+	frames, _ := encLogFrames([]Record{{Oid: "a"}, {Oid: "b"}})
+	recs, valid, e := decFrames(append(frames, make([]byte, 64)...))
+	if e != nil || len(recs) != 2 || valid != len(frames) {
+		t.Fatal("zero filled tail error", len(recs), valid, e)
+	}
+}
+
+func TestIndexLogLegacy(t *testing.T) {
+	d := newTestIndex(t)
+	defer os.RemoveAll(d.Dir)
+
+	// legacy log, the separator shows up inside md5
+	buf := &bytes.Buffer{}
+	for i := 0; i < 3; i++ {
+		rec := Record{Oid: "oid_" + strconv.Itoa(i), Md5: append([]byte{byte(i)}, common.SP...), Len: 10}
+		bb, _ := ConvIndexTo(rec)
+		buf.Write(bb)
+		buf.Write(common.SP)
+	}
+	fn := d.getWriteLogFile()
+	ioutil.WriteFile(fn, buf.Bytes(), 0666)
+
+	if e := d.Load(); e != nil {
+		t.Fatal(e)
+	}
+	rec, e := d.Get("oid_1")
+	if e != nil || d.Len() != 3 || !bytes.Equal(rec.Md5, append([]byte{1}, common.SP...)) {
+		t.Fatal("load legacy log error", d.Len(), rec, e)
+	}
+
+	// migrated
+	bb, _ := ioutil.ReadFile(fn)
+	if !isFramedLog(bb) {
+		t.Fatal("legacy log should be migrated")
+	}
+	recs, valid, e := decLogFrames(bb)
+	if e != nil || len(recs) != 3 || valid != len(bb) {
+		t.Fatal("migrated log error", len(recs), valid, e)
+	}
+}
+
+func TestDecLegacyLogOldRecord(t *testing.T) {
+	buf := &bytes.Buffer{}
+	for i := 0; i < 3; i++ {
+		bb, _ := common.Enc(&recordV0{Oid: "oid_" + strconv.Itoa(i), BlockId: i, Len: 10})
+		buf.Write(bb)
+		buf.Write(common.SP)
+	}
+
+	recs, e := decLegacyLog(buf.Bytes())
+	if e != nil || len(recs) != 3 || recs[2].BlockId != 2 {
+		t.Fatal("decode legacy log of old records error", recs, e)
+	}
+}
+
+func TestDecLegacyLogTornTail(t *testing.T) {
+	buf := &bytes.Buffer{}
+	for i := 0; i < 3; i++ {
+		bb, _ := ConvIndexTo(Record{Oid: "oid_" + strconv.Itoa(i), BlockId: i, Len: 10})
+		buf.Write(bb)
+		buf.Write(common.SP)
+	}
+	bb, _ := ConvIndexTo(Record{Oid: "oid_torn", BlockId: 3, Len: 10})
+	buf.Write(bb[:len(bb)/2])
+
+	recs, e := decLegacyLog(buf.Bytes())
+	if e != nil || len(recs) != 3 || recs[2].BlockId != 2 {
+		t.Fatal("decode legacy log with torn tail error", recs, e)
+	}
+
+	// old records
+	buf.Reset()
+	for i := 0; i < 3; i++ {
+		bb, _ := common.Enc(&recordV0{Oid: "oid_" + strconv.Itoa(i), BlockId: i, Len: 10})
+		buf.Write(bb)
+		buf.Write(common.SP)
+	}
+	bb, _ = common.Enc(&recordV0{Oid: "oid_torn", BlockId: 3, Len: 10})
+	buf.Write(bb[:3])
+
+	if recs, e = decLegacyLog(buf.Bytes()); e != nil || len(recs) != 3 || recs[2].BlockId != 2 {
+		t.Fatal("decode legacy log of old records with torn tail error", recs, e)
+	}
+}
+
+func TestIndexLogSyncBatch(t *testing.T) {
+	d := newTestIndex(t)
+	defer os.RemoveAll(d.Dir)
+
+	old, oldBatch := LogSyncPolicy, LogSyncBatch
+	LogSyncPolicy, LogSyncBatch = LOG_SYNC_BATCH, 3
+	defer func() { LogSyncPolicy, LogSyncBatch = old, oldBatch }()
+
+	d.Set(Record{Oid: "a"})
+	d.Set(Record{Oid: "b"})
+	if d.log.pending != 2 {
+		t.Fatal("pending error", d.log.pending)
+	}
+	d.Set(Record{Oid: "c"})
+	if d.log.pending != 0 {
+		t.Fatal("should sync after batch", d.log.pending)
+	}
+	d.Close()
+
+	if e := SetLogSyncPolicy("sometimes"); e == nil {
+		t.Fatal("unknown policy should fail")
+	}
+}
@@ -1,8 +1,12 @@
 package center
 
 import (
+	"errors"
 	"io"
 	"sort"
+	"strings"
+
+	"github.com/blastbao/whisper/common"
 )
 
 func (index *Index) Filter(fn func(one Record) bool) (RecordList, error) {
@@ -65,10 +69,319 @@ func (index *Index) ChangeBlock(blockId, newBlockId int) error {
 	}
 
 	// 逐个更新 blockId
-	for _, record := range records {
-		record.BlockId = newBlockId
+	for i := range records {
+		records[i].BlockId = newBlockId
 	}
 
 	// 逐个将 recs 更新到索引
 	return index.SetBatch(records)
 }
+
+// 根据 md5 查找持有数据的记录
+func (index *Index) GetByMd5(md5 []byte) (rec Record, err error) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	return index.getByMd5(md5)
+}
+
+// need lock first
+func (index *Index) getByMd5(md5 []byte) (rec Record, err error) {
+	if index.OidMd5Tree == nil || len(md5) == 0 {
+		err = errors.New("center index get by md5 but not found")
+		return
+	}
+
+	v, ok := index.OidMd5Tree.Get(md5)
+	if !ok {
+		err = errors.New("center index get by md5 but not found")
+		return
+	}
+	oid := v.(string)
+	rec, err = index.get(oid)
+	rec.Oid = oid
+	return
+}
+
+// 去重：如果已存在 md5 相同的数据，为新 oid 的每个副本创建引用记录，并增加被引用记录的 RefCount 。
+//
+// oid 不含副本号，rec 提供 Md5/HashAlg/Len/Mime/Created/Expired ，返回被引用的 oid(不含副本号)。
+// 不存在可引用的数据时返回 not found ，调用方需要正常上传。
+func (index *Index) PutRef(oid string, rec Record) (ref string, err error) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	// 旧的抽样校验码会冲突，不做去重
+	if rec.HashAlg != common.HASH_MD5 {
+		err = errors.New("center index put ref but not found as hash alg not supported")
+		return
+	}
+
+	owner, e := index.getByMd5(rec.Md5)
+	if e != nil {
+		err = e
+		return
+	}
+	if owner.HashAlg != rec.HashAlg || owner.Len != rec.Len || !owner.IsBytesLive() || owner.IsErasure() {
+		err = errors.New("center index put ref but not found as no live record of md5")
+		return
+	}
+
+	// 引用记录与被引用记录副本一一对应，被引用记录副本不足时不去重
+	copies := GetOidSiblings(oid + "_0")
+	ownerCopies := GetOidSiblings(owner.Oid)
+	if len(ownerCopies) < len(copies) {
+		err = errors.New("center index put ref but not found as copy number not enough")
+		return
+	}
+
+	var recs []Record
+	for i, oidCopy := range copies {
+		o, e := index.get(ownerCopies[i])
+		if e != nil {
+			err = e
+			return
+		}
+		if !o.IsBytesLive() {
+			err = errors.New("center index put ref but not found as copy is not live " + o.Oid)
+			return
+		}
+		o.Oid = ownerCopies[i]
+
+		one := o
+		one.Oid = oidCopy
+		one.Ref = o.Oid
+		one.RefCount = 0
+		one.Status = 0
+		one.Mime = rec.Mime
+		one.Created = rec.Created
+		one.Expired = rec.Expired
+
+		o.RefCount++
+		recs = append(recs, o, one)
+	}
+
+	if err = index.setBatch(recs, true); err != nil {
+		return
+	}
+
+	ref = owner.Oid[:strings.LastIndex(owner.Oid, "_")]
+	return
+}
+
+// 修改记录状态，引用记录失效时减少被引用记录的 RefCount 。
+func (index *Index) ChangeStatus(oid string, status int) error {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	rec, e := index.get(oid)
+	if e != nil {
+		return e
+	}
+	rec.Oid = oid
+
+	wasLive := rec.IsLive()
+	rec.Status = status
+	recs := []Record{rec}
+
+	if rec.Ref != "" && wasLive && !rec.IsLive() {
+		owner, e := index.get(rec.Ref)
+		if e != nil {
+			common.Log.Warning("center index change status but ref not found", oid, rec.Ref)
+		} else {
+			owner.Oid = rec.Ref
+			if owner.RefCount > 0 {
+				owner.RefCount--
+			}
+			recs = append(recs, owner)
+		}
+	}
+
+	return index.setBatch(recs, true)
+}
+
+// 按过期时间顺序取出已过期且仍有效的记录，最多 limit 个，同时清理已失效的过期索引项
+func (index *Index) ExpiredOids(now int64, limit int) ([]string, error) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	if index.OidExpiredTree == nil || index.OidExpiredTree.Len() == 0 {
+		return nil, nil
+	}
+
+	en, err := index.OidExpiredTree.SeekFirst()
+	if err != nil {
+		return nil, err
+	}
+
+	var r []string
+	stale := make(map[int64][]string)
+	for len(r) < limit {
+		k, v, e := en.Next()
+		if e != nil {
+			if e != io.EOF {
+				return nil, e
+			}
+			break
+		}
+
+		expired := k.(int64)
+		if expired > now {
+			break
+		}
+
+		var left []string
+		for _, oid := range v.([]string) {
+			rec, e := index.get(oid)
+			// 已删除、已修改过期时间的记录不再处理
+			if e != nil || !rec.IsLive() || rec.Expired != expired {
+				continue
+			}
+			left = append(left, oid)
+			if len(r) < limit {
+				r = append(r, oid)
+			}
+		}
+		stale[expired] = left
+	}
+
+	// 不能在遍历时修改
+	for expired, left := range stale {
+		if len(left) == 0 {
+			index.OidExpiredTree.Delete(expired)
+		} else {
+			index.OidExpiredTree.Set(expired, left)
+		}
+	}
+
+	return r, nil
+}
+
+// 压缩时数据的移动，块内 Offset 处的数据移动到 NewBlockId 的 NewOffset 处
+type RecordMove struct {
+	BlockId    int
+	Offset     int
+	NewBlockId int
+	NewOffset  int
+}
+
+// 块内每段数据(按 Offset 去重)的使用情况，引用记录与被引用记录共享同一段数据
+func (index *Index) BlockUsage(live, total map[int]int) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	if index.IndexTree == nil {
+		return
+	}
+	en, err := index.IndexTree.SeekFirst()
+	if err != nil {
+		return
+	}
+
+	type region struct {
+		blockId int
+		offset  int
+	}
+	lens := make(map[region]int)
+	isLive := make(map[region]bool)
+	for {
+		_, v, e := en.Next()
+		if e != nil {
+			break
+		}
+
+		rec := v.(Record)
+		if rec.Len == 0 || rec.Status == common.STATUS_RECORD_BLOCK_BEGIN {
+			continue
+		}
+		r := region{rec.BlockId, rec.Offset}
+		lens[r] = rec.Len
+		if rec.IsBytesLive() {
+			isLive[r] = true
+		}
+	}
+
+	for r, l := range lens {
+		total[r.blockId] += l
+		if isLive[r] {
+			live[r.blockId] += l
+		}
+	}
+}
+
+// 块内仍需保留的数据段，每段取一条记录，按 Offset 排序
+func (index *Index) GetLiveRegionsByBlockId(blockId int) (RecordList, error) {
+	records, err := index.GetRecordsByBlockId(blockId)
+	if err != nil {
+		return nil, err
+	}
+
+	liveOffsets := make(map[int]bool)
+	for _, rec := range records {
+		if rec.IsBytesLive() {
+			liveOffsets[rec.Offset] = true
+		}
+	}
+
+	var list RecordList
+	for _, rec := range records {
+		if rec.Len == 0 || rec.Status == common.STATUS_RECORD_BLOCK_BEGIN {
+			continue
+		}
+		if liveOffsets[rec.Offset] {
+			list = append(list, rec)
+			delete(liveOffsets, rec.Offset)
+		}
+	}
+	return list, nil
+}
+
+// 按 moves 更新所有指向被移动数据的记录(包括已删除的记录)，一次写入日志
+func (index *Index) MoveRecords(moves []RecordMove) (int, error) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	if index.IndexTree == nil || len(moves) == 0 {
+		return 0, nil
+	}
+
+	type region struct {
+		blockId int
+		offset  int
+	}
+	m := make(map[region]RecordMove)
+	for _, move := range moves {
+		m[region{move.BlockId, move.Offset}] = move
+	}
+
+	en, err := index.IndexTree.SeekFirst()
+	if err != nil {
+		return 0, err
+	}
+
+	var recs []Record
+	for {
+		k, v, e := en.Next()
+		if e != nil {
+			if e != io.EOF {
+				return 0, e
+			}
+			break
+		}
+
+		rec := v.(Record)
+		move, ok := m[region{rec.BlockId, rec.Offset}]
+		if !ok {
+			continue
+		}
+		rec.Oid = k.(string)
+		rec.BlockId = move.NewBlockId
+		rec.Offset = move.NewOffset
+		recs = append(recs, rec)
+	}
+
+	if len(recs) == 0 {
+		return 0, nil
+	}
+	return len(recs), index.setBatch(recs, true)
+}
@@ -0,0 +1,441 @@
+package center
+
+import (
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/blastbao/whisper/common"
+)
+
+// 索引目录布局(INDEX_LAYOUT_VERSION)
+//
+// index_log_{id}                  当前日志
+// index_log_{id}_bak_gen{G}       第 G 代快照轮转出的日志段，已包含在第 G 代快照中
+// index_{id}_gen_{G}_part{K}      第 G 代快照的分片，内容为压缩后的 frames
+// index_{id}_gen_{G}.manifest     第 G 代快照的 manifest ，列出分片及其覆盖的日志段
+// index_{id} / index_{id}_part{K} 旧格式快照，没有 manifest 时加载
+//
+// 每次 Persist 生成新的一代(generation)：
+// (1) 当前日志轮转为 index_log_{id}_bak_gen{G} ，创建新的当前日志
+// (2) 写入分片并 fsync
+// (3) 写入 manifest.tmp 并 fsync ，rename 为 manifest ，fsync 目录
+// (4) 删除更早的快照
+//
+// manifest 存在即表示这一代完整，Load 选择最新的完整 manifest ，然后重放比它新的日志段及当前日志。
+// 步骤 (3) 之前崩溃时，上一代快照加上轮转出的日志段仍然完整。
+
+const (
+	INDEX_LAYOUT_VERSION = 1
+	INDEX_GEN_PRE        = "_gen_"
+	INDEX_PART_PRE       = "_part"
+	INDEX_MANIFEST_SUF   = ".manifest"
+	INDEX_LOG_BAK_PRE    = "_bak_gen"
+)
+
+type SnapshotPart struct {
+	Name    string // file name in index dir
+	Size    int64
+	Crc     uint32 // crc32 of file content
+	Records int
+}
+
+type SnapshotManifest struct {
+	Version    int // INDEX_LAYOUT_VERSION
+	IndexId    int
+	Generation int
+	Created    int64
+	Records    int
+	Parts      []SnapshotPart
+	LogSegment string // the last log segment included, index_log_{id}_bak_gen{G}
+}
+
+// index_{id}_gen_{G}
+func (index *Index) getGenerationPre(gen int) string {
+	return INDEX_FILE_PRE + strconv.Itoa(index.Id) + INDEX_GEN_PRE + strconv.Itoa(gen)
+}
+
+// dir/index_{id}_gen_{G}.manifest
+func (index *Index) getManifestFile(gen int) string {
+	return index.Dir + "/" + index.getGenerationPre(gen) + INDEX_MANIFEST_SUF
+}
+
+// index_{id}_gen_{G}_part{K}
+func (index *Index) getPartName(gen, k int) string {
+	return index.getGenerationPre(gen) + INDEX_PART_PRE + strconv.Itoa(k)
+}
+
+// index_log_{id}_bak_gen{G}
+func (index *Index) getLogSegmentName(gen int) string {
+	return INDEX_LOG_FILE_PRE + strconv.Itoa(index.Id) + INDEX_LOG_BAK_PRE + strconv.Itoa(gen)
+}
+
+// 目录中所有轮转出的日志段的 generation ，从旧到新
+func (index *Index) listLogSegments() ([]int, error) {
+	reg := regexp.MustCompile("^" + INDEX_LOG_FILE_PRE + strconv.Itoa(index.Id) + INDEX_LOG_BAK_PRE + "(\\d+)$")
+
+	fis, e := ioutil.ReadDir(index.Dir)
+	if e != nil {
+		return nil, e
+	}
+
+	var gens []int
+	for _, fi := range fis {
+		if arr := reg.FindStringSubmatch(fi.Name()); arr != nil {
+			gen, _ := strconv.Atoi(arr[1])
+			gens = append(gens, gen)
+		}
+	}
+	sort.Ints(gens)
+	return gens, nil
+}
+
+// 大于所有已有快照及日志段的 generation ，避免覆盖崩溃时留下的日志段
+func (index *Index) nextGeneration() (int, error) {
+	gen := index.generation
+
+	gens, e := index.listGenerations()
+	if e != nil {
+		return 0, e
+	}
+	if len(gens) > 0 && gens[0] > gen {
+		gen = gens[0]
+	}
+
+	segs, e := index.listLogSegments()
+	if e != nil {
+		return 0, e
+	}
+	if len(segs) > 0 && segs[len(segs)-1] > gen {
+		gen = segs[len(segs)-1]
+	}
+	return gen + 1, nil
+}
+
+// need lock first
+//
+// 当前日志轮转为第 gen 代的日志段，并创建新的当前日志
+func (index *Index) rotateLog(gen int) error {
+	if err := index.closeLog(); err != nil {
+		return err
+	}
+
+	fn := index.getWriteLogFile()
+	_, e := os.Stat(fn)
+	isExists := e == nil || os.IsExist(e)
+	if isExists {
+		if err := os.Rename(fn, index.Dir+"/"+index.getLogSegmentName(gen)); err != nil {
+			return err
+		}
+	}
+
+	// 生成新的日志文件
+	if err := index.generateLogFile(); err != nil {
+		return err
+	}
+	return common.SyncDir(index.Dir)
+}
+
+// need lock first
+//
+// 重放比当前快照新的日志段
+func (index *Index) replayLogSegments(t *trees) error {
+	segs, e := index.listLogSegments()
+	if e != nil {
+		return e
+	}
+
+	for _, gen := range segs {
+		if gen <= index.generation {
+			continue
+		}
+
+		fn := index.Dir + "/" + index.getLogSegmentName(gen)
+		common.Log.Info("center index replay log segment " + fn)
+		recs, e := readLogFile(fn)
+		if e != nil {
+			return e
+		}
+		for _, rec := range recs {
+			t.set(rec)
+		}
+		index.logRecords += len(recs)
+	}
+	return nil
+}
+
+// 目录中所有 manifest 的 generation ，从新到旧
+func (index *Index) listGenerations() ([]int, error) {
+	reg := regexp.MustCompile("^" + INDEX_FILE_PRE + strconv.Itoa(index.Id) + INDEX_GEN_PRE + "(\\d+)" + regexp.QuoteMeta(INDEX_MANIFEST_SUF) + "$")
+
+	fis, e := ioutil.ReadDir(index.Dir)
+	if e != nil {
+		return nil, e
+	}
+
+	var gens []int
+	for _, fi := range fis {
+		if arr := reg.FindStringSubmatch(fi.Name()); arr != nil {
+			gen, _ := strconv.Atoi(arr[1])
+			gens = append(gens, gen)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(gens)))
+	return gens, nil
+}
+
+// 写入一个快照分片并 fsync
+func (index *Index) writeSnapshotPart(gen, k int, recs []Record) (SnapshotPart, error) {
+	part := SnapshotPart{Name: index.getPartName(gen, k), Records: len(recs)}
+
+	frames, e := encLogFrames(recs)
+	if e != nil {
+		return part, e
+	}
+	compressed, e := common.Compress(frames)
+	if e != nil {
+		return part, e
+	}
+
+	file, e := os.OpenFile(index.Dir+"/"+part.Name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if e != nil {
+		return part, e
+	}
+	_, e = file.Write(compressed)
+	if e == nil {
+		e = file.Sync()
+	}
+	if e2 := file.Close(); e == nil {
+		e = e2
+	}
+
+	part.Size = int64(len(compressed))
+	part.Crc = crc32.ChecksumIEEE(compressed)
+	return part, e
+}
+
+// need lock first
+//
+// 将索引写入第 gen 代快照，manifest 写入后这一代才可见
+func (index *Index) writeSnapshot(gen int) (*SnapshotManifest, error) {
+	m := &SnapshotManifest{
+		Version:    INDEX_LAYOUT_VERSION,
+		IndexId:    index.Id,
+		Generation: gen,
+		Created:    time.Now().Unix(),
+		LogSegment: index.getLogSegmentName(gen),
+	}
+
+	var recs []Record
+	flush := func() error {
+		if len(recs) == 0 {
+			return nil
+		}
+		common.Log.Info("center index begin persist part", index.Id, index.Dir, gen, len(m.Parts))
+		part, e := index.writeSnapshotPart(gen, len(m.Parts), recs)
+		if e != nil {
+			return e
+		}
+		m.Parts = append(m.Parts, part)
+		m.Records += len(recs)
+		recs = recs[:0]
+		return nil
+	}
+
+	if index.IndexTree != nil && index.IndexTree.Len() > 0 {
+		en, e := index.IndexTree.SeekFirst()
+		if e != nil {
+			return nil, e
+		}
+		for {
+			k, v, e := en.Next()
+			if e != nil {
+				if e != io.EOF {
+					return nil, e
+				}
+				break
+			}
+
+			rec := v.(Record)
+			rec.Oid = k.(string)
+			recs = append(recs, rec)
+
+			// 判断是否要分文件
+			if len(recs) == PERSIST_EACH_FILE_RECORD_NUM_LIMIT {
+				if e := flush(); e != nil {
+					return nil, e
+				}
+			}
+		}
+	}
+	if e := flush(); e != nil {
+		return nil, e
+	}
+
+	bb, e := common.Enc(m)
+	if e != nil {
+		return nil, e
+	}
+	// 分片已 fsync ，manifest 原子替换后 fsync 目录
+	if e := common.WriteFileSync(bb, index.getManifestFile(gen)); e != nil {
+		return nil, e
+	}
+	return m, nil
+}
+
+func (index *Index) readManifest(gen int) (*SnapshotManifest, error) {
+	bb, e := ioutil.ReadFile(index.getManifestFile(gen))
+	if e != nil {
+		return nil, e
+	}
+
+	m := &SnapshotManifest{}
+	if e := common.Dec(bb, m); e != nil {
+		return nil, e
+	}
+	if e := index.validateManifest(m, gen); e != nil {
+		return nil, e
+	}
+	return m, nil
+}
+
+// manifest 的版本、所属索引及分片命名必须与布局一致
+func (index *Index) validateManifest(m *SnapshotManifest, gen int) error {
+	fn := index.getManifestFile(gen)
+	if m.Version != INDEX_LAYOUT_VERSION {
+		return errors.New("center index manifest version not supported - " + strconv.Itoa(m.Version) + " " + fn)
+	}
+	if m.IndexId != index.Id || m.Generation != gen {
+		return errors.New("center index manifest not match - " + fn)
+	}
+	if m.LogSegment != index.getLogSegmentName(gen) {
+		return errors.New("center index manifest log segment invalid - " + m.LogSegment)
+	}
+
+	n := 0
+	for k, part := range m.Parts {
+		if part.Name != index.getPartName(gen, k) {
+			return errors.New("center index manifest part invalid - " + part.Name)
+		}
+		n += part.Records
+	}
+	if n != m.Records {
+		return errors.New("center index manifest record number mismatch - " + fn)
+	}
+	return nil
+}
+
+// 读取并校验一个快照分片
+func (index *Index) readSnapshotPart(part SnapshotPart) ([]Record, error) {
+	content, e := ioutil.ReadFile(index.Dir + "/" + part.Name)
+	if e != nil {
+		return nil, e
+	}
+	if int64(len(content)) != part.Size || crc32.ChecksumIEEE(content) != part.Crc {
+		return nil, errors.New("center index snapshot part checksum mismatch - " + part.Name)
+	}
+
+	raw, e := common.Depress(content)
+	if e != nil {
+		return nil, e
+	}
+	recs, valid, e := decFrames(raw)
+	if e != nil {
+		return nil, e
+	}
+	if valid != len(raw) || len(recs) != part.Records {
+		return nil, errors.New("center index snapshot part incomplete - " + part.Name)
+	}
+	return recs, nil
+}
+
+// 校验并加载 manifest 中的所有分片，记录总数已由 validateManifest 校验
+func (index *Index) loadSnapshot(m *SnapshotManifest, t *trees) error {
+	for _, part := range m.Parts {
+		recs, e := index.readSnapshotPart(part)
+		if e != nil {
+			return e
+		}
+		for _, rec := range recs {
+			t.set(rec)
+		}
+	}
+	return nil
+}
+
+// need lock first
+//
+// 加载最新的完整快照，没有快照时 loaded 为 false
+func (index *Index) loadLatestSnapshot(t **trees) (loaded bool, err error) {
+	gens, e := index.listGenerations()
+	if e != nil {
+		return false, e
+	}
+
+	for _, gen := range gens {
+		m, e := index.readManifest(gen)
+		if e == nil {
+			one := newTrees()
+			if e = index.loadSnapshot(m, one); e == nil {
+				*t = one
+				index.generation = gen
+				index.lastPersist = time.Unix(m.Created, 0)
+				common.Log.Info("center index snapshot loaded", index.Id, gen, m.Records)
+				return true, nil
+			}
+		}
+		common.Log.Error("center index snapshot skipped", index.Id, gen, e)
+	}
+
+	if len(gens) > 0 {
+		return false, errors.New("center index no complete snapshot in " + index.Dir)
+	}
+	index.generation = 0
+	index.lastPersist = time.Time{}
+	return false, nil
+}
+
+// 快照分片、manifest 及其临时文件，第一个分组为 generation
+func (index *Index) getSnapshotFileReg() *regexp.Regexp {
+	pre := INDEX_FILE_PRE + strconv.Itoa(index.Id)
+	return regexp.MustCompile("^" + pre + INDEX_GEN_PRE + "(\\d+)(" + INDEX_PART_PRE + "\\d+|" + regexp.QuoteMeta(INDEX_MANIFEST_SUF) + ")(\\.tmp)?$")
+}
+
+// 删除 gen 之前的快照、未完成的临时文件及旧格式的索引文件
+func (index *Index) removeSnapshotsBefore(gen int) {
+	fis, e := ioutil.ReadDir(index.Dir)
+	if e != nil {
+		common.Log.Error("center index remove old snapshots error", index.Id, e)
+		return
+	}
+
+	legacy, e := index.listLegacyFiles()
+	if e != nil {
+		common.Log.Error("center index list legacy files error", index.Id, e)
+	}
+
+	reg := index.getSnapshotFileReg()
+	for _, fi := range fis {
+		name := fi.Name()
+
+		remove := false
+		if arr := reg.FindStringSubmatch(name); arr != nil {
+			g, _ := strconv.Atoi(arr[1])
+			remove = g < gen
+		} else if common.ContainsStr(legacy, name) {
+			remove = true
+		}
+
+		if remove {
+			if e := os.Remove(index.Dir + "/" + name); e != nil {
+				common.Log.Error("center index remove old snapshot file error", name, e)
+			}
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package center
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/blastbao/whisper/common"
+)
+
+func setTestRecords(t *testing.T, d *Index, from, to int) {
+	for i := from; i < to; i++ {
+		if e := d.Set(Record{Oid: "oid_" + strconv.Itoa(i), BlockId: 1, Offset: i * 10, Len: 10}); e != nil {
+			t.Fatal(e)
+		}
+	}
+}
+
+func loadTestIndex(t *testing.T, dir string) *Index {
+	d := &Index{}
+	if e := d.Init(1, dir); e != nil {
+		t.Fatal(e)
+	}
+	if e := d.Load(); e != nil {
+		t.Fatal(e)
+	}
+	return d
+}
+
+func exists(fn string) bool {
+	_, e := os.Stat(fn)
+	return e == nil
+}
+
+func TestIndexPersistGeneration(t *testing.T) {
+	d := newTestIndex(t)
+	defer os.RemoveAll(d.Dir)
+
+	setTestRecords(t, d, 0, 3)
+	if e := d.Persist(); e != nil {
+		t.Fatal(e)
+	}
+	if !exists(d.getManifestFile(1)) {
+		t.Fatal("manifest of generation 1 not found")
+	}
+
+	setTestRecords(t, d, 3, 5)
+	if e := d.Persist(); e != nil {
+		t.Fatal(e)
+	}
+	if !exists(d.getManifestFile(2)) || exists(d.getManifestFile(1)) || exists(d.Dir+"/"+d.getGenerationPre(1)+"_part0") {
+		t.Fatal("generation 1 should be replaced by generation 2")
+	}
+
+	// records after the snapshot come from log
+	setTestRecords(t, d, 5, 6)
+	d.Close()
+
+	d2 := loadTestIndex(t, d.Dir)
+	defer d2.Close()
+	if d2.Len() != 6 || d2.generation != 2 {
+		t.Fatal("load after persist error", d2.Len(), d2.generation)
+	}
+
+	// empty index
+	d3 := newTestIndex(t)
+	defer os.RemoveAll(d3.Dir)
+	d3.Load()
+	if e := d3.Persist(); e != nil {
+		t.Fatal(e)
+	}
+	d3.Close()
+	if d4 := loadTestIndex(t, d3.Dir); d4.Len() != 0 || d4.generation != 1 {
+		t.Fatal("load empty snapshot error", d4.Len(), d4.generation)
+	}
+}
+
+func TestIndexPersistCrash(t *testing.T) {
+	d := newTestIndex(t)
+	defer os.RemoveAll(d.Dir)
+
+	setTestRecords(t, d, 0, 3)
+	if e := d.Persist(); e != nil {
+		t.Fatal(e)
+	}
+	setTestRecords(t, d, 3, 4)
+
+	// crash after parts of generation 2 are written but before the manifest
+	if _, e := d.writeSnapshotPart(2, 0, []Record{{Oid: "half"}}); e != nil {
+		t.Fatal(e)
+	}
+	ioutil.WriteFile(d.getManifestFile(2)+".tmp", []byte("half"), 0666)
+	d.Close()
+
+	d2 := loadTestIndex(t, d.Dir)
+	if _, e := d2.Get("half"); e == nil || d2.Len() != 4 || d2.generation != 1 {
+		t.Fatal("load after crash error", d2.Len(), d2.generation)
+	}
+
+	// a complete generation 3 whose part is damaged later falls back to generation 1 and the log
+	d2.mutex.Lock()
+	m, e := d2.writeSnapshot(3)
+	d2.mutex.Unlock()
+	if e != nil {
+		t.Fatal(e)
+	}
+	d2.Close()
+	fn := d.Dir + "/" + m.Parts[0].Name
+	bb, _ := ioutil.ReadFile(fn)
+	bb[0] ^= 0xFF
+	ioutil.WriteFile(fn, bb, 0666)
+
+	d3 := loadTestIndex(t, d.Dir)
+	if d3.Len() != 4 || d3.generation != 1 {
+		t.Fatal("load fallback error", d3.Len(), d3.generation)
+	}
+
+	// next persist goes beyond the damaged generation and removes older ones
+	if e := d3.Persist(); e != nil {
+		t.Fatal(e)
+	}
+	d3.Close()
+	if d3.generation != 4 || exists(d.getManifestFile(3)) || exists(d.getManifestFile(1)) || exists(d.getManifestFile(2)+".tmp") {
+		t.Fatal("persist after fallback error", d3.generation)
+	}
+}
+
+func TestIndexPersistCrashAfterRotate(t *testing.T) {
+	d := newTestIndex(t)
+	defer os.RemoveAll(d.Dir)
+
+	setTestRecords(t, d, 0, 3)
+	if e := d.Persist(); e != nil {
+		t.Fatal(e)
+	}
+	setTestRecords(t, d, 3, 5)
+
+	// crash after the log is rotated but before the snapshot is written
+	d.mutex.Lock()
+	if e := d.rotateLog(2); e != nil {
+		t.Fatal(e)
+	}
+	d.mutex.Unlock()
+	setTestRecords(t, d, 5, 6)
+	d.Close()
+
+	d2 := loadTestIndex(t, d.Dir)
+	if d2.Len() != 6 || d2.generation != 1 {
+		t.Fatal("load after rotate crash error", d2.Len(), d2.generation)
+	}
+
+	// the rotated segment is not overwritten
+	if e := d2.Persist(); e != nil {
+		t.Fatal(e)
+	}
+	d2.Close()
+	if d2.generation != 3 || !exists(d.Dir+"/"+d.getLogSegmentName(2)) {
+		t.Fatal("persist after rotate crash error", d2.generation)
+	}
+	if d3 := loadTestIndex(t, d.Dir); d3.Len() != 6 {
+		t.Fatal("load after persist error", d3.Len())
+	}
+}
+
+func TestIndexLoadLegacySnapshot(t *testing.T) {
+	d := newTestIndex(t)
+	defer os.RemoveAll(d.Dir)
+
+	buf := &bytes.Buffer{}
+	for i := 0; i < 3; i++ {
+		bb, _ := ConvIndexTo(Record{Oid: "oid_" + strconv.Itoa(i), Len: 10})
+		buf.Write(bb)
+		buf.Write(common.SP)
+	}
+	compressed, _ := common.Compress(buf.Bytes())
+	legacy := d.Dir + "/" + INDEX_FILE_PRE + "1"
+	ioutil.WriteFile(legacy, compressed, 0666)
+
+	d2 := loadTestIndex(t, d.Dir)
+	if d2.Len() != 3 {
+		t.Fatal("load legacy snapshot error", d2.Len())
+	}
+
+	if e := d2.Persist(); e != nil {
+		t.Fatal(e)
+	}
+	d2.Close()
+	if exists(legacy) {
+		t.Fatal("legacy snapshot should be removed after persist")
+	}
+	if d3 := loadTestIndex(t, d.Dir); d3.Len() != 3 {
+		t.Fatal("load after legacy persist error", d3.Len())
+	}
+}
@@ -0,0 +1,162 @@
+package center
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 索引目录的检查结果，只读，不修改任何文件
+type IndexReport struct {
+	IndexId    int
+	Dir        string
+	Generation int      // latest complete snapshot generation, 0 if none
+	Records    int      // records in the snapshot
+	Legacy     []string // legacy snapshot files used when there is no manifest
+	Missing    []string // parts listed in a manifest but not found
+	Corrupt    []string // manifests or parts failing validation
+	Extra      []string // files of this index not used by the loader
+	Replay     []string // log files replayed after the snapshot
+}
+
+func (r *IndexReport) IsOk() bool {
+	return len(r.Missing) == 0 && len(r.Corrupt) == 0
+}
+
+func (r *IndexReport) String() string {
+	buf := &bytes.Buffer{}
+	status := "ok"
+	if !r.IsOk() {
+		status = "broken"
+	}
+	buf.WriteString("index " + strconv.Itoa(r.IndexId) + " " + status + " - " + r.Dir + "\n")
+	buf.WriteString("  generation: " + strconv.Itoa(r.Generation) + ", records: " + strconv.Itoa(r.Records) + "\n")
+
+	write := func(title string, list []string) {
+		if len(list) > 0 {
+			buf.WriteString("  " + title + ": " + strings.Join(list, ", ") + "\n")
+		}
+	}
+	write("legacy", r.Legacy)
+	write("missing", r.Missing)
+	write("corrupt", r.Corrupt)
+	write("extra", r.Extra)
+	write("replay", r.Replay)
+	return buf.String()
+}
+
+// 检查索引目录，按 Load 的规则选择快照并列出缺失、损坏及多余的文件
+func VerifyIndex(id int, dir string) (*IndexReport, error) {
+	index := &Index{Id: id, Dir: dir}
+	r := &IndexReport{IndexId: id, Dir: dir}
+
+	gens, e := index.listGenerations()
+	if e != nil {
+		return nil, e
+	}
+
+	used := map[string]bool{}
+	for _, gen := range gens {
+		name := index.getGenerationPre(gen) + INDEX_MANIFEST_SUF
+		m, e := index.readManifest(gen)
+		if e != nil {
+			r.Corrupt = append(r.Corrupt, name+" ("+e.Error()+")")
+			continue
+		}
+
+		complete := true
+		for _, part := range m.Parts {
+			if _, e := os.Stat(dir + "/" + part.Name); os.IsNotExist(e) {
+				r.Missing = append(r.Missing, part.Name)
+				complete = false
+			} else if _, e := index.readSnapshotPart(part); e != nil {
+				r.Corrupt = append(r.Corrupt, part.Name+" ("+e.Error()+")")
+				complete = false
+			}
+		}
+		if !complete {
+			continue
+		}
+
+		r.Generation = gen
+		r.Records = m.Records
+		used[name] = true
+		for _, part := range m.Parts {
+			used[part.Name] = true
+		}
+		break
+	}
+
+	// 没有完整的快照时才加载旧格式文件
+	if len(gens) == 0 {
+		if r.Legacy, e = index.listLegacyFiles(); e != nil {
+			return nil, e
+		}
+		for _, name := range r.Legacy {
+			used[name] = true
+		}
+	}
+
+	// 日志段：比快照新的需要重放，旧的已包含在快照中
+	segs, e := index.listLogSegments()
+	if e != nil {
+		return nil, e
+	}
+	for _, gen := range segs {
+		name := index.getLogSegmentName(gen)
+		used[name] = true
+		if gen > r.Generation {
+			r.Replay = append(r.Replay, name)
+		}
+	}
+	logName := INDEX_LOG_FILE_PRE + strconv.Itoa(id)
+	if _, e := os.Stat(dir + "/" + logName); e == nil {
+		used[logName] = true
+		r.Replay = append(r.Replay, logName)
+	}
+
+	// 属于该索引但不会被加载的文件，旧版本的 index_log_{id}_bak_{timestamp} 也列在这里
+	reg := regexp.MustCompile("^(" + INDEX_FILE_PRE + "|" + INDEX_LOG_FILE_PRE + ")" + strconv.Itoa(id) + "($|_|\\.)")
+	fis, e := ioutil.ReadDir(dir)
+	if e != nil {
+		return nil, e
+	}
+	for _, fi := range fis {
+		if !fi.IsDir() && reg.MatchString(fi.Name()) && !used[fi.Name()] {
+			r.Extra = append(r.Extra, fi.Name())
+		}
+	}
+	sort.Strings(r.Extra)
+
+	return r, nil
+}
+
+// 检查 baseDir 下所有 data_{id} 目录
+func VerifyIndexes(baseDir string) ([]*IndexReport, error) {
+	reg := regexp.MustCompile("^data_(\\d+)$")
+
+	fis, e := ioutil.ReadDir(baseDir)
+	if e != nil {
+		return nil, e
+	}
+
+	var reports []*IndexReport
+	for _, fi := range fis {
+		arr := reg.FindStringSubmatch(fi.Name())
+		if !fi.IsDir() || arr == nil {
+			continue
+		}
+
+		id, _ := strconv.Atoi(arr[1])
+		r, e := VerifyIndex(id, baseDir+"/"+fi.Name())
+		if e != nil {
+			return nil, e
+		}
+		reports = append(reports, r)
+	}
+	return reports, nil
+}
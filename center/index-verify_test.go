@@ -0,0 +1,56 @@
+package center
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestListLegacyFiles(t *testing.T) {
+	d := newTestIndex(t)
+	defer os.RemoveAll(d.Dir)
+
+	for _, name := range []string{"index_1_part10", "index_1_part2", "index_1", "index_log_1_bak_1500000000", "index_12", "index_12_part0"} {
+		ioutil.WriteFile(d.Dir+"/"+name, []byte{}, 0666)
+	}
+	os.Mkdir(d.Dir+"/sub", 0777)
+	ioutil.WriteFile(d.Dir+"/sub/index_1", []byte{}, 0666)
+
+	files, e := d.listLegacyFiles()
+	if e != nil || !reflect.DeepEqual(files, []string{"index_1_part2", "index_1_part10", "index_1"}) {
+		t.Fatal("list legacy files error", files, e)
+	}
+}
+
+func TestVerifyIndex(t *testing.T) {
+	d := newTestIndex(t)
+	defer os.RemoveAll(d.Dir)
+
+	setTestRecords(t, d, 0, 3)
+	if e := d.Persist(); e != nil {
+		t.Fatal(e)
+	}
+	setTestRecords(t, d, 3, 4)
+	d.Close()
+	ioutil.WriteFile(d.Dir+"/index_1_gen_2_part0", []byte("orphan"), 0666)
+	ioutil.WriteFile(d.Dir+"/index_log_1_bak_1500000000", []byte{}, 0666)
+
+	r, e := VerifyIndex(1, d.Dir)
+	if e != nil || !r.IsOk() || r.Generation != 1 || r.Records != 3 {
+		t.Fatal("verify index error", r, e)
+	}
+	if !reflect.DeepEqual(r.Extra, []string{"index_1_gen_2_part0", "index_log_1_bak_1500000000"}) {
+		t.Fatal("verify index extra error", r.Extra)
+	}
+	if !reflect.DeepEqual(r.Replay, []string{"index_log_1"}) {
+		t.Fatal("verify index replay error", r.Replay)
+	}
+
+	// part lost
+	os.Remove(d.Dir + "/index_1_gen_1_part0")
+	r, e = VerifyIndex(1, d.Dir)
+	if e != nil || r.IsOk() || !reflect.DeepEqual(r.Missing, []string{"index_1_gen_1_part0"}) {
+		t.Fatal("verify index missing error", r, e)
+	}
+}
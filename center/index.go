@@ -1,15 +1,12 @@
 package center
 
 import (
-	"bytes"
 	"errors"
-	"io"
 	"io/ioutil"
 	"os"
-	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 
@@ -38,9 +35,21 @@ type Index struct {
 	OidMd5Tree       *b.Tree // key is md5, value is oid
 	// CTime => oid
 	OidCreatedTree   *b.Tree // key is created time, value is oid
+	// ETime => oids
+	OidExpiredTree   *b.Tree // key is expired time, value is oids, only records with ttl
 	// MTime
 	LastModifyMillis time.Time
 	mutex            *sync.Mutex
+	// 日志写入，首次写入时打开
+	log              *logWriter
+	// 当前快照的 generation
+	generation       int
+	// 上次快照时间
+	lastPersist      time.Time
+	// 上次快照之后写入日志的记录数
+	logRecords       int
+	// 正在应用的 raft 日志序号，0 表示不经 raft 写入
+	applying         int64
 }
 
 func (index *Index) Init(id int, dir string) error {
@@ -60,13 +69,16 @@ func (index *Index) generateLogFile() error {
 
 	isExists := error == nil || os.IsExist(error)
 
-	// 不存在则创建，并更新修改时间
+	// 不存在则创建并写入 header ，更新修改时间
 	if !isExists {
 		file, error := os.Create(fd)
 		if error != nil {
 			return error
 		}
 		defer file.Close()
+		if _, error = file.Write(logHeader()); error != nil {
+			return error
+		}
 		index.LastModifyMillis = time.Now()
 	// 存在则获取修改时间
 	} else {
@@ -86,7 +98,7 @@ func (index *Index) getWriteLogFile() string {
 }
 
 // 加载索引文件
-func (index *Index) loadEachSync(fileName string, indexTree, oidMd5Tree, oidCreatedTree *b.Tree) error {
+func (index *Index) loadEachSync(fileName string, t *trees) error {
 
 	_, e := os.Stat(fileName)
 	isExists := e == nil || os.IsExist(e)
@@ -109,11 +121,16 @@ func (index *Index) loadEachSync(fileName string, indexTree, oidMd5Tree, oidCrea
 			return e
 		}
 
-		// 将索引数据同步到索引中
-		e = index.appendIndexFromBytes(raw, indexTree, oidMd5Tree, oidCreatedTree)
+		// 分隔符可能出现在记录内部，按旧格式日志的方式解析
+		recs, e := decLegacyLog(raw)
 		if e != nil {
 			return e
 		}
+
+		// 将索引数据同步到索引中
+		for _, rec := range recs {
+			t.set(rec)
+		}
 	}
 
 	return nil
@@ -128,31 +145,45 @@ func (index *Index) Load() error {
 	index.mutex.Lock()
 	defer index.mutex.Unlock()
 
-	// 创建三个索引结果
-	indexTree := b.TreeNew(common.CmpStr)
-	oidMd5Tree := b.TreeNew(common.CmpByte)
-	oidCreatedTree := b.TreeNew(common.CmpInt64)
+	// 创建各个索引
+	t := newTrees()
 
-	// 原始索引文件：index_{dataID}
-	rawPersistFilePath := INDEX_FILE_PRE + strconv.Itoa(index.Id)
+	// 优先加载最新的完整快照，没有快照时加载旧格式的索引文件
+	loaded, err := index.loadLatestSnapshot(&t)
+	if err != nil {
+		return err
+	}
+	if !loaded {
+		if err := index.loadLegacy(t); err != nil {
+			return err
+		}
+	}
 
-	// 原始索引文件：index_{dataID}_part{xxx}
-	exp := rawPersistFilePath + "_part\\d+$"
+	// read from log, the log may be truncated so close the writer first
+	if err := index.closeLog(); err != nil {
+		return err
+	}
+	index.logRecords = 0
+	// 快照之后轮转出的日志段，只在持久化中途崩溃时存在
+	if err := index.replayLogSegments(t); err != nil {
+		return err
+	}
+	if err := index.appendIndexFromLogFile(t); err != nil {
+		return err
+	}
 
-	// 正则表达式
-	reg := regexp.MustCompile(exp)
+	index.setTrees(t)
 
-	// 遍历 index.Dir ，获取其中所有 "以 index_{dataID} 为后缀" 或者 "匹配 index_{dataID}_part{xxx} 模式" 的索引文件
-	files := make([]string, 1, 1)
-	if err := filepath.Walk(
-		index.Dir,
-		func(path string, info os.FileInfo, e error) error {
-			if strings.HasSuffix(path, rawPersistFilePath) || reg.MatchString(path) {
-				files = append(files, path)
-			}
-			return e
-		},
-	); err != nil {
+	return nil
+}
+
+// 旧格式的索引文件 index_{dataID}_part{xxx} 及 index_{dataID}
+//
+// 旧版本 Persist 先写 part0..partN ，剩余的记录写入 index_{dataID} ，按同样的顺序加载。
+func (index *Index) loadLegacy(t *trees) error {
+
+	files, err := index.listLegacyFiles()
+	if err != nil {
 		return err
 	}
 
@@ -160,27 +191,52 @@ func (index *Index) Load() error {
 
 	// 逐个文件进行加载
 	for _, file := range files {
-		//
-		if err := index.loadEachSync(file, indexTree, oidMd5Tree, oidCreatedTree); err != nil {
+		if err := index.loadEachSync(index.Dir+"/"+file, t); err != nil {
 			common.Log.Info("center index load part error", file, err)
 			return err
 		}
 		common.Log.Info("center index load part ok", file)
 	}
 
-	// read from log
-	if err := index.appendIndexFromLogFile(indexTree, oidMd5Tree, oidCreatedTree); err != nil {
-		return err
+	return nil
+}
+
+// 目录下旧格式的索引文件名，part 按编号排序，index_{dataID} 在最后
+func (index *Index) listLegacyFiles() ([]string, error) {
+	pre := INDEX_FILE_PRE + strconv.Itoa(index.Id)
+	reg := regexp.MustCompile("^" + pre + INDEX_PART_PRE + "(\\d+)$")
+
+	fis, err := ioutil.ReadDir(index.Dir)
+	if err != nil {
+		return nil, err
 	}
 
-	index.IndexTree = indexTree
-	index.OidMd5Tree = oidMd5Tree
-	index.OidCreatedTree = oidCreatedTree
+	var parts []int
+	hasRaw := false
+	for _, fi := range fis {
+		if fi.IsDir() {
+			continue
+		}
+		if fi.Name() == pre {
+			hasRaw = true
+		} else if arr := reg.FindStringSubmatch(fi.Name()); arr != nil {
+			k, _ := strconv.Atoi(arr[1])
+			parts = append(parts, k)
+		}
+	}
+	sort.Ints(parts)
 
-	return nil
+	var files []string
+	for _, k := range parts {
+		files = append(files, pre+INDEX_PART_PRE+strconv.Itoa(k))
+	}
+	if hasRaw {
+		files = append(files, pre)
+	}
+	return files, nil
 }
 
-func (index *Index) appendIndexFromLogFile(indexTree, oidMd5Tree, oidCreatedTree *b.Tree) error {
+func (index *Index) appendIndexFromLogFile(t *trees) error {
 
 	// 读取日志文件
 	fn := index.getWriteLogFile()
@@ -193,68 +249,78 @@ func (index *Index) appendIndexFromLogFile(indexTree, oidMd5Tree, oidCreatedTree
 		return nil
 	}
 
-	// 读取日志文件内容
-	bb, err := ioutil.ReadFile(fn)
+	// 读取日志，旧格式会被迁移，不完整的尾部会被截断
+	recs, err := readLogFile(fn)
 	if err != nil {
 		return err
 	}
+	common.Log.Info("center index load log record number", len(recs))
 
-	// 将日志数据 bb 同步到索引中
-	return index.appendIndexFromBytes(bb, indexTree, oidMd5Tree, oidCreatedTree)
+	// 将日志记录同步到索引中
+	for _, rec := range recs {
+		t.set(rec)
+	}
+	index.logRecords += len(recs)
+	return nil
 }
 
-// 将索引数据 bb 同步到索引中
-func (index *Index) appendIndexFromBytes(bb []byte, indexTree, oidMd5Tree, oidCreatedTree *b.Tree) error {
-
-	// 按分隔符切割，得到一组索引项
-	records := bytes.Split(bb, common.SP)
-	common.Log.Info("center index load split number", len(records))
+// 各个索引，加载时先构建新的索引，完成后再替换
+type trees struct {
+	indexTree      *b.Tree
+	oidMd5Tree     *b.Tree
+	oidCreatedTree *b.Tree
+	oidExpiredTree *b.Tree
+}
 
-	// 将 records 逐个同步到索引 indexTree/oidMd5Tree/oidCreatedTree 中
-	for _, recBinary := range records {
+func newTrees() *trees {
+	return &trees{
+		indexTree:      b.TreeNew(common.CmpStr),
+		oidMd5Tree:     b.TreeNew(common.CmpByte),
+		oidCreatedTree: b.TreeNew(common.CmpInt64),
+		oidExpiredTree: b.TreeNew(common.CmpInt64),
+	}
+}
 
-		// 0 means it's the last one
-		if len(recBinary) == 0 {
-			continue
+// 将 rec 写入各个索引，引用记录(rec.Ref 非空)不写入 md5 索引，保证 md5 总是指向持有数据的记录
+func (t *trees) set(rec Record) {
+	oid := rec.Oid
+	// ID => rec
+	t.indexTree.Set(oid, rec)
+	// Md5 => ID
+	if rec.Ref == "" {
+		t.oidMd5Tree.Set(rec.Md5, oid)
+	}
+	// CTime => ID
+	t.oidCreatedTree.Set(rec.Created, oid)
+	// ETime => IDs, stale entries are dropped when sweeping
+	if rec.Expired > 0 && rec.IsLive() {
+		var oids []string
+		if v, ok := t.oidExpiredTree.Get(rec.Expired); ok {
+			oids = v.([]string)
 		}
-
-		// 反序列化，得到 Record 对象
-		var rec Record
-		if err := GetIndexFrom(recBinary, &rec); err != nil {
-			common.Log.Error("center index load record error", recBinary, err)
-			return err
+		if !common.ContainsStr(oids, oid) {
+			t.oidExpiredTree.Set(rec.Expired, append(oids, oid))
 		}
-
-		// 同步到索引
-		oid := rec.Oid
-		indexTree.Set(oid, rec)
-		oidMd5Tree.Set(rec.Md5, oid)
-		oidCreatedTree.Set(rec.Created, oid)
-
 	}
-
-	return nil
 }
 
-
-func (index *Index) persistEachSync(raw []byte, part string) error {
-
-	// 文件名: dir/index_{dataId}_{part{xxx}}
-	fn := index.getPersistFile() + part
-
-	// 数据压缩
-	compressed, e := common.Compress(raw)
-	if e != nil {
-		return e
+func (index *Index) getTrees() *trees {
+	if index.IndexTree == nil {
+		index.setTrees(newTrees())
 	}
+	return &trees{index.IndexTree, index.OidMd5Tree, index.OidCreatedTree, index.OidExpiredTree}
+}
 
-	// 写入文件
-	return common.Write2File(compressed, fn, os.O_WRONLY)
+func (index *Index) setTrees(t *trees) {
+	index.IndexTree = t.indexTree
+	index.OidMd5Tree = t.oidMd5Tree
+	index.OidCreatedTree = t.oidCreatedTree
+	index.OidExpiredTree = t.oidExpiredTree
 }
 
 // write to file
 //
-//
+// 写入新一代快照，完成后轮转日志并删除更早的快照
 func (index *Index) Persist() error {
 
 	// 主索引不存在，报错
@@ -265,90 +331,32 @@ func (index *Index) Persist() error {
 	index.mutex.Lock()
 	defer index.mutex.Unlock()
 
-	// 定位到首元素
-	en, e := index.IndexTree.SeekFirst()
+	// 新的 generation ，大于所有已有的快照及日志段
+	gen, e := index.nextGeneration()
 	if e != nil {
 		return e
 	}
 
-	buf := &bytes.Buffer{}
-
-	j := 0
-	fileIndex := 0
-
-	// 遍历索引元素，把所含每个 record 序列化后存储到索引文件中
-	for {
-
-		k, v, e := en.Next()
-		if e != nil {
-
-			if e != io.EOF {
-				return e
-			}
-
-			// last
-			arr := buf.Bytes()
-			if len(arr) > 0 {
-				common.Log.Info("center index begin persist part", index.Id, index.Dir, j)
-				// 将 buf 写入到索引文件 dir/index_{dataId} 文件中。
-				if e := index.persistEachSync(buf.Bytes(), ""); e != nil {
-					return e
-				}
-			}
-
-			break
-		}
-
-		// k,v
-		oid := k.(string)
-		rec := v.(Record)
-		rec.Oid = oid
-
-		// 序列化成二进制，binary.Marshal(rec)
-		bb, e := ConvIndexTo(rec)
-		if e != nil {
-			return e
-		}
-
-		// 写入数据
-		buf.Write(bb)
-
-		// 写入分隔符
-		buf.Write(common.SP)
-
-		// 判断是否要分文件
-		if (j+1)%PERSIST_EACH_FILE_RECORD_NUM_LIMIT == 0 {
-			common.Log.Info("center index begin persist part", index.Id, index.Dir, j+1)
-			// 存储到索引文件 dir/index_{dataId}_part{xxx} 中
-			if err := index.persistEachSync(buf.Bytes(), "_part"+strconv.Itoa(fileIndex)); err != nil {
-				return err
-			}
-			// 清空 buf
-			buf.Reset()
-			// 文件下标++
-			fileIndex++
-		}
-
-		// 数据条数++
-		j++
-	}
-
-
 	// move log file as bak
+	//
+	// 先轮转日志，快照包含轮转出的日志段 dir/index_log_{dataId}_bak_gen{G} 中的全部记录。
+	// 快照完成前崩溃时，加载上一代快照并重放该日志段。
+	if err := index.rotateLog(gen); err != nil {
+		return err
+	}
 
-	// 将当前的日志文件 dir/index_log_{dataId} 修改为 dir/index_log_{dataId}_bak_timestamp 。
-	fn := index.getWriteLogFile()
-	_, e = os.Stat(fn)
-	isExists := e == nil || os.IsExist(e)
-	if isExists {
-		suf := "_bak_" + strconv.FormatInt(time.Now().Unix(), 10)
-		if err := os.Rename(fn, fn+suf) ; err != nil {
-			return err
-		}
+	m, e := index.writeSnapshot(gen)
+	if e != nil {
+		return e
 	}
+	index.generation = gen
+	index.lastPersist = time.Unix(m.Created, 0)
+	index.logRecords = 0
+	common.Log.Info("center index snapshot persisted", index.Id, gen, m.Records, len(m.Parts))
 
-	// 生成新的日志文件
-	return index.generateLogFile()
+	// 新快照完整后再删除旧快照
+	index.removeSnapshotsBefore(gen)
+	return nil
 }
 
 func (index *Index) Set(rec Record) (err error) {
@@ -369,21 +377,38 @@ func (index *Index) SetBatchWithLog(recs []Record, writeLog bool) error {
 	index.mutex.Lock()
 	defer index.mutex.Unlock()
 
+	return index.setBatch(recs, writeLog)
+}
+
+// need lock first
+func (index *Index) setBatch(recs []Record, writeLog bool) error {
+
 	// 更近最近修改时间
 	index.LastModifyMillis = time.Now()
 
 	// 初始化各个索引
-	if index.IndexTree == nil {
-		index.IndexTree = b.TreeNew(common.CmpStr)
-		index.OidMd5Tree = b.TreeNew(common.CmpByte)
-		index.OidCreatedTree = b.TreeNew(common.CmpInt64)
-	}
+	t := index.getTrees()
 
 	// 索引规模限制
 	if index.IndexTree.Len() >= MAX_TREE_LEN {
 		return errors.New("index error as exceed max length")
 	}
 
+	// 重启后重放 raft 日志时，记录已被该条目或之后的条目写入，跳过
+	if index.applying > 0 {
+		var left []Record
+		for _, rec := range recs {
+			if old, e := index.get(rec.Oid); e == nil && old.Seq >= index.applying {
+				continue
+			}
+			rec.Seq = index.applying
+			left = append(left, rec)
+		}
+		if recs = left; len(recs) == 0 {
+			return nil
+		}
+	}
+
 	// batch flush and using chan (a log system kafka etc) can improve throughput but worsen response time
 	// 批量刷新和使用管道（如 kafka 等）可以提高吞吐量，但会增加耗时。
 	if writeLog {
@@ -391,23 +416,17 @@ func (index *Index) SetBatchWithLog(recs []Record, writeLog bool) error {
 		if err := index.WriteLog(recs); err != nil {
 			return err
 		}
+		index.logRecords += len(recs)
 	}
 
 	// 将 recs 逐个写入索引
 	for _, rec := range recs {
-		oid := rec.Oid
-		// ID => rec
-		index.IndexTree.Set(oid, rec)
-		// Md5 => ID
-		index.OidMd5Tree.Set(rec.Md5, oid)
-		// CTime => ID
-		index.OidCreatedTree.Set(rec.Created, oid)
+		t.set(rec)
 	}
 
 	return nil
 }
 
-
 // 将 recs 写入日志
 func (index *Index) WriteLog(recs []Record) error {
 
@@ -419,34 +438,52 @@ func (index *Index) WriteLog(recs []Record) error {
 		return errors.New("center index log file not exists for index " + strconv.Itoa(index.Id))
 	}
 
-	// 追加写入
-	file, error := os.OpenFile(fn, os.O_APPEND, 0666)
-	if error != nil {
-		return error
-	}
-	defer file.Close()
-
-	// 把 recs 写入临时内存缓存
-	buf := &bytes.Buffer{}
-	for _, rec := range recs {
-		// 二进制序列化
-		body, error := ConvIndexTo(rec)
+	// 追加写入，文件保持打开
+	if index.log == nil {
+		w, error := openLogWriter(fn)
 		if error != nil {
 			return error
 		}
-		// 写入数据
-		buf.Write(body)
-		// 写入分隔符
-		buf.Write(common.SP)
+		index.log = w
+	}
+
+	// 每条记录一个 frame ，一次写入
+	return index.log.write(recs)
+}
+
+// need lock first
+func (index *Index) closeLog() error {
+	if index.log == nil {
+		return nil
 	}
+	e := index.log.close()
+	index.log = nil
+	return e
+}
+
+// 关闭日志，未同步的记录会被 fsync
+func (index *Index) Close() error {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
 
-	// 写入文件
-	_, error = file.Write(buf.Bytes())
-	return error
+	return index.closeLog()
 }
 
 // 根据 id 从 IndexTree 获取 record
 func (index *Index) Get(oid string) (rec Record, err error) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	return index.get(oid)
+}
+
+// need lock first
+func (index *Index) get(oid string) (rec Record, err error) {
+	if index.IndexTree == nil {
+		err = errors.New("center index get but not found " + oid)
+		return
+	}
+
 	v, ok := index.IndexTree.Get(oid)
 	if !ok {
 		err = errors.New("center index get but not found " + oid)
@@ -2,6 +2,8 @@ package center
 
 import (
 	"github.com/blastbao/whisper/common"
+	"io/ioutil"
+	"os"
 	"strconv"
 	"testing"
 )
@@ -70,3 +72,153 @@ func TestDataLoad(t *testing.T) {
 		}
 	}
 }
+
+func newTestIndex(t *testing.T) *Index {
+	dir, e := ioutil.TempDir("", "test-whisper-index")
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	d := &Index{}
+	if e := d.Init(1, dir); e != nil {
+		t.Fatal(e)
+	}
+	return d
+}
+
+func TestIndexPutRef(t *testing.T) {
+	d := newTestIndex(t)
+	defer os.RemoveAll(d.Dir)
+
+	body := []byte("the same avatar")
+	oid := GenOidNoSuffix(1, 1)
+	for i, oidCopy := range GetOidSiblings(oid + "_0") {
+		rec := Record{Oid: oidCopy, BlockId: i + 1, Offset: 100, Len: len(body),
+			Md5: common.GenMd5(body), HashAlg: common.HASH_MD5}
+		if e := d.Set(rec); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	// miss
+	other := []byte("another avatar")
+	if _, e := d.PutRef(GenOidNoSuffix(1, 1), Record{Md5: common.GenMd5(other), HashAlg: common.HASH_MD5, Len: len(other)}); e == nil {
+		t.Fatal("put ref should miss")
+	}
+
+	// hit
+	oidRef := GenOidNoSuffix(1, 1)
+	ref, e := d.PutRef(oidRef, Record{Md5: common.GenMd5(body), HashAlg: common.HASH_MD5, Len: len(body), Mime: common.MIME_PNG})
+	if e != nil || ref != oid {
+		t.Fatal("put ref error", ref, e)
+	}
+
+	rec, _ := d.Get(oidRef + "_1")
+	if rec.Ref != oid+"_1" || rec.BlockId != 2 || rec.Offset != 100 || rec.Mime != common.MIME_PNG {
+		t.Fatal("ref record error", rec)
+	}
+	owner, _ := d.Get(oid + "_1")
+	if owner.RefCount != 1 {
+		t.Fatal("ref count error", owner)
+	}
+
+	// md5 still points to the owner
+	byMd5, _ := d.GetByMd5(common.GenMd5(body))
+	if byMd5.Ref != "" {
+		t.Fatal("md5 should point to owner", byMd5)
+	}
+
+	// owner deleted but bytes still referenced
+	if e := d.ChangeStatus(oid+"_1", common.STATUS_RECORD_DEL); e != nil {
+		t.Fatal(e)
+	}
+	owner, _ = d.Get(oid + "_1")
+	if !owner.IsBytesLive() {
+		t.Fatal("owner bytes should be live", owner)
+	}
+
+	// last reference goes
+	if e := d.ChangeStatus(oidRef+"_1", common.STATUS_RECORD_DEL); e != nil {
+		t.Fatal(e)
+	}
+	// delete twice should not decrease again
+	if e := d.ChangeStatus(oidRef+"_1", common.STATUS_RECORD_DEL); e != nil {
+		t.Fatal(e)
+	}
+	owner, _ = d.Get(oid + "_1")
+	if owner.RefCount != 0 || owner.IsBytesLive() {
+		t.Fatal("owner bytes should be reclaimable", owner)
+	}
+}
+
+func TestIndexExpiredOids(t *testing.T) {
+	d := newTestIndex(t)
+	defer os.RemoveAll(d.Dir)
+
+	for i := 0; i < 5; i++ {
+		rec := Record{Oid: "oid_" + strconv.Itoa(i), Created: 100, Expired: int64(200 + i)}
+		if e := d.Set(rec); e != nil {
+			t.Fatal(e)
+		}
+	}
+	d.Set(Record{Oid: "oid_no_ttl", Created: 100})
+
+	oids, e := d.ExpiredOids(202, 100)
+	if e != nil || len(oids) != 3 {
+		t.Fatal("expired oids error", oids, e)
+	}
+
+	// limit
+	oids, _ = d.ExpiredOids(300, 2)
+	if len(oids) != 2 || oids[0] != "oid_0" {
+		t.Fatal("expired oids limit error", oids)
+	}
+
+	// deleted records are dropped
+	d.ChangeStatus("oid_0", common.STATUS_RECORD_DEL)
+	oids, _ = d.ExpiredOids(300, 100)
+	if len(oids) != 4 || common.ContainsStr(oids, "oid_0") {
+		t.Fatal("expired oids after delete error", oids)
+	}
+}
+
+func TestIndexMoveRecords(t *testing.T) {
+	d := newTestIndex(t)
+	defer os.RemoveAll(d.Dir)
+
+	// block 1: a[0,10) deleted, b[10,20) live, c[20,30) referenced by d
+	d.Set(Record{Oid: "a", BlockId: 1, Offset: 0, Len: 10, Status: common.STATUS_RECORD_DEL})
+	d.Set(Record{Oid: "b", BlockId: 1, Offset: 10, Len: 10})
+	d.Set(Record{Oid: "c", BlockId: 1, Offset: 20, Len: 10, Status: common.STATUS_RECORD_DEL, RefCount: 1})
+	d.Set(Record{Oid: "d", BlockId: 1, Offset: 20, Len: 10, Ref: "c"})
+	d.Set(Record{Oid: "e", BlockId: 2, Offset: 0, Len: 10})
+
+	live, total := make(map[int]int), make(map[int]int)
+	d.BlockUsage(live, total)
+	if live[1] != 20 || total[1] != 30 || live[2] != 10 || total[2] != 10 {
+		t.Fatal("block usage error", live, total)
+	}
+
+	regions, e := d.GetLiveRegionsByBlockId(1)
+	if e != nil || len(regions) != 2 || regions[0].Offset != 10 || regions[1].Offset != 20 {
+		t.Fatal("live regions error", regions, e)
+	}
+
+	n, e := d.MoveRecords([]RecordMove{
+		{BlockId: 1, Offset: 10, NewBlockId: 3, NewOffset: 0},
+		{BlockId: 1, Offset: 20, NewBlockId: 3, NewOffset: 10},
+	})
+	if e != nil || n != 3 {
+		t.Fatal("move records error", n, e)
+	}
+
+	for oid, offset := range map[string]int{"b": 0, "c": 10, "d": 10} {
+		rec, _ := d.Get(oid)
+		if rec.BlockId != 3 || rec.Offset != offset {
+			t.Fatal("moved record error", oid, rec)
+		}
+	}
+	if rec, _ := d.Get("a"); rec.BlockId != 1 {
+		t.Fatal("dead record should not move", rec)
+	}
+}
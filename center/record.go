@@ -27,6 +27,19 @@ type Record struct {
 	Created int64
 	Expired int64
 	Status  int
+	HashAlg int // algorithm of Md5, common.HASH_SAMPLED for records saved by old versions
+	// dedup, a reference record shares bytes (BlockId/Offset/Len) with the record Ref
+	Ref      string // oid of the record holding bytes, empty if it holds bytes itself
+	RefCount int    // live reference records of this one
+	// erasure coding, the record holds one shard (oid suffix) of a stripe, see client/client-erasure.go
+	EcData   int // data shards of the stripe, 0 for a full copy
+	EcParity int // parity shards of the stripe
+	EcFrom   int // bytes of the file are [EcFrom, EcFrom+EcLen) of the decoded stripe, small files may share one
+	EcLen    int
+	// raft, index of the log entry that wrote the record last, see Index.setBatch
+	Seq int64
+	// erasure coding, md5 of the file, Md5 is the checksum of the shard
+	EcMd5 []byte
 }
 
 var r = rand.New(rand.NewSource(time.Now().UnixNano()))
@@ -80,7 +93,8 @@ func GetOidSiblings(oid string) []string {
 			}
 		} else {
 			if cc == 1 {
-				copyNum, _ = strconv.Atoi(ch)
+				d, _ := strconv.Atoi(ch)
+				copyNum = copyNum*10 + d
 			}
 		}
 	}
@@ -99,12 +113,33 @@ func GetOidSiblings(oid string) []string {
 	return arr
 }
 
+// 纠删码分片，文件数据需要由 EcData 个分片恢复
+func (rec Record) IsErasure() bool {
+	return rec.EcData > 0
+}
+
+// 记录本身未删除/未禁用
+func (rec Record) IsLive() bool {
+	return rec.Status != common.STATUS_RECORD_DEL && rec.Status != common.STATUS_RECORD_DISABLE
+}
+
+// 记录指向的数据是否还需要保留：自身有效，或者仍被其它记录引用
+func (rec Record) IsBytesLive() bool {
+	return rec.IsLive() || rec.RefCount > 0
+}
+
+// 设置了过期时间且已过期，now 为秒
+func (rec Record) IsExpired(now int64) bool {
+	return rec.Expired > 0 && rec.Expired <= now
+}
+
 func NewBlockBeginRecord(dataId, blockId int) Record {
 	return Record{Oid: GenOid(dataId, 0), Offset: 0, Len: 10, Status: common.STATUS_RECORD_BLOCK_BEGIN}
 }
 
+// fields appended to Record are missing in old index files and keep zero value
 func GetIndexFrom(body []byte, rec *Record) (err error) {
-	return common.Dec(body, rec)
+	return common.DecCompat(body, rec)
 }
 
 func ConvIndexTo(rec Record) (body []byte, err error) {
@@ -140,7 +175,7 @@ func (rs RecordList) FilterByStatus(status int) RecordList {
 	var res RecordList
 	for _, rec := range rs {
 		if rec.Status == status {
-			res = append(rs, rec)
+			res = append(res, rec)
 		}
 	}
 	return res
@@ -13,6 +13,14 @@ func TestGetOidInfo(t *testing.T) {
 	common.Log.Info("oid siblings", GetOidSiblings(oid))
 }
 
+func TestGetOidSiblings(t *testing.T) {
+	oid := GenOidNoSuffix(1, 13)
+	siblings := GetOidSiblings(oid + "_0")
+	if len(siblings) != 14 || siblings[13] != oid+"_13" {
+		t.Fatal("siblings error", siblings)
+	}
+}
+
 func LoopGenOid(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		GenOid(1, 1)
@@ -23,3 +31,35 @@ func TestGenOid(t *testing.T) {
 	br := testing.Benchmark(LoopGenOid)
 	fmt.Println(br)
 }
+
+// record saved before HashAlg was added
+type recordV0 struct {
+	Oid     string
+	BlockId int
+	Md5     []byte
+	Offset  int
+	Len     int
+	Mime    int
+	Created int64
+	Expired int64
+	Status  int
+}
+
+func TestGetIndexFromOld(t *testing.T) {
+	old := recordV0{Oid: GenOid(1, 1), BlockId: 2, Md5: common.GenSampledMd5([]byte("body")), Len: 4}
+	b, e := common.Enc(&old)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	var rec Record
+	if e := GetIndexFrom(b, &rec); e != nil {
+		t.Fatal(e)
+	}
+	if rec.Oid != old.Oid || rec.BlockId != 2 || rec.HashAlg != common.HASH_SAMPLED {
+		t.Fatal("get index from old record error", rec)
+	}
+	if !common.CheckHash([]byte("body"), rec.Md5, rec.HashAlg) {
+		t.Fatal("old record checksum error")
+	}
+}
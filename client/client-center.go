@@ -0,0 +1,230 @@
+package client
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/blastbao/whisper/center"
+	"github.com/blastbao/whisper/common"
+	"github.com/blastbao/whisper/mediator"
+	"github.com/valyala/gorpc"
+)
+
+// 读扩展
+//
+// client 连接拓扑(KEY_CENTER_TOPOLOGY)中的所有 center ，写命令发送给 master(c.c)，
+// 元数据读取按 ConnConf.ReadMode 发送给 slaves ，从轮询的位置开始依次尝试，出错时换下一个，最后是 master 。
+// READ_YOUR_WRITES 时请求带上本 client 最后一次写入的序号，落后的 center 返回失败后换下一个。
+//
+// center 分片后(KEY_CENTER_SHARDS)，oid 中的 IndexId 属于其它分组时，读写发送给该分组的 center ，
+// 属于默认分组或没有分组信息时使用上面的连接。
+const (
+	READ_YOUR_WRITES = 0 // replica applied the last write of this client
+	READ_ANY         = 1 // any replica, may miss recent writes
+	READ_MASTER      = 2 // master only
+)
+
+// 连接拓扑中除 master 之外的 center ，已有的连接保留
+func (c *Client) ConnectToReplicas(role mediator.CenterRole) {
+	var addrs []string
+	for _, addr := range role.Slaves {
+		if addr != "" && addr != role.Master {
+			addrs = append(addrs, addr)
+		}
+	}
+	common.Log.Info("client center replicas ready to connect", addrs)
+
+	c.centerMutex.Lock()
+	defer c.centerMutex.Unlock()
+
+	var replicas []*gorpc.Client
+	for _, cl := range c.replicas {
+		if common.ContainsStr(addrs, cl.Addr) {
+			replicas = append(replicas, cl)
+		} else {
+			common.Log.Info("client center replica is disconnecting - " + cl.Addr)
+			cl.Stop()
+		}
+	}
+	for _, addr := range addrs {
+		if !hasClient(replicas, addr) {
+			common.Log.Info("client center replica is connecting - " + addr)
+			cl := gorpc.NewTCPClient(addr)
+			cl.Start()
+			replicas = append(replicas, cl)
+		}
+	}
+	c.replicas = replicas
+}
+
+func hasClient(list []*gorpc.Client, addr string) bool {
+	for _, cl := range list {
+		if cl.Addr == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) closeReplicas() {
+	c.centerMutex.Lock()
+	defer c.centerMutex.Unlock()
+
+	for _, cl := range c.replicas {
+		cl.Stop()
+	}
+	c.replicas = nil
+}
+
+// 连接默认分组以外所有分组的 center ，已有的连接保留
+func (c *Client) ConnectToShards(shards mediator.CenterShards) {
+	var addrs []string
+	for _, role := range shards.Groups {
+		if role.Group == mediator.DEFAULT_CENTER_GROUP {
+			continue
+		}
+		for _, addr := range append([]string{role.Master}, role.Slaves...) {
+			if addr != "" && !common.ContainsStr(addrs, addr) {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	common.Log.Info("client center groups ready to connect", addrs)
+
+	c.centerMutex.Lock()
+	defer c.centerMutex.Unlock()
+
+	groups := make(map[string]*gorpc.Client)
+	for addr, cl := range c.groups {
+		if common.ContainsStr(addrs, addr) {
+			groups[addr] = cl
+		} else {
+			common.Log.Info("client center group member is disconnecting - " + addr)
+			cl.Stop()
+		}
+	}
+	for _, addr := range addrs {
+		if _, ok := groups[addr]; !ok {
+			common.Log.Info("client center group member is connecting - " + addr)
+			cl := gorpc.NewTCPClient(addr)
+			cl.Start()
+			groups[addr] = cl
+		}
+	}
+	c.groups = groups
+	c.shards = shards
+}
+
+func (c *Client) closeGroups() {
+	c.centerMutex.Lock()
+	defer c.centerMutex.Unlock()
+
+	for _, cl := range c.groups {
+		cl.Stop()
+	}
+	c.groups = nil
+}
+
+// need lock first, indexId 所属的其它分组
+func (c *Client) groupOf(indexId int) (mediator.CenterRole, bool) {
+	role, ok := c.shards.GroupOf(indexId)
+	if !ok || role.Group == mediator.DEFAULT_CENTER_GROUP {
+		return mediator.CenterRole{}, false
+	}
+	return role, true
+}
+
+// 写命令发送的 center ，indexId 所属分组的 master
+func (c *Client) centerFor(indexId int) *gorpc.Client {
+	c.centerMutex.Lock()
+	defer c.centerMutex.Unlock()
+
+	if role, ok := c.groupOf(indexId); ok {
+		if cl, ok := c.groups[role.Master]; ok {
+			return cl
+		}
+	}
+	return c.c
+}
+
+// 记录写命令返回的序号，每个分组的 raft 日志各自编号
+func (c *Client) observeSeq(indexId int, seq int64) {
+	c.centerMutex.Lock()
+	defer c.centerMutex.Unlock()
+
+	role, _ := c.groupOf(indexId)
+	if c.lastSeqs == nil {
+		c.lastSeqs = make(map[string]int64)
+	}
+	if seq > c.lastSeqs[role.Group] {
+		c.lastSeqs[role.Group] = seq
+	}
+}
+
+// 读命令需要 center 已应用的序号
+func (c *Client) readSeq(indexId int) int64 {
+	c.centerMutex.Lock()
+	defer c.centerMutex.Unlock()
+
+	role, _ := c.groupOf(indexId)
+	return c.lastSeqs[role.Group]
+}
+
+// 读请求依次尝试的 center
+func (c *Client) readTargets(indexId int) []*gorpc.Client {
+	c.centerMutex.Lock()
+	defer c.centerMutex.Unlock()
+
+	replicas, master := c.replicas, c.c
+	if role, ok := c.groupOf(indexId); ok {
+		replicas, master = nil, c.groups[role.Master]
+		for _, addr := range role.Slaves {
+			if cl, ok := c.groups[addr]; ok && addr != role.Master {
+				replicas = append(replicas, cl)
+			}
+		}
+	}
+
+	var targets []*gorpc.Client
+	if c.Conf.ReadMode != READ_MASTER && len(replicas) > 0 {
+		start := c.readNext % len(replicas)
+		c.readNext++
+		for i := range replicas {
+			targets = append(targets, replicas[(start+i)%len(replicas)])
+		}
+	}
+	if master != nil {
+		targets = append(targets, master)
+	}
+	return targets
+}
+
+// 发送读命令，记录不存在是确定的结果，其它失败换下一个 center
+func (c *Client) callRead(p center.PackRecord) (pack center.PackRecord, err error) {
+	indexId := center.GetOidInfo(p.Oid).IndexId
+	targets := c.readTargets(indexId)
+	if len(targets) == 0 {
+		err = ErrCenterNotConnected
+		return
+	}
+	if c.Conf.ReadMode == READ_YOUR_WRITES {
+		p.Seq = c.readSeq(indexId)
+	}
+
+	for _, cl := range targets {
+		resp, e := cl.Call(p)
+		if e != nil {
+			common.Log.Warning("client center read error", cl.Addr, p.Command, e)
+			err = e
+			continue
+		}
+
+		pack = resp.(center.PackRecord)
+		if pack.Flag || strings.Contains(pack.Msg, "not found") {
+			return pack, nil
+		}
+		common.Log.Warning("client center read fail", cl.Addr, p.Command, pack.Msg)
+		err = errors.New(pack.Msg)
+	}
+	return
+}
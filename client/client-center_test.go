@@ -0,0 +1,144 @@
+package client
+
+import (
+	"encoding/gob"
+	"testing"
+
+	"github.com/blastbao/whisper/center"
+	"github.com/blastbao/whisper/mediator"
+	"github.com/valyala/gorpc"
+)
+
+// 模拟 center ，applied 为已应用的序号，返回的 Msg 为地址
+func startTestCenter(t *testing.T, addr string, applied int64, calls map[string]int) *gorpc.Server {
+	s := gorpc.NewTCPServer(addr, func(clientAddr string, request interface{}) interface{} {
+		p := request.(center.PackRecord)
+		calls[addr]++
+		if p.Seq > applied {
+			return center.PackRecord{Msg: "center lagging behind seq"}
+		}
+		return center.PackRecord{Flag: true, Rec: center.Record{Oid: p.Oid, Len: len(addr)}, Msg: addr}
+	})
+	if e := s.Start(); e != nil {
+		t.Fatal(e)
+	}
+	return s
+}
+
+func TestClientReadReplicas(t *testing.T) {
+	gob.Register(center.PackRecord{})
+
+	master, slave := "127.0.0.1:9793", "127.0.0.1:9794"
+	calls := make(map[string]int)
+	ms := startTestCenter(t, master, 10, calls)
+	defer ms.Stop()
+	ss := startTestCenter(t, slave, 5, calls)
+
+	c := &Client{}
+	c.ConnectToCenter(master)
+	c.ConnectToReplicas(mediator.CenterRole{Master: master, Slaves: []string{slave}})
+	defer c.Close()
+
+	read := func(mode int) string {
+		c.Conf.ReadMode = mode
+		pack, e := c.callRead(center.PackRecord{Command: center.CMD_GET_OID_META, Oid: "1_1_2_3_0"})
+		if e != nil || !pack.Flag {
+			t.Fatal("read error", mode, e, pack.Msg)
+		}
+		return pack.Msg
+	}
+
+	if addr := read(READ_ANY); addr != slave {
+		t.Fatal("read any should go to slave", addr)
+	}
+	if addr := read(READ_MASTER); addr != master {
+		t.Fatal("read master-only should go to master", addr)
+	}
+
+	// slave has applied the last write
+	c.observeSeq(1, 5)
+	if addr := read(READ_YOUR_WRITES); addr != slave {
+		t.Fatal("read your writes should go to an up to date slave", addr)
+	}
+	// slave lags behind, falls back to master
+	c.observeSeq(1, 8)
+	c.observeSeq(1, 3)
+	if addr := read(READ_YOUR_WRITES); addr != master {
+		t.Fatal("read your writes should fall back to master", addr)
+	}
+	if calls[slave] != 3 {
+		t.Fatal("slave calls error", calls)
+	}
+
+	// slave down, falls back to master
+	ss.Stop()
+	if addr := read(READ_ANY); addr != master {
+		t.Fatal("read should fall back when slave is down", addr)
+	}
+
+	// slave removed from topology
+	c.ConnectToReplicas(mediator.CenterRole{Master: master})
+	if len(c.replicas) != 0 {
+		t.Fatal("replica not disconnected", len(c.replicas))
+	}
+}
+
+func TestClientShardRouting(t *testing.T) {
+	gob.Register(center.PackRecord{})
+
+	master, groupMaster, groupSlave := "127.0.0.1:9795", "127.0.0.1:9796", "127.0.0.1:9797"
+	calls := make(map[string]int)
+	for _, addr := range []string{master, groupMaster, groupSlave} {
+		s := startTestCenter(t, addr, 10, calls)
+		defer s.Stop()
+	}
+
+	c := &Client{}
+	c.ConnectToCenter(master)
+	c.ConnectToShards(mediator.CenterShards{Groups: []mediator.CenterRole{
+		{Master: master, Ranges: []mediator.IndexRange{{From: 1, To: 1}}},
+		{Group: "g1", Master: groupMaster, Slaves: []string{groupSlave}, Ranges: []mediator.IndexRange{{From: 2, To: 3}}},
+	}})
+	defer c.Close()
+
+	read := func(oid string) string {
+		pack, e := c.callRead(center.PackRecord{Command: center.CMD_GET_OID_META, Oid: oid})
+		if e != nil || !pack.Flag {
+			t.Fatal("read error", oid, e, pack.Msg)
+		}
+		return pack.Msg
+	}
+
+	c.Conf.ReadMode = READ_MASTER
+	if addr := read("1_1_2_3_0"); addr != master {
+		t.Fatal("default group should be read from master", addr)
+	}
+	if addr := read("3_1_2_3_0"); addr != groupMaster {
+		t.Fatal("index of group should be read from group master", addr)
+	}
+	// not assigned, default group
+	if addr := read("9_1_2_3_0"); addr != master {
+		t.Fatal("unassigned index should be read from default master", addr)
+	}
+	c.Conf.ReadMode = READ_ANY
+	if addr := read("2_1_2_3_0"); addr != groupSlave {
+		t.Fatal("index of group should be read from group slave", addr)
+	}
+
+	if cl := c.centerFor(2); cl == nil || cl.Addr != groupMaster {
+		t.Fatal("write should go to group master", cl)
+	}
+	if cl := c.centerFor(1); cl == nil || cl.Addr != master {
+		t.Fatal("write should go to default master", cl)
+	}
+
+	// seqs of groups are separate
+	c.observeSeq(2, 20)
+	c.observeSeq(1, 5)
+	if seq := c.readSeq(3); seq != 20 {
+		t.Fatal("group seq error", seq)
+	}
+	if seq := c.readSeq(1); seq != 5 {
+		t.Fatal("default seq error", seq)
+	}
+}
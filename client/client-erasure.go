@@ -0,0 +1,235 @@
+package client
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/blastbao/whisper/center"
+	"github.com/blastbao/whisper/common"
+	"github.com/blastbao/whisper/erasure"
+	"github.com/blastbao/whisper/mediator"
+)
+
+// 纠删码存储
+//
+// 文件(或打包在一起的一批小文件)组成一个条带，切分为 k 个数据分片并计算 m 个校验分片，
+// 每个分片保存在不同 agent 的块上，oid 的副本号即分片号(copyNum 为 k+m-1)，center 的记录保存分片位置及 k/m 。
+// 批量写入时其它文件的记录与第一个文件共享分片数据，EcFrom/EcLen 为文件在条带中的位置。
+// 读取时下载任意 k 个完好的分片即可恢复，相比多副本只需要 (k+m)/k 倍的空间。
+// 分片记录的 Md5 为分片的校验码，EcMd5 为文件的 md5 ，用于校验恢复的数据及作为 ETag 。
+
+// 纠删码保存，ttl 秒后过期，0 表示不过期
+func (c *Client) SaveErasure(body []byte, mime int, ttl int64, dataShards, parityShards int) (oid string, err error) {
+	oids, e := c.SaveErasureBatch([][]byte{body}, mime, ttl, dataShards, parityShards)
+	if e != nil {
+		return "", e
+	}
+	return oids[0], nil
+}
+
+// 多个小文件打包为一个条带后纠删码保存，每个文件一个 oid
+func (c *Client) SaveErasureBatch(bodies [][]byte, mime int, ttl int64, dataShards, parityShards int) (oids []string, err error) {
+	if len(bodies) == 0 {
+		return nil, nil
+	}
+
+	codec, e := erasure.New(dataShards, parityShards)
+	if e != nil {
+		return nil, e
+	}
+
+	var expired int64
+	if ttl > 0 {
+		expired = time.Now().Unix() + ttl
+	}
+
+	// 打包，记录每个文件的位置
+	var stripe []byte
+	froms := make([]int, len(bodies))
+	for i, body := range bodies {
+		froms[i] = len(stripe)
+		stripe = append(stripe, body...)
+		oids = append(oids, center.GenOidNoSuffix(c.Conf.IndexId, codec.Shards()-1))
+	}
+
+	shards := codec.Split(stripe)
+	if e := codec.Encode(shards); e != nil {
+		return nil, e
+	}
+
+	// 每个分片在不同的 agent 上，尽量分散到不同的 zone/rack
+	blocks := spreadBlocks(c.writableBlocks(), codec.Shards(), mediator.TOPOLOGY_HOST)
+	for _, block := range blocks {
+		if block == nil {
+			return nil, errors.New("client not enough agents to save erasure shards")
+		}
+	}
+
+	// 第一个文件的记录由 agent 写入 center
+	chs := make([]chan center.PackRecord, len(blocks))
+	for i, block := range blocks {
+		connect := c.getTargetConnect(block.Addr)
+		if connect == nil {
+			msg := "client save but connect not found " + block.Addr
+			common.Log.Error(msg)
+			return nil, errors.New(msg)
+		}
+
+		rec := center.Record{
+			Oid:      oids[0] + "_" + strconv.Itoa(i),
+			BlockId:  block.BlockId,
+			Mime:     mime,
+			Expired:  expired,
+			EcData:   dataShards,
+			EcParity: parityShards,
+			EcFrom:   froms[0],
+			EcLen:    len(bodies[0]),
+			EcMd5:    common.GenMd5(bodies[0]),
+		}
+		chs[i] = make(chan center.PackRecord, 1)
+		go connect.UploadRecord(rec, shards[i], chs[i])
+	}
+
+	saved := make([]center.Record, len(chs))
+	indexId := center.GetOidInfo(oids[0] + "_0").IndexId
+	for i, ch := range chs {
+		packReturn := <-ch
+		c.observeSeq(indexId, packReturn.Seq)
+
+		if !packReturn.Flag {
+			go c.disableAll(oids[:1])
+			msg := "client write erasure shard fail " + oids[0] + " - " + blocks[i].Addr
+			common.Log.Error(msg)
+			return nil, errors.New(msg)
+		}
+		saved[i] = packReturn.Rec
+	}
+
+	// 其它文件的记录共享分片数据
+	var recs []center.Record
+	for j := 1; j < len(bodies); j++ {
+		for i, one := range saved {
+			rec := one
+			rec.Oid = oids[j] + "_" + strconv.Itoa(i)
+			rec.EcFrom = froms[j]
+			rec.EcLen = len(bodies[j])
+			rec.EcMd5 = common.GenMd5(bodies[j])
+			recs = append(recs, rec)
+		}
+	}
+	if e := c.putRecords(recs); e != nil {
+		go c.disableAll(oids)
+		return nil, e
+	}
+
+	return oids, nil
+}
+
+// 写入失败时将 oid 置为不可用
+func (c *Client) disableAll(oids []string) {
+	for _, oid := range oids {
+		if e := c.changeStatus(oid, common.STATUS_RECORD_DISABLE); e != nil && e != ErrNotFound {
+			common.Log.Error("client write fail then disable oid status error", oid, e)
+		}
+	}
+}
+
+// 直接向 center 写入记录
+func (c *Client) putRecords(recs []center.Record) error {
+	for _, rec := range recs {
+		indexId := center.GetOidInfo(rec.Oid).IndexId
+		cl := c.centerFor(indexId)
+		if cl == nil {
+			return ErrCenterNotConnected
+		}
+
+		resp, e := cl.Call(center.PackRecord{Command: center.CMD_PUT_RECORD, Rec: rec})
+		if e != nil {
+			return e
+		}
+		pack := resp.(center.PackRecord)
+		if !pack.Flag {
+			return errors.New("client put record fail " + rec.Oid + " - " + pack.Msg)
+		}
+		c.observeSeq(indexId, pack.Seq)
+	}
+	return nil
+}
+
+// 下载 oid 的分片，任意 EcData 个分片完好时恢复文件数据，rec 为其中一个分片的记录
+func (c *Client) getErasure(oid string, rec center.Record) (body []byte, err error) {
+	codec, e := erasure.New(rec.EcData, rec.EcParity)
+	if e != nil {
+		return nil, e
+	}
+
+	siblings := center.GetOidSiblings(oid + "_0")
+	if len(siblings) != codec.Shards() {
+		return nil, errors.New("client erasure shards number mismatch " + oid)
+	}
+
+	// 依次下载，数据分片优先，够 k 个即可
+	shards := make([][]byte, codec.Shards())
+	got := 0
+	for i, oidShard := range siblings {
+		if got == codec.DataShards {
+			break
+		}
+
+		one, e := c.getMeta(oidShard)
+		if e == ErrDeleted || e == ErrDisabled || e == ErrCenterNotConnected {
+			return nil, e
+		}
+		if e == nil {
+			shards[i], e = c.download(one)
+		}
+		if e != nil {
+			common.Log.Warning("client erasure shard unavailable", oidShard, e)
+			shards[i] = nil
+			continue
+		}
+		got++
+	}
+	if got < codec.DataShards {
+		common.Log.Error("client erasure not enough shards", oid, got)
+		return nil, ErrNotEnoughShards
+	}
+
+	if e := codec.ReconstructData(shards); e != nil {
+		return nil, e
+	}
+	stripe, e := codec.Join(shards, rec.EcFrom+rec.EcLen)
+	if e != nil {
+		return nil, e
+	}
+
+	body = stripe[rec.EcFrom:]
+	if len(rec.EcMd5) > 0 && !common.CheckHash(body, rec.EcMd5, common.HASH_MD5) {
+		common.Log.Error("client erasure checksum mismatch", oid)
+		return nil, ErrChecksumMismatch
+	}
+	return body, nil
+}
+
+// 纠删码分片的记录转为文件的元数据，分片的校验码不代表文件，使用文件的 md5
+func erasureView(rec center.Record) center.Record {
+	rec.Len = rec.EcLen
+	rec.Md5 = rec.EcMd5
+	rec.HashAlg = 0
+	if len(rec.Md5) > 0 {
+		rec.HashAlg = common.HASH_MD5
+	}
+	return rec
+}
+
+// [from, from+length) 范围的数据，length 为 0 表示读到末尾
+func sliceRange(body []byte, from, length int) ([]byte, error) {
+	if length == 0 {
+		length = len(body) - from
+	}
+	if from < 0 || length < 0 || from+length > len(body) {
+		return nil, errors.New("client range out of record - " + strconv.Itoa(from) + "," + strconv.Itoa(length))
+	}
+	return body[from : from+length], nil
+}
@@ -0,0 +1,196 @@
+package client
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/blastbao/whisper/agent"
+	"github.com/blastbao/whisper/center"
+	"github.com/blastbao/whisper/common"
+	"github.com/blastbao/whisper/mediator"
+	"github.com/valyala/gorpc"
+)
+
+// 内存中的 center ，只支持写入、查询和修改状态
+type testRecords struct {
+	recs  map[string]center.Record
+	gets  int
+	mutex sync.Mutex
+}
+
+func startTestRecordCenter(t *testing.T, addr string) (*gorpc.Server, *testRecords) {
+	records := &testRecords{recs: make(map[string]center.Record)}
+	s := gorpc.NewTCPServer(addr, func(clientAddr string, request interface{}) interface{} {
+		p := request.(center.PackRecord)
+		records.mutex.Lock()
+		defer records.mutex.Unlock()
+
+		switch p.Command {
+		case center.CMD_PUT_RECORD:
+			records.recs[p.Rec.Oid] = p.Rec
+			return center.PackRecord{Flag: true}
+		case center.CMD_GET_OID_META:
+			records.gets++
+			rec, ok := records.recs[p.Oid]
+			if !ok {
+				return center.PackRecord{Msg: "center index get but not found " + p.Oid}
+			}
+			return center.PackRecord{Flag: true, Rec: rec}
+		case center.CMD_CHANGE_OID_STATUS:
+			rec, ok := records.recs[p.Oid]
+			if !ok {
+				return center.PackRecord{Msg: "center index change status but not found " + p.Oid}
+			}
+			rec.Status = p.Status
+			records.recs[p.Oid] = rec
+			return center.PackRecord{Flag: true}
+		}
+		return center.PackRecord{Msg: "command not supported"}
+	})
+	if e := s.Start(); e != nil {
+		t.Fatal(e)
+	}
+	return s, records
+}
+
+// 在进程内启动 agent ，块由注册表加载，直接连接 center
+func startTestAgent(t *testing.T, host string, block mediator.Block, centerAddr string) *agent.NodeServer {
+	n := &agent.Node{Dirs: []string{block.Dir}}
+	n.MergeBlocks([]mediator.Block{block})
+	if e := n.PersistRegistry(); e != nil {
+		t.Fatal(e)
+	}
+
+	ns := &agent.NodeServer{DataDirs: []string{block.Dir}}
+	if e := ns.Listen(host); e != nil {
+		t.Fatal(e)
+	}
+	ns.ConnectToCenter(centerAddr)
+	return ns
+}
+
+func TestClientErasure(t *testing.T) {
+	gob.Register(center.PackRecord{})
+
+	dir, e := ioutil.TempDir("", "test-whisper-erasure")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	centerAddr := "127.0.0.1:9798"
+	cs, records := startTestRecordCenter(t, centerAddr)
+	defer cs.Stop()
+
+	c := &Client{Conf: ConnConf{IndexId: 1}}
+	var addrs []string
+	for i := 0; i < 6; i++ {
+		host := "127.0.0.1" + strconv.Itoa(i+1)
+		block := mediator.Block{BlockId: i + 1, DataId: 1, Addr: host, Dir: dir + "/" + strconv.Itoa(i), Size: 1024 * 1024}
+		if e := os.MkdirAll(block.Dir, 0755); e != nil {
+			t.Fatal(e)
+		}
+		ns := startTestAgent(t, host, block, centerAddr)
+		defer ns.Close()
+
+		b := block
+		c.BlockInfoList = append(c.BlockInfoList, &b)
+		addrs = append(addrs, host+":"+strconv.Itoa(common.SERVER_PORT_AGENT))
+	}
+	c.ConnectToCenter(centerAddr)
+	c.ConnectToNodeServer(strings.Join(addrs, ","))
+	defer c.Close()
+
+	body := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(body)
+
+	// 4 + 2 个分片分布在 6 个 agent 上
+	oid, e := c.SaveErasure(body, common.MIME_JPG, 0, 4, 2)
+	if e != nil {
+		t.Fatal(e)
+	}
+	blockIds := make(map[int]bool)
+	for _, oidShard := range center.GetOidSiblings(oid + "_0") {
+		rec, ok := records.recs[oidShard]
+		if !ok || rec.EcData != 4 || rec.EcParity != 2 || rec.Len != 2500 {
+			t.Fatal("shard record error", oidShard, rec)
+		}
+		blockIds[rec.BlockId] = true
+	}
+	if len(blockIds) != 6 {
+		t.Fatal("shards should be on different agents", blockIds)
+	}
+
+	if b, mime, e := c.Get(oid); e != nil || mime != common.MIME_JPG || !bytes.Equal(b, body) {
+		t.Fatal("get erasure error", mime, e)
+	}
+	if rec, e := c.Stat(oid); e != nil || rec.Len != len(body) || !bytes.Equal(rec.Md5, common.GenMd5(body)) {
+		t.Fatal("stat erasure error", rec, e)
+	}
+	if b, _, e := c.GetRange(oid, 100, 10); e != nil || !bytes.Equal(b, body[100:110]) {
+		t.Fatal("get range erasure error", e)
+	}
+
+	// 恢复的数据校验失败时不再逐个副本重试，只查询一次第一个分片及 4 个数据分片
+	records.mutex.Lock()
+	rec := records.recs[oid+"_0"]
+	bad := rec
+	bad.EcMd5 = common.GenMd5([]byte("other"))
+	records.recs[oid+"_0"] = bad
+	records.gets = 0
+	records.mutex.Unlock()
+	_, _, e = c.Get(oid)
+	records.mutex.Lock()
+	gets := records.gets
+	records.recs[oid+"_0"] = rec
+	records.mutex.Unlock()
+	if e != ErrChecksumMismatch || gets != 5 {
+		t.Fatal("get erasure checksum mismatch error", gets, e)
+	}
+
+	// 多个小文件打包在一个条带
+	bodies := [][]byte{[]byte("first"), []byte("second file"), []byte("3")}
+	oids, e := c.SaveErasureBatch(bodies, common.MIME_PNG, 0, 4, 2)
+	if e != nil || len(oids) != 3 {
+		t.Fatal("save batch error", oids, e)
+	}
+	for i, one := range oids {
+		if b, _, e := c.Get(one); e != nil || !bytes.Equal(b, bodies[i]) {
+			t.Fatal("get batch file error", i, string(b), e)
+		}
+	}
+	first, second := records.recs[oids[0]+"_5"], records.recs[oids[1]+"_5"]
+	if first.BlockId != second.BlockId || first.Offset != second.Offset || second.EcFrom != 5 {
+		t.Fatal("batch files should share shards", first, second)
+	}
+
+	// 两个 agent 不可用，仍可恢复
+	c.ConnectToNodeServer(strings.Join(addrs[2:], ","))
+	if b, _, e := c.Get(oid); e != nil || !bytes.Equal(b, body) {
+		t.Fatal("get erasure with lost shards error", e)
+	}
+
+	// 分片不足
+	delete(records.recs, oid+"_2")
+	if _, _, e := c.Get(oid); e != ErrNotEnoughShards {
+		t.Fatal("not enough shards error", e)
+	}
+
+	// 删除所有分片
+	if e := c.Del(oids[1]); e != nil {
+		t.Fatal(e)
+	}
+	if _, _, e := c.Get(oids[1]); e != ErrDeleted {
+		t.Fatal("get deleted error", e)
+	}
+	if b, _, e := c.Get(oids[2]); e != nil || !bytes.Equal(b, bodies[2]) {
+		t.Fatal("other batch file should be kept", e)
+	}
+}
@@ -1,21 +1,320 @@
 package client
 
 import (
+	"encoding/hex"
+	"github.com/blastbao/whisper/center"
 	"github.com/blastbao/whisper/common"
+	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
-// http for other clients TODO
+// max upload body size, a record can not be larger than one block
+var MaxUploadBytes int64 = 64 * 1024 * 1024
+
+// http facade for other clients
+//
+// GET/HEAD   /get?oid={oid}             下载，Content-Type 由 record mime 决定，支持 Range/If-None-Match/If-Modified-Since
+// PUT/POST   /save?mime={jpg|png|...}&ttl={seconds}&ec={k,m}   上传，mime 缺省时取 Content-Type ，ttl 缺省不过期，ec 为纠删码的数据/校验分片数，缺省按配置，返回 oid
+// DELETE     /del?oid={oid}             删除
 func (c *Client) getFromHttp(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		httpError(rw, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	oid := req.URL.Query().Get("oid")
+	if oid == "" {
+		httpError(rw, http.StatusBadRequest, "oid required")
+		return
+	}
+
+	// 先查元数据，命中缓存时不需要去 node svr 下载
+	rec, e := c.Stat(oid)
+	if e != nil {
+		common.Log.Error("client http stat error", oid, e)
+		httpError(rw, httpStatusOf(e), e.Error())
+		return
+	}
+
+	etag := getETag(rec)
+	header := rw.Header()
+	header.Set("Accept-Ranges", "bytes")
+	if etag != "" {
+		header.Set("ETag", etag)
+	}
+	if rec.Created > 0 {
+		header.Set("Last-Modified", time.Unix(rec.Created, 0).UTC().Format(http.TimeFormat))
+	}
+
+	if isNotModified(req, rec, etag) {
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// If-Range 不匹配时忽略 Range ，返回全部
+	from, length, isPartial := 0, 0, false
+	rangeHeader := req.Header.Get("Range")
+	if rangeHeader != "" && isIfRangeMatch(req, rec, etag) {
+		var ok bool
+		from, length, ok = parseRange(rangeHeader, rec.Len)
+		if !ok {
+			header.Set("Content-Range", "bytes */"+strconv.Itoa(rec.Len))
+			httpError(rw, http.StatusRequestedRangeNotSatisfiable, "range not satisfiable")
+			return
+		}
+		isPartial = length != rec.Len
+	}
+
+	body, rec, e := c.GetRange(oid, from, length)
+	if e != nil {
+		common.Log.Error("client http get error", oid, e)
+		httpError(rw, httpStatusOf(e), e.Error())
+		return
+	}
+
+	header.Set("Content-Type", common.GetContentType(rec.Mime))
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	if isPartial {
+		header.Set("Content-Range", "bytes "+strconv.Itoa(from)+"-"+strconv.Itoa(from+len(body)-1)+"/"+strconv.Itoa(rec.Len))
+		rw.WriteHeader(http.StatusPartialContent)
+	} else {
+		rw.WriteHeader(http.StatusOK)
+	}
+	rw.Write(body)
 }
 
 func (c *Client) saveFromHttp(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPut && req.Method != http.MethodPost {
+		httpError(rw, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	// mime 参数优先，其次 Content-Type
+	mime := common.GetMimeByName(req.URL.Query().Get("mime"))
+	if mime == 0 {
+		mime = common.GetMimeByContentType(req.Header.Get("Content-Type"))
+	}
+	if mime == 0 {
+		httpError(rw, http.StatusUnsupportedMediaType, "mime not supported")
+		return
+	}
+
+	var ttl int64
+	if str := req.URL.Query().Get("ttl"); str != "" {
+		var e error
+		ttl, e = strconv.ParseInt(str, 10, 64)
+		if e != nil || ttl < 0 {
+			httpError(rw, http.StatusBadRequest, "ttl should be seconds")
+			return
+		}
+	}
+
+	var dataShards, parityShards int
+	if str := req.URL.Query().Get("ec"); str != "" {
+		var ok bool
+		if dataShards, parityShards, ok = parseErasure(str); !ok {
+			httpError(rw, http.StatusBadRequest, "ec should be data,parity shards")
+			return
+		}
+	}
+
+	body, e := ioutil.ReadAll(http.MaxBytesReader(rw, req.Body, MaxUploadBytes))
+	if e != nil {
+		httpError(rw, http.StatusRequestEntityTooLarge, e.Error())
+		return
+	}
+	if len(body) == 0 {
+		httpError(rw, http.StatusBadRequest, "body required")
+		return
+	}
+
+	var oid string
+	if dataShards > 0 {
+		oid, e = c.SaveErasure(body, mime, ttl, dataShards, parityShards)
+	} else {
+		oid, e = c.SaveWithTTL(body, mime, ttl)
+	}
+	if e != nil {
+		common.Log.Error("client http save error", oid, e)
+		httpError(rw, httpStatusOf(e), e.Error())
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/plain")
+	rw.WriteHeader(http.StatusCreated)
+	rw.Write([]byte(oid))
+}
+
+func (c *Client) delFromHttp(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodDelete && req.Method != http.MethodPost {
+		httpError(rw, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	oid := req.URL.Query().Get("oid")
+	if oid == "" {
+		httpError(rw, http.StatusBadRequest, "oid required")
+		return
+	}
+
+	if e := c.Del(oid); e != nil {
+		common.Log.Error("client http del error", oid, e)
+		httpError(rw, httpStatusOf(e), e.Error())
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// "md5 hex"
+func getETag(rec center.Record) string {
+	if len(rec.Md5) == 0 {
+		return ""
+	}
+	return "\"" + hex.EncodeToString(rec.Md5) + "\""
+}
+
+// If-None-Match 优先于 If-Modified-Since
+func isNotModified(req *http.Request, rec center.Record, etag string) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		if etag == "" {
+			return false
+		}
+		for _, one := range strings.Split(inm, ",") {
+			one = strings.TrimPrefix(strings.TrimSpace(one), "W/")
+			if one == "*" || one == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims := req.Header.Get("If-Modified-Since"); ims != "" && rec.Created > 0 {
+		t, e := http.ParseTime(ims)
+		return e == nil && rec.Created <= t.Unix()
+	}
+	return false
+}
+
+// If-Range 可以是 etag 或者时间
+func isIfRangeMatch(req *http.Request, rec center.Record, etag string) bool {
+	ir := req.Header.Get("If-Range")
+	if ir == "" {
+		return true
+	}
+	if strings.HasPrefix(ir, "\"") {
+		return ir == etag
+	}
+
+	t, e := http.ParseTime(ir)
+	return e == nil && rec.Created > 0 && rec.Created <= t.Unix()
+}
+
+// 解析纠删码参数，如 4,2
+func parseErasure(str string) (dataShards, parityShards int, ok bool) {
+	arr := strings.Split(str, ",")
+	if len(arr) != 2 {
+		return
+	}
+	var e1, e2 error
+	dataShards, e1 = strconv.Atoi(arr[0])
+	parityShards, e2 = strconv.Atoi(arr[1])
+	ok = e1 == nil && e2 == nil && dataShards > 0 && parityShards > 0
+	return
+}
+
+// 解析单个 range ，如 bytes=0-99 / bytes=100- / bytes=-100
+//
+// 非 bytes 单位或多个 range 时返回全部内容，range 不可满足时 ok 为 false
+func parseRange(header string, size int) (from, length int, ok bool) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return 0, size, true
+	}
+	spec := strings.TrimSpace(header[len("bytes="):])
+	if strings.Contains(spec, ",") {
+		return 0, size, true
+	}
+
+	i := strings.Index(spec, "-")
+	if i < 0 {
+		return 0, size, false
+	}
+	start, end := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+
+	// suffix: bytes=-n
+	if start == "" {
+		n, e := strconv.Atoi(end)
+		if e != nil || n <= 0 || size == 0 {
+			return 0, size, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true
+	}
+
+	from, e := strconv.Atoi(start)
+	if e != nil || from < 0 || from >= size {
+		return 0, size, false
+	}
+
+	last := size - 1
+	if end != "" {
+		last, e = strconv.Atoi(end)
+		if e != nil || last < from {
+			return 0, size, false
+		}
+		if last >= size {
+			last = size - 1
+		}
+	}
+
+	return from, last - from + 1, true
+}
+
+// 错误 -> http 状态码
+func httpStatusOf(e error) int {
+	switch e {
+	case ErrNotFound:
+		return http.StatusNotFound
+	case ErrDeleted:
+		return http.StatusGone
+	case ErrDisabled:
+		return http.StatusForbidden
+	case ErrCenterNotConnected:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func httpError(rw http.ResponseWriter, status int, msg string) {
+	rw.Header().Set("Content-Type", "text/plain")
+	rw.WriteHeader(status)
+	rw.Write([]byte(msg))
+}
+
+func (c *Client) httpHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/get", c.getFromHttp)
+	mux.HandleFunc("/save", c.saveFromHttp)
+	mux.HandleFunc("/del", c.delFromHttp)
+	return mux
 }
 
+// 监听 SERVER_HTTP_PORT_CLIENT ，阻塞直到 Close
 func (c *Client) Listen() error {
-	http.HandleFunc("/get", c.getFromHttp)
-	http.HandleFunc("/save", c.saveFromHttp)
+	c.hs = &http.Server{
+		Addr:    ":" + strconv.Itoa(common.SERVER_HTTP_PORT_CLIENT),
+		Handler: c.httpHandler(),
+	}
+	common.Log.Info("client http server listen - " + c.hs.Addr)
 
-	return http.ListenAndServe(":"+strconv.Itoa(common.SERVER_HTTP_PORT_CLIENT), nil)
+	e := c.hs.ListenAndServe()
+	if e == http.ErrServerClosed {
+		return nil
+	}
+	return e
 }
@@ -0,0 +1,113 @@
+package client
+
+import (
+	"github.com/blastbao/whisper/center"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHttpFacadeRequestCheck(t *testing.T) {
+	c := &Client{Conf: ConnConf{Stratigy: STRATEGY_FILLING_RATE, CopyNum: 1, IndexId: 1}}
+	h := c.httpHandler()
+
+	cases := []struct {
+		method string
+		url    string
+		body   string
+		header string
+		status int
+	}{
+		{http.MethodPost, "/get?oid=1_1_2_3", "", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/get", "", "", http.StatusBadRequest},
+		{http.MethodGet, "/get?oid=1_1_2_3", "", "", http.StatusServiceUnavailable},
+		{http.MethodPut, "/save", "xxx", "text/plain", http.StatusUnsupportedMediaType},
+		{http.MethodPut, "/save?mime=jpg", "", "", http.StatusBadRequest},
+		{http.MethodPut, "/save?mime=jpg&ttl=-1", "xxx", "", http.StatusBadRequest},
+		{http.MethodPut, "/save?mime=jpg&ec=4", "xxx", "", http.StatusBadRequest},
+		{http.MethodGet, "/del?oid=1_1_2_3", "", "", http.StatusMethodNotAllowed},
+		{http.MethodDelete, "/del?oid=1_1_2_3", "", "", http.StatusServiceUnavailable},
+	}
+
+	for _, one := range cases {
+		req := httptest.NewRequest(one.method, one.url, strings.NewReader(one.body))
+		if one.header != "" {
+			req.Header.Set("Content-Type", one.header)
+		}
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+
+		if rw.Code != one.status {
+			t.Fatal("http facade status error", one.method, one.url, rw.Code, one.status)
+		}
+	}
+}
+
+func TestHttpStatusOf(t *testing.T) {
+	if httpStatusOf(ErrNotFound) != http.StatusNotFound ||
+		httpStatusOf(ErrDeleted) != http.StatusGone ||
+		httpStatusOf(ErrDisabled) != http.StatusForbidden {
+		t.Fatal("http status of record error")
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	cases := []struct {
+		header string
+		from   int
+		length int
+		ok     bool
+	}{
+		{"bytes=0-99", 0, 100, true},
+		{"bytes=100-", 100, 900, true},
+		{"bytes=-100", 900, 100, true},
+		{"bytes=-2000", 0, 1000, true},
+		{"bytes=990-2000", 990, 10, true},
+		{"bytes=0-1,5-9", 0, 1000, true},
+		{"items=0-1", 0, 1000, true},
+		{"bytes=1000-", 0, 1000, false},
+		{"bytes=9-1", 0, 1000, false},
+		{"bytes=x-1", 0, 1000, false},
+	}
+
+	for _, one := range cases {
+		from, length, ok := parseRange(one.header, 1000)
+		if from != one.from || length != one.length || ok != one.ok {
+			t.Fatal("parse range error", one.header, from, length, ok)
+		}
+	}
+}
+
+func TestIsNotModified(t *testing.T) {
+	rec := center.Record{Md5: []byte{1, 2, 3}, Created: 1600000000}
+	etag := getETag(rec)
+	if etag != "\"010203\"" {
+		t.Fatal("etag error", etag)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/get?oid=1", nil)
+	req.Header.Set("If-None-Match", "\"aaa\", W/"+etag)
+	if !isNotModified(req, rec, etag) {
+		t.Fatal("if none match should hit")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/get?oid=1", nil)
+	req.Header.Set("If-None-Match", "\"aaa\"")
+	req.Header.Set("If-Modified-Since", time.Unix(rec.Created, 0).UTC().Format(http.TimeFormat))
+	if isNotModified(req, rec, etag) {
+		t.Fatal("if none match should take precedence")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/get?oid=1", nil)
+	req.Header.Set("If-Modified-Since", time.Unix(rec.Created, 0).UTC().Format(http.TimeFormat))
+	if !isNotModified(req, rec, etag) {
+		t.Fatal("if modified since should hit")
+	}
+
+	req.Header.Set("If-Range", "\"aaa\"")
+	if isIfRangeMatch(req, rec, etag) {
+		t.Fatal("if range should not match")
+	}
+}
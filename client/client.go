@@ -7,8 +7,12 @@ import (
 	"errors"
 	"github.com/valyala/gorpc"
 	"github.com/blastbao/whisper/mediator"
+	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // filling rate/visit load/in different disks/in different hosts
@@ -17,9 +21,19 @@ const (
 	STRATEGY_VISIT_AVG    = 2
 	STRATEGY_DIR_PART     = 3
 	STRATEGY_ADDR_PART    = 4
+	STRATEGY_TOPOLOGY     = 5
 	COPY_NUMBER_DEFAULT   = 2
 )
 
+var (
+	ErrCenterNotConnected = errors.New("client center not connected")
+	ErrNotFound           = errors.New("client record not found")
+	ErrDisabled           = errors.New("client record disabled")
+	ErrDeleted            = errors.New("client record deleted")
+	ErrChecksumMismatch   = errors.New("client record checksum mismatch")
+	ErrNotEnoughShards    = errors.New("client record not enough erasure shards")
+)
+
 type Client struct {
 	HostLocal     string
 	Conf          ConnConf
@@ -27,19 +41,33 @@ type Client struct {
 	connectList   []*Connect          // to node server servers
 	c             *gorpc.Client       // to center server
 	mc            *mediator.NetClient // to mediator
+	hs            *http.Server        // http facade
+
+	replicas    []*gorpc.Client  // to other center servers, for reads
+	readNext    int              // round robin of replicas
+	centerMutex sync.Mutex       // guards c, replicas and the fields below
+	lastSeqs    map[string]int64 // group -> seq of the last write, for read-your-writes
+
+	shards mediator.CenterShards    // center groups by index id
+	groups map[string]*gorpc.Client // addr -> center of other groups
 }
 
 type ConnConf struct {
 	Stratigy int  	// 路由策略
 	CopyNum  int	// 副本数
 	IndexId  int 	// 写入的 Index // for balance
+	Dedup    bool	// 去重，相同内容只保存一份
+	ReadMode int	// 元数据读取的一致性 READ_YOUR_WRITES/READ_ANY/READ_MASTER
+	DomainLevel int	// STRATEGY_TOPOLOGY 下副本必须位于不同故障域的层级 mediator.TOPOLOGY_*，TOPOLOGY_NONE 表示尽量分散
+	EcData   int	// 纠删码的数据分片数，0 表示使用多副本，见 client-erasure.go
+	EcParity int	// 纠删码的校验分片数
 }
 
 
 //
 func (c *Client) Start(mediatorHost string) {
 	c.HostLocal = common.GetLocalAddr()
-	c.Conf = ConnConf{STRATEGY_FILLING_RATE, 1, 1}
+	c.Conf = ConnConf{Stratigy: STRATEGY_FILLING_RATE, CopyNum: 1, IndexId: 1}
 	c.LetMediate(mediatorHost)
 }
 
@@ -48,12 +76,14 @@ func (c *Client) LetMediate(mediatorHost string) {
 
 	// 同 mediator server 建立连接
 	c.mc = &mediator.NetClient{}
+	c.mc.OnStateChange = c.onMediatorState
 	if e := c.mc.Start(mediatorHost + ":" + strconv.Itoa(common.SERVER_PORT_MEDIATOR)); e != nil {
 		common.Log.Error("client mediator client started failed", e)
 		return
 	} else {
 		common.Log.Info("client mediator client started")
 	}
+	c.mc.Register(mediator.Member{Role: common.ROLE_CLIENT, Addr: c.HostLocal})
 
 	// 注册 watcher 到 mediator server 上，当收到 trigger 时，client 会自动调用回调函数。
 
@@ -73,7 +103,7 @@ func (c *Client) LetMediate(mediatorHost string) {
 
 				// 反序列化
 				var block mediator.Block
-				if err := common.Dec(b, &block); err != nil {
+				if err := common.DecCompat(b, &block); err != nil {
 					common.Log.Error("client block refresh decode error", err)
 					return
 				}
@@ -94,7 +124,7 @@ func (c *Client) LetMediate(mediatorHost string) {
 
 			// 解析配置
 			var conf ConnConf
-			e := common.Dec(value, &conf)
+			e := common.DecCompat(value, &conf)
 
 			if e != nil {
 				common.Log.Info("client conf refresh error", e)
@@ -108,7 +138,7 @@ func (c *Client) LetMediate(mediatorHost string) {
 
 	// connect to center server
 	c.mc.Watch(
-		"client-connect-to-center",
+		mediator.KEY_CLIENT_CENTER_ADDR,
 		func(value, valueOld []byte) {
 
 			if c.c != nil {
@@ -124,9 +154,35 @@ func (c *Client) LetMediate(mediatorHost string) {
 		},
 	)
 
-	// connect to node server
+	// connect to all centers for reads
 	c.mc.Watch(
-		"client-connect-to-node-server",
+		mediator.KEY_CENTER_TOPOLOGY,
+		func(value, valueOld []byte) {
+			var role mediator.CenterRole
+			if e := common.DecCompat(value, &role); e != nil {
+				common.Log.Error("client center topology decode error", e)
+				return
+			}
+			c.ConnectToReplicas(role)
+		},
+	)
+
+	// connect to centers of other groups
+	c.mc.Watch(
+		mediator.KEY_CENTER_SHARDS,
+		func(value, valueOld []byte) {
+			var shards mediator.CenterShards
+			if e := common.DecCompat(value, &shards); e != nil {
+				common.Log.Error("client center shards decode error", e)
+				return
+			}
+			c.ConnectToShards(shards)
+		},
+	)
+
+	// connect to node server, agent addrs kept by the mediator member registry
+	c.mc.Watch(
+		mediator.KEY_NODE_SERVER_ADDRS,
 		func(value, valueOld []byte) {
 			str := string(value)
 			// 建立连接
@@ -135,47 +191,70 @@ func (c *Client) LetMediate(mediatorHost string) {
 	)
 }
 
+// mediator 断开期间继续使用已有的块信息和连接，重连后 watcher 被重新注册并收到最新值
+func (c *Client) onMediatorState(state int) {
+	if state == mediator.NetClientConnected {
+		common.Log.Info("client mediator reconnected")
+	} else {
+		common.Log.Warning("client mediator disconnected, reconnecting")
+	}
+}
+
 //
 func (c *Client) ConnectToCenter(addr string) {
-	c.c = gorpc.NewTCPClient(addr)
-	c.c.Start()
+	cl := gorpc.NewTCPClient(addr)
+	cl.Start()
+
+	c.centerMutex.Lock()
+	c.c = cl
+	c.centerMutex.Unlock()
 	common.Log.Info("client center client connected")
 }
 
 func (c *Client) ConnectToNodeServer(nodeAddrs string) {
 
-	addrs := strings.Split(nodeAddrs, ",")
+	var addrs []string
+	for _, addr := range strings.Split(nodeAddrs, ",") {
+		if addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
 	common.Log.Info("client to node servers ready to connect - " + nodeAddrs)
 
-	// 遍历已建立的连接列表，如果有连接不属于 addrs 列表，则从 移除并关闭它。
+	// 遍历已建立的连接列表，保留属于 addrs 的连接，关闭其它连接。
+	var connectList []*Connect
 	var alreadyConnectedAddrs []string
 	for _, connect := range c.connectList {
 		if common.ContainsStr(addrs, connect.addr) {
 			common.Log.Info("client to node server already connected - " + connect.addr)
 			alreadyConnectedAddrs = append(alreadyConnectedAddrs, connect.addr)
+			connectList = append(connectList, connect)
 		} else {
 			common.Log.Info("client to node server is disconnecting - " + connect.addr)
 			connect.Close()
-			// todo: remove from c.connectList
-			// c.connectList = append(c.connectList[0:i], c.connectList[i+1:]...)
 		}
 	}
 
-	if len(c.connectList) == 0 {
-		c.connectList = make([]*Connect, len(addrs))
-	}
-
 	// 新建连接
-	for i, addr := range addrs {
+	for _, addr := range addrs {
 		if !common.ContainsStr(alreadyConnectedAddrs, addr) {
 			common.Log.Info("client to node server is connecting - " + addr)
-			c.connectList[i] = &Connect{addr: addr}
-			c.connectList[i].Start()
+			connect := &Connect{addr: addr}
+			connect.Start()
+			connectList = append(connectList, connect)
 		}
 	}
+
+	// agent 列表随成员变化更新
+	c.connectList = connectList
 }
 
 func (c *Client) Close() {
+	if c.hs != nil {
+		common.Log.Info("client http server stoped")
+		c.hs.Close()
+	}
+
 	for _, connect := range c.connectList {
 		common.Log.Info("client to node server is disconnecting - " + connect.addr)
 		connect.Close()
@@ -185,6 +264,8 @@ func (c *Client) Close() {
 		common.Log.Info("client center client stoped")
 		c.c.Stop()
 	}
+	c.closeReplicas()
+	c.closeGroups()
 	if c.mc != nil {
 		common.Log.Info("client mediator client stoped")
 		c.mc.Close()
@@ -214,57 +295,212 @@ func (c *Client) getTargetBlock(blockId int) (block *mediator.Block) {
 	return nil
 }
 
-// get blocks for writing TODO
+// get blocks for writing
+//
+// 从 c.BlockInfoList 中按 c.Conf.Stratigy 取出 c.Conf.CopyNum+1 个 Block ，用于写入数据，不足时对应位置为 nil 。
 //
-// 从 c.BlockInfoList 中取出 c.Conf.CopyNum+1 个 Block ，用于写入数据。
+// STRATEGY_FILLING_RATE: 填充率低的块优先
+// STRATEGY_DIR_PART: 副本在不同的磁盘 (addr + dir)
+// STRATEGY_ADDR_PART: 副本在不同的主机
+// STRATEGY_VISIT_AVG: 读取频率低的块优先，相同时填充率低的优先
+// STRATEGY_TOPOLOGY: 副本依次分散到不同的 zone/rack/host/disk ，见 spreadBlocks
 func (c *Client) getTargetBlocks() (arr []*mediator.Block) {
+	writable := c.writableBlocks()
 
-
-	arr = make([]*mediator.Block, c.Conf.CopyNum+1)
-
-	len := len(c.BlockInfoList)
-	if c.Conf.Stratigy == STRATEGY_FILLING_RATE {
-		for i := 0; i <= c.Conf.CopyNum; i++ {
-			if i < len {
-				arr[i] = c.BlockInfoList[i]
-			}
-		}
-	} else if c.Conf.Stratigy == STRATEGY_DIR_PART {
+	n := c.Conf.CopyNum + 1
+	if c.Conf.Stratigy == STRATEGY_DIR_PART {
 		// should be in different disk
+		return pickBlocks(writable, n, func(b *mediator.Block) string { return b.Addr + ":" + b.Dir })
 	} else if c.Conf.Stratigy == STRATEGY_ADDR_PART {
 		// should be in different host
+		return pickBlocks(writable, n, func(b *mediator.Block) string { return b.Addr })
 	} else if c.Conf.Stratigy == STRATEGY_VISIT_AVG {
+		sort.SliceStable(writable, func(i, j int) bool { return writable[i].VisitAvg < writable[j].VisitAvg })
+	} else if c.Conf.Stratigy == STRATEGY_TOPOLOGY {
+		return spreadBlocks(writable, n, c.Conf.DomainLevel)
+	}
+	return pickBlocks(writable, n, func(b *mediator.Block) string { return strconv.Itoa(b.BlockId) })
+}
+
+// 可写的块，按填充率排序，不修改 c.BlockInfoList 的顺序
+func (c *Client) writableBlocks() []*mediator.Block {
+
+	// 只读、退役、分配中及已写满的块不再写入
+	var writable []*mediator.Block
+	for _, block := range c.BlockInfoList {
+		if block.IsWritable() && block.End < block.Size {
+			writable = append(writable, block)
+		}
 	}
 
+	sort.Stable(mediator.BlockList(writable))
+	return writable
+}
+
+// 按顺序取 n 个 key 互不相同的块
+func pickBlocks(blocks []*mediator.Block, n int, key func(b *mediator.Block) string) []*mediator.Block {
+	arr := make([]*mediator.Block, n)
+	used := make(map[string]bool)
+
+	i := 0
+	for _, block := range blocks {
+		if i == n {
+			break
+		}
+		k := key(block)
+		if used[k] {
+			continue
+		}
+		used[k] = true
+		arr[i] = block
+		i++
+	}
+	return arr
+}
+
+// 按顺序取 n 个块，每次选择与已选副本共享故障域最少的块，先比较 zone ，再比较 rack/host/disk 。
+// 故障域不够时退而分散到更小的故障域；domainLevel 上与已选副本相同的块不可选，没有可选的块时对应位置为 nil 。
+func spreadBlocks(blocks []*mediator.Block, n int, domainLevel int) []*mediator.Block {
+	arr := make([]*mediator.Block, n)
+	used := make(map[int]bool)
+	isStrict := domainLevel > mediator.TOPOLOGY_NONE && domainLevel <= mediator.TOPOLOGY_DISK
+
+	for i := 0; i < n; i++ {
+		var best *mediator.Block
+		var bestShared []int
+		for _, block := range blocks {
+			if used[block.BlockId] {
+				continue
+			}
+
+			// 每一层与已选副本相同的故障域数
+			shared := make([]int, mediator.TOPOLOGY_DISK)
+			for level := mediator.TOPOLOGY_ZONE; level <= mediator.TOPOLOGY_DISK; level++ {
+				for _, chosen := range arr[:i] {
+					if chosen.Domain(level) == block.Domain(level) {
+						shared[level-1]++
+					}
+				}
+			}
+			if isStrict && shared[domainLevel-1] > 0 {
+				continue
+			}
+			if best == nil || lessInts(shared, bestShared) {
+				best = block
+				bestShared = shared
+			}
+		}
+
+		if best == nil {
+			if isStrict {
+				common.Log.Warning("client not enough failure domains", domainLevel, i)
+			}
+			break
+		}
+		used[best.BlockId] = true
+		arr[i] = best
+	}
 	return arr
 }
 
+// 按字典序比较
+func lessInts(a, b []int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
 
 // 多副本下载
 func (c *Client) Get(oid string) (body []byte, mime int, err error) {
 
 	// use goroutine as an option
 
-	// 查询第一个副本
-	body, mime, err = c.GetOne(oid + "_0")
-	if err == nil {
+	var rec center.Record
+	err = c.eachCopy(oid, func(oidCopy string) (e error) {
+		rec, e = c.getMeta(oidCopy)
+		if e != nil || rec.IsErasure() {
+			return
+		}
+		mime = rec.Mime
+		body, e = c.download(rec)
 		return
+	})
+
+	// 纠删码由多个分片恢复，getErasure 已尝试所有分片，不再逐个副本重试
+	if err == nil && rec.IsErasure() {
+		mime = rec.Mime
+		body, err = c.getErasure(oid, rec)
 	}
+	return
+}
 
-	// 查询其它副本
-	for i := 1; i <= int(c.Conf.CopyNum); i++ {
-		common.Log.Info("client try fetch time " + strconv.Itoa(i) + " for " + oid)
-		body, mime, err = c.GetOne(oid + "_" + strconv.Itoa(i))
-		if err == nil {
+// 多副本下载 [from, from+length) 范围的数据，length 为 0 表示读到末尾，同时返回 record 元数据
+func (c *Client) GetRange(oid string, from, length int) (body []byte, rec center.Record, err error) {
+	err = c.eachCopy(oid, func(oidCopy string) (e error) {
+		rec, e = c.getMeta(oidCopy)
+		if e != nil || rec.IsErasure() {
 			return
 		}
+		body, e = c.downloadRange(rec, from, length)
+		return
+	})
+
+	if err == nil && rec.IsErasure() {
+		rec = erasureView(rec)
+		if body, err = c.getErasure(oid, rec); err == nil {
+			body, err = sliceRange(body, from, length)
+		}
 	}
+	return
+}
 
-	// 报错
-	err = errors.New("client get failed")
+// 多副本查询元数据
+func (c *Client) Stat(oid string) (rec center.Record, err error) {
+	err = c.eachCopy(oid, func(oidCopy string) (e error) {
+		rec, e = c.getMeta(oidCopy)
+		if e == nil && rec.IsErasure() {
+			rec = erasureView(rec)
+		}
+		return
+	})
 	return
 }
 
+// 依次对 oid 的每个副本执行 fn 直到成功
+//
+// 副本不存在或读取失败时尝试下一个副本；记录已删除/已禁用时直接返回，所有副本状态一致。
+func (c *Client) eachCopy(oid string, fn func(oidCopy string) error) error {
+	isAllNotFound := true
+	for i, oidCopy := range center.GetOidSiblings(oid + "_0") {
+		if i > 0 {
+			common.Log.Info("client try fetch time " + strconv.Itoa(i) + " for " + oid)
+		}
+
+		e := fn(oidCopy)
+		if e == nil {
+			return nil
+		}
+
+		if e == ErrDeleted || e == ErrDisabled || e == ErrCenterNotConnected {
+			return e
+		}
+		if e != ErrNotFound {
+			common.Log.Error("client fetch copy error", oidCopy, e)
+			isAllNotFound = false
+		}
+	}
+
+	// 报错
+	if isAllNotFound {
+		return ErrNotFound
+	}
+	return errors.New("client get failed")
+}
+
 // 下载
 //
 // (1) 从 center svr 查询 oid 对应的 Record 信息
@@ -274,20 +510,35 @@ func (c *Client) Get(oid string) (body []byte, mime int, err error) {
 func (c *Client) GetOne(oid string) (body []byte, mime int, err error) {
 
 	// 调用 center svr 查询 oid 对应的 saveRecord 信息
-	resp, e := c.c.Call(center.PackRecord{Command: center.CMD_GET_OID_META, Oid: oid})
+	rec, e := c.getMeta(oid)
 	if e != nil {
 		err = e
 		return
 	}
+	mime = rec.Mime
 
-	pack := resp.(center.PackRecord)
-	if !pack.Flag {
-		err = errors.New(pack.Msg)
+	// 去 node svr 下载 record
+	body, err = c.download(rec)
+	return
+}
+
+// 下载 record 的全部数据并校验，不一致时由 Get 尝试下一个副本
+func (c *Client) download(rec center.Record) (body []byte, err error) {
+	body, err = c.downloadRange(rec, 0, 0)
+	if err != nil {
 		return
 	}
 
-	rec := pack.Rec
-	mime = rec.Mime
+	if len(rec.Md5) > 0 && !common.CheckHash(body, rec.Md5, rec.HashAlg) {
+		common.Log.Error("client get checksum mismatch", rec.Oid)
+		body = nil
+		err = ErrChecksumMismatch
+	}
+	return
+}
+
+// 根据 rec.BlockId 找到 node svr ，下载 [from, from+length) 范围的数据
+func (c *Client) downloadRange(rec center.Record, from, length int) (body []byte, err error) {
 
 	// 在 c.BlockInfoList 中查询 blockId 的块信息
 	block := c.getTargetBlock(rec.BlockId)
@@ -303,24 +554,66 @@ func (c *Client) GetOne(oid string) (body []byte, mime int, err error) {
 		return
 	}
 
-	// 去 node svr 下载 record
-	body, err = connect.Download(rec)
+	return connect.DownloadRange(rec, from, length)
+}
+
+// 从 center svr 查询 oid(含副本号) 对应的 Record ，并检查其状态，按 ReadMode 选择 center
+func (c *Client) getMeta(oid string) (rec center.Record, err error) {
+	pack, e := c.callRead(center.PackRecord{Command: center.CMD_GET_OID_META, Oid: oid})
+	if e != nil {
+		err = e
+		return
+	}
+
+	if !pack.Flag {
+		if strings.Contains(pack.Msg, "not found") {
+			err = ErrNotFound
+		} else {
+			err = errors.New(pack.Msg)
+		}
+		return
+	}
+
+	rec = pack.Rec
+	if rec.Status == common.STATUS_RECORD_DEL {
+		err = ErrDeleted
+	} else if rec.Status == common.STATUS_RECORD_DISABLE {
+		err = ErrDisabled
+	}
 	return
 }
 
 // 多副本保存
 func (c *Client) Save(body []byte, mime int) (oid string, err error) {
+	return c.SaveWithTTL(body, mime, 0)
+}
+
+// 多副本保存，ttl 秒后过期，0 表示不过期
+func (c *Client) SaveWithTTL(body []byte, mime int, ttl int64) (oid string, err error) {
+
+	var expired int64
+	if ttl > 0 {
+		expired = time.Now().Unix() + ttl
+	}
+
+	// 纠删码
+	if c.Conf.EcData > 0 {
+		return c.SaveErasure(body, mime, ttl, c.Conf.EcData, c.Conf.EcParity)
+	}
 
 	// oid = indexId_copyNum_RandInt_RandInt
 	oid = center.GenOidNoSuffix(c.Conf.IndexId, c.Conf.CopyNum)
 
+	// 去重命中时不需要上传
+	if c.Conf.Dedup && c.saveRef(oid, body, mime, expired) {
+		return oid, nil
+	}
+
 	// 从 c.BlockInfoList 中取出 c.Conf.CopyNum+1 个 Block ，用于写入数据。
 	blocks := c.getTargetBlocks()
 
-	// 监听写入结果
-	chs := make([]chan bool, len(blocks))
-
-	// 往每个 block 中写入新数据（多副本）
+	// 所有副本的块及连接都可用时才开始上传，避免部分副本写入后返回失败
+	connects := make([]*Connect, len(blocks))
 	for i, block := range blocks {
 
 		if block == nil {
@@ -329,43 +622,45 @@ func (c *Client) Save(body []byte, mime int) (oid string, err error) {
 		}
 
 		// 获取 block 所在 NodeSvr 的地址
-		connect := c.getTargetConnect(block.Addr)
-		if connect == nil {
+		connects[i] = c.getTargetConnect(block.Addr)
+		if connects[i] == nil {
 			msg := "client save but connect not found " + block.Addr
 			common.Log.Error(msg)
 			err = errors.New(msg)
 			return
 		}
+	}
+
+	// 监听写入结果
+	chs := make([]chan center.PackRecord, len(blocks))
+
+	// 往每个 block 中写入新数据（多副本）
+	for i, block := range blocks {
+		connect := connects[i]
 
 		// 结果管道
-		chs[i] = make(chan bool, 1)
+		chs[i] = make(chan center.PackRecord, 1)
 
 		// main is the first and end width _0
 		// 副本号
 		oidCopy := oid + "_" + strconv.Itoa(i)
 
 		// 后台上传数据到 NodeSvr
-		go connect.Upload(oidCopy, body, mime, chs[i])
+		go connect.Upload(oidCopy, block.BlockId, body, mime, expired, chs[i])
 	}
 
 
 	// every should be writing done
 	for i, ch := range chs {
 
-		isOk := <-ch
+		packReturn := <-ch
+		c.observeSeq(center.GetOidInfo(oid+"_0").IndexId, packReturn.Seq)
 
 		// 如果上传失败，调用 Center Svr 将数据 oid 的状态置为不可用
-		if !isOk {
+		if !packReturn.Flag {
 
 			go func() {
-				_, e := c.c.Call(
-					center.PackRecord{
-						Command: center.CMD_CHANGE_OID_STATUS,
-						Oid: oid,
-						Status: common.STATUS_RECORD_DISABLE,
-					},
-				)
-				if e != nil {
+				if e := c.changeStatus(oid, common.STATUS_RECORD_DISABLE); e != nil {
 					common.Log.Error("client write fail then disable oid status error", oid, e)
 				}
 			}()
@@ -380,14 +675,81 @@ func (c *Client) Save(body []byte, mime int) (oid string, err error) {
 	return oid, nil
 }
 
+// 去重：center 已存在相同内容时，oid 成为已有记录的引用
+func (c *Client) saveRef(oid string, body []byte, mime int, expired int64) bool {
+	cl := c.centerFor(center.GetOidInfo(oid + "_0").IndexId)
+	if cl == nil {
+		return false
+	}
+
+	rec := center.Record{
+		Md5: common.GenMd5(body),
+		HashAlg: common.HASH_MD5,
+		Len: len(body),
+		Mime: mime,
+		Created: time.Now().Unix(),
+		Expired: expired,
+	}
+	resp, e := cl.Call(center.PackRecord{Command: center.CMD_PUT_REF, Oid: oid, Rec: rec})
+	if e != nil {
+		common.Log.Error("client save ref error", oid, e)
+		return false
+	}
+
+	pack := resp.(center.PackRecord)
+	if !pack.Flag {
+		common.Log.Debug("client save ref miss", oid, pack.Msg)
+		return false
+	}
+	c.observeSeq(center.GetOidInfo(oid+"_0").IndexId, pack.Seq)
+
+	common.Log.Info("client save ref hit", oid, pack.Oid)
+	return true
+}
+
 func (c *Client) Del(oid string) error {
 	// 调用 Center Svr 将数据 oid 的状态置为已删除
-	_, e := c.c.Call(
-		center.PackRecord{
-			Command: center.CMD_CHANGE_OID_STATUS,
-			Oid: oid,
-			Status: common.STATUS_RECORD_DEL,
-		},
-	)
-	return e
+	return c.changeStatus(oid, common.STATUS_RECORD_DEL)
+}
+
+// 修改 oid 所有副本的状态，oid 不含副本号
+func (c *Client) changeStatus(oid string, status int) error {
+	cl := c.centerFor(center.GetOidInfo(oid + "_0").IndexId)
+	if cl == nil {
+		return ErrCenterNotConnected
+	}
+
+	isAllNotFound := true
+	var err error
+	for _, oidCopy := range center.GetOidSiblings(oid + "_0") {
+		resp, e := cl.Call(
+			center.PackRecord{
+				Command: center.CMD_CHANGE_OID_STATUS,
+				Oid: oidCopy,
+				Status: status,
+			},
+		)
+		if e != nil {
+			return e
+		}
+
+		pack := resp.(center.PackRecord)
+		if pack.Flag {
+			c.observeSeq(center.GetOidInfo(oidCopy).IndexId, pack.Seq)
+			isAllNotFound = false
+			continue
+		}
+
+		// 某个副本写入失败时可能没有记录，跳过
+		if strings.Contains(pack.Msg, "not found") {
+			continue
+		}
+		isAllNotFound = false
+		err = errors.New(pack.Msg)
+	}
+
+	if isAllNotFound {
+		return ErrNotFound
+	}
+	return err
 }
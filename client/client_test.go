@@ -3,11 +3,14 @@ package client
 import (
 	"github.com/blastbao/whisper/agent"
 	"bytes"
+	"encoding/gob"
 	"github.com/blastbao/whisper/center"
 	"github.com/blastbao/whisper/common"
 	"io/ioutil"
 	"github.com/blastbao/whisper/mediator"
+	"os"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -135,3 +138,149 @@ func TestClientNodeServerConnect(t *testing.T) {
 
 	time.Sleep(15 * time.Second)
 }
+
+func TestClientTargetBlocks(t *testing.T) {
+	c := &Client{Conf: ConnConf{CopyNum: 1}}
+	c.BlockInfoList = []*mediator.Block{
+		{BlockId: 1, Addr: "h1", Dir: "/d1", Size: 100, End: 10, VisitAvg: 50},
+		{BlockId: 2, Addr: "h1", Dir: "/d1", Size: 100, End: 20, VisitAvg: 0},
+		{BlockId: 3, Addr: "h1", Dir: "/d2", Size: 100, End: 30, VisitAvg: 10},
+		{BlockId: 4, Addr: "h2", Dir: "/d1", Size: 100, End: 40, VisitAvg: 20},
+		{BlockId: 5, Addr: "h3", Dir: "/d1", Size: 100, End: 100},
+		{BlockId: 6, Addr: "h3", Dir: "/d1", Size: 100, Status: mediator.BLOCK_STATUS_READONLY},
+	}
+
+	cases := []struct {
+		strategy int
+		ids      []int
+	}{
+		{STRATEGY_FILLING_RATE, []int{1, 2}},
+		{STRATEGY_DIR_PART, []int{1, 3}},
+		{STRATEGY_ADDR_PART, []int{1, 4}},
+		{STRATEGY_VISIT_AVG, []int{2, 3}},
+	}
+	for _, one := range cases {
+		c.Conf.Stratigy = one.strategy
+		arr := c.getTargetBlocks()
+		if len(arr) != len(one.ids) {
+			t.Fatal("target blocks number error", one.strategy, len(arr))
+		}
+		for i, block := range arr {
+			if block == nil || block.BlockId != one.ids[i] {
+				t.Fatal("target blocks error", one.strategy, i, block)
+			}
+		}
+	}
+	if c.BlockInfoList[0].BlockId != 1 {
+		t.Fatal("block info list should not be reordered")
+	}
+
+	// 只有两台可写主机，三个副本不够
+	c.Conf.CopyNum = 2
+	c.Conf.Stratigy = STRATEGY_ADDR_PART
+	if arr := c.getTargetBlocks(); arr[2] != nil {
+		t.Fatal("not enough hosts should leave nil", arr[2])
+	}
+}
+
+func TestClientSpreadBlocks(t *testing.T) {
+	c := &Client{Conf: ConnConf{Stratigy: STRATEGY_TOPOLOGY, CopyNum: 2}}
+	c.BlockInfoList = []*mediator.Block{
+		{BlockId: 1, Zone: "z1", Rack: "r1", Addr: "h1", Dir: "/d1", Size: 100, End: 10},
+		{BlockId: 2, Zone: "z1", Rack: "r1", Addr: "h2", Dir: "/d1", Size: 100, End: 20},
+		{BlockId: 3, Zone: "z1", Rack: "r2", Addr: "h3", Dir: "/d1", Size: 100, End: 30},
+		{BlockId: 4, Zone: "z2", Rack: "r3", Addr: "h4", Dir: "/d1", Size: 100, End: 40},
+		{BlockId: 5, Zone: "z2", Rack: "r3", Addr: "h4", Dir: "/d2", Size: 100, End: 50},
+	}
+
+	ids := func(arr []*mediator.Block) (r []int) {
+		for _, block := range arr {
+			if block == nil {
+				r = append(r, 0)
+			} else {
+				r = append(r, block.BlockId)
+			}
+		}
+		return
+	}
+	check := func(arr []*mediator.Block, expected ...int) {
+		r := ids(arr)
+		if len(r) != len(expected) {
+			t.Fatal("spread blocks number error", r, expected)
+		}
+		for i := range r {
+			if r[i] != expected[i] {
+				t.Fatal("spread blocks error", r, expected)
+			}
+		}
+	}
+
+	// 两个 zone ，第三个副本放到另一个 rack
+	check(c.getTargetBlocks(), 1, 4, 3)
+
+	// 只有两个 zone ，要求 zone 不同时第三个副本失败
+	c.Conf.DomainLevel = mediator.TOPOLOGY_ZONE
+	check(c.getTargetBlocks(), 1, 4, 0)
+
+	c.Conf.DomainLevel = mediator.TOPOLOGY_RACK
+	check(c.getTargetBlocks(), 1, 4, 3)
+
+	// 四个副本时 rack 不够，退而使用不同的 host
+	c.Conf.CopyNum = 3
+	c.Conf.DomainLevel = mediator.TOPOLOGY_HOST
+	check(c.getTargetBlocks(), 1, 4, 3, 2)
+	c.Conf.DomainLevel = mediator.TOPOLOGY_RACK
+	check(c.getTargetBlocks(), 1, 4, 3, 0)
+
+	// 未标记时按 host/disk 分散
+	for _, block := range c.BlockInfoList {
+		block.Zone, block.Rack = "", ""
+	}
+	c.Conf.DomainLevel = mediator.TOPOLOGY_NONE
+	check(c.getTargetBlocks(), 1, 2, 3, 4)
+}
+
+// 块不足时不上传任何副本
+func TestClientSaveNotEnoughBlocks(t *testing.T) {
+	gob.Register(center.PackRecord{})
+
+	dir, e := ioutil.TempDir("", "test-whisper-save")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	centerAddr := "127.0.0.1:9799"
+	cs, records := startTestRecordCenter(t, centerAddr)
+	defer cs.Stop()
+
+	c := &Client{Conf: ConnConf{IndexId: 1, CopyNum: 2, Stratigy: STRATEGY_ADDR_PART}}
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		host := "127.0.0.2" + strconv.Itoa(i+1)
+		block := mediator.Block{BlockId: i + 1, DataId: 1, Addr: host, Dir: dir + "/" + strconv.Itoa(i), Size: 1024 * 1024}
+		if e := os.MkdirAll(block.Dir, 0755); e != nil {
+			t.Fatal(e)
+		}
+		ns := startTestAgent(t, host, block, centerAddr)
+		defer ns.Close()
+
+		b := block
+		c.BlockInfoList = append(c.BlockInfoList, &b)
+		addrs = append(addrs, host+":"+strconv.Itoa(common.SERVER_PORT_AGENT))
+	}
+	c.ConnectToCenter(centerAddr)
+	c.ConnectToNodeServer(strings.Join(addrs, ","))
+	defer c.Close()
+
+	if _, e := c.Save([]byte("0123456789"), common.MIME_JPG); e == nil {
+		t.Fatal("save should fail with two hosts for three copies")
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	records.mutex.Lock()
+	defer records.mutex.Unlock()
+	if len(records.recs) != 0 {
+		t.Fatal("no copy should be written", records.recs)
+	}
+}
@@ -33,14 +33,20 @@ func (c *Connect) Close() {
 }
 
 
-// 上传 Record 到 nodeSvr
-func (c *Connect) Upload(oid string, body []byte, mime int, ch chan bool) {
+// 上传 Record 到 nodeSvr 的 blockId 块，blockId 不可用时由 nodeSvr 选择，expired 为过期时间(秒)，0 表示不过期，结果的 Seq 为 center 的写入序号
+func (c *Connect) Upload(oid string, blockId int, body []byte, mime int, expired int64, ch chan center.PackRecord) {
+	c.UploadRecord(center.Record{Oid: oid, BlockId: blockId, Mime: mime, Expired: expired}, body, ch)
+}
+
+// 上传 Record 到 nodeSvr ，rec 的 Oid/BlockId/Mime/Expired 及纠删码字段由 nodeSvr 保存到 center ，结果的 Rec 为保存的记录
+func (c *Connect) UploadRecord(rec center.Record, body []byte, ch chan center.PackRecord) {
+	oid, mime := rec.Oid, rec.Mime
 
 	// 构造上传请求
 	pack := center.PackRecord{}
 	pack.Command = agent.AGENT_SERVER_COMMAND_SAVE
 	pack.Body = body
-	pack.Rec = center.Record{Oid: oid, Mime: mime}
+	pack.Rec = rec
 
 	var error error
 	var resp interface{}
@@ -57,30 +63,35 @@ func (c *Connect) Upload(oid string, body []byte, mime int, ch chan bool) {
 			common.Log.Error("client upload error", oid, error)
 		}
 
-		ch <- false
+		ch <- center.PackRecord{Msg: error.Error()}
 		return
 	}
 
 	if resp == nil {
 		common.Log.Error("client upload result is nil", oid)
-		ch <- false
+		ch <- center.PackRecord{Msg: "client upload result is nil"}
 		return
 	}
 
 	packReturn := resp.(center.PackRecord)
-	if packReturn.Flag {
-		ch <- true
-	} else {
+	if !packReturn.Flag {
 		common.Log.Error("client upload error", oid, mime, len(body), packReturn.Msg)
-		ch <- false
 	}
+	ch <- packReturn
 }
 
 // 从 nodeSvr 下载 Record
 func (c *Connect) Download(rec center.Record) (body []byte, err error) {
+	return c.DownloadRange(rec, 0, 0)
+}
+
+// 从 nodeSvr 下载 Record 中 [from, from+length) 范围的数据，length 为 0 表示读到末尾
+func (c *Connect) DownloadRange(rec center.Record, from, length int) (body []byte, err error) {
 	pack := center.PackRecord{}
 	pack.Command = agent.AGENT_SERVER_COMMAND_GET
 	pack.Rec = rec
+	pack.RangeFrom = from
+	pack.RangeLen = length
 
 	resp, e := c.c.Call(pack)
 	if e != nil {
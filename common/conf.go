@@ -23,6 +23,10 @@ const (
 	STATUS_RECORD_DEL         = 10
 	STATUS_RECORD_DISABLE     = 20
 
+	// record checksum algorithm, sampled is the legacy one
+	HASH_SAMPLED = 0
+	HASH_MD5     = 1
+
 	MIME_JPG = 1
 	MIME_PNG = 2
 	MIME_GIF = 3
@@ -42,6 +46,13 @@ type Conf struct {
 	MediatorHost            string
 	BaseDir                 string
 	MediatorControlBodyFile string
+	IndexLogSync            string   // center index log fsync policy, always / batch / interval
+	MediatorLegacyPack      bool     // send mediator packs in the old CRLF format, for rolling upgrade
+	CenterGroup             string   // center shard group, empty for the default group
+	CenterStandalone        bool     // center runs alone without other centers of the group
+	DataDirs                []string // agent data dirs holding the block registry, comma separated
+	Zone                    string   // agent failure domain labels, used by replica placement
+	Rack                    string
 }
 
 var conf *Conf
@@ -71,6 +82,17 @@ func GetConf() *Conf {
 			conf.BaseDir = r["baseDir"]
 			conf.MediatorHost = r["mediatorHost"]
 			conf.MediatorControlBodyFile = r["mediatorControlBodyFile"]
+			conf.IndexLogSync = r["indexLogSync"]
+			conf.MediatorLegacyPack = "true" == r["mediatorLegacyPack"]
+			conf.CenterGroup = r["centerGroup"]
+			conf.CenterStandalone = "true" == r["centerStandalone"]
+			conf.Zone = r["zone"]
+			conf.Rack = r["rack"]
+			for _, dir := range strings.Split(r["dataDirs"], ",") {
+				if dir = strings.TrimSpace(dir); dir != "" {
+					conf.DataDirs = append(conf.DataDirs, dir)
+				}
+			}
 		}
 	}
 
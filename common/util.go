@@ -10,19 +10,31 @@ import (
 	"net"
 	"os"
 	"os/user"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 )
 
-// generate a simple indentity id for this byte array
+// md5 of the whole byte array
 func GenMd5(b []byte) []byte {
+	r := md5.Sum(b)
+	return r[:]
+}
+
+// generate a simple indentity id for this byte array
+//
+// 旧版本的校验码，只对长度及每隔 len/10 的字节做 md5 ，仅用于校验旧数据。
+func GenSampledMd5(b []byte) []byte {
 	len := len(b)
 
 	buf := bytes.Buffer{}
 	buf.WriteString(strconv.Itoa(len))
 
 	var step int = len / 10
+	if step == 0 {
+		step = 1
+	}
 
 	for i := 0; i < len-1; i = i + step {
 		buf.WriteByte(b[i])
@@ -35,9 +47,64 @@ func GenMd5(b []byte) []byte {
 }
 
 func CheckMd5(b []byte, md5 []byte) bool {
-	r := GenMd5(b)
+	return CheckHash(b, md5, HASH_MD5)
+}
+
+// 按 record 记录的算法生成校验码
+func GenHash(b []byte, alg int) []byte {
+	if alg == HASH_SAMPLED {
+		return GenSampledMd5(b)
+	}
+	return GenMd5(b)
+}
+
+func CheckHash(b []byte, sum []byte, alg int) bool {
+	return bytes.Compare(GenHash(b, alg), sum) == 0
+}
+
+// mime <-> http content type
+var mimeContentTypes = map[int]string{
+	MIME_JPG: "image/jpeg",
+	MIME_PNG: "image/png",
+	MIME_GIF: "image/gif",
+	MIME_BMP: "image/bmp",
+}
+
+var mimeNames = map[string]int{
+	"jpg":  MIME_JPG,
+	"jpeg": MIME_JPG,
+	"png":  MIME_PNG,
+	"gif":  MIME_GIF,
+	"bmp":  MIME_BMP,
+}
+
+// 未知 mime 返回 application/octet-stream
+func GetContentType(mime int) string {
+	if ct, ok := mimeContentTypes[mime]; ok {
+		return ct
+	}
+	return "application/octet-stream"
+}
+
+// 根据 http content type 获取 mime ，未知返回 0
+func GetMimeByContentType(contentType string) int {
+	// ignore params like "; charset=..."
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+
+	for mime, ct := range mimeContentTypes {
+		if ct == contentType {
+			return mime
+		}
+	}
+	return 0
+}
 
-	return bytes.Compare(r, md5) == 0
+// 根据扩展名 jpg/png/gif/bmp 获取 mime ，未知返回 0
+func GetMimeByName(name string) int {
+	return mimeNames[strings.ToLower(strings.TrimPrefix(name, "."))]
 }
 
 func CmpInt(a, b interface{}) int {
@@ -95,6 +162,15 @@ func Dec(b []byte, v interface{}) error {
 	return binary.Unmarshal(b, v)
 }
 
+// 兼容旧数据：新字段只追加在 struct 末尾，旧数据在字段边界处结束，缺失的字段保持零值。
+func DecCompat(b []byte, v interface{}) error {
+	e := binary.Unmarshal(b, v)
+	if e == io.EOF {
+		return nil
+	}
+	return e
+}
+
 // compress
 func Compress(b []byte) (r []byte, err error) {
 	var buf bytes.Buffer
@@ -155,7 +231,10 @@ func Write2File(b []byte, fn string, writeType int) error {
 			return error
 		}
 	} else {
-		// os.O_WRONLY or
+		// os.O_APPEND 等需要加上写模式
+		if writeType&(os.O_WRONLY|os.O_RDWR) == 0 {
+			writeType |= os.O_WRONLY
+		}
 		file, error = os.OpenFile(fn, writeType, 0666)
 		if error != nil {
 			return error
@@ -172,6 +251,44 @@ func Write2File(b []byte, fn string, writeType int) error {
 	return nil
 }
 
+// fsync the directory so that created/renamed entries survive a crash
+func SyncDir(dir string) error {
+	d, e := os.Open(dir)
+	if e != nil {
+		return e
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// write and fsync a file, the file is not visible as fn until it is complete
+//
+// 先写 fn.tmp 并 fsync ，再 rename 为 fn ，最后 fsync 所在目录。
+func WriteFileSync(b []byte, fn string) error {
+	tmp := fn + ".tmp"
+	file, e := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if e != nil {
+		return e
+	}
+
+	_, e = file.Write(b)
+	if e == nil {
+		e = file.Sync()
+	}
+	if e2 := file.Close(); e == nil {
+		e = e2
+	}
+	if e == nil {
+		e = os.Rename(tmp, fn)
+	}
+	if e != nil {
+		os.Remove(tmp)
+		return e
+	}
+
+	return SyncDir(filepath.Dir(fn))
+}
+
 // get host
 func GetLocalAddr() string {
 	addrs, e := net.InterfaceAddrs()
@@ -2,6 +2,8 @@ package common
 
 import (
 	"bytes"
+	"io/ioutil"
+	"os"
 	"testing"
 	"time"
 )
@@ -24,6 +26,63 @@ func TestGenMd5(t *testing.T) {
 	}
 }
 
+func TestGenHash(t *testing.T) {
+	b1 := make([]byte, 100)
+	b2 := make([]byte, 100)
+	b2[5] = 1
+
+	// sampled md5 only checks every 10th byte
+	if !CheckHash(b2, GenHash(b1, HASH_SAMPLED), HASH_SAMPLED) {
+		t.Fatal("sampled md5 should collide")
+	}
+	if CheckHash(b2, GenHash(b1, HASH_MD5), HASH_MD5) {
+		t.Fatal("md5 should not collide")
+	}
+
+	// short bytes
+	if !CheckHash([]byte("abc"), GenSampledMd5([]byte("abc")), HASH_SAMPLED) {
+		t.Fatal("sampled md5 of short bytes error")
+	}
+}
+
+func TestDecCompat(t *testing.T) {
+	type v1 struct {
+		Name string
+	}
+	type v2 struct {
+		Name string
+		Age  int
+	}
+
+	b, _ := Enc(&v1{"dog"})
+
+	var one v2
+	if e := Dec(b, &one); e == nil {
+		t.Fatal("dec should fail as field missing")
+	}
+	if e := DecCompat(b, &one); e != nil || one.Name != "dog" || one.Age != 0 {
+		t.Fatal("dec compat error", one, e)
+	}
+}
+
+func TestWrite2FileAppend(t *testing.T) {
+	dir, e := ioutil.TempDir("", "test-whisper-common")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := dir + "/append.log"
+	for _, s := range []string{"a", "b"} {
+		if e := Write2File([]byte(s), fn, os.O_APPEND); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if bb, _ := ioutil.ReadFile(fn); string(bb) != "ab" {
+		t.Fatal("append error", string(bb))
+	}
+}
+
 func TestCmpInt(t *testing.T) {
 	Log.Info("", CmpInt(1, 2))
 	Log.Info("", CmpInt(2, 2))
@@ -125,3 +184,21 @@ func TestTrace(t *testing.T) {
 
 	time.Sleep(1e9 * 2)
 }
+
+func TestMimeContentType(t *testing.T) {
+	if GetContentType(MIME_PNG) != "image/png" {
+		t.Fatal("content type of png error")
+	}
+	if GetContentType(0) != "application/octet-stream" {
+		t.Fatal("content type of unknown mime error")
+	}
+	if GetMimeByContentType("image/jpeg; charset=binary") != MIME_JPG {
+		t.Fatal("mime of content type error")
+	}
+	if GetMimeByContentType("text/plain") != 0 {
+		t.Fatal("mime of unknown content type error")
+	}
+	if GetMimeByName(".GIF") != MIME_GIF || GetMimeByName("txt") != 0 {
+		t.Fatal("mime of name error")
+	}
+}
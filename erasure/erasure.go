@@ -0,0 +1,192 @@
+package erasure
+
+import (
+	"errors"
+	"strconv"
+)
+
+// Reed-Solomon 纠删码
+//
+// 数据切分为 DataShards 个等长的数据分片，计算出 ParityShards 个校验分片，任意 DataShards 个分片即可恢复全部数据。
+// 编码矩阵由范德蒙矩阵变换得到，上方 DataShards 行为单位矩阵，数据分片保持原样，任意 DataShards 行可逆。
+
+// fewer than DataShards shards are present
+var ErrTooFewShards = errors.New("erasure too few shards to reconstruct")
+
+type Codec struct {
+	DataShards   int
+	ParityShards int
+	matrix       matrix // (DataShards+ParityShards) x DataShards
+}
+
+func New(dataShards, parityShards int) (*Codec, error) {
+	if dataShards <= 0 || parityShards <= 0 || dataShards+parityShards > 256 {
+		return nil, errors.New("erasure invalid shards " + strconv.Itoa(dataShards) + "+" + strconv.Itoa(parityShards))
+	}
+
+	n := dataShards + parityShards
+	v := vandermonde(n, dataShards)
+	top := make([]int, dataShards)
+	for i := range top {
+		top[i] = i
+	}
+	inv, e := v.subRows(top).invert()
+	if e != nil {
+		return nil, e
+	}
+	return &Codec{DataShards: dataShards, ParityShards: parityShards, matrix: v.mul(inv)}, nil
+}
+
+func (c *Codec) Shards() int {
+	return c.DataShards + c.ParityShards
+}
+
+// 切分为数据分片，末尾补 0 ，并分配校验分片，需要再调用 Encode
+func (c *Codec) Split(data []byte) [][]byte {
+	size := (len(data) + c.DataShards - 1) / c.DataShards
+	if size == 0 {
+		size = 1
+	}
+
+	buf := make([]byte, size*c.Shards())
+	copy(buf, data)
+	shards := make([][]byte, c.Shards())
+	for i := range shards {
+		shards[i] = buf[i*size : (i+1)*size : (i+1)*size]
+	}
+	return shards
+}
+
+// 由数据分片计算校验分片
+func (c *Codec) Encode(shards [][]byte) error {
+	size, e := c.checkShards(shards, false)
+	if e != nil {
+		return e
+	}
+
+	for i := c.DataShards; i < c.Shards(); i++ {
+		parity := shards[i]
+		for j := range parity {
+			parity[j] = 0
+		}
+		for j := 0; j < c.DataShards; j++ {
+			gfMulAdd(c.matrix[i][j], shards[j][:size], parity)
+		}
+	}
+	return nil
+}
+
+// 恢复缺失(nil 或长度为 0)的分片，至少需要 DataShards 个分片
+func (c *Codec) Reconstruct(shards [][]byte) error {
+	return c.reconstruct(shards, false)
+}
+
+// 只恢复数据分片，用于读取
+func (c *Codec) ReconstructData(shards [][]byte) error {
+	return c.reconstruct(shards, true)
+}
+
+func (c *Codec) reconstruct(shards [][]byte, isDataOnly bool) error {
+	size, e := c.checkShards(shards, true)
+	if e != nil {
+		return e
+	}
+
+	var present []int
+	isDataMissing := false
+	for i, shard := range shards {
+		if len(shard) > 0 {
+			present = append(present, i)
+		} else if i < c.DataShards {
+			isDataMissing = true
+		}
+	}
+	if len(present) == c.Shards() {
+		return nil
+	}
+	if len(present) < c.DataShards {
+		return ErrTooFewShards
+	}
+
+	// 用任意 DataShards 个分片对应的行求逆，恢复数据分片
+	if isDataMissing {
+		present = present[:c.DataShards]
+		inv, e := c.matrix.subRows(present).invert()
+		if e != nil {
+			return e
+		}
+
+		for i := 0; i < c.DataShards; i++ {
+			if len(shards[i]) > 0 {
+				continue
+			}
+			shard := make([]byte, size)
+			for j, row := range present {
+				gfMulAdd(inv[i][j], shards[row], shard)
+			}
+			shards[i] = shard
+		}
+	}
+
+	if isDataOnly {
+		return nil
+	}
+
+	// 重新计算缺失的校验分片
+	for i := c.DataShards; i < c.Shards(); i++ {
+		if len(shards[i]) > 0 {
+			continue
+		}
+		shard := make([]byte, size)
+		for j := 0; j < c.DataShards; j++ {
+			gfMulAdd(c.matrix[i][j], shards[j], shard)
+		}
+		shards[i] = shard
+	}
+	return nil
+}
+
+// 拼接数据分片，取前 size 个字节
+func (c *Codec) Join(shards [][]byte, size int) ([]byte, error) {
+	if len(shards) < c.DataShards {
+		return nil, ErrTooFewShards
+	}
+
+	r := make([]byte, 0, size)
+	for _, shard := range shards[:c.DataShards] {
+		if len(shard) == 0 {
+			return nil, ErrTooFewShards
+		}
+		if left := size - len(r); len(shard) >= left {
+			return append(r, shard[:left]...), nil
+		}
+		r = append(r, shard...)
+	}
+	return nil, errors.New("erasure join size out of shards " + strconv.Itoa(size))
+}
+
+// 分片数正确且长度相同，返回分片长度，allowMissing 时跳过缺失的分片
+func (c *Codec) checkShards(shards [][]byte, allowMissing bool) (int, error) {
+	if len(shards) != c.Shards() {
+		return 0, errors.New("erasure shards number error " + strconv.Itoa(len(shards)))
+	}
+
+	size := 0
+	for _, shard := range shards {
+		if len(shard) == 0 {
+			if !allowMissing {
+				return 0, errors.New("erasure shard missing")
+			}
+			continue
+		}
+		if size == 0 {
+			size = len(shard)
+		} else if len(shard) != size {
+			return 0, errors.New("erasure shard size mismatch")
+		}
+	}
+	if size == 0 {
+		return 0, ErrTooFewShards
+	}
+	return size, nil
+}
@@ -0,0 +1,111 @@
+package erasure
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestGalois(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			if gfDiv(gfMul(byte(a), byte(b)), byte(b)) != byte(a) {
+				t.Fatal("gf mul/div error", a, b)
+			}
+		}
+	}
+}
+
+// 任意丢失 ParityShards 个分片都可以恢复
+func TestCodecReconstruct(t *testing.T) {
+	data := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	for _, km := range [][2]int{{1, 1}, {4, 2}, {6, 3}, {10, 4}} {
+		c, e := New(km[0], km[1])
+		if e != nil {
+			t.Fatal(e)
+		}
+		shards := c.Split(data)
+		if e := c.Encode(shards); e != nil {
+			t.Fatal(e)
+		}
+
+		n := c.Shards()
+		for mask := 0; mask < 1<<uint(n); mask++ {
+			missing := 0
+			for i := 0; i < n; i++ {
+				if mask&(1<<uint(i)) != 0 {
+					missing++
+				}
+			}
+			if missing > c.ParityShards {
+				continue
+			}
+
+			copies := make([][]byte, n)
+			for i := range shards {
+				if mask&(1<<uint(i)) == 0 {
+					copies[i] = append([]byte(nil), shards[i]...)
+				}
+			}
+			if e := c.Reconstruct(copies); e != nil {
+				t.Fatal(km, mask, e)
+			}
+			for i := range shards {
+				if !bytes.Equal(copies[i], shards[i]) {
+					t.Fatal("reconstruct shard error", km, mask, i)
+				}
+			}
+			dataOnly := make([][]byte, n)
+			for i := range copies {
+				if mask&(1<<uint(i)) == 0 {
+					dataOnly[i] = shards[i]
+				}
+			}
+			if e := c.ReconstructData(dataOnly); e != nil {
+				t.Fatal(km, mask, e)
+			}
+			body, e := c.Join(dataOnly, len(data))
+			if e != nil || !bytes.Equal(body, data) {
+				t.Fatal("join error", km, mask, e)
+			}
+		}
+	}
+}
+
+func TestCodecErrors(t *testing.T) {
+	if _, e := New(0, 1); e == nil {
+		t.Fatal("zero data shards should fail")
+	}
+	if _, e := New(200, 57); e == nil {
+		t.Fatal("too many shards should fail")
+	}
+
+	c, _ := New(3, 2)
+	shards := c.Split([]byte("hello erasure"))
+	if len(shards) != 5 || len(shards[0]) != 5 {
+		t.Fatal("split error", len(shards), len(shards[0]))
+	}
+	c.Encode(shards)
+
+	shards[0], shards[1], shards[4] = nil, nil, nil
+	if e := c.Reconstruct(shards); e != ErrTooFewShards {
+		t.Fatal("too few shards error", e)
+	}
+
+	shards = c.Split([]byte("hello erasure"))
+	shards[4] = shards[4][:2]
+	if e := c.Encode(shards); e == nil {
+		t.Fatal("shard size mismatch should fail")
+	}
+
+	// empty data
+	shards = c.Split(nil)
+	if e := c.Encode(shards); e != nil {
+		t.Fatal(e)
+	}
+	if body, e := c.Join(shards, 0); e != nil || len(body) != 0 {
+		t.Fatal("join empty error", body, e)
+	}
+}
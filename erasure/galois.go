@@ -0,0 +1,62 @@
+package erasure
+
+// GF(2^8) 运算，本原多项式 x^8 + x^4 + x^3 + x^2 + 1 (0x11d)
+
+const gfPoly = 0x11d
+
+var (
+	gfExp [510]byte // gfExp[i] = 2^i, doubled to skip the mod 255
+	gfLog [256]int
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfExp[i+255] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= gfPoly
+		}
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+gfLog[b]]
+}
+
+// b must not be 0
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+255-gfLog[b]]
+}
+
+// a^n
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(gfLog[a]*n)%255]
+}
+
+// dst ^= c * src
+func gfMulAdd(c byte, src, dst []byte) {
+	if c == 0 {
+		return
+	}
+	logC := gfLog[c]
+	for i, s := range src {
+		if s != 0 {
+			dst[i] ^= gfExp[logC+gfLog[s]]
+		}
+	}
+}
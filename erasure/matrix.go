@@ -0,0 +1,98 @@
+package erasure
+
+import "errors"
+
+// GF(2^8) 上的矩阵
+type matrix [][]byte
+
+func newMatrix(rows, cols int) matrix {
+	m := make(matrix, rows)
+	for r := range m {
+		m[r] = make([]byte, cols)
+	}
+	return m
+}
+
+func identityMatrix(n int) matrix {
+	m := newMatrix(n, n)
+	for i := range m {
+		m[i][i] = 1
+	}
+	return m
+}
+
+// m[r][c] = r^c ，任意 cols 行线性无关
+func vandermonde(rows, cols int) matrix {
+	m := newMatrix(rows, cols)
+	for r := range m {
+		for c := range m[r] {
+			m[r][c] = gfPow(byte(r), c)
+		}
+	}
+	return m
+}
+
+func (m matrix) mul(o matrix) matrix {
+	r := newMatrix(len(m), len(o[0]))
+	for i := range m {
+		for j := range o[0] {
+			var v byte
+			for k := range o {
+				v ^= gfMul(m[i][k], o[k][j])
+			}
+			r[i][j] = v
+		}
+	}
+	return r
+}
+
+// 取出 rows 指定的行
+func (m matrix) subRows(rows []int) matrix {
+	r := make(matrix, len(rows))
+	for i, row := range rows {
+		r[i] = append([]byte(nil), m[row]...)
+	}
+	return r
+}
+
+// 高斯-约旦消元求逆
+func (m matrix) invert() (matrix, error) {
+	n := len(m)
+	work := newMatrix(n, 2*n)
+	for i := range m {
+		copy(work[i], m[i])
+		work[i][n+i] = 1
+	}
+
+	for c := 0; c < n; c++ {
+		// 找到主元
+		if work[c][c] == 0 {
+			for r := c + 1; r < n; r++ {
+				if work[r][c] != 0 {
+					work[c], work[r] = work[r], work[c]
+					break
+				}
+			}
+		}
+		if work[c][c] == 0 {
+			return nil, errors.New("erasure matrix is singular")
+		}
+
+		if p := work[c][c]; p != 1 {
+			for j := range work[c] {
+				work[c][j] = gfDiv(work[c][j], p)
+			}
+		}
+		for r := 0; r < n; r++ {
+			if r != c && work[r][c] != 0 {
+				gfMulAdd(work[r][c], work[c], work[r])
+			}
+		}
+	}
+
+	r := newMatrix(n, n)
+	for i := range r {
+		copy(r[i], work[i][n:])
+	}
+	return r, nil
+}
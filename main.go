@@ -2,7 +2,10 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"io/ioutil"
+	"os"
+	"time"
 
 	"github.com/blastbao/whisper/agent"
 	"github.com/blastbao/whisper/center"
@@ -37,6 +40,94 @@ func closeMediator(mediatorHost string) {
 	cl.Close()
 }
 
+// 通知 mediator 开始块压缩
+func compactMediator(mediatorHost string) {
+	cl := &mediator.NetClient{}
+	if e := cl.Start(mediatorHost); e != nil {
+		common.Log.Error("client start error", e)
+		return
+	}
+	cl.Send(mediator.Pack{Command: mediator.CMD_COMPACT})
+	cl.Close()
+}
+
+// 通知 mediator 在负载最小的 center 分组中创建索引
+func newIndexMediator(mediatorHost string) {
+	cl := &mediator.NetClient{}
+	if e := cl.Start(mediatorHost); e != nil {
+		common.Log.Error("client start error", e)
+		return
+	}
+	cl.Send(mediator.Pack{Command: mediator.CMD_NEW_INDEX})
+	cl.Close()
+}
+
+// 通知 mediator 修改块状态，status 为 ok / readonly / retired
+func blockStatusMediator(mediatorHost string, blockId int, status string) bool {
+	statuses := map[string]int{
+		"ok":       mediator.BLOCK_STATUS_OK,
+		"readonly": mediator.BLOCK_STATUS_READONLY,
+		"retired":  mediator.BLOCK_STATUS_RETIRED,
+	}
+	s, ok := statuses[status]
+	if !ok {
+		common.Log.Error("block status should be ok, readonly or retired", status)
+		return false
+	}
+	body, e := common.Enc(&mediator.BlockStatusOp{BlockId: blockId, Status: s})
+	if e != nil {
+		common.Log.Error("block status encode error", e)
+		return false
+	}
+
+	// mediator 以同一命令回复修改结果
+	chReply := make(chan mediator.Pack, 1)
+	cl := &mediator.NetClient{}
+	cl.AddHandler(mediator.CMD_BLOCK_STATUS, func(p mediator.Pack) mediator.Pack {
+		select {
+		case chReply <- p:
+		default:
+		}
+		return mediator.PACK_NO_RETURN
+	})
+	if e := cl.Start(mediatorHost); e != nil {
+		common.Log.Error("client start error", e)
+		return false
+	}
+	defer cl.Close()
+
+	if e := cl.Send(mediator.Pack{Command: mediator.CMD_BLOCK_STATUS, Body: body}); e != nil {
+		common.Log.Error("block status send error", e)
+		return false
+	}
+	select {
+	case r := <-chReply:
+		if !r.Flag {
+			common.Log.Error("block status error", blockId, r.Msg)
+		}
+		return r.Flag
+	case <-time.After(10 * time.Second):
+		common.Log.Error("block status reply timeout", blockId)
+		return false
+	}
+}
+
+// 检查索引目录，不启动服务，有缺失或损坏时返回 false
+func verifyIndex(baseDir string) bool {
+	reports, e := center.VerifyIndexes(baseDir)
+	if e != nil {
+		common.Log.Error("verify index error", e)
+		return false
+	}
+
+	isOk := true
+	for _, r := range reports {
+		fmt.Print(r.String())
+		isOk = isOk && r.IsOk()
+	}
+	return isOk
+}
+
 func closeCenter(rpcHost string) {
 	cl := gorpc.NewTCPClient(rpcHost)
 	cl.Start()
@@ -45,6 +136,28 @@ func closeCenter(rpcHost string) {
 	cl.Call(mediator.Pack{Command: mediator.CMD_CLOSE})
 }
 
+// 将旧版本遗留的 put back 日志重新提交给 center
+func replayPutback(rpcHost string) bool {
+	cl := gorpc.NewTCPClient(rpcHost)
+	cl.Start()
+	defer cl.Stop()
+
+	fn := common.GetUserHomeFile(center.PUT_BACK_LOG_FILE)
+	n, e := center.ReplayPutbackLog(fn, func(p center.PackRecord) (center.PackRecord, error) {
+		resp, e := cl.Call(p)
+		if e != nil {
+			return center.PackRecord{}, e
+		}
+		return resp.(center.PackRecord), nil
+	})
+	if e != nil {
+		common.Log.Error("replay put back log error", fn, n, e)
+		return false
+	}
+	common.Log.Info("replay put back log done", fn, n)
+	return true
+}
+
 func closeAgent(rpcHost string) {
 	cl := gorpc.NewTCPClient(rpcHost)
 	cl.Start()
@@ -61,11 +174,21 @@ func main() {
 	// 配置文件
 	configFile := flag.String("configFile", "", "config file path")
 	// 命令
-	command := flag.String("command", "", "command(close or ...)")
+	command := flag.String("command", "", "command(close, mediatorControl, compact, newIndex, blockStatus, verifyIndex, replayPutback)")
+	// 关闭时的目标地址
+	rpcHost := flag.String("rpcHost", "", "rpc host")
+	httpHost := flag.String("httpHost", "", "http host")
+	// 修改块状态
+	blockId := flag.Int("blockId", 0, "block id for blockStatus")
+	blockStatus := flag.String("blockStatus", "", "block status for blockStatus(ok, readonly, retired)")
+	flag.Parse()
+
 	// 是否需要关闭
 	isCloseCommand := "close" == *command
 	//
 	isMediatorControl := "mediatorControl" == *command
+	// 块压缩
+	isCompactCommand := "compact" == *command
 
 	if *configFile != "" {
 		common.ConfFilePath = *configFile
@@ -74,6 +197,8 @@ func main() {
 	// 读取配置文件
 	c := common.GetConf()
 
+	// 升级期间连接旧版本 mediator 时使用旧的 Pack 格式
+	mediator.PackLegacyFraming = c.MediatorLegacyPack
 
 	// Mediator
 	if common.ROLE_MEDIATOR == c.Role {
@@ -86,6 +211,20 @@ func main() {
 		} else if isMediatorControl {
 			controlMediator(c.MediatorHost, c.MediatorControlBodyFile)
 			return
+		// 块压缩
+		} else if isCompactCommand {
+			compactMediator(c.MediatorHost)
+			return
+		// 创建索引
+		} else if "newIndex" == *command {
+			newIndexMediator(c.MediatorHost)
+			return
+		// 块只读/退役
+		} else if "blockStatus" == *command {
+			if !blockStatusMediator(c.MediatorHost, *blockId, *blockStatus) {
+				os.Exit(1)
+			}
+			return
 		}
 
 		// 其它 Command ，则启动 Mediator ，监听在 LOCALHOST:SERVER_PORT_MEDIATOR 地址上，数据目录为 c.BaseDir 。
@@ -103,11 +242,32 @@ func main() {
 
 		// 关闭 Center Svr
 		if isCloseCommand {
-			rpcHost := flag.String("rpcHost", "", "rpc host")
 			closeCenter(*rpcHost)
 			return
 		}
 
+		// 重放 put back 日志
+		if "replayPutback" == *command {
+			if !replayPutback(*rpcHost) {
+				os.Exit(1)
+			}
+			return
+		}
+
+		// 检查索引目录
+		if "verifyIndex" == *command {
+			if !verifyIndex(c.BaseDir) {
+				os.Exit(1)
+			}
+			return
+		}
+
+		// 索引日志 fsync 策略
+		if e := center.SetLogSyncPolicy(c.IndexLogSync); e != nil {
+			common.Log.Error("center config error", e)
+			return
+		}
+
 		// 创建 Center ，并从 c.BaseDir 加载 oid => record 的索引。
 		cc := &center.Center{}
 		e := cc.Load(c.BaseDir)
@@ -119,6 +279,8 @@ func main() {
 		// 启动 CenterServer，监听在 LOCALHOST:SERVER_PORT_CENTER 地址上
 		s := &center.CenterServer{}
 		s.Center = cc
+		s.Group = c.CenterGroup
+		s.Standalone = c.CenterStandalone
 		center.AddHandler2CenterServer(s)
 		s.Start(c.MediatorHost, common.LOCALHOST)
 
@@ -128,20 +290,24 @@ func main() {
 
 		// 关闭 Agent
 		if isCloseCommand {
-			rpcHost := flag.String("rpcHost", "", "rpc host")
 			closeAgent(*rpcHost)
 			return
 		}
 
-		// 启动 node server
+		// 启动 node server ，块注册表默认保存在 BaseDir
 		s := &agent.NodeServer{}
+		s.DataDirs = c.DataDirs
+		if len(s.DataDirs) == 0 && c.BaseDir != "" {
+			s.DataDirs = []string{c.BaseDir}
+		}
+		s.Zone = c.Zone
+		s.Rack = c.Rack
 		s.Start(c.MediatorHost, common.LOCALHOST)
 
 	// Client
 	} else if common.ROLE_CLIENT == c.Role {
 
 		if isCloseCommand {
-			httpHost := flag.String("httpHost", "", "http host")
 			closeClient(*httpHost)
 			return
 		}
@@ -149,6 +315,11 @@ func main() {
 		// 创建 Client ，建立同 mediator server 建立长连接
 		cl := &client.Client{}
 		cl.Start(c.MediatorHost)
+
+		// 启动 http 服务，阻塞
+		if e := cl.Listen(); e != nil {
+			common.Log.Error("client http listen failed", e)
+		}
 	} else {
 		common.Log.Error("config file error, role required")
 	}
@@ -0,0 +1,271 @@
+package mediator
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/blastbao/whisper/common"
+)
+
+// 块分配
+//
+// (1) agent 定时上报数据目录的可用空间(CMD_DISK_REPORT)
+// (2) agent 可写块的剩余空间低于 BlockHeadroomBytes 时，mediator 在可用空间最多的目录创建块，状态为 BLOCK_STATUS_ALLOCATING ，
+//     向 agent 发送 CMD_ALLOC_BLOCK ；agent 还有未确认的块时不再创建，而是重发
+// (3) agent 预分配块文件后回复 CMD_ALLOC_BLOCK_DONE ，块变为可写，持久化并刷新 client/agent 的块列表，失败时删除块
+// (4) CMD_BLOCK_STATUS 将块设为只读或退役，只读的块可恢复可写，退役的块不再变化
+
+// keep at least this many writable free bytes on each agent
+var BlockHeadroomBytes int64 = 4 * int64(defaultBlockSize)
+
+// disk bytes never allocated to blocks
+var DiskReserveBytes int64 = 1024 * 1024 * 1024
+
+// 数据目录的容量
+type DiskInfo struct {
+	Dir   string
+	Free  int64
+	Total int64
+}
+
+// agent 的磁盘，agent -> mediator
+type DiskReport struct {
+	Addr  string // block addr of the agent
+	Disks []DiskInfo
+}
+
+// 预分配结果，agent -> mediator
+type BlockAllocResult struct {
+	BlockId int
+	Flag    bool
+	Msg     string
+}
+
+// 修改块状态，control -> mediator
+type BlockStatusOp struct {
+	BlockId int
+	Status  int
+}
+
+func (m *Mediator) addBlockAllocHandler() {
+
+	// agent 上报磁盘，按需创建块
+	m.Server.AddHandler(
+		CMD_DISK_REPORT,
+		func(p Pack, conn net.Conn) Pack {
+			var report DiskReport
+			if e := common.DecCompat(p.Body, &report); e != nil {
+				common.Log.Error("mediator disk report decode error", e)
+				return PACK_NO_RETURN
+			}
+
+			m.mutex.Lock()
+			if m.disks == nil {
+				m.disks = make(map[string]DiskReport)
+			}
+			m.disks[report.Addr] = report
+			m.mutex.Unlock()
+
+			m.AllocateBlocks(report.Addr)
+			return PACK_NO_RETURN
+		},
+	)
+
+	// agent 预分配完成
+	m.Server.AddHandler(
+		CMD_ALLOC_BLOCK_DONE,
+		func(p Pack, conn net.Conn) Pack {
+			var r BlockAllocResult
+			if e := common.DecCompat(p.Body, &r); e != nil {
+				common.Log.Error("mediator block alloc result decode error", e)
+				return PACK_NO_RETURN
+			}
+
+			m.finishAlloc(r)
+			return PACK_NO_RETURN
+		},
+	)
+
+	// 修改块状态
+	m.Server.AddHandler(
+		CMD_BLOCK_STATUS,
+		func(p Pack, conn net.Conn) Pack {
+			r := Pack{Command: CMD_BLOCK_STATUS}
+
+			var op BlockStatusOp
+			e := common.Dec(p.Body, &op)
+			if e == nil {
+				e = m.SetBlockStatus(op.BlockId, op.Status)
+			}
+			if e != nil {
+				r.Msg = e.Error()
+				return r
+			}
+			r.Flag = true
+			return r
+		},
+	)
+}
+
+// 为 agent 创建块并通知预分配，返回本次需要 agent 预分配的块
+func (m *Mediator) AllocateBlocks(addr string) []Block {
+	blocks, isCreated := m.planBlocks(addr)
+	if isCreated {
+		if e := m.Persist(); e != nil {
+			common.Log.Error("mediator alloc block persist error", e)
+		}
+	}
+
+	for _, block := range blocks {
+		body, e := common.Enc(&block)
+		if e != nil {
+			common.Log.Error("mediator alloc block encode error", e)
+			continue
+		}
+		common.Log.Info("mediator alloc block", block.BlockId, block.Addr, block.Dir, block.Size)
+		m.Server.Notify(addr, Pack{Command: CMD_ALLOC_BLOCK, Body: body})
+	}
+	return blocks
+}
+
+// 未确认的块需要重发，否则剩余空间不足时在可用空间最多的目录创建块
+func (m *Mediator) planBlocks(addr string) (blocks []Block, isCreated bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	report, ok := m.disks[addr]
+	if !ok {
+		return
+	}
+
+	var free int64
+	m.eachBlock(func(block Block) error {
+		if block.Addr != addr {
+			return nil
+		}
+		if block.Status == BLOCK_STATUS_ALLOCATING {
+			blocks = append(blocks, block)
+		} else if block.IsWritable() && block.Size > block.End {
+			free += int64(block.Size - block.End)
+		}
+		return nil
+	})
+	if len(blocks) > 0 {
+		return
+	}
+
+	avail := make(map[string]int64)
+	for _, disk := range report.Disks {
+		avail[disk.Dir] = disk.Free - DiskReserveBytes
+	}
+	size := int64(defaultBlockSize)
+	for free < BlockHeadroomBytes {
+		dir := mostAvailDir(avail)
+		if dir == "" || avail[dir] < size {
+			common.Log.Warning("mediator alloc block no disk space", addr, free)
+			break
+		}
+
+		blockId, e := m.nextBlockId()
+		if e != nil {
+			common.Log.Error("mediator alloc block id error", e)
+			break
+		}
+		block := Block{BlockId: blockId, Addr: addr, Dir: dir, Size: defaultBlockSize, Status: BLOCK_STATUS_ALLOCATING}
+		m.labelBlock(&block)
+		m.BlockTree.Set(blockId, block)
+		blocks = append(blocks, block)
+		isCreated = true
+
+		avail[dir] -= size
+		free += size
+	}
+	return
+}
+
+// 可用空间最多的目录，相同时按名称
+func mostAvailDir(avail map[string]int64) string {
+	var dirs []string
+	for dir := range avail {
+		dirs = append(dirs, dir)
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		if avail[dirs[i]] != avail[dirs[j]] {
+			return avail[dirs[i]] > avail[dirs[j]]
+		}
+		return dirs[i] < dirs[j]
+	})
+	if len(dirs) == 0 {
+		return ""
+	}
+	return dirs[0]
+}
+
+func (m *Mediator) finishAlloc(r BlockAllocResult) {
+	m.mutex.Lock()
+	v, ok := m.BlockTree.Get(r.BlockId)
+	if !ok || v.(Block).Status != BLOCK_STATUS_ALLOCATING {
+		m.mutex.Unlock()
+		common.Log.Warning("mediator alloc block done but not allocating", r.BlockId)
+		return
+	}
+
+	block := v.(Block)
+	if r.Flag {
+		block.Status = BLOCK_STATUS_OK
+		m.BlockTree.Set(r.BlockId, block)
+		common.Log.Info("mediator alloc block done", r.BlockId, block.Addr, block.Dir)
+	} else {
+		m.BlockTree.Delete(r.BlockId)
+		common.Log.Error("mediator alloc block fail", r.BlockId, block.Addr, r.Msg)
+	}
+	m.mutex.Unlock()
+
+	if e := m.Persist(); e != nil {
+		common.Log.Error("mediator alloc block persist error", e)
+	}
+	if r.Flag {
+		m.RefreshBlocks()
+	}
+}
+
+// 设为只读、退役或恢复可写
+func (m *Mediator) SetBlockStatus(blockId, status int) error {
+	m.mutex.Lock()
+	v, ok := m.BlockTree.Get(blockId)
+	if !ok {
+		m.mutex.Unlock()
+		return errors.New("mediator block not found - " + strconv.Itoa(blockId))
+	}
+
+	block := v.(Block)
+	switch {
+	case block.Status == status:
+		m.mutex.Unlock()
+		return nil
+	case block.Status == BLOCK_STATUS_ALLOCATING || block.Status == BLOCK_STATUS_RETIRED:
+		m.mutex.Unlock()
+		return errors.New("mediator block status can not change - " + strconv.Itoa(block.Status))
+	case status != BLOCK_STATUS_OK && status != BLOCK_STATUS_READONLY && status != BLOCK_STATUS_RETIRED:
+		m.mutex.Unlock()
+		return errors.New("mediator block status invalid - " + strconv.Itoa(status))
+	}
+
+	common.Log.Info("mediator block status changed", blockId, block.Status, status)
+	block.Status = status
+	m.BlockTree.Set(blockId, block)
+	m.mutex.Unlock()
+
+	if e := m.Persist(); e != nil {
+		return e
+	}
+	m.RefreshBlocks()
+
+	// 可写空间减少，补充新块
+	if status != BLOCK_STATUS_OK {
+		m.AllocateBlocks(block.Addr)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package mediator
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/blastbao/whisper/common"
+	"github.com/cznic/b"
+)
+
+func newTestAllocMediator(t *testing.T) *Mediator {
+	dir, e := ioutil.TempDir("", "whisper-alloc")
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	m := &Mediator{Dir: dir, BlockTree: b.TreeNew(common.CmpInt), mutex: new(sync.Mutex), Server: &NetServer{}}
+	m.compacting = make(map[int]int)
+	m.disks = make(map[string]DiskReport)
+	m.Znodes = NewZnodeStore(m.getZnodeFile(), nil)
+	m.Server.Values = m.Znodes
+	return m
+}
+
+// 剩余空间不足时在可用空间最多的目录创建块，确认后可写，未确认时重发
+func TestMediatorAllocateBlocks(t *testing.T) {
+	oldHeadroom, oldReserve := BlockHeadroomBytes, DiskReserveBytes
+	defer func() { BlockHeadroomBytes, DiskReserveBytes = oldHeadroom, oldReserve }()
+	size := int64(defaultBlockSize)
+	BlockHeadroomBytes = 2 * size
+	DiskReserveBytes = 0
+
+	m := newTestAllocMediator(t)
+	defer os.RemoveAll(m.Dir)
+
+	// existing block half used
+	m.BlockTree.Set(1, Block{BlockId: 1, Addr: "a1", Dir: "/d1", Size: defaultBlockSize, End: defaultBlockSize / 2})
+	m.disks["a1"] = DiskReport{Addr: "a1", Disks: []DiskInfo{{Dir: "/d1", Free: size}, {Dir: "/d2", Free: 3 * size}}}
+
+	blocks := m.AllocateBlocks("a1")
+	if len(blocks) != 2 || blocks[0].BlockId != 2 || blocks[0].Dir != "/d2" || blocks[1].Dir != "/d2" || blocks[0].Status != BLOCK_STATUS_ALLOCATING {
+		t.Fatal("allocated blocks error", blocks)
+	}
+
+	// not acknowledged, sent again
+	if again := m.AllocateBlocks("a1"); len(again) != 2 || again[0].BlockId != 2 {
+		t.Fatal("allocating blocks should be sent again", again)
+	}
+
+	m.finishAlloc(BlockAllocResult{BlockId: 2, Flag: true})
+	m.finishAlloc(BlockAllocResult{BlockId: 3, Msg: "disk error"})
+	if v, _ := m.BlockTree.Get(2); !v.(Block).IsWritable() {
+		t.Fatal("acknowledged block should be writable", v)
+	}
+	if _, ok := m.BlockTree.Get(3); ok {
+		t.Fatal("failed block should be removed")
+	}
+
+	// 1.5 blocks free, one more from the disk with more space
+	m.disks["a1"] = DiskReport{Addr: "a1", Disks: []DiskInfo{{Dir: "/d1", Free: size}, {Dir: "/d2", Free: size / 2}}}
+	if blocks = m.AllocateBlocks("a1"); len(blocks) != 1 || blocks[0].Dir != "/d1" {
+		t.Fatal("allocated blocks error", blocks)
+	}
+	m.finishAlloc(BlockAllocResult{BlockId: blocks[0].BlockId, Flag: true})
+
+	// no disk space
+	m.disks["a1"] = DiskReport{Addr: "a1"}
+	if e := m.SetBlockStatus(2, BLOCK_STATUS_READONLY); e != nil {
+		t.Fatal(e)
+	}
+	if blocks = m.AllocateBlocks("a1"); len(blocks) != 0 {
+		t.Fatal("no block should be allocated without disk space", blocks)
+	}
+	if blocks = m.AllocateBlocks("unknown"); len(blocks) != 0 {
+		t.Fatal("unknown agent should not be allocated", blocks)
+	}
+}
+
+func TestMediatorBlockStatus(t *testing.T) {
+	m := newTestAllocMediator(t)
+	defer os.RemoveAll(m.Dir)
+
+	m.BlockTree.Set(1, Block{BlockId: 1, Addr: "a1", Dir: "/d1", Size: 100, End: 10})
+	m.BlockTree.Set(2, Block{BlockId: 2, Addr: "a1", Dir: "/d1", Size: 100, Status: BLOCK_STATUS_ALLOCATING})
+
+	if e := m.SetBlockStatus(1, BLOCK_STATUS_READONLY); e != nil {
+		t.Fatal(e)
+	}
+	if e := m.SetBlockStatus(1, BLOCK_STATUS_OK); e != nil {
+		t.Fatal("readonly block should become writable again", e)
+	}
+	if e := m.SetBlockStatus(1, BLOCK_STATUS_RETIRED); e != nil {
+		t.Fatal(e)
+	}
+	if e := m.SetBlockStatus(1, BLOCK_STATUS_OK); e == nil {
+		t.Fatal("retired block should not change")
+	}
+	if e := m.SetBlockStatus(2, BLOCK_STATUS_READONLY); e == nil {
+		t.Fatal("allocating block should not change")
+	}
+	if e := m.SetBlockStatus(9, BLOCK_STATUS_READONLY); e == nil {
+		t.Fatal("unknown block should fail")
+	}
+
+	// lifecycle survives restart
+	m2 := &Mediator{Dir: m.Dir, BlockTree: b.TreeNew(common.CmpInt), mutex: new(sync.Mutex)}
+	if e := m2.Load(); e != nil {
+		t.Fatal(e)
+	}
+	if v, _ := m2.BlockTree.Get(1); v.(Block).Status != BLOCK_STATUS_RETIRED || v.(Block).End != 10 {
+		t.Fatal("retired status not loaded", v)
+	}
+	if v, _ := m2.BlockTree.Get(2); v.(Block).Status != BLOCK_STATUS_ALLOCATING {
+		t.Fatal("allocating status not loaded", v)
+	}
+}
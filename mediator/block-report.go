@@ -0,0 +1,69 @@
+package mediator
+
+import (
+	"net"
+
+	"github.com/blastbao/whisper/common"
+)
+
+// 块位置上报
+//
+// agent 以块文件为准维护 End ，并统计每个块的读取频率，定时发送 CMD_BLOCK_REPORT ，mediator 用上报的值更新块，
+// 有变化时持久化并刷新 client/agent 的块列表。压缩中的块由压缩结果更新，忽略上报。
+
+// 块写入位置及读取频率，agent -> mediator
+type BlockEnd struct {
+	BlockId  int
+	End      int
+	VisitAvg int // reads per minute since the last report
+}
+
+func (m *Mediator) addBlockReportHandler() {
+	m.Server.AddHandler(
+		CMD_BLOCK_REPORT,
+		func(p Pack, conn net.Conn) Pack {
+			var ends []BlockEnd
+			if e := common.Dec(p.Body, &ends); e != nil {
+				common.Log.Error("mediator block report decode error", e)
+				return PACK_NO_RETURN
+			}
+
+			if m.UpdateBlockEnds(ends) > 0 {
+				if e := m.Persist(); e != nil {
+					common.Log.Error("mediator block report persist error", e)
+				}
+				m.RefreshBlocks()
+			}
+			return PACK_NO_RETURN
+		},
+	)
+}
+
+// 更新块的 End ，返回有变化的块数
+func (m *Mediator) UpdateBlockEnds(ends []BlockEnd) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	n := 0
+	for _, end := range ends {
+		if _, ok := m.compacting[end.BlockId]; ok {
+			continue
+		}
+		v, ok := m.BlockTree.Get(end.BlockId)
+		if !ok {
+			common.Log.Warning("mediator block report unknown block", end.BlockId)
+			continue
+		}
+
+		block := v.(Block)
+		if block.End == end.End && block.VisitAvg == end.VisitAvg {
+			continue
+		}
+		common.Log.Debug("mediator block end reported", block.BlockId, block.End, end.End, end.VisitAvg)
+		block.End = end.End
+		block.VisitAvg = end.VisitAvg
+		m.BlockTree.Set(block.BlockId, block)
+		n++
+	}
+	return n
+}
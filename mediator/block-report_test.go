@@ -0,0 +1,35 @@
+package mediator
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/blastbao/whisper/common"
+	"github.com/cznic/b"
+)
+
+func TestMediatorUpdateBlockEnds(t *testing.T) {
+	m := &Mediator{BlockTree: b.TreeNew(common.CmpInt), mutex: new(sync.Mutex), compacting: make(map[int]int)}
+	m.BlockTree.Set(1, Block{BlockId: 1, Size: 100, End: 10})
+	m.BlockTree.Set(2, Block{BlockId: 2, Size: 100, End: 20})
+	m.compacting[2] = 3
+
+	if n := m.UpdateBlockEnds([]BlockEnd{{BlockId: 1, End: 30}, {BlockId: 2, End: 40}, {BlockId: 9, End: 1}}); n != 1 {
+		t.Fatal("updated number error", n)
+	}
+	if v, _ := m.BlockTree.Get(1); v.(Block).End != 30 {
+		t.Fatal("block end not updated", v)
+	}
+	if v, _ := m.BlockTree.Get(2); v.(Block).End != 20 {
+		t.Fatal("compacting block should be ignored", v)
+	}
+	if n := m.UpdateBlockEnds([]BlockEnd{{BlockId: 1, End: 30}}); n != 0 {
+		t.Fatal("same end should not count", n)
+	}
+	if n := m.UpdateBlockEnds([]BlockEnd{{BlockId: 1, End: 30, VisitAvg: 12}}); n != 1 {
+		t.Fatal("visit avg change should count", n)
+	}
+	if v, _ := m.BlockTree.Get(1); v.(Block).VisitAvg != 12 {
+		t.Fatal("block visit avg not updated", v)
+	}
+}
@@ -14,12 +14,28 @@ type Block struct {
 	Addr    string // host net address
 	Size    int    // block size
 	End     int    // records offset sum
+	Status   int    // lifecycle, BLOCK_STATUS_*
+	VisitAvg int    // reads per minute reported by agent, for STRATEGY_VISIT_AVG
+	Zone     string // failure domain labels of the agent, see topology.go
+	Rack     string
+}
+
+// block lifecycle, see block-alloc.go
+const (
+	BLOCK_STATUS_OK         = 0 // writable, blocks persisted by old versions
+	BLOCK_STATUS_ALLOCATING = 1 // created by mediator, waiting for the agent to preallocate
+	BLOCK_STATUS_READONLY   = 2 // no more writes, still readable and compacted
+	BLOCK_STATUS_RETIRED    = 3 // no more writes, not counted as capacity, file kept until removed
+)
+
+// 可以写入新数据
+func (b Block) IsWritable() bool {
+	return b.Status == BLOCK_STATUS_OK
 }
 
 /*
 	End       int    // not accurate, refresh by mediator
 	OidNumber int    // this block contains oid number
-	VisitAvg  int
 */
 
 // 64 MB
@@ -47,6 +63,10 @@ func (bl BlockList) Swap(i, j int) {
 	bl[j] = temp
 }
 
-func (b *Block) getFillingRate() int {
-	return b.End / b.Size
+// 已写入的比例
+func (b *Block) getFillingRate() float64 {
+	if b.Size <= 0 {
+		return 1
+	}
+	return float64(b.End) / float64(b.Size)
 }
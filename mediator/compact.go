@@ -0,0 +1,274 @@
+package mediator
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/blastbao/whisper/common"
+)
+
+// 块压缩
+//
+// (1) mediator 向 center 广播 CMD_BLOCK_USAGE ，每个分组的 master 回复本组记录在每个块的有效数据量，全部回复后累加
+// (2) mediator 选出有效数据比例低于 CompactLiveRatio 的块，在同一 agent 同一目录创建新块，向 agent 发送 CMD_COMPACT_BLOCK
+// (3) agent 锁住旧块，将有效数据拷贝到新块，通知 center 更新记录的 BlockId/Offset ，用新块替换旧块
+// (4) agent 回复 CMD_COMPACT_BLOCK_DONE ，mediator 移除旧块，持久化并刷新 client/agent 的块列表
+
+// blocks whose live bytes ratio is lower than this will be compacted
+var CompactLiveRatio float64 = 0.5
+
+// 块使用情况，由 center 统计
+type BlockUsage struct {
+	BlockId int
+	Live    int // bytes still referenced by live records
+	Total   int // bytes of all records
+}
+
+// 压缩任务，mediator -> agent
+type CompactTask struct {
+	BlockId  int
+	NewBlock Block
+}
+
+// 压缩结果，agent -> mediator
+type CompactResult struct {
+	BlockId    int
+	NewBlockId int
+	End        int // new block end
+	Flag       bool
+	Msg        string
+}
+
+func (m *Mediator) addCompactHandler() {
+
+	// 开始压缩，向所有连接广播，由 center 回复块使用情况
+	m.Server.AddHandler(
+		CMD_COMPACT,
+		func(p Pack, conn net.Conn) Pack {
+			m.Compact()
+			return Pack{Command: CMD_COMPACT, Flag: true}
+		},
+	)
+
+	// center 回复块使用情况
+	m.Server.AddHandler(
+		CMD_BLOCK_USAGE,
+		func(p Pack, conn net.Conn) Pack {
+			if !p.Flag {
+				common.Log.Error("mediator block usage error", p.Msg)
+				return PACK_NO_RETURN
+			}
+
+			var usages []BlockUsage
+			if e := common.Dec(p.Body, &usages); e != nil {
+				common.Log.Error("mediator block usage decode error", e)
+				return PACK_NO_RETURN
+			}
+
+			group := DEFAULT_CENTER_GROUP
+			if member, ok := m.Server.GetMember(conn.RemoteAddr().String()); ok {
+				group = member.Group
+			}
+			if usages = m.collectUsages(group, usages); usages != nil {
+				m.compactBlocks(usages)
+			}
+			return PACK_NO_RETURN
+		},
+	)
+
+	// agent 回复压缩结果
+	m.Server.AddHandler(
+		CMD_COMPACT_BLOCK_DONE,
+		func(p Pack, conn net.Conn) Pack {
+			var r CompactResult
+			if e := common.Dec(p.Body, &r); e != nil {
+				common.Log.Error("mediator compact result decode error", e)
+				return PACK_NO_RETURN
+			}
+
+			m.finishCompact(r)
+			return PACK_NO_RETURN
+		},
+	)
+}
+
+// 向 center 请求块使用情况
+func (m *Mediator) Compact() {
+	common.Log.Info("mediator compact begin")
+	m.mutex.Lock()
+	m.usages = make(map[string][]BlockUsage)
+	m.mutex.Unlock()
+	m.Server.Pub(Pack{Command: CMD_BLOCK_USAGE})
+}
+
+// 记录分组的块使用情况，所有有 master 的分组都回复后返回累加的结果，否则返回 nil
+func (m *Mediator) collectUsages(group string, usages []BlockUsage) []BlockUsage {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var groups []string
+	for g, role := range m.centerRoles {
+		if role.Master != "" {
+			groups = append(groups, g)
+		}
+	}
+	if m.usages == nil || len(groups) == 0 {
+		return usages
+	}
+
+	m.usages[group] = usages
+	for _, g := range groups {
+		if _, ok := m.usages[g]; !ok {
+			return nil
+		}
+	}
+
+	sum := make(map[int]BlockUsage)
+	for _, one := range m.usages {
+		for _, u := range one {
+			s := sum[u.BlockId]
+			s.BlockId = u.BlockId
+			s.Live += u.Live
+			s.Total += u.Total
+			sum[u.BlockId] = s
+		}
+	}
+	m.usages = nil
+
+	var r []BlockUsage
+	for _, u := range sum {
+		r = append(r, u)
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].BlockId < r[j].BlockId })
+	return r
+}
+
+// 有效数据比例低于 CompactLiveRatio 且不在压缩中的块
+func (m *Mediator) compactCandidates(usages []BlockUsage) []Block {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var r []Block
+	for _, u := range usages {
+		if u.Total == 0 || float64(u.Live)/float64(u.Total) >= CompactLiveRatio {
+			continue
+		}
+		if _, ok := m.compacting[u.BlockId]; ok {
+			continue
+		}
+
+		v, ok := m.BlockTree.Get(u.BlockId)
+		if !ok || v.(Block).Status == BLOCK_STATUS_ALLOCATING {
+			continue
+		}
+		r = append(r, v.(Block))
+	}
+	return r
+}
+
+func (m *Mediator) compactBlocks(usages []BlockUsage) {
+	for _, block := range m.compactCandidates(usages) {
+
+		// 在同一 agent 同一目录创建新块
+		newBlockId, e := m.NewBlock(block.DataId, block.Addr, block.Dir, block.Size)
+		if e != nil {
+			common.Log.Error("mediator compact new block error", block.BlockId, e)
+			continue
+		}
+
+		// 新块沿用旧块的状态
+		m.mutex.Lock()
+		m.compacting[block.BlockId] = newBlockId
+		v, _ := m.BlockTree.Get(newBlockId)
+		newBlock := v.(Block)
+		newBlock.Status = block.Status
+		m.BlockTree.Set(newBlockId, newBlock)
+		m.mutex.Unlock()
+
+		body, e := common.Enc(&CompactTask{BlockId: block.BlockId, NewBlock: newBlock})
+		if e != nil {
+			common.Log.Error("mediator compact task encode error", block.BlockId, e)
+			continue
+		}
+
+		common.Log.Info("mediator compact block " + strconv.Itoa(block.BlockId) + " to " + strconv.Itoa(newBlockId) + " on " + block.Addr)
+		m.Server.Notify(block.Addr, Pack{Command: CMD_COMPACT_BLOCK, Body: body})
+	}
+}
+
+func (m *Mediator) finishCompact(r CompactResult) {
+	m.mutex.Lock()
+	delete(m.compacting, r.BlockId)
+
+	if !r.Flag {
+		common.Log.Error("mediator compact block fail", r.BlockId, r.Msg)
+		m.BlockTree.Delete(r.NewBlockId)
+		m.mutex.Unlock()
+		return
+	}
+
+	// 新块替换旧块
+	if v, ok := m.BlockTree.Get(r.NewBlockId); ok {
+		block := v.(Block)
+		block.End = r.End
+		m.BlockTree.Set(r.NewBlockId, block)
+	}
+	m.BlockTree.Delete(r.BlockId)
+	m.mutex.Unlock()
+
+	common.Log.Info("mediator compact block done", r.BlockId, r.NewBlockId, r.End)
+
+	if e := m.Persist(); e != nil {
+		common.Log.Error("mediator compact persist error", e)
+	}
+	m.RefreshBlocks()
+}
+
+// 所有块，以 common.SP 分隔
+func (m *Mediator) EncBlocks() ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	buf := &bytes.Buffer{}
+	if m.BlockTree.Len() == 0 {
+		return buf.Bytes(), nil
+	}
+
+	en, e := m.BlockTree.SeekFirst()
+	if e != nil {
+		return nil, e
+	}
+	for {
+		_, v, e := en.Next()
+		if e != nil {
+			if e != io.EOF {
+				return nil, e
+			}
+			break
+		}
+
+		block := v.(Block)
+		bb, e := common.Enc(&block)
+		if e != nil {
+			return nil, e
+		}
+		buf.Write(bb)
+		buf.Write(common.SP)
+	}
+	return buf.Bytes(), nil
+}
+
+// 通知 client/agent 刷新块列表
+func (m *Mediator) RefreshBlocks() {
+	body, e := m.EncBlocks()
+	if e != nil {
+		common.Log.Error("mediator refresh blocks encode error", e)
+		return
+	}
+
+	m.Server.Tri("", "client-block-refresh", body, nil)
+	m.Server.Tri("", "node-server-block-refresh", body, nil)
+}
@@ -0,0 +1,28 @@
+package mediator
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/blastbao/whisper/common"
+	"github.com/cznic/b"
+)
+
+func TestCompactCandidates(t *testing.T) {
+	m := &Mediator{BlockTree: b.TreeNew(common.CmpInt), mutex: new(sync.Mutex), compacting: make(map[int]int)}
+	for i := 1; i <= 4; i++ {
+		m.BlockTree.Set(i, Block{BlockId: i, Size: 100})
+	}
+	m.compacting[3] = 5
+
+	blocks := m.compactCandidates([]BlockUsage{
+		{BlockId: 1, Live: 10, Total: 100}, // candidate
+		{BlockId: 2, Live: 80, Total: 100}, // mostly live
+		{BlockId: 3, Live: 0, Total: 100},  // compacting
+		{BlockId: 4, Live: 0, Total: 0},    // empty
+		{BlockId: 9, Live: 0, Total: 100},  // unknown
+	})
+	if len(blocks) != 1 || blocks[0].BlockId != 1 {
+		t.Fatal("compact candidates error", blocks)
+	}
+}
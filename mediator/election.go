@@ -0,0 +1,273 @@
+package mediator
+
+import (
+	"net"
+	"sort"
+	"time"
+
+	"github.com/blastbao/whisper/common"
+)
+
+// center 主从选举
+//
+// mediator 根据注册的 center 成员维护每个分组(Member.Group)的主从拓扑，分组之间互不影响：
+// (1) 分组没有 master 或 master 失效时，向组内 center 发送 CMD_CENTER_STATE ，等待 ElectionWaitMs 收集回复
+// (2) 选出数据最新(Position 最大)的 center ，相同时优先保留原 master ，再按地址排序
+// (3) epoch 加 1 ，向组内 center 发送 CMD_CENTER_ROLE ，master 据此连接 slaves ，旧 epoch 的命令被忽略
+// (4) 所有分组的拓扑写入 KEY_CENTER_SHARDS ，mediator 重启后沿用；默认分组的 master 地址写入 client/agent 监听的 key
+// 新 center 加入时只发送拓扑，不重新选举。
+
+var ElectionWaitMs int = 3 * 1000
+
+// center 状态，center -> mediator
+type CenterState struct {
+	Addr     string
+	IsMaster bool
+	Epoch    int
+	Position int64 // last applied raft sequence, or last modify unix seconds of all indexes without raft
+	Records  int   // records of all indexes, compared when Position equals
+	Group    string
+	IndexIds []int // indexes on the center
+}
+
+// 一个分组的 center 拓扑，mediator -> center
+type CenterRole struct {
+	Epoch  int
+	Master string
+	Slaves []string
+	Group  string
+	Ranges []IndexRange // index ids served by the group
+}
+
+// 当前 center 成员，key 为 Addr
+func centerAddrs(members MemberList) []string {
+	var addrs []string
+	for _, member := range members {
+		if !common.ContainsStr(addrs, member.Addr) {
+			addrs = append(addrs, member.Addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// 按分组划分 center 成员
+func centerGroups(members MemberList) map[string]MemberList {
+	groups := make(map[string]MemberList)
+	for _, member := range members {
+		groups[member.Group] = append(groups[member.Group], member)
+	}
+	return groups
+}
+
+func (m *Mediator) addElectionHandler() {
+
+	// center 回复状态，选举期间记录，master 的状态同时用于统计负载及分配已有的索引
+	m.Server.AddHandler(
+		CMD_CENTER_STATE,
+		func(p Pack, conn net.Conn) Pack {
+			var state CenterState
+			if e := common.DecCompat(p.Body, &state); e != nil {
+				common.Log.Error("mediator center state decode error", e)
+				return PACK_NO_RETURN
+			}
+
+			m.mutex.Lock()
+			if states, ok := m.centerStates[state.Group]; ok {
+				states[state.Addr] = state
+			}
+			changed := false
+			if role, ok := m.centerRoles[state.Group]; ok && role.Master == state.Addr {
+				m.centerLoads[state.Group] = state.Records
+				changed = m.assignIndexes(state.Group, state.IndexIds)
+			}
+			m.mutex.Unlock()
+
+			if changed {
+				m.publishShards()
+			}
+			return PACK_NO_RETURN
+		},
+	)
+}
+
+// 加载上次运行时的拓扑，旧版本只保存了一个分组
+func (m *Mediator) loadCenterRole() {
+	m.centerRoles = make(map[string]CenterRole)
+
+	if node, ok := m.Znodes.Get(KEY_CENTER_SHARDS); ok {
+		var shards CenterShards
+		if e := common.DecCompat(node.Value, &shards); e != nil {
+			common.Log.Error("mediator center shards decode error", e)
+			return
+		}
+		for _, role := range shards.Groups {
+			m.centerRoles[role.Group] = role
+		}
+		return
+	}
+
+	node, ok := m.Znodes.Get(KEY_CENTER_TOPOLOGY)
+	if !ok {
+		return
+	}
+	var role CenterRole
+	if e := common.DecCompat(node.Value, &role); e != nil {
+		common.Log.Error("mediator center topology decode error", e)
+		return
+	}
+	m.centerRoles[role.Group] = role
+}
+
+// 成员变化时回调
+func (m *Mediator) onMemberChange(role int, members MemberList) {
+	m.publishMembers(role, members)
+
+	if role == common.ROLE_CENTER {
+		m.checkCenters(members)
+	} else if role == common.ROLE_AGENT {
+		m.LabelBlocks(members)
+	}
+}
+
+// 每个分组 master 仍在时更新 slaves ，否则重新选举
+func (m *Mediator) checkCenters(members MemberList) {
+	groups := centerGroups(members)
+
+	var roles []CenterRole
+	var electing []string
+	isChanged := false
+
+	m.mutex.Lock()
+	for group, groupMembers := range groups {
+		if _, ok := m.centerStates[group]; ok {
+			// 正在选举，选举结束时使用最新的成员
+			continue
+		}
+
+		addrs := centerAddrs(groupMembers)
+		old := m.centerRoles[group]
+		if old.Master != "" && common.ContainsStr(addrs, old.Master) {
+			role := old
+			role.Group = group
+			role.Slaves = nil
+			for _, addr := range addrs {
+				if addr != role.Master {
+					role.Slaves = append(role.Slaves, addr)
+				}
+			}
+			isChanged = isChanged || !sameStrs(old.Slaves, role.Slaves)
+			m.centerRoles[group] = role
+			roles = append(roles, role)
+			continue
+		}
+
+		// 开始选举
+		m.centerStates[group] = make(map[string]CenterState)
+		electing = append(electing, group)
+	}
+	m.mutex.Unlock()
+
+	for _, role := range roles {
+		m.sendCenterRole(role, groups[role.Group])
+	}
+	if isChanged {
+		m.publishShards()
+	}
+
+	for _, group := range electing {
+		common.Log.Warning("mediator center master election begin", group, m.CenterMasterOf(group))
+		for _, member := range groups[group] {
+			m.Server.Notify(member.RemoteAddr, Pack{Command: CMD_CENTER_STATE})
+		}
+		go m.elect(group)
+	}
+}
+
+// 等待组内 center 回复状态后选出 master
+func (m *Mediator) elect(group string) {
+	time.Sleep(time.Duration(ElectionWaitMs) * time.Millisecond)
+
+	members := centerGroups(m.Server.ListMembers(common.ROLE_CENTER))[group]
+	addrs := centerAddrs(members)
+
+	m.mutex.Lock()
+	states := m.centerStates[group]
+	delete(m.centerStates, group)
+
+	var states2 []CenterState
+	for _, state := range states {
+		// 选举期间离开的 center 不参与
+		if common.ContainsStr(addrs, state.Addr) {
+			states2 = append(states2, state)
+		}
+	}
+	master := chooseMaster(states2, m.centerRoles[group].Master)
+	if master == "" {
+		m.mutex.Unlock()
+		common.Log.Error("mediator center master election failed as no center replied", group)
+		return
+	}
+
+	old := m.centerRoles[group]
+	role := CenterRole{Epoch: old.Epoch + 1, Master: master, Group: group, Ranges: old.Ranges}
+	for _, addr := range addrs {
+		if addr != master {
+			role.Slaves = append(role.Slaves, addr)
+		}
+	}
+	m.centerRoles[group] = role
+	m.centerLoads[group] = states[master].Records
+	m.assignIndexes(group, states[master].IndexIds)
+	role = m.centerRoles[group]
+	m.mutex.Unlock()
+
+	common.Log.Warning("mediator center master elected", group, role.Master, role.Epoch, role.Slaves)
+	m.sendCenterRole(role, members)
+	m.publishShards()
+}
+
+// 选出 Position 最大的，相同时优先原 master ，再按地址
+func chooseMaster(states []CenterState, lastMaster string) string {
+	if len(states) == 0 {
+		return ""
+	}
+
+	sort.Slice(states, func(i, j int) bool {
+		a, b := states[i], states[j]
+		if a.Position != b.Position {
+			return a.Position > b.Position
+		}
+		if a.Records != b.Records {
+			return a.Records > b.Records
+		}
+		if (a.Addr == lastMaster) != (b.Addr == lastMaster) {
+			return a.Addr == lastMaster
+		}
+		return a.Addr < b.Addr
+	})
+	return states[0].Addr
+}
+
+func (m *Mediator) sendCenterRole(role CenterRole, members MemberList) {
+	body, e := common.Enc(&role)
+	if e != nil {
+		common.Log.Error("mediator center role encode error", e)
+		return
+	}
+	for _, member := range members {
+		m.Server.Notify(member.RemoteAddr, Pack{Command: CMD_CENTER_ROLE, Body: body, Flag: true})
+	}
+}
+
+// 默认分组的 master
+func (m *Mediator) CenterMaster() string {
+	return m.CenterMasterOf(DEFAULT_CENTER_GROUP)
+}
+
+// 分组的 master 地址，没有时为空
+func (m *Mediator) CenterMasterOf(group string) string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.centerRoles[group].Master
+}
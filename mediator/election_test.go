@@ -0,0 +1,158 @@
+package mediator
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blastbao/whisper/common"
+)
+
+func TestChooseMaster(t *testing.T) {
+	if master := chooseMaster(nil, "c1"); master != "" {
+		t.Fatal("no state should choose no master", master)
+	}
+
+	states := []CenterState{
+		{Addr: "c1", Position: 10, Records: 5},
+		{Addr: "c2", Position: 20, Records: 1},
+		{Addr: "c3", Position: 20, Records: 1},
+	}
+	if master := chooseMaster(states, ""); master != "c2" {
+		t.Fatal("latest position with smaller addr should win", master)
+	}
+	if master := chooseMaster(states, "c3"); master != "c3" {
+		t.Fatal("last master should win when position equals", master)
+	}
+	if master := chooseMaster(states, "c1"); master != "c2" {
+		t.Fatal("last master with older position should lose", master)
+	}
+
+	states = []CenterState{
+		{Addr: "c2", Position: 20, Records: 1},
+		{Addr: "c3", Position: 20, Records: 2},
+	}
+	if master := chooseMaster(states, "c2"); master != "c3" {
+		t.Fatal("more records should win when position equals", master)
+	}
+}
+
+// 第一个 center 成为 master ，新加入的 center 不触发选举，master 断开后重新选举
+func TestMediatorElection(t *testing.T) {
+	old := ElectionWaitMs
+	defer func() { ElectionWaitMs = old }()
+	ElectionWaitMs = 200
+
+	dir, e := ioutil.TempDir("", "whisper-election")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	m := &Mediator{Dir: dir, mutex: new(sync.Mutex), Server: &NetServer{}}
+	m.centerRoles = make(map[string]CenterRole)
+	m.centerStates = make(map[string]map[string]CenterState)
+	m.centerLoads = make(map[string]int)
+	m.Znodes = NewZnodeStore(m.getZnodeFile(), nil)
+	m.Server.Values = m.Znodes
+	m.Server.OnMemberChange = m.onMemberChange
+	if e := m.Server.Start("localhost", 9786); e != nil {
+		t.Fatal(e)
+	}
+	m.addElectionHandler()
+
+	var clients []*NetClient
+	defer func() {
+		for _, c := range clients {
+			c.Close()
+		}
+		m.Server.listener.Close()
+		for _, c := range m.Server.conns() {
+			c.Close()
+		}
+	}()
+
+	newCenter := func(addr string, position int64) (*NetClient, chan CenterRole) {
+		ch := make(chan CenterRole, 10)
+		c := &NetClient{}
+		if e := c.Start("localhost:9786"); e != nil {
+			t.Fatal(e)
+		}
+		clients = append(clients, c)
+
+		c.AddHandler(CMD_CENTER_STATE, func(p Pack) Pack {
+			body, _ := common.Enc(&CenterState{Addr: addr, Position: position})
+			return Pack{Command: CMD_CENTER_STATE, Body: body, Flag: true}
+		})
+		c.AddHandler(CMD_CENTER_ROLE, func(p Pack) Pack {
+			var role CenterRole
+			if e := common.DecCompat(p.Body, &role); e != nil {
+				t.Error(e)
+			}
+			ch <- role
+			return PACK_NO_RETURN
+		})
+		if e := c.Register(Member{Role: common.ROLE_CENTER, Addr: addr}); e != nil {
+			t.Fatal(e)
+		}
+		return c, ch
+	}
+	waitRole := func(ch chan CenterRole) CenterRole {
+		select {
+		case role := <-ch:
+			return role
+		case <-time.After(5 * time.Second):
+			t.Fatal("center role not received")
+		}
+		return CenterRole{}
+	}
+	// znode is set after roles are sent
+	waitZnode := func(key, value string) {
+		for i := 0; i < 100; i++ {
+			if node, ok := m.Znodes.Get(key); ok && string(node.Value) == value {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatal("center master not published", key, value)
+	}
+
+	c1, ch1 := newCenter("center-1", 10)
+	if role := waitRole(ch1); role.Master != "center-1" || role.Epoch != 1 || len(role.Slaves) != 0 {
+		t.Fatal("first center should be master", role)
+	}
+	waitZnode(KEY_CLIENT_CENTER_ADDR, "center-1")
+
+	// newer data but joins later, only becomes slave
+	_, ch2 := newCenter("center-2", 20)
+	if role := waitRole(ch2); role.Master != "center-1" || role.Epoch != 1 || len(role.Slaves) != 1 || role.Slaves[0] != "center-2" {
+		t.Fatal("new center should be slave", role)
+	}
+	if role := waitRole(ch1); role.Master != "center-1" || role.Epoch != 1 {
+		t.Fatal("master should get the new topology", role)
+	}
+
+	// master lost
+	c1.Close()
+	if role := waitRole(ch2); role.Master != "center-2" || role.Epoch != 2 || len(role.Slaves) != 0 {
+		t.Fatal("failover error", role)
+	}
+	if master := m.CenterMaster(); master != "center-2" {
+		t.Fatal("center master error", master)
+	}
+	waitZnode(KEY_NODE_SERVER_CENTER_ADDR, "center-2")
+	waitZnode(KEY_CLIENT_CENTER_ADDR, "center-2")
+
+	// topology survives mediator restart
+	m2 := &Mediator{Dir: dir}
+	m2.Znodes = NewZnodeStore(m2.getZnodeFile(), nil)
+	if e := m2.Znodes.Load(); e != nil {
+		t.Fatal(e)
+	}
+	m2.loadCenterRole()
+	if role := m2.centerRoles[DEFAULT_CENTER_GROUP]; role.Master != "center-2" || role.Epoch != 2 {
+		t.Fatal("center topology not loaded", role)
+	}
+}
@@ -20,7 +20,9 @@ import (
 // 通知 Client 当前有哪些块(副本)列表
 // 通知 Client 刷新客户端配置，主要有路由策略、副本数、IndexId
 //
-// 通知 CenterSvr 创建 Index
+// 按 agent 上报的磁盘容量创建块，通知 NodeSvr 预分配，块可设为只读或退役
+//
+// 通知 CenterSvr 创建 Index ，按分组分配 IndexId
 // 请求 CenterSvr 获取所有 Index 及数据量
 // 通知 CenterSvr 持久化 Index
 // 通知 CenterSvr 转换角色为 Master 节点
@@ -33,7 +35,18 @@ type Mediator struct {
 	Dir       string
 	BlockTree *b.Tree
 	Server    *NetServer
+	Znodes    *ZnodeStore // current values of watcher keys
 	mutex     *sync.Mutex
+
+	compacting map[int]int              // old block id -> new block id
+	usages     map[string][]BlockUsage // group -> usage replied in the current compaction
+
+	centerRoles  map[string]CenterRole             // group -> current center topology
+	centerStates map[string]map[string]CenterState // group -> replies during election
+	centerLoads  map[string]int                    // group -> records reported by master
+
+	disks    map[string]DiskReport // agent addr -> disks
+	topology map[string]Topology   // agent addr -> zone/rack
 }
 
 func (m *Mediator) Start(host, dir string) {
@@ -41,14 +54,40 @@ func (m *Mediator) Start(host, dir string) {
 	m.Dir = dir
 	m.BlockTree = b.TreeNew(common.CmpInt)
 	m.mutex = new(sync.Mutex)
+	m.compacting = make(map[int]int)
+	m.centerStates = make(map[string]map[string]CenterState)
+	m.centerLoads = make(map[string]int)
+	m.disks = make(map[string]DiskReport)
+	m.topology = make(map[string]Topology)
 	m.Server = &NetServer{}
 
+	// watcher 的值保存在 znode 中，修改时通知所有 watcher
+	m.Znodes = NewZnodeStore(m.getZnodeFile(), func(key string, value, valueOld []byte) {
+		m.Server.TriggerKey(key, value, valueOld)
+	})
+	if e := m.Znodes.Load(); e != nil {
+		common.Log.Error("mediator znode load error", e)
+	}
+	m.loadCenterRole()
+	m.Server.Values = m.Znodes
+	m.Server.OnMemberChange = m.onMemberChange
+
 	// 启动 Mediator Server 。
 	if e := m.Server.Start(host, common.SERVER_PORT_MEDIATOR); e != nil {
 		common.Log.Error("mediator server start error", e)
 	} else {
 		common.Log.Info("mediator server start success")
 	}
+
+	// handlers must be added after server started
+	m.addCompactHandler()
+	m.addZnodeHandler()
+	m.addElectionHandler()
+	m.addShardHandler()
+	m.addBlockReportHandler()
+	m.addBlockAllocHandler()
+
+	go m.publishMembersLater()
 }
 
 func (m *Mediator) Close() {
@@ -62,56 +101,60 @@ func (m *Mediator) getPersistFile() string {
 }
 
 // write to file
-// 持久化
+// 持久化，包含块的状态，整个文件替换，避免块减少时残留旧内容
 func (m *Mediator) Persist() (err error) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
 	if m.BlockTree.Len() == 0 {
 		fn := m.getPersistFile()
-		return os.Remove(fn)
+		if e := os.Remove(fn); e != nil && !os.IsNotExist(e) {
+			return e
+		}
+		return nil
 	}
 
-	en, e := m.BlockTree.SeekFirst()
+	buf := &bytes.Buffer{}
+	e := m.eachBlock(func(block Block) error {
+		bb, e := common.Enc(&block)
+		if e != nil {
+			return e
+		}
+
+		buf.Write(bb)
+		buf.Write(common.SP)
+		return nil
+	})
 	if e != nil {
 		err = e
 		return
 	}
 
-	buf := &bytes.Buffer{}
+	return common.WriteFileSync(buf.Bytes(), m.getPersistFile())
+}
 
+// need lock first, 按 BlockId 顺序遍历
+func (m *Mediator) eachBlock(fn func(block Block) error) error {
+	if m.BlockTree.Len() == 0 {
+		return nil
+	}
+
+	en, e := m.BlockTree.SeekFirst()
+	if e != nil {
+		return e
+	}
 	for {
 		_, v, e := en.Next()
 		if e != nil {
 			if e != io.EOF {
-				err = e
-				return
+				return e
 			}
-
-			break
-		}
-
-		block := v.(Block)
-		bb, e := common.Enc(&block)
-		if e != nil {
-			err = e
-			return
+			return nil
 		}
-
-		buf.Write(bb)
-		buf.Write(common.SP)
-	}
-
-	bb := buf.Bytes()
-	if len(bb) > 0 {
-		e = common.Write2File(bb, m.getPersistFile(), os.O_WRONLY)
-		if e != nil {
-			err = e
-			return
+		if e := fn(v.(Block)); e != nil {
+			return e
 		}
 	}
-
-	return nil
 }
 
 // 重加载
@@ -131,8 +174,12 @@ func (m *Mediator) Load() (err error) {
 			continue
 		}
 
+		// 旧版本的块没有状态，视为可写
 		var block Block
-		common.Dec(b, &block)
+		if e := common.DecCompat(b, &block); e != nil {
+			common.Log.Error("mediator load block decode error but skip", e)
+			continue
+		}
 		m.BlockTree.Set(block.BlockId, block)
 	}
 
@@ -147,35 +194,12 @@ func (m *Mediator) NewBlock(dataId int, addr string, dir string, size int) (bloc
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	blockIdMax := 0
-	if m.BlockTree.Len() != 0 {
-
-		en, e := m.BlockTree.SeekFirst()
-		if e != nil {
-			err = e
-			return
-		}
-
-		for {
-			k, _, e := en.Next()
-			if e != nil {
-				if e != io.EOF {
-					err = e
-					return
-				}
-
-				break
-			}
-
-			blockId := k.(int)
-			if blockId > blockIdMax {
-				blockIdMax = blockId
-			}
-		}
+	newBlockId, e := m.nextBlockId()
+	if e != nil {
+		err = e
+		return
 	}
 
-	newBlockId := blockIdMax + 1
-
 	block := Block{
 		BlockId: newBlockId,
 		DataId: dataId,
@@ -183,8 +207,21 @@ func (m *Mediator) NewBlock(dataId int, addr string, dir string, size int) (bloc
 		Dir: dir,
 		Size: size,
 	}
+	m.labelBlock(&block)
 
 	m.BlockTree.Set(newBlockId, block)
 
 	return newBlockId, nil
 }
+
+// need lock first, 最大的 BlockId + 1
+func (m *Mediator) nextBlockId() (int, error) {
+	blockIdMax := 0
+	e := m.eachBlock(func(block Block) error {
+		if block.BlockId > blockIdMax {
+			blockIdMax = block.BlockId
+		}
+		return nil
+	})
+	return blockIdMax + 1, e
+}
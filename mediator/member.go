@@ -0,0 +1,184 @@
+package mediator
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blastbao/whisper/common"
+)
+
+// 成员注册
+//
+// agent / center / client 连接 mediator 后发送 CMD_REGISTER_MEMBER 注册角色、服务地址及容量，
+// 条目与连接绑定：连接断开或因超过 ConnEvictSec 没有收到 CMD_REPLY_ALIVE 被移除时，成员随之移除。
+// 成员变化时 Mediator 将列表写入 znode "members-{role}"，agent 地址列表写入 "client-connect-to-node-server"，
+// watcher 因此自动收到最新的成员列表。
+
+type Member struct {
+	Role     int    // common.ROLE_AGENT / ROLE_CENTER / ROLE_CLIENT
+	Addr     string // service address, agent rpc host:port etc.
+	Capacity int64  // free bytes for agents, 0 if unknown
+
+	RemoteAddr string // set by mediator
+	LastSeen   int64  // unix seconds, set by mediator
+
+	Group string // center group, DEFAULT_CENTER_GROUP if not sharded
+
+	Zone string // agent failure domain labels, see topology.go
+	Rack string
+}
+
+type MemberList []Member
+
+type MemberChangeFn func(role int, members MemberList)
+
+func GetRoleName(role int) string {
+	switch role {
+	case common.ROLE_MEDIATOR:
+		return "mediator"
+	case common.ROLE_CENTER:
+		return "center"
+	case common.ROLE_AGENT:
+		return "agent"
+	case common.ROLE_CLIENT:
+		return "client"
+	}
+	return strconv.Itoa(role)
+}
+
+// znode key of members of the role
+func GetMemberKey(role int) string {
+	return "members-" + GetRoleName(role)
+}
+
+func EncMembers(members MemberList) []byte {
+	buf := &bytes.Buffer{}
+	for _, member := range members {
+		bb, e := common.Enc(&member)
+		if e != nil {
+			common.Log.Error("mediator encode member error", e)
+			continue
+		}
+		buf.Write(bb)
+		buf.Write(common.SP)
+	}
+	return buf.Bytes()
+}
+
+func DecMembers(b []byte) (MemberList, error) {
+	var members MemberList
+	for _, one := range bytes.Split(b, common.SP) {
+		if len(one) == 0 {
+			continue
+		}
+		var member Member
+		if e := common.DecCompat(one, &member); e != nil {
+			return nil, e
+		}
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+func (ns *NetServer) addMemberHandler() {
+
+	// 注册或更新成员信息，同一连接重复注册时覆盖
+	ns.AddHandler(
+		CMD_REGISTER_MEMBER,
+		func(p Pack, conn net.Conn) Pack {
+			var member Member
+			if e := common.DecCompat(p.Body, &member); e != nil {
+				return Pack{Command: CMD_REGISTER_MEMBER, Msg: e.Error()}
+			}
+
+			member.RemoteAddr = conn.RemoteAddr().String()
+			member.LastSeen = time.Now().Unix()
+
+			ns.mutex.Lock()
+			ns.members[member.RemoteAddr] = member
+			ns.mutex.Unlock()
+
+			common.Log.Info("net server member registered", GetRoleName(member.Role), member.Addr, member.RemoteAddr)
+			ns.memberChanged(member.Role)
+			return Pack{Command: CMD_REGISTER_MEMBER, Flag: true}
+		},
+	)
+}
+
+// 移除连接上的成员，need lock first
+func (ns *NetServer) removeMember(remoteAddr string) (Member, bool) {
+	member, ok := ns.members[remoteAddr]
+	if ok {
+		delete(ns.members, remoteAddr)
+	}
+	return member, ok
+}
+
+// 连接上注册的成员
+func (ns *NetServer) GetMember(remoteAddr string) (Member, bool) {
+	ns.mutex.RLock()
+	defer ns.mutex.RUnlock()
+	member, ok := ns.members[remoteAddr]
+	return member, ok
+}
+
+// 按 Addr 排序的成员列表
+func (ns *NetServer) ListMembers(role int) MemberList {
+	ns.mutex.RLock()
+	var members MemberList
+	for _, member := range ns.members {
+		if member.Role == role {
+			members = append(members, member)
+		}
+	}
+	ns.mutex.RUnlock()
+
+	sort.Slice(members, func(i, j int) bool { return members[i].Addr < members[j].Addr })
+	return members
+}
+
+func (ns *NetServer) memberChanged(role int) {
+	if ns.OnMemberChange != nil {
+		ns.OnMemberChange(role, ns.ListMembers(role))
+	}
+}
+
+// 成员变化时更新 znode ，client 据此连接 agent
+func (m *Mediator) publishMembers(role int, members MemberList) {
+	if _, e := m.Znodes.Set(GetMemberKey(role), EncMembers(members)); e != nil {
+		common.Log.Error("mediator publish members error", GetRoleName(role), e)
+	}
+
+	if role != common.ROLE_AGENT {
+		return
+	}
+
+	var addrs []string
+	for _, member := range members {
+		if !common.ContainsStr(addrs, member.Addr) {
+			addrs = append(addrs, member.Addr)
+		}
+	}
+	value := []byte(strings.Join(addrs, ","))
+
+	// 值不变时不通知，避免 client 重复连接
+	if node, ok := m.Znodes.Get(KEY_NODE_SERVER_ADDRS); ok && bytes.Equal(node.Value, value) {
+		return
+	}
+	if _, e := m.Znodes.Set(KEY_NODE_SERVER_ADDRS, value); e != nil {
+		common.Log.Error("mediator publish node server addrs error", e)
+	}
+}
+
+// 启动后等待成员重新注册，再以当前成员覆盖上次运行时保存的列表
+func (m *Mediator) publishMembersLater() {
+	time.Sleep(time.Duration(ConnEvictSec) * time.Second)
+
+	for _, role := range []int{common.ROLE_CENTER, common.ROLE_AGENT, common.ROLE_CLIENT} {
+		m.publishMembers(role, m.Server.ListMembers(role))
+	}
+}
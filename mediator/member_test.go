@@ -0,0 +1,144 @@
+package mediator
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blastbao/whisper/common"
+)
+
+func TestMemberRegistry(t *testing.T) {
+	s := &NetServer{}
+
+	mutex := new(sync.Mutex)
+	changed := map[int]MemberList{}
+	s.OnMemberChange = func(role int, members MemberList) {
+		mutex.Lock()
+		changed[role] = members
+		mutex.Unlock()
+	}
+	getChanged := func(role int) (MemberList, bool) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		members, ok := changed[role]
+		return members, ok
+	}
+	waitMembers := func(role int, n int) MemberList {
+		for i := 0; i < 100; i++ {
+			if members, ok := getChanged(role); ok && len(members) == n {
+				return members
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatal("member change not notified", GetRoleName(role), n)
+		return nil
+	}
+
+	if e := s.Start("localhost", 9783); e != nil {
+		t.Fatal(e)
+	}
+	var clients []*NetClient
+	defer func() {
+		for _, c := range clients {
+			c.Close()
+		}
+		s.listener.Close()
+		for _, c := range s.conns() {
+			c.Close()
+		}
+	}()
+
+	register := func(member Member) *NetClient {
+		c := &NetClient{}
+		if e := c.Start("localhost:9783"); e != nil {
+			t.Fatal(e)
+		}
+		clients = append(clients, c)
+		if e := c.Register(member); e != nil {
+			t.Fatal(e)
+		}
+		return c
+	}
+
+	a1 := register(Member{Role: common.ROLE_AGENT, Addr: "host-b:9001", Capacity: 100})
+	register(Member{Role: common.ROLE_AGENT, Addr: "host-a:9001", Capacity: 200})
+	register(Member{Role: common.ROLE_CENTER, Addr: "host-c:9002"})
+
+	members := waitMembers(common.ROLE_AGENT, 2)
+	if members[0].Addr != "host-a:9001" || members[1].Capacity != 100 || members[0].RemoteAddr == "" {
+		t.Fatal("agent members error", members)
+	}
+	waitMembers(common.ROLE_CENTER, 1)
+
+	// register again updates the entry
+	a1.Register(Member{Role: common.ROLE_AGENT, Addr: "host-b:9001", Capacity: 50})
+	for i := 0; i < 100; i++ {
+		if members := s.ListMembers(common.ROLE_AGENT); len(members) == 2 && members[1].Capacity == 50 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if members := s.ListMembers(common.ROLE_AGENT); members[1].Capacity != 50 {
+		t.Fatal("member update error", members)
+	}
+
+	// disconnect removes the member
+	a1.Close()
+	if members := waitMembers(common.ROLE_AGENT, 1); members[0].Addr != "host-a:9001" {
+		t.Fatal("member not removed after disconnect", members)
+	}
+
+	if members := s.ListMembers(common.ROLE_CENTER); len(members) != 1 {
+		t.Fatal("center members error", members)
+	}
+}
+
+func TestMediatorPublishMembers(t *testing.T) {
+	dir, e := ioutil.TempDir("", "whisper-member")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	m := &Mediator{Dir: dir}
+	m.Znodes = NewZnodeStore(m.getZnodeFile(), nil)
+
+	agents := MemberList{
+		{Role: common.ROLE_AGENT, Addr: "host-a:9001"},
+		{Role: common.ROLE_AGENT, Addr: "host-b:9001"},
+	}
+	m.publishMembers(common.ROLE_AGENT, agents)
+
+	node, ok := m.Znodes.Get(KEY_NODE_SERVER_ADDRS)
+	if !ok || string(node.Value) != "host-a:9001,host-b:9001" {
+		t.Fatal("node server addrs error", string(node.Value))
+	}
+	node, ok = m.Znodes.Get(GetMemberKey(common.ROLE_AGENT))
+	if !ok {
+		t.Fatal("members not published")
+	}
+	if members, e := DecMembers(node.Value); e != nil || len(members) != 2 || members[1].Addr != "host-b:9001" {
+		t.Fatal("members decode error", members, e)
+	}
+
+	// same addrs, capacity changed only
+	agents[0].Capacity = 10
+	m.publishMembers(common.ROLE_AGENT, agents)
+	if node, _ := m.Znodes.Get(KEY_NODE_SERVER_ADDRS); node.Version != 1 {
+		t.Fatal("node server addrs should not be set again", node.Version)
+	}
+
+	m.publishMembers(common.ROLE_AGENT, agents[1:])
+	if node, _ := m.Znodes.Get(KEY_NODE_SERVER_ADDRS); string(node.Value) != "host-b:9001" || node.Version != 2 {
+		t.Fatal("node server addrs error", string(node.Value), node.Version)
+	}
+
+	// clients are not node servers
+	m.publishMembers(common.ROLE_CLIENT, MemberList{{Role: common.ROLE_CLIENT, Addr: "client"}})
+	if node, _ := m.Znodes.Get(KEY_NODE_SERVER_ADDRS); node.Version != 2 {
+		t.Fatal("node server addrs changed by client members")
+	}
+}
@@ -1,16 +1,22 @@
 package mediator
 
 import (
-	"bytes"
+	"errors"
 	"github.com/blastbao/whisper/common"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 var WatcherStatusOk, WatcherStatusFail int = 1, 10
 
+// 连接状态，断开后按 ReconnectMinMs 到 ReconnectMaxMs 指数退避重连
+var NetClientConnected, NetClientDisconnected int = 1, 2
+var ReconnectMinMs int = 500
+var ReconnectMaxMs int = 30 * 1000
+
 // if group is all, notify all clients, otherwise trigger one client in a group
 var WatcherGroupAll string = "all"
 
@@ -36,15 +42,27 @@ type CmdClientHandler struct {
 	Fn  PackProcessFn
 }
 
+type NetClientStateFn func(state int)
+
 type NetClient struct {
 	conn        net.Conn
 	handlers    []CmdClientHandler
 	watcherList []*Watcher
 	chTrigger   chan Trigger
+
+	// 连接状态变化时回调，在 Start 之前设置
+	OnStateChange NetClientStateFn
+
+	addr     string
+	host     string  // mapping host, sent again after reconnect
+	member   *Member // registered member, sent again after reconnect
+	isClosed bool
+	mutex    sync.Mutex
 }
 
 func (nc *NetClient) Start(addr string) error {
 	nc.watcherList = []*Watcher{}
+	nc.addr = addr
 
 	// 建立通过 mediator 的 tcp 长连接
 	conn, e := net.Dial("tcp", addr)
@@ -67,20 +85,111 @@ func (nc *NetClient) Start(addr string) error {
 }
 
 func (nc *NetClient) Close() error {
+	nc.mutex.Lock()
+	defer nc.mutex.Unlock()
+
+	// 主动关闭后不再重连
+	nc.isClosed = true
 	if nc.conn != nil {
 		common.Log.Info("net client is closing")
 		return nc.conn.Close()
 	}
-
-	close(nc.chTrigger)
 	return nil
 }
 
+// 将本连接映射为 host ，mediator 可以按 host 通知，重连后自动重新发送
+func (nc *NetClient) MappingHost(host string) error {
+	nc.mutex.Lock()
+	nc.host = host
+	nc.mutex.Unlock()
+
+	return nc.Send(Pack{Command: CMD_MAPPING_HOST, Body: []byte(host)})
+}
+
+func (nc *NetClient) closed() bool {
+	nc.mutex.Lock()
+	defer nc.mutex.Unlock()
+	return nc.isClosed
+}
+
+// 注册为 mediator 的成员，重复调用时更新，重连后自动重新注册
+func (nc *NetClient) Register(member Member) error {
+	nc.mutex.Lock()
+	nc.member = &member
+	nc.mutex.Unlock()
+
+	body, e := common.Enc(&member)
+	if e != nil {
+		return e
+	}
+	return nc.Send(Pack{Command: CMD_REGISTER_MEMBER, Body: body})
+}
+
+func (nc *NetClient) setState(state int) {
+	if nc.OnStateChange != nil {
+		nc.OnStateChange(state)
+	}
+}
+
+// 连接断开后重连，直到成功或 Close
+func (nc *NetClient) reconnect() {
+	nc.setState(NetClientDisconnected)
+
+	delay := ReconnectMinMs
+	for {
+		time.Sleep(time.Duration(delay) * time.Millisecond)
+		if nc.closed() {
+			return
+		}
+
+		conn, e := net.Dial("tcp", nc.addr)
+		if e != nil {
+			common.Log.Warning("net client reconnect failed - "+nc.addr, e)
+
+			delay *= 2
+			if delay > ReconnectMaxMs {
+				delay = ReconnectMaxMs
+			}
+			continue
+		}
+
+		nc.mutex.Lock()
+		if nc.isClosed {
+			nc.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		nc.conn = conn
+		host := nc.host
+		member := nc.member
+		watchers := append([]*Watcher{}, nc.watcherList...)
+		nc.mutex.Unlock()
+
+		common.Log.Info("net client reconnected - " + nc.addr)
+		go nc.handle(conn)
+
+		// 新连接上 mediator 没有 host 映射和 watcher ，重新注册
+		if host != "" {
+			nc.Send(Pack{Command: CMD_MAPPING_HOST, Body: []byte(host)})
+		}
+		if member != nil {
+			nc.Register(*member)
+		}
+		for _, w := range watchers {
+			nc.setWatcherStatus(w, 0)
+			nc.Send(Pack{Command: CMD_REGISTER_WATCHER, Body: []byte(w.group + "," + w.key)})
+		}
+
+		nc.setState(NetClientConnected)
+		return
+	}
+}
+
 func (nc *NetClient) AddHandler(cmd string, fn PackProcessFn) {
 	for i, f := range nc.handlers {
 		if f.Cmd == cmd {
 			nc.handlers[i] = CmdClientHandler{Cmd: cmd, Fn: fn}
-			break
+			return
 		}
 	}
 
@@ -88,8 +197,8 @@ func (nc *NetClient) AddHandler(cmd string, fn PackProcessFn) {
 	common.Log.Info("net client handler number after add one - " + cmd + " - " + strconv.Itoa(len(nc.handlers)))
 }
 
+// handlers added before Start are kept
 func (nc *NetClient) addBaseHandler() {
-	nc.handlers = []CmdClientHandler{}
 	// mediator 会定时检查连接是否活跃，此时回复 mediator 本连接还活跃。
 	nc.AddHandler(
 		CMD_CHECK_ALIVE,
@@ -106,9 +215,13 @@ func (nc *NetClient) handleTrigger() {
 		t := <-nc.chTrigger
 		common.Log.Debug("net client recieve trigger event", t)
 
+		nc.mutex.Lock()
+		watchers := append([]*Watcher{}, nc.watcherList...)
+		nc.mutex.Unlock()
+
 		// 调用 trigger 事件回调函数
-		for _, w := range nc.watcherList {
-			if w.group == t.group && w.key == t.key && w.status == WatcherStatusOk {
+		for _, w := range watchers {
+			if w.group == t.group && w.key == t.key && nc.getWatcherStatus(w) == WatcherStatusOk {
 				common.Log.Info("net client watcher triggered - " + w.group + "," + w.key)
 				w.callback(t.value, t.valueOld)
 			}
@@ -119,48 +232,37 @@ func (nc *NetClient) handleTrigger() {
 
 // 不断从长连接 conn 中读取 mediator server 发来的请求并处理。
 func (nc *NetClient) handle(conn net.Conn) {
+	reader := newPackReader(conn)
 	for {
 
-		// 读取数据
-		data := make([]byte, ReadLenOnce)
-		length, e := conn.Read(data)
+		// 读取数据，一个包可能跨多次 Read
+		pack, decErr, e := reader.readPack()
 		if e != nil {
 			common.Log.Error("net client handle conn read error", conn.RemoteAddr(), e)
 			conn.Close()
-			return
-		}
-		body := data[:length]
-		common.Log.Debug("net client recieve from server", body)
-
-		arr := bytes.Split(body, common.CL)
-		for _, one := range arr {
 
-			// 0 means it's the last one
-			if len(one) == 0 {
-				continue
+			if !nc.closed() {
+				go nc.reconnect()
 			}
-
-			// 解析请求
-			var pack Pack
-			e = common.Dec(one, &pack)
-			if e != nil {
-				common.Log.Error("net client recieve pack error", e)
-			} else {
-				// some special pack handle
-
-				// 预处理
-				isNext := nc.packPreHandle(pack)
-				// 需要进一步处理
-				if isNext {
-					// 根据 f.Cmd 查找 handler ，然后调用 handler.Fn() 处理 pack 请求。
-					packReturn := nc.process(pack)
-					// 返回响应值
-					if packReturn.Command != CMD_NO_RETURN {
-						r, _ := common.Enc(&packReturn)
-						r = append(r, common.CL...)
-						conn.Write(r)
-					}
-				}
+			return
+		}
+		if decErr != nil {
+			common.Log.Error("net client recieve pack error", decErr)
+			continue
+		}
+		common.Log.Debug("net client recieve from server", pack.Command)
+
+		// some special pack handle
+
+		// 预处理
+		isNext := nc.packPreHandle(pack)
+		// 需要进一步处理
+		if isNext {
+			// 根据 f.Cmd 查找 handler ，然后调用 handler.Fn() 处理 pack 请求。
+			packReturn := nc.process(pack)
+			// 返回响应值
+			if packReturn.Command != CMD_NO_RETURN {
+				nc.Send(packReturn)
 			}
 		}
 	}
@@ -209,12 +311,19 @@ func (nc *NetClient) packPreHandle(pack Pack) bool {
 
 // 发包
 func (nc *NetClient) Send(pack Pack) error {
-	body, e := common.Enc(&pack)
+	body, e := encPack(&pack, PackLegacyFraming)
 	if e != nil {
 		return e
 	}
-	body = append(body, common.CL...)// add CL
-	_, e = nc.conn.Write(body)
+
+	nc.mutex.Lock()
+	conn := nc.conn
+	nc.mutex.Unlock()
+	if conn == nil {
+		return errors.New("net client not connected")
+	}
+
+	_, e = conn.Write(body)
 	return e
 }
 
@@ -223,7 +332,9 @@ func (nc *NetClient) WatchInGroup(group, key string, callback WatcherCallback) {
 	common.Log.Info("net client add watcher - " + group + "," + key)
 	// 先把 watcher 添加到本地列表中，等收到 server 回复后，修改状态为 "WatcherStatusOk" 从而可以进行回调处理。
 	w := &Watcher{ group: group, key: key, callback: callback }
+	nc.mutex.Lock()
 	nc.watcherList = append(nc.watcherList, w)
+	nc.mutex.Unlock()
 	// 调用 server 接口，注册 watcher 。
 	nc.Send(Pack{Command: CMD_REGISTER_WATCHER, Body: []byte(group + "," + key)})
 }
@@ -235,6 +346,9 @@ func (nc *NetClient) Watch(key string, callback WatcherCallback) {
 
 // 等收到 server 回复后，修改状态为 "WatcherStatusOk" 从而可以进行回调处理。
 func (nc *NetClient) setRegisterWatcher(groupKey string) {
+	nc.mutex.Lock()
+	defer nc.mutex.Unlock()
+
 	for _, w := range nc.watcherList {
 		if (w.group + "," + w.key) == groupKey {
 			w.status = WatcherStatusOk
@@ -243,3 +357,15 @@ func (nc *NetClient) setRegisterWatcher(groupKey string) {
 		}
 	}
 }
+
+func (nc *NetClient) setWatcherStatus(w *Watcher, status int) {
+	nc.mutex.Lock()
+	w.status = status
+	nc.mutex.Unlock()
+}
+
+func (nc *NetClient) getWatcherStatus(w *Watcher) int {
+	nc.mutex.Lock()
+	defer nc.mutex.Unlock()
+	return w.status
+}
@@ -0,0 +1,136 @@
+package mediator
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// mediator 重启后 client 自动重连，重新映射 host 并注册 watcher
+func TestNetClientReconnect(t *testing.T) {
+	oldDelay, oldMin := TriggerDelaySec, ReconnectMinMs
+	defer func() { TriggerDelaySec, ReconnectMinMs = oldDelay, oldMin }()
+	TriggerDelaySec, ReconnectMinMs = 0, 50
+
+	startServer := func() *NetServer {
+		s := &NetServer{}
+		if e := s.Start("localhost", 9780); e != nil {
+			t.Fatal(e)
+		}
+		s.AddWatchCallback(WatcherGroupAll, "dog-changed", func() (v, v2 []byte) {
+			return []byte("init"), nil
+		})
+		return s
+	}
+	stopServer := func(s *NetServer) {
+		s.listener.Close()
+		for _, c := range s.conns() {
+			c.Close()
+		}
+	}
+
+	s := startServer()
+
+	chState := make(chan int, 10)
+	chValue := make(chan string, 10)
+	chNotify := make(chan bool, 10)
+
+	c := &NetClient{}
+	c.OnStateChange = func(state int) { chState <- state }
+	c.AddHandler("yyy", func(p Pack) Pack {
+		chNotify <- true
+		return PACK_NO_RETURN
+	})
+	if e := c.Start("localhost:9780"); e != nil {
+		t.Fatal(e)
+	}
+	defer c.Close()
+
+	c.MappingHost("local-client")
+	c.Watch("dog-changed", func(value, valueOld []byte) {
+		chValue <- string(value)
+	})
+
+	waitValue := func() string {
+		select {
+		case v := <-chValue:
+			return v
+		case <-time.After(5 * time.Second):
+			t.Fatal("watcher not triggered")
+		}
+		return ""
+	}
+	waitState := func() int {
+		select {
+		case v := <-chState:
+			return v
+		case <-time.After(5 * time.Second):
+			t.Fatal("state not changed")
+		}
+		return 0
+	}
+
+	if v := waitValue(); v != "init" {
+		t.Fatal("watcher value error", v)
+	}
+
+	// mediator restarts
+	stopServer(s)
+	if state := waitState(); state != NetClientDisconnected {
+		t.Fatal("should be disconnected", state)
+	}
+
+	s = startServer()
+	if state := waitState(); state != NetClientConnected {
+		t.Fatal("should be reconnected", state)
+	}
+
+	// watcher registered again, current value pushed
+	if v := waitValue(); v != "init" {
+		t.Fatal("watcher value after reconnect error", v)
+	}
+
+	// host mapping sent again
+	s.Notify("local-client", Pack{Command: "yyy"})
+	select {
+	case <-chNotify:
+	case <-time.After(5 * time.Second):
+		t.Fatal("notify by host after reconnect failed")
+	}
+
+	s.Tri("", "dog-changed", []byte("changed"), []byte("init"))
+	if v := waitValue(); v != "changed" {
+		t.Fatal("watcher value error", v)
+	}
+
+	// close client first so that it does not reconnect
+	c.Close()
+	stopServer(s)
+}
+
+// Close 之后不再重连
+func TestNetClientCloseNoReconnect(t *testing.T) {
+	oldMin := ReconnectMinMs
+	defer func() { ReconnectMinMs = oldMin }()
+	ReconnectMinMs = 50
+
+	listener, e := net.Listen("tcp", "localhost:9781")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer listener.Close()
+
+	chState := make(chan int, 10)
+	c := &NetClient{}
+	c.OnStateChange = func(state int) { chState <- state }
+	if e := c.Start("localhost:9781"); e != nil {
+		t.Fatal(e)
+	}
+	c.Close()
+
+	select {
+	case state := <-chState:
+		t.Fatal("should not reconnect after close", state)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
@@ -0,0 +1,117 @@
+package mediator
+
+import (
+	"net"
+	"time"
+
+	"github.com/blastbao/whisper/common"
+)
+
+// 连接存活检测
+//
+// 每收到一个包更新连接的 lastSeen ，client 每 common.CheckAliveInterval 秒回复一次 CMD_CHECK_ALIVE 。
+// 超过 ConnSuspectSec 没有收到包时记录日志，超过 ConnEvictSec 时关闭并移除连接。
+// 写入设置 WriteTimeoutMs 超时，写入失败的连接同样被移除，不会阻塞 Pub/Notify 。
+// 连接上注册的成员被移除时写入 watcher key KEY_MEMBER_DEAD 并回调 OnMemberDead ，用于故障切换。
+
+var ConnSuspectSec int = 2 * common.CheckAliveInterval
+var ConnEvictSec int = 3 * common.CheckAliveInterval
+var WriteTimeoutMs int = 5 * 1000
+
+// 移除原因
+const (
+	EVICT_REASON_CLOSED  = "closed"
+	EVICT_REASON_QUIT    = "quit"
+	EVICT_REASON_ERROR   = "read error"
+	EVICT_REASON_TIMEOUT = "timeout"
+	EVICT_REASON_WRITE   = "write error"
+)
+
+type connState struct {
+	lastSeen  time.Time
+	suspected bool
+}
+
+// 成员被移除的事件，KEY_MEMBER_DEAD 的值
+type MemberEvent struct {
+	Member Member
+	Reason string
+	Time   int64 // unix seconds
+}
+
+type MemberDeadFn func(member Member, reason string)
+
+// 收到对端的包
+func (ns *NetServer) seen(conn net.Conn, now time.Time) {
+	addr := conn.RemoteAddr().String()
+
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+
+	if state, ok := ns.connStates[addr]; ok {
+		if state.suspected {
+			common.Log.Info("net server suspected client is alive again - " + addr)
+		}
+		state.lastSeen = now
+		state.suspected = false
+	}
+	if member, ok := ns.members[addr]; ok {
+		member.LastSeen = now.Unix()
+		ns.members[addr] = member
+	}
+}
+
+// 检查所有连接，移除超时的连接，返回被移除的 remoteAddr
+func (ns *NetServer) checkConns(now time.Time) []string {
+	var evicting []net.Conn
+
+	ns.mutex.Lock()
+	for _, c := range ns.cc {
+		addr := c.RemoteAddr().String()
+		state, ok := ns.connStates[addr]
+		if !ok {
+			continue
+		}
+
+		idle := now.Sub(state.lastSeen)
+		if idle >= time.Duration(ConnEvictSec)*time.Second {
+			evicting = append(evicting, c)
+		} else if idle >= time.Duration(ConnSuspectSec)*time.Second && !state.suspected {
+			state.suspected = true
+			common.Log.Warning("net server client suspected as no pack received - "+addr, idle.String())
+		}
+	}
+	ns.mutex.Unlock()
+
+	var addrs []string
+	for _, c := range evicting {
+		ns.evict(c, EVICT_REASON_TIMEOUT)
+		addrs = append(addrs, c.RemoteAddr().String())
+	}
+	return addrs
+}
+
+// 关闭并移除连接
+func (ns *NetServer) evict(conn net.Conn, reason string) {
+	common.Log.Warning("net server evict client - "+conn.RemoteAddr().String(), reason)
+	// 先移除，读取协程随后因连接关闭退出时不会以其它原因再次移除
+	ns.disconnect(conn, reason)
+	conn.Close()
+}
+
+func (ns *NetServer) memberDead(member Member, reason string) {
+	common.Log.Warning("net server member dead", GetRoleName(member.Role), member.Addr, reason)
+
+	if ns.Values != nil {
+		event := MemberEvent{Member: member, Reason: reason, Time: time.Now().Unix()}
+		if body, e := common.Enc(&event); e != nil {
+			common.Log.Error("net server encode member event error", e)
+		} else if e := ns.Values.SetValue(KEY_MEMBER_DEAD, body); e != nil {
+			common.Log.Error("net server save member event error", e)
+		}
+	}
+
+	if ns.OnMemberDead != nil {
+		ns.OnMemberDead(member, reason)
+	}
+}
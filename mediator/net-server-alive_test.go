@@ -0,0 +1,125 @@
+package mediator
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/blastbao/whisper/common"
+)
+
+// 一直不发包的连接被移除，其上的成员触发失效事件
+func TestNetServerEvictTimeout(t *testing.T) {
+	dir, e := ioutil.TempDir("", "whisper-evict")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &NetServer{}
+	zs := NewZnodeStore(dir+"/mediator.znode", nil)
+	s.Values = zs
+	chDead := make(chan string, 10)
+	s.OnMemberDead = func(member Member, reason string) {
+		chDead <- member.Addr + "," + reason
+	}
+	if e := s.Start("localhost", 9784); e != nil {
+		t.Fatal(e)
+	}
+	defer s.listener.Close()
+
+	// raw conn never replies alive
+	conn, e := net.Dial("tcp", "localhost:9784")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer conn.Close()
+
+	body, _ := common.Enc(&Member{Role: common.ROLE_CENTER, Addr: "center-1"})
+	b, _ := encPackFrame(&Pack{Command: CMD_REGISTER_MEMBER, Body: body})
+	if _, e := conn.Write(b); e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 100 && len(s.ListMembers(common.ROLE_CENTER)) == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if len(s.ListMembers(common.ROLE_CENTER)) != 1 {
+		t.Fatal("member not registered")
+	}
+
+	now := time.Now()
+	if addrs := s.checkConns(now.Add(time.Duration(ConnSuspectSec) * time.Second)); len(addrs) != 0 {
+		t.Fatal("suspected conn should not be evicted", addrs)
+	}
+	if addrs := s.checkConns(now.Add(time.Duration(ConnEvictSec+1) * time.Second)); len(addrs) != 1 {
+		t.Fatal("dead conn not evicted", addrs)
+	}
+
+	select {
+	case dead := <-chDead:
+		if dead != "center-1,"+EVICT_REASON_TIMEOUT {
+			t.Fatal("member dead event error", dead)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("member dead event not fired")
+	}
+
+	if len(s.ListClients()) != 0 || len(s.ListMembers(common.ROLE_CENTER)) != 0 {
+		t.Fatal("evicted conn still in server")
+	}
+
+	node, ok := zs.Get(KEY_MEMBER_DEAD)
+	if !ok {
+		t.Fatal("member dead event not saved")
+	}
+	var event MemberEvent
+	if e := common.DecCompat(node.Value, &event); e != nil || event.Member.Addr != "center-1" || event.Reason != EVICT_REASON_TIMEOUT {
+		t.Fatal("member dead event error", event, e)
+	}
+
+	// server closed the conn, read the register reply before
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, e := ioutil.ReadAll(conn); e != nil {
+		t.Fatal("evicted conn should be closed", e)
+	}
+}
+
+// 不读取数据的连接写入超时后被移除，Pub 不会一直阻塞
+func TestNetServerWriteTimeout(t *testing.T) {
+	old := WriteTimeoutMs
+	defer func() { WriteTimeoutMs = old }()
+	WriteTimeoutMs = 100
+
+	s := &NetServer{}
+	if e := s.Start("localhost", 9785); e != nil {
+		t.Fatal(e)
+	}
+	defer s.listener.Close()
+
+	conn, e := net.Dial("tcp", "localhost:9785")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer conn.Close()
+
+	for i := 0; i < 100 && len(s.ListClients()) == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if len(s.ListClients()) != 1 {
+		t.Fatal("conn not accepted")
+	}
+
+	begin := time.Now()
+	p := Pack{Command: "big", Body: make([]byte, 1024*1024)}
+	for i := 0; i < 100 && len(s.ListClients()) != 0; i++ {
+		s.Pub(p)
+	}
+	if len(s.ListClients()) != 0 {
+		t.Fatal("blocked conn not evicted")
+	}
+	if time.Since(begin) > 10*time.Second {
+		t.Fatal("pub blocked too long", time.Since(begin))
+	}
+}
@@ -18,6 +18,12 @@ var ReadLenOnce int = 1024
 type PackServerProcessFn func(p Pack, conn net.Conn) Pack
 type WatchRegisterCallbackFn func() (value, valueOld []byte)
 
+// watcher key 的当前值
+type ValueStore interface {
+	GetValue(key string) ([]byte, bool)
+	SetValue(key string, value []byte) error // saves then triggers watchers
+}
+
 type CmdHandler struct {
 	Cmd string
 	Fn  PackServerProcessFn
@@ -34,6 +40,19 @@ type NetServer struct {
 	tickerCheckAlive         *time.Ticker
 	AliveCheckLogWriter      *common.BufferWriter
 	closeWg                  sync.WaitGroup
+	mutex                    sync.RWMutex // guards cc, watcherKeys, watcherRegisterCallbacks, hostAddrs and members
+	members                  map[string]Member     // key is remoteAddr
+	connStates               map[string]*connState // key is remoteAddr
+	legacyAddrs              map[string]bool // remote addrs sending legacy packs, reply in legacy format
+	legacyMutex              sync.Mutex
+
+	// 设置后，group all 的 Tri 先保存值再通知，watcher 注册时立即收到当前值
+	Values ValueStore
+
+	// 成员注册、断开或超时时回调
+	OnMemberChange MemberChangeFn
+	// 成员所在连接断开或被移除时回调
+	OnMemberDead MemberDeadFn
 }
 
 func (ns *NetServer) Start(ip string, port int) error {
@@ -41,9 +60,8 @@ func (ns *NetServer) Start(ip string, port int) error {
 	listener, e := net.ListenTCP(
 		"tcp",
 		&net.TCPAddr{
-			net.ParseIP(ip),
-			port,
-			"",
+			IP:   net.ParseIP(ip),
+			Port: port,
 		},
 	)
 	if e != nil {
@@ -58,9 +76,13 @@ func (ns *NetServer) Start(ip string, port int) error {
 	ns.watcherKeys = make(map[string][]WatcherInfo)
 	ns.watcherRegisterCallbacks = make(map[string]WatchRegisterCallbackFn)
 	ns.hostAddrs = make(map[string]string)
+	ns.legacyAddrs = make(map[string]bool)
+	ns.members = make(map[string]Member)
+	ns.connStates = make(map[string]*connState)
 	ns.chAliveReply = make(chan string)
 
 	ns.addBaseHandler()
+	ns.addMemberHandler()
 
 	go func() {
 
@@ -84,9 +106,13 @@ func (ns *NetServer) Start(ip string, port int) error {
 			}
 
 			// 保存长连接
+			ns.mutex.Lock()
 			ns.cc = append(ns.cc, conn)
+			ns.connStates[conn.RemoteAddr().String()] = &connState{lastSeen: time.Now()}
+			num := len(ns.cc)
+			ns.mutex.Unlock()
 			common.Log.Info("net server found client connected - " + conn.RemoteAddr().String())
-			common.Log.Info("net server client number - " + strconv.Itoa(len(ns.cc)))
+			common.Log.Info("net server client number - " + strconv.Itoa(num))
 
 			// 后台处理长连接的请求
 			go ns.handle(conn)
@@ -103,8 +129,8 @@ func (ns *NetServer) Start(ip string, port int) error {
 func (ns *NetServer) Close() error {
 
 	// 逐个关闭长连接
-	for _, conn := range ns.cc {
-		ns.disconnect(conn)
+	for _, conn := range ns.conns() {
+		ns.disconnect(conn, "")
 	}
 
 	common.Log.Info("net server is waiting for clients to disconnect")
@@ -127,21 +153,59 @@ func (ns *NetServer) Close() error {
 	return nil
 }
 
-// 断开连接
-func (ns *NetServer) disconnect(conn net.Conn) {
+// 断开连接，reason 不为空时该连接上的成员视为失效
+func (ns *NetServer) disconnect(conn net.Conn, reason string) {
+	addr := conn.RemoteAddr().String()
+
+	ns.mutex.Lock()
+	isFound := false
 	for i, c := range ns.cc {
 		// 查找目标连接
-		if conn.RemoteAddr().String() == c.RemoteAddr().String() {
+		if addr == c.RemoteAddr().String() {
 			// 将 conn 从 ns.cc 中移除
 			ns.cc = append(ns.cc[:i], ns.cc[i+1:]...)
-			// 长连接数目减 1
-			ns.closeWg.Done()
-			common.Log.Info("net server disconnect client - " + conn.RemoteAddr().String())
+			isFound = true
 			break
 		}
 	}
+	var member Member
+	isMember := false
+	if isFound {
+		// 该连接上的 watcher 、host 映射及成员失效，重连后由 client 重新注册
+		delete(ns.watcherKeys, addr)
+		delete(ns.connStates, addr)
+		member, isMember = ns.removeMember(addr)
+		for host, remoteAddr := range ns.hostAddrs {
+			if remoteAddr == addr {
+				delete(ns.hostAddrs, host)
+			}
+		}
+	}
+	ns.mutex.Unlock()
+
+	if !isFound {
+		common.Log.Info("net server disconnect client but skip - " + addr)
+		return
+	}
 
-	common.Log.Info("net server disconnect client but skip - " + conn.RemoteAddr().String())
+	ns.setLegacy(conn, false)
+	if isMember {
+		common.Log.Info("net server member removed", GetRoleName(member.Role), member.Addr, addr)
+		ns.memberChanged(member.Role)
+		if reason != "" {
+			ns.memberDead(member, reason)
+		}
+	}
+	// 长连接数目减 1
+	ns.closeWg.Done()
+	common.Log.Info("net server disconnect client - " + addr)
+}
+
+// 当前长连接的副本，遍历时不持有锁
+func (ns *NetServer) conns() []net.Conn {
+	ns.mutex.RLock()
+	defer ns.mutex.RUnlock()
+	return append([]net.Conn{}, ns.cc...)
 }
 
 func (ns *NetServer) setupKeepalive(conn net.Conn) error {
@@ -158,6 +222,9 @@ func (ns *NetServer) setupKeepalive(conn net.Conn) error {
 func (ns *NetServer) AddWatchCallback(group, key string, fn WatchRegisterCallbackFn) {
 	groupKey := group + "," + key
 
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+
 	// 若已存在，则先移除旧 watcher
 	_, ok := ns.watcherRegisterCallbacks[groupKey]
 	if ok {
@@ -175,7 +242,7 @@ func (ns *NetServer) AddHandler(cmd string, fn PackServerProcessFn) {
 	for i, f := range ns.handlers {
 		if f.Cmd == cmd {
 			ns.handlers[i] = CmdHandler{Cmd: cmd, Fn: fn}
-			break
+			return
 		}
 	}
 
@@ -218,17 +285,30 @@ func (ns *NetServer) addBaseHandler() {
 			group, key := arr[0], arr[1]
 
 			removeAddr := conn.RemoteAddr().String()
+			ns.mutex.Lock()
 			if _, ok := ns.watcherKeys[removeAddr]; !ok {
 				ns.watcherKeys[removeAddr] = []WatcherInfo{}
 			}
 
 			// 注册 Watcher: removeAddr 正在监听 {group, key} 上的变更。
 			ns.watcherKeys[removeAddr] = append(ns.watcherKeys[removeAddr], WatcherInfo{group, key})
+			fn, hasCallback := ns.watcherRegisterCallbacks[groupKey]
+			ns.mutex.Unlock()
+
+			// 有保存的当前值时，先回复注册成功再推送当前值，client 按顺序处理，回调不会丢失
+			if ns.Values != nil {
+				if value, ok := ns.Values.GetValue(key); ok {
+					ns.write(conn, Pack{Command: CMD_ADD_WATCHER_DONE, Body: p.Body})
+					t := Trigger{group, key, value, nil}
+					ns.write(conn, Pack{Command: CMD_TRIGGER_WATCHER, Body: EncTri(&t), Flag: true})
+					return PACK_NO_RETURN
+				}
+			}
 
 			// later tigger
 			//
 			// 获取 groupKey 上的回调函数，如果存在，则延迟触发。
-			if fn, ok := ns.watcherRegisterCallbacks[groupKey]; ok {
+			if hasCallback {
 				go func(group, key string) {
 					common.Log.Info("net server trigger when client after watch register", group, key)
 					// 延迟 3 秒
@@ -254,7 +334,9 @@ func (ns *NetServer) addBaseHandler() {
 		func(p Pack, conn net.Conn) Pack {
 			hostAddr := string(p.Body)
 			remoteAddr := conn.RemoteAddr().String()
+			ns.mutex.Lock()
 			ns.hostAddrs[hostAddr] = remoteAddr
+			ns.mutex.Unlock()
 
 			common.Log.Info("net server add host addr mapping - " + hostAddr + " to " + remoteAddr)
 			return Pack{Command: CMD_MAPPING_HOST, Flag: true}
@@ -318,80 +400,92 @@ func (ns *NetServer) handle(conn net.Conn) {
 	// 长连接数目 +1
 	ns.closeWg.Add(1)
 
+	reader := newPackReader(conn)
 	for {
 
-		// 读取数据
-		data := make([]byte, ReadLenOnce)
-		length, e := conn.Read(data)
+		// 读取数据，一个包可能跨多次 Read
+		pack, decErr, e := reader.readPack()
 		if e != nil {
 			if e == io.EOF {
 				// client closed
 				common.Log.Error("net server found conn closed - " + conn.RemoteAddr().String())
-				ns.disconnect(conn)
+				ns.disconnect(conn, EVICT_REASON_CLOSED)
 			} else {
 				common.Log.Error("net server handle conn read error - "+conn.RemoteAddr().String(), e)
 				conn.Close()
-				ns.disconnect(conn)
+				ns.disconnect(conn, EVICT_REASON_ERROR)
 			}
 			return
 		}
+		ns.seen(conn, time.Now())
+		ns.setLegacy(conn, reader.legacy)
+		common.Log.Debug("net server recieve from client", pack.Command)
 
-		body := data[:length]
-		common.Log.Debug("net server recieve from client", body)
-		arr := bytes.Split(body, common.CL)
-		for _, one := range arr {
+		// 出错处理
+		if decErr != nil {
+			ns.write(conn, Pack{Flag: false, Msg: decErr.Error()})
 
-			if len(one) == 0 {
-				continue
+		// 关闭 NetServer
+		} else if CMD_CLOSE == pack.Command {
+			ns.Close()
+
+		// 关闭长连接 conn
+		} else if CMD_QUIT == pack.Command {
+			common.Log.Error("net server found conn closed - " + conn.RemoteAddr().String())
+			ns.disconnect(conn, EVICT_REASON_QUIT)
+
+		// 执行其它 Command
+		} else {
+			packReturn := ns.handleEach(pack, conn)
+			if packReturn.Command != CMD_NO_RETURN {
+				ns.write(conn, packReturn)
 			}
+		}
+	}
+}
 
-			// 数据解析
-			var pack Pack
-			e = common.Dec(one, &pack)
+// 记录对端使用的格式，以相同格式发送
+func (ns *NetServer) setLegacy(conn net.Conn, legacy bool) {
+	addr := conn.RemoteAddr().String()
 
+	ns.legacyMutex.Lock()
+	defer ns.legacyMutex.Unlock()
 
-			// 出错处理
-			if e != nil {
-				packReturn := Pack{}
-				packReturn.Flag = false
-				packReturn.Msg = e.Error()
-				r, _ := common.Enc(&packReturn)
-				// add CL
-				r = append(r, common.CL...)
-				conn.Write(r)
-
-			// 执行 pack.Command 命令
-			} else {
+	if legacy {
+		ns.legacyAddrs[addr] = true
+	} else {
+		delete(ns.legacyAddrs, addr)
+	}
+}
 
-				// 关闭 NetServer
-				if CMD_CLOSE == pack.Command {
-					ns.Close()
-
-				// 关闭长连接 conn
-				} else if CMD_QUIT == pack.Command {
-					common.Log.Error("net server found conn closed - " + conn.RemoteAddr().String())
-					ns.disconnect(conn)
-
-				// 执行其它 Command
-				} else {
-					packReturn := ns.handleEach(pack, conn)
-					if packReturn.Command != CMD_NO_RETURN {
-						r, _ := common.Enc(&packReturn)
-						// add CL
-						r = append(r, common.CL...)
-						conn.Write(r)
-					}
-				}
-			}
-		}
+func (ns *NetServer) isLegacy(conn net.Conn) bool {
+	ns.legacyMutex.Lock()
+	defer ns.legacyMutex.Unlock()
+
+	return PackLegacyFraming || ns.legacyAddrs[conn.RemoteAddr().String()]
+}
+
+// 按对端的格式编码并发送
+func (ns *NetServer) write(conn net.Conn, p Pack) error {
+	b, e := encPack(&p, ns.isLegacy(conn))
+	if e != nil {
+		return e
+	}
 
+	// 对端不读取时不会一直阻塞
+	conn.SetWriteDeadline(time.Now().Add(time.Duration(WriteTimeoutMs) * time.Millisecond))
+	if _, e = conn.Write(b); e != nil {
+		common.Log.Error("net server write error - "+conn.RemoteAddr().String(), e)
+		ns.evict(conn, EVICT_REASON_WRITE)
+		return e
 	}
+	return nil
 }
 
 // 获取在线长连接的 RemoteAddrs
 func (ns *NetServer) ListClients() []string {
 	var r []string
-	for _, c := range ns.cc {
+	for _, c := range ns.conns() {
 		r = append(r, c.RemoteAddr().String())
 	}
 	return r
@@ -402,9 +496,37 @@ func (ns *NetServer) Tri(group, key string, value, valueOld []byte) []string {
 	if "" == group {
 		group = WatcherGroupAll
 	}
+
+	// 保存当前值，由 store 通知 watcher
+	if group == WatcherGroupAll && ns.Values != nil {
+		if e := ns.Values.SetValue(key, value); e != nil {
+			common.Log.Error("net server save watcher value error", key, e)
+		}
+		return nil
+	}
 	return ns.Trigger(Trigger{group, key, value, valueOld})
 }
 
+// 通知所有监听 key 的 watcher ，group all 的每个 client 及其它每个 group 中的一个 client
+func (ns *NetServer) TriggerKey(key string, value, valueOld []byte) []string {
+	groups := map[string]bool{}
+	ns.mutex.RLock()
+	for _, watchers := range ns.watcherKeys {
+		for _, watcher := range watchers {
+			if watcher.key == key {
+				groups[watcher.group] = true
+			}
+		}
+	}
+	ns.mutex.RUnlock()
+
+	var addrs []string
+	for group := range groups {
+		addrs = append(addrs, ns.Trigger(Trigger{group, key, value, valueOld})...)
+	}
+	return addrs
+}
+
 // need trigger different clients in balance TODO
 func (ns *NetServer) Trigger(t Trigger) []string {
 
@@ -412,6 +534,7 @@ func (ns *NetServer) Trigger(t Trigger) []string {
 
 	// 每个 remoteAddr 可能关联多个 Watchers ，需要遍历每个 remoteAddr 关联的 Watchers ，
 	// 如果其中某个 Watcher 和 t.group/t.key 相匹配，就需要回调通知这个 remoteAddr 。
+	ns.mutex.RLock()
 	for remoteAddr, watchers := range ns.watcherKeys {
 
 		for _, watcher := range watchers {
@@ -421,19 +544,14 @@ func (ns *NetServer) Trigger(t Trigger) []string {
 				continue
 			}
 
-			// ???
-			if t.group != WatcherGroupAll {
+			// group all 通知所有 client ，其它 group 只通知其中一个
+			if t.group == WatcherGroupAll || len(addrs) == 0 {
 				addrs = append(addrs, remoteAddr)
-			} else {
-				// only one
-				if len(addrs) == 0 {
-					addrs = append(addrs, remoteAddr)
-				} else {
-					break
-				}
 			}
+			break
 		}
 	}
+	ns.mutex.RUnlock()
 	common.Log.Info("net server trigger - " + t.group + "," + t.key + " - " + strings.Join(addrs, ","))
 
 	// 遍历所有需要通知的 addrs ，将 t 序列化后发送给它们。
@@ -446,31 +564,29 @@ func (ns *NetServer) Trigger(t Trigger) []string {
 }
 
 func (ns *NetServer) Notify(remoteAddr string, p Pack) {
-	// 二进制序列化
-	body, _ := common.Enc(&p)
-
 	// 遍历所有长连接，如果找到匹配地址 remoteAddr 的 conn ，则将数据 p 发送给它。
-	isExist := false
+	var conn net.Conn
+	ns.mutex.RLock()
 	for _, c := range ns.cc {
 		connAddr := c.RemoteAddr().String()
 		if connAddr == remoteAddr || connAddr == ns.hostAddrs[remoteAddr] {
-			isExist = true
-			c.Write(append(body, common.CL...)) // add CL
+			conn = c
 			break
 		}
 	}
+	ns.mutex.RUnlock()
 
-	if !isExist {
+	if conn == nil {
 		common.Log.Warning("remote addr not exists in clients", remoteAddr)
+		return
 	}
+	ns.write(conn, p)
 }
 
 func (ns *NetServer) Pub(p Pack) {
-	// 二进制序列化
-	body, _ := common.Enc(&p)
 	// 遍历所有长连接，向每个长连接发送数据 p 。
-	for _, c := range ns.cc {
-		_, _ = c.Write(append(body, common.CL...))	// add CL
+	for _, c := range ns.conns() {
+		_ = ns.write(c, p)
 	}
 }
 
@@ -487,6 +603,8 @@ func (ns *NetServer) checkAlivePub() {
 			common.Log.Info("net server check alive publishing")
 			// 定时广播消息到每个长连接
 			ns.Pub(Pack{Command: CMD_CHECK_ALIVE})
+			// 移除超时未回复的连接
+			ns.checkConns(time.Now())
 		}
 	}
 }
@@ -505,6 +623,9 @@ func (ns *NetServer) checkAliveLog() {
 }
 
 func (ns *NetServer) GetClientHostByRemoteAddr(remoteAddr string) string {
+	ns.mutex.RLock()
+	defer ns.mutex.RUnlock()
+
 	for key, val := range ns.hostAddrs {
 		if val == remoteAddr {
 			return key
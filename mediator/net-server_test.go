@@ -37,7 +37,8 @@ func TestNetServer(t *testing.T) {
 
 		if e := c.Start("localhost:9778"); e != nil {
 			common.Log.Error("client start error", e)
-			t.Fatal(e)
+			t.Error(e)
+			return
 		}
 		c.AddHandler("zzz", func(p Pack) Pack {
 			common.Log.Info("..." + p.Command)
@@ -56,13 +57,15 @@ func TestNetServer(t *testing.T) {
 
 		e := c.Send(Pack{Command: "aaa"})
 		if e != nil {
-			t.Fatal(e)
+			t.Error(e)
+			return
 		}
 
 		time.Sleep(time.Duration(10) * time.Second)
 		e = c.Send(Pack{Command: CMD_QUIT})
 		if e != nil {
-			t.Fatal(e)
+			t.Error(e)
+			return
 		}
 	}()
 
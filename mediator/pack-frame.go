@@ -0,0 +1,149 @@
+package mediator
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+
+	"github.com/blastbao/whisper/common"
+)
+
+// Pack 传输格式
+//
+// frame:  [1 字节 PACK_MAGIC][1 字节 PACK_VERSION][4 字节 payload 长度][payload]，payload 为序列化的 Pack
+// legacy: [payload][common.CL]，payload 过长或包含 CL 时会被截断或切开，仅用于兼容旧版本
+//
+// 读取时按首字节识别两种格式，可以与旧版本的对端混用；
+// 发送时默认使用 frame ，PackLegacyFraming 为 true 时使用 legacy ，用于新 client 连接旧 server 的升级过程。
+// server 对曾发来 legacy 包的连接也以 legacy 格式发送。
+
+const (
+	PACK_MAGIC        = 0xF8
+	PACK_VERSION      = 1
+	PACK_FRAME_HEADER = 6
+)
+
+// 0xF8 can not be the first byte of a marshalled Pack, whose command length is a small uvarint
+var PackLegacyFraming bool = false
+
+// max payload length of one frame
+var PackMaxLen int = 64 * 1024 * 1024
+
+func encPackFrame(p *Pack) ([]byte, error) {
+	body, e := common.Enc(p)
+	if e != nil {
+		return nil, e
+	}
+
+	b := make([]byte, PACK_FRAME_HEADER, PACK_FRAME_HEADER+len(body))
+	b[0] = PACK_MAGIC
+	b[1] = PACK_VERSION
+	binary.BigEndian.PutUint32(b[2:PACK_FRAME_HEADER], uint32(len(body)))
+	return append(b, body...), nil
+}
+
+func encPackLegacy(p *Pack) ([]byte, error) {
+	body, e := common.Enc(p)
+	if e != nil {
+		return nil, e
+	}
+	return append(body, common.CL...), nil // add CL
+}
+
+func encPack(p *Pack, legacy bool) ([]byte, error) {
+	if legacy {
+		return encPackLegacy(p)
+	}
+	return encPackFrame(p)
+}
+
+// 从连接中连续读取 Pack ，数据可以跨多次 Read
+type packReader struct {
+	reader *bufio.Reader
+	legacy bool // the last pack read is legacy format
+}
+
+func newPackReader(r io.Reader) *packReader {
+	return &packReader{reader: bufio.NewReaderSize(r, ReadLenOnce)}
+}
+
+// 读取下一个包的 payload
+//
+// 返回 error 时连接不可再用，payload 解码失败不影响后续读取。
+func (pr *packReader) next() ([]byte, error) {
+	for {
+		first, e := pr.reader.Peek(1)
+		if e != nil {
+			return nil, e
+		}
+
+		if first[0] != PACK_MAGIC {
+			pr.legacy = true
+			body, e := pr.readLegacy()
+			if e != nil {
+				return nil, e
+			}
+			// 0 means it's an empty line
+			if len(body) == 0 {
+				continue
+			}
+			return body, nil
+		}
+
+		pr.legacy = false
+		return pr.readFrame()
+	}
+}
+
+func (pr *packReader) readFrame() ([]byte, error) {
+	head := make([]byte, PACK_FRAME_HEADER)
+	if _, e := io.ReadFull(pr.reader, head); e != nil {
+		return nil, e
+	}
+	if head[1] != PACK_VERSION {
+		return nil, errors.New("pack version not supported - " + strconv.Itoa(int(head[1])))
+	}
+
+	size := int(binary.BigEndian.Uint32(head[2:PACK_FRAME_HEADER]))
+	if size > PackMaxLen {
+		return nil, errors.New("pack too large - " + strconv.Itoa(size))
+	}
+
+	body := make([]byte, size)
+	if _, e := io.ReadFull(pr.reader, body); e != nil {
+		return nil, e
+	}
+	return body, nil
+}
+
+// 读到 CL 为止
+func (pr *packReader) readLegacy() ([]byte, error) {
+	var body []byte
+	for {
+		line, e := pr.reader.ReadBytes(common.CL[len(common.CL)-1])
+		body = append(body, line...)
+		if e != nil {
+			return nil, e
+		}
+		if bytes.HasSuffix(body, common.CL) {
+			return body[:len(body)-len(common.CL)], nil
+		}
+		if len(body) > PackMaxLen {
+			return nil, errors.New("pack too large - " + strconv.Itoa(len(body)))
+		}
+	}
+}
+
+// 读取并解码下一个包，decErr 不为 nil 表示该包解码失败，可以继续读取
+func (pr *packReader) readPack() (pack Pack, decErr error, err error) {
+	body, err := pr.next()
+	if err != nil {
+		return
+	}
+	// binary returns io.EOF when the last field is an empty string, all fields are decoded then
+	decErr = common.DecCompat(body, &pack)
+	return
+}
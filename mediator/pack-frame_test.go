@@ -0,0 +1,105 @@
+package mediator
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPackReader(t *testing.T) {
+	// larger than ReadLenOnce and containing CL
+	big := bytes.Repeat([]byte("a\r\nb"), 1000)
+
+	buf := &bytes.Buffer{}
+	packs := []Pack{
+		{Command: "big", Body: big, Flag: true},
+		{Command: "legacy", Body: []byte("old client")},
+		{Command: "small", Msg: "ok"},
+	}
+	for i, p := range packs {
+		b, e := encPack(&p, i == 1)
+		if e != nil {
+			t.Fatal(e)
+		}
+		buf.Write(b)
+	}
+
+	// read a few bytes at a time
+	reader := newPackReader(&slowReader{buf, 7})
+	for i, p := range packs {
+		pack, decErr, e := reader.readPack()
+		if e != nil || decErr != nil {
+			t.Fatal(e, decErr)
+		}
+		if pack.Command != p.Command || !bytes.Equal(pack.Body, p.Body) || pack.Flag != p.Flag || pack.Msg != p.Msg {
+			t.Fatal("pack read error", i, pack.Command)
+		}
+		if reader.legacy != (i == 1) {
+			t.Fatal("pack legacy format not detected", i)
+		}
+	}
+	if _, _, e := reader.readPack(); e == nil {
+		t.Fatal("should return eof")
+	}
+}
+
+func TestPackReaderTooLarge(t *testing.T) {
+	old := PackMaxLen
+	defer func() { PackMaxLen = old }()
+	PackMaxLen = 10
+
+	b, _ := encPackFrame(&Pack{Command: "big", Body: make([]byte, 100)})
+	if _, _, e := newPackReader(bytes.NewReader(b)).readPack(); e == nil {
+		t.Fatal("should fail as pack too large")
+	}
+}
+
+func TestNetServerLargePack(t *testing.T) {
+	s := &NetServer{}
+	if e := s.Start("localhost", 9779); e != nil {
+		t.Fatal(e)
+	}
+	defer s.listener.Close()
+
+	big := bytes.Repeat([]byte{'\r', '\n', 0, 1}, 4096)
+	s.AddHandler("echo", func(p Pack, conn net.Conn) Pack {
+		return Pack{Command: "echo-back", Body: p.Body}
+	})
+
+	c := &NetClient{}
+	ch := make(chan []byte, 1)
+	c.AddHandler("echo-back", func(p Pack) Pack {
+		ch <- p.Body
+		return PACK_NO_RETURN
+	})
+	if e := c.Start("localhost:9779"); e != nil {
+		t.Fatal(e)
+	}
+	defer c.Close()
+
+	if e := c.Send(Pack{Command: "echo", Body: big}); e != nil {
+		t.Fatal(e)
+	}
+
+	select {
+	case body := <-ch:
+		if !bytes.Equal(body, big) {
+			t.Fatal("large pack corrupted", len(body))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("large pack not echoed")
+	}
+}
+
+type slowReader struct {
+	buf *bytes.Buffer
+	n   int
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if len(p) > r.n {
+		p = p[:r.n]
+	}
+	return r.buf.Read(p)
+}
@@ -15,7 +15,51 @@ const (
 	CMD_TRIGGER_WATCHER  = "201"
 	CMD_REGISTER_WATCHER = "202"
 	CMD_MAPPING_HOST     = "300"
+	CMD_REGISTER_MEMBER  = "301"
 	CMD_DO_NOTIFY        = "400"
+
+	// block compaction, control -> mediator -> center(usage) -> mediator -> agent -> mediator
+	CMD_COMPACT            = "500"
+	CMD_BLOCK_USAGE        = "501"
+	CMD_COMPACT_BLOCK      = "502"
+	CMD_COMPACT_BLOCK_DONE = "503"
+
+	// znode store, body is ZnodeOp, reply body is Znode
+	CMD_ZNODE_GET    = "600"
+	CMD_ZNODE_SET    = "601"
+	CMD_ZNODE_CAS    = "602"
+	CMD_ZNODE_DELETE = "603"
+
+	// center master election, mediator -> center -> mediator
+	CMD_CENTER_STATE = "700"
+	CMD_CENTER_ROLE  = "701"
+
+	// center sharding, control -> mediator -> center master -> mediator
+	CMD_NEW_INDEX        = "800"
+	CMD_CENTER_NEW_INDEX = "new-data" // body is the index id
+
+	// block ends reported by agent, agent -> mediator
+	CMD_BLOCK_REPORT = "900"
+
+	// block allocation, agent(disks) -> mediator -> agent(preallocate) -> mediator, control -> mediator(status)
+	CMD_DISK_REPORT      = "901"
+	CMD_ALLOC_BLOCK      = "902"
+	CMD_ALLOC_BLOCK_DONE = "903"
+	CMD_BLOCK_STATUS     = "904"
+)
+
+// watched by clients, agent addrs joined by comma, kept by the member registry
+const KEY_NODE_SERVER_ADDRS = "client-connect-to-node-server"
+
+// watched by failover logic, value is MemberEvent of the last dead member
+const KEY_MEMBER_DEAD = "member-dead"
+
+// center master addr, set by the mediator after election
+const (
+	KEY_CLIENT_CENTER_ADDR      = "client-connect-to-center"
+	KEY_NODE_SERVER_CENTER_ADDR = "node-server-connect-to-center"
+	KEY_CENTER_TOPOLOGY         = "center-topology" // CenterRole of the default group
+	KEY_CENTER_SHARDS           = "center-shards"   // CenterShards
 )
 
 type Pack struct {
@@ -0,0 +1,266 @@
+package mediator
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/blastbao/whisper/common"
+)
+
+// center 分片
+//
+// center 按配置的分组(Member.Group)组成多个 master/slave 组，每组负责若干段 IndexId(CenterRole.Ranges)，
+// oid 中的 IndexId(center.GetOidInfo) 决定由哪个组处理。
+// (1) 组内 master 回复的 CenterState 带有本地已有的索引，没有分配的索引分给该组
+// (2) CMD_NEW_INDEX 时先刷新各组的记录数，再选择记录最少的组，分配最大的 IndexId + 1 ，通知该组 master 创建
+// (3) 所有分组写入 KEY_CENTER_SHARDS ，client/agent 据此为每个 oid 选择连接，不属于任何组的索引使用默认分组
+// 默认分组的拓扑同时写入 KEY_CENTER_TOPOLOGY 及 client/agent 监听的 master 地址，兼容旧版本。
+
+const DEFAULT_CENTER_GROUP = ""
+
+// index ids in [From, To]
+type IndexRange struct {
+	From int
+	To   int
+}
+
+// 所有分组的拓扑，保存在 KEY_CENTER_SHARDS
+type CenterShards struct {
+	Groups []CenterRole // sorted by Group
+}
+
+func (role CenterRole) Contains(indexId int) bool {
+	for _, r := range role.Ranges {
+		if indexId >= r.From && indexId <= r.To {
+			return true
+		}
+	}
+	return false
+}
+
+// 负责 indexId 的分组
+func (s CenterShards) GroupOf(indexId int) (CenterRole, bool) {
+	for _, role := range s.Groups {
+		if role.Contains(indexId) {
+			return role, true
+		}
+	}
+	return CenterRole{}, false
+}
+
+// 加入 id 并合并相邻的范围
+func addIndexRange(ranges []IndexRange, id int) []IndexRange {
+	r := append(append([]IndexRange{}, ranges...), IndexRange{From: id, To: id})
+	sort.Slice(r, func(i, j int) bool { return r[i].From < r[j].From })
+
+	merged := []IndexRange{r[0]}
+	for _, one := range r[1:] {
+		last := &merged[len(merged)-1]
+		if one.From <= last.To+1 {
+			if one.To > last.To {
+				last.To = one.To
+			}
+			continue
+		}
+		merged = append(merged, one)
+	}
+	return merged
+}
+
+func sameStrs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *Mediator) addShardHandler() {
+
+	// 创建索引，control -> mediator
+	m.Server.AddHandler(
+		CMD_NEW_INDEX,
+		func(p Pack, conn net.Conn) Pack {
+			go func() {
+				m.refreshCenterLoads()
+				time.Sleep(time.Duration(ElectionWaitMs) * time.Millisecond)
+				if _, _, e := m.NewIndex(); e != nil {
+					common.Log.Error("mediator new index error", e)
+				}
+			}()
+			return Pack{Command: CMD_NEW_INDEX, Flag: true}
+		},
+	)
+
+	// center master 创建索引的结果
+	m.Server.AddHandler(
+		CMD_CENTER_NEW_INDEX,
+		func(p Pack, conn net.Conn) Pack {
+			if !p.Flag {
+				common.Log.Error("mediator center new index fail", conn.RemoteAddr().String(), p.Msg)
+			} else {
+				common.Log.Info("mediator center new index done", conn.RemoteAddr().String(), string(p.Body))
+			}
+			return PACK_NO_RETURN
+		},
+	)
+}
+
+// 向各组 master 请求状态，回复时更新记录数
+func (m *Mediator) refreshCenterLoads() {
+	for _, member := range m.Server.ListMembers(common.ROLE_CENTER) {
+		if m.CenterMasterOf(member.Group) == member.Addr {
+			m.Server.Notify(member.RemoteAddr, Pack{Command: CMD_CENTER_STATE})
+		}
+	}
+}
+
+// need lock first, 已分配的最大 IndexId
+func (m *Mediator) maxIndexId() int {
+	max := 0
+	for _, role := range m.centerRoles {
+		for _, r := range role.Ranges {
+			if r.To > max {
+				max = r.To
+			}
+		}
+	}
+	return max
+}
+
+// need lock first, 将没有分配的索引分给 group ，有变化时返回 true
+func (m *Mediator) assignIndexes(group string, ids []int) bool {
+	isChanged := false
+	for _, id := range ids {
+		isAssigned := false
+		for _, role := range m.centerRoles {
+			if role.Contains(id) {
+				isAssigned = true
+				break
+			}
+		}
+		if isAssigned {
+			continue
+		}
+
+		role := m.centerRoles[group]
+		role.Ranges = addIndexRange(role.Ranges, id)
+		m.centerRoles[group] = role
+		isChanged = true
+		common.Log.Info("mediator index assigned to center group", id, group)
+	}
+	return isChanged
+}
+
+// need lock first, 有 master 的分组中记录最少的，相同时索引数少的优先，再按名称
+func (m *Mediator) leastLoadedGroup() string {
+	var groups []string
+	for group, role := range m.centerRoles {
+		if role.Master != "" {
+			groups = append(groups, group)
+		}
+	}
+	if len(groups) == 0 {
+		return ""
+	}
+
+	indexes := func(group string) int {
+		n := 0
+		for _, r := range m.centerRoles[group].Ranges {
+			n += r.To - r.From + 1
+		}
+		return n
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		a, b := groups[i], groups[j]
+		if m.centerLoads[a] != m.centerLoads[b] {
+			return m.centerLoads[a] < m.centerLoads[b]
+		}
+		if indexes(a) != indexes(b) {
+			return indexes(a) < indexes(b)
+		}
+		return a < b
+	})
+	return groups[0]
+}
+
+// 在负载最小的分组中创建索引，返回 IndexId 及分组
+func (m *Mediator) NewIndex() (int, string, error) {
+	m.mutex.Lock()
+	group := m.leastLoadedGroup()
+	role, ok := m.centerRoles[group]
+	if !ok || role.Master == "" {
+		m.mutex.Unlock()
+		return 0, "", errors.New("mediator new index error as no center master")
+	}
+
+	id := m.maxIndexId() + 1
+	role.Ranges = addIndexRange(role.Ranges, id)
+	m.centerRoles[group] = role
+	m.mutex.Unlock()
+
+	common.Log.Info("mediator new index", id, group, role.Master)
+	m.publishShards()
+
+	for _, member := range centerGroups(m.Server.ListMembers(common.ROLE_CENTER))[group] {
+		if member.Addr == role.Master {
+			m.Server.Notify(member.RemoteAddr, Pack{Command: CMD_CENTER_NEW_INDEX, Body: []byte(strconv.Itoa(id))})
+		}
+	}
+	return id, group, nil
+}
+
+// 所有分组的拓扑
+func (m *Mediator) CenterShards() CenterShards {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var shards CenterShards
+	for _, role := range m.centerRoles {
+		shards.Groups = append(shards.Groups, role)
+	}
+	sort.Slice(shards.Groups, func(i, j int) bool { return shards.Groups[i].Group < shards.Groups[j].Group })
+	return shards
+}
+
+// 保存并通知所有分组的拓扑，默认分组同时写入旧的 key
+func (m *Mediator) publishShards() {
+	shards := m.CenterShards()
+	body, e := common.Enc(&shards)
+	if e != nil {
+		common.Log.Error("mediator center shards encode error", e)
+		return
+	}
+	if _, e := m.Znodes.Set(KEY_CENTER_SHARDS, body); e != nil {
+		common.Log.Error("mediator save center shards error", e)
+	}
+
+	for _, role := range shards.Groups {
+		if role.Group != DEFAULT_CENTER_GROUP {
+			continue
+		}
+		body, e := common.Enc(&role)
+		if e != nil {
+			common.Log.Error("mediator center role encode error", e)
+			return
+		}
+		if _, e := m.Znodes.Set(KEY_CENTER_TOPOLOGY, body); e != nil {
+			common.Log.Error("mediator save center topology error", e)
+		}
+		for _, key := range []string{KEY_CLIENT_CENTER_ADDR, KEY_NODE_SERVER_CENTER_ADDR} {
+			if node, ok := m.Znodes.Get(key); ok && string(node.Value) == role.Master {
+				continue
+			}
+			if _, e := m.Znodes.Set(key, []byte(role.Master)); e != nil {
+				common.Log.Error("mediator publish center master error", key, e)
+			}
+		}
+	}
+}
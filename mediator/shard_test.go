@@ -0,0 +1,117 @@
+package mediator
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/blastbao/whisper/common"
+)
+
+func TestAddIndexRange(t *testing.T) {
+	var ranges []IndexRange
+	for _, id := range []int{3, 1, 2, 7, 5} {
+		ranges = addIndexRange(ranges, id)
+	}
+	if len(ranges) != 3 || ranges[0] != (IndexRange{1, 3}) || ranges[1] != (IndexRange{5, 5}) || ranges[2] != (IndexRange{7, 7}) {
+		t.Fatal("ranges error", ranges)
+	}
+	if ranges = addIndexRange(ranges, 6); len(ranges) != 2 || ranges[1] != (IndexRange{5, 7}) {
+		t.Fatal("adjacent ranges should merge", ranges)
+	}
+
+	shards := CenterShards{Groups: []CenterRole{
+		{Master: "c1", Ranges: []IndexRange{{1, 2}}},
+		{Group: "g1", Master: "c2", Ranges: ranges},
+	}}
+	if role, ok := shards.GroupOf(6); !ok || role.Group != "g1" {
+		t.Fatal("group of index error", role)
+	}
+	if _, ok := shards.GroupOf(4); ok {
+		t.Fatal("unassigned index should have no group")
+	}
+}
+
+// 已有索引分给回复的分组，新索引分给记录最少的分组
+func TestMediatorNewIndex(t *testing.T) {
+	dir, e := ioutil.TempDir("", "whisper-shard")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	m := &Mediator{Dir: dir, mutex: new(sync.Mutex), Server: &NetServer{}}
+	m.centerRoles = make(map[string]CenterRole)
+	m.centerStates = make(map[string]map[string]CenterState)
+	m.centerLoads = make(map[string]int)
+	m.Znodes = NewZnodeStore(m.getZnodeFile(), nil)
+
+	if _, _, e := m.NewIndex(); e == nil {
+		t.Fatal("new index without center master should fail")
+	}
+
+	m.centerRoles[DEFAULT_CENTER_GROUP] = CenterRole{Master: "c1"}
+	m.centerRoles["g1"] = CenterRole{Group: "g1", Master: "c2"}
+	if !m.assignIndexes(DEFAULT_CENTER_GROUP, []int{1, 2}) {
+		t.Fatal("indexes should be assigned")
+	}
+	// assigned to the default group already
+	if m.assignIndexes("g1", []int{2}) {
+		t.Fatal("assigned index should not move")
+	}
+	m.centerLoads[DEFAULT_CENTER_GROUP] = 100
+	m.centerLoads["g1"] = 10
+
+	id, group, e := m.NewIndex()
+	if e != nil || id != 3 || group != "g1" {
+		t.Fatal("new index error", id, group, e)
+	}
+
+	// equal records, fewer indexes wins
+	m.centerLoads["g1"] = 100
+	if id, group, _ = m.NewIndex(); id != 4 || group != "g1" {
+		t.Fatal("new index error", id, group)
+	}
+
+	node, ok := m.Znodes.Get(KEY_CENTER_SHARDS)
+	if !ok {
+		t.Fatal("center shards not published")
+	}
+	var shards CenterShards
+	if e := common.DecCompat(node.Value, &shards); e != nil {
+		t.Fatal(e)
+	}
+	if role, ok := shards.GroupOf(4); !ok || role.Group != "g1" || role.Master != "c2" {
+		t.Fatal("published shards error", shards)
+	}
+	if node, ok := m.Znodes.Get(KEY_CLIENT_CENTER_ADDR); !ok || string(node.Value) != "c1" {
+		t.Fatal("default group master should be published", node)
+	}
+}
+
+// 合并各分组 master 回复的块使用情况
+func TestMediatorCollectUsages(t *testing.T) {
+	m := &Mediator{mutex: new(sync.Mutex)}
+	m.centerRoles = map[string]CenterRole{
+		DEFAULT_CENTER_GROUP: {Master: "c1"},
+		"g1":                 {Group: "g1", Master: "c2"},
+	}
+
+	// not compacting
+	if r := m.collectUsages("g1", []BlockUsage{{BlockId: 1}}); len(r) != 1 {
+		t.Fatal("usage should pass through", r)
+	}
+
+	m.usages = make(map[string][]BlockUsage)
+	if r := m.collectUsages(DEFAULT_CENTER_GROUP, []BlockUsage{{BlockId: 2, Live: 10, Total: 20}, {BlockId: 1, Live: 1, Total: 1}}); r != nil {
+		t.Fatal("should wait for all groups", r)
+	}
+	r := m.collectUsages("g1", []BlockUsage{{BlockId: 2, Live: 5, Total: 30}})
+	if len(r) != 2 || r[0] != (BlockUsage{BlockId: 1, Live: 1, Total: 1}) || r[1] != (BlockUsage{BlockId: 2, Live: 15, Total: 50}) {
+		t.Fatal("usages error", r)
+	}
+	if m.usages != nil {
+		t.Fatal("usages should be reset")
+	}
+}
@@ -0,0 +1,91 @@
+package mediator
+
+import (
+	"net"
+
+	"github.com/blastbao/whisper/common"
+)
+
+// 故障域
+//
+// agent 注册时带上所在的 zone/rack ，mediator 据此标记该 agent 的块，新建的块沿用 agent 的标签，
+// host/disk 即块的 Addr/Dir 。client 按故障域分散副本，见 client.getTargetBlocks 的 STRATEGY_TOPOLOGY 。
+
+// failure domain levels, from the largest to the smallest
+const (
+	TOPOLOGY_NONE = 0
+	TOPOLOGY_ZONE = 1
+	TOPOLOGY_RACK = 2
+	TOPOLOGY_HOST = 3
+	TOPOLOGY_DISK = 4
+)
+
+// agent 所在的位置
+type Topology struct {
+	Zone string
+	Rack string
+}
+
+// 块在 level 上所属的故障域，包含上层的故障域，未标记的 zone/rack 视为同一个
+func (b Block) Domain(level int) string {
+	switch level {
+	case TOPOLOGY_ZONE:
+		return b.Zone
+	case TOPOLOGY_RACK:
+		return b.Zone + "/" + b.Rack
+	case TOPOLOGY_HOST:
+		return b.Zone + "/" + b.Rack + "/" + b.Addr
+	case TOPOLOGY_DISK:
+		return b.Zone + "/" + b.Rack + "/" + b.Addr + "/" + b.Dir
+	}
+	return ""
+}
+
+// agent 注册或变化时更新其块的标签，有变化时持久化并刷新块列表
+func (m *Mediator) LabelBlocks(members MemberList) int {
+	m.mutex.Lock()
+	if m.topology == nil {
+		m.topology = make(map[string]Topology)
+	}
+	for _, member := range members {
+		host, _, e := net.SplitHostPort(member.Addr)
+		if e != nil {
+			host = member.Addr
+		}
+		m.topology[host] = Topology{Zone: member.Zone, Rack: member.Rack}
+	}
+
+	var changed []Block
+	m.eachBlock(func(block Block) error {
+		t, ok := m.topology[block.Addr]
+		if !ok || (block.Zone == t.Zone && block.Rack == t.Rack) {
+			return nil
+		}
+		block.Zone = t.Zone
+		block.Rack = t.Rack
+		changed = append(changed, block)
+		return nil
+	})
+	for _, block := range changed {
+		m.BlockTree.Set(block.BlockId, block)
+	}
+	m.mutex.Unlock()
+
+	if len(changed) == 0 {
+		return 0
+	}
+	common.Log.Info("mediator block topology labeled", len(changed))
+	if e := m.Persist(); e != nil {
+		common.Log.Error("mediator label blocks persist error", e)
+	}
+	m.RefreshBlocks()
+	return len(changed)
+}
+
+// 新建块时使用 agent 的标签，need lock first
+func (m *Mediator) labelBlock(block *Block) {
+	if t, ok := m.topology[block.Addr]; ok {
+		block.Zone = t.Zone
+		block.Rack = t.Rack
+	}
+}
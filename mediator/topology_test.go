@@ -0,0 +1,37 @@
+package mediator
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMediatorLabelBlocks(t *testing.T) {
+	m := newTestAllocMediator(t)
+	defer os.RemoveAll(m.Dir)
+
+	m.BlockTree.Set(1, Block{BlockId: 1, Addr: "a1", Dir: "/d1", Size: 100})
+	m.BlockTree.Set(2, Block{BlockId: 2, Addr: "a2", Dir: "/d1", Size: 100})
+
+	members := MemberList{{Addr: "a1:9783", Zone: "z1", Rack: "r1"}}
+	if n := m.LabelBlocks(members); n != 1 {
+		t.Fatal("labeled number error", n)
+	}
+	if v, _ := m.BlockTree.Get(1); v.(Block).Zone != "z1" || v.(Block).Rack != "r1" {
+		t.Fatal("block not labeled", v)
+	}
+	if v, _ := m.BlockTree.Get(2); v.(Block).Zone != "" {
+		t.Fatal("block of other agent labeled", v)
+	}
+	if n := m.LabelBlocks(members); n != 0 {
+		t.Fatal("same labels should not count", n)
+	}
+
+	// 新块沿用 agent 的标签
+	blockId, e := m.NewBlock(1, "a1", "/d2", 100)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if v, _ := m.BlockTree.Get(blockId); v.(Block).Domain(TOPOLOGY_DISK) != "z1/r1/a1//d2" {
+		t.Fatal("new block domain error", v.(Block).Domain(TOPOLOGY_DISK))
+	}
+}
@@ -0,0 +1,260 @@
+package mediator
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blastbao/whisper/common"
+)
+
+// znode 存储
+//
+// 保存 watcher key 的当前值及版本号，每次修改后整体写入 Mediator.Dir 下的 mediator.znode 并通知 watcher 。
+// watcher 注册时立即收到当前值，新连接的 client 不需要等待下一次 trigger 。
+// Version 创建时为 1 ，每次修改加 1 ，CompareAndSet/Delete 据此判断是否被其他人修改过。
+
+const ZNODE_STORE_VERSION = 1
+
+var ErrZnodeNotExist = errors.New("mediator znode not exists")
+var ErrZnodeVersion = errors.New("mediator znode version mismatch")
+
+type Znode struct {
+	Key     string
+	Value   []byte
+	Version int
+	Mtime   int64 // unix seconds
+}
+
+// znode 请求，client -> mediator ，回包 Body 为修改后的 Znode
+type ZnodeOp struct {
+	Key     string
+	Value   []byte
+	Version int // expected version for CAS / delete, 0 means not exists, -1 means any
+}
+
+// 持久化格式
+type znodeData struct {
+	Version int
+	Nodes   []Znode
+}
+
+type ZnodeChangeFn func(key string, value, valueOld []byte)
+
+type ZnodeStore struct {
+	file     string
+	nodes    map[string]Znode
+	mutex    *sync.Mutex
+	onChange ZnodeChangeFn
+}
+
+func NewZnodeStore(file string, onChange ZnodeChangeFn) *ZnodeStore {
+	return &ZnodeStore{file: file, nodes: make(map[string]Znode), mutex: new(sync.Mutex), onChange: onChange}
+}
+
+func (zs *ZnodeStore) Load() error {
+	zs.mutex.Lock()
+	defer zs.mutex.Unlock()
+
+	bb, e := ioutil.ReadFile(zs.file)
+	if e != nil {
+		if os.IsNotExist(e) {
+			return nil
+		}
+		return e
+	}
+
+	var data znodeData
+	if e := common.DecCompat(bb, &data); e != nil {
+		return e
+	}
+	if data.Version != ZNODE_STORE_VERSION {
+		return errors.New("mediator znode store version not supported - " + zs.file)
+	}
+
+	for _, node := range data.Nodes {
+		zs.nodes[node.Key] = node
+	}
+	common.Log.Info("mediator znode loaded number", len(zs.nodes))
+	return nil
+}
+
+// need lock first
+func (zs *ZnodeStore) persist() error {
+	data := znodeData{Version: ZNODE_STORE_VERSION}
+	for _, node := range zs.nodes {
+		data.Nodes = append(data.Nodes, node)
+	}
+	sort.Slice(data.Nodes, func(i, j int) bool { return data.Nodes[i].Key < data.Nodes[j].Key })
+
+	bb, e := common.Enc(&data)
+	if e != nil {
+		return e
+	}
+	return common.WriteFileSync(bb, zs.file)
+}
+
+func (zs *ZnodeStore) Get(key string) (Znode, bool) {
+	zs.mutex.Lock()
+	defer zs.mutex.Unlock()
+
+	node, ok := zs.nodes[key]
+	return node, ok
+}
+
+func (zs *ZnodeStore) Keys() []string {
+	zs.mutex.Lock()
+	defer zs.mutex.Unlock()
+
+	var keys []string
+	for key := range zs.nodes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (zs *ZnodeStore) Set(key string, value []byte) (Znode, error) {
+	return zs.CompareAndSet(key, value, -1)
+}
+
+// version 为期望的当前版本，0 表示 key 不存在，-1 表示不检查
+func (zs *ZnodeStore) CompareAndSet(key string, value []byte, version int) (Znode, error) {
+	zs.mutex.Lock()
+
+	old, ok := zs.nodes[key]
+	if e := checkZnodeVersion(old, ok, version); e != nil {
+		zs.mutex.Unlock()
+		return old, e
+	}
+
+	node := Znode{Key: key, Value: value, Version: old.Version + 1, Mtime: time.Now().Unix()}
+	zs.nodes[key] = node
+	if e := zs.persist(); e != nil {
+		// 保持内存与文件一致
+		if ok {
+			zs.nodes[key] = old
+		} else {
+			delete(zs.nodes, key)
+		}
+		zs.mutex.Unlock()
+		return old, e
+	}
+	zs.mutex.Unlock()
+
+	// 持久化之后再通知
+	if zs.onChange != nil {
+		zs.onChange(key, value, old.Value)
+	}
+	return node, nil
+}
+
+// version 为期望的当前版本，-1 表示不检查
+func (zs *ZnodeStore) Delete(key string, version int) error {
+	zs.mutex.Lock()
+
+	old, ok := zs.nodes[key]
+	if !ok {
+		zs.mutex.Unlock()
+		return ErrZnodeNotExist
+	}
+	if e := checkZnodeVersion(old, ok, version); e != nil {
+		zs.mutex.Unlock()
+		return e
+	}
+
+	delete(zs.nodes, key)
+	if e := zs.persist(); e != nil {
+		zs.nodes[key] = old
+		zs.mutex.Unlock()
+		return e
+	}
+	zs.mutex.Unlock()
+
+	if zs.onChange != nil {
+		zs.onChange(key, nil, old.Value)
+	}
+	return nil
+}
+
+func checkZnodeVersion(old Znode, exists bool, version int) error {
+	if version < 0 {
+		return nil
+	}
+	if version == 0 && exists {
+		return ErrZnodeVersion
+	}
+	if version > 0 && (!exists || old.Version != version) {
+		return ErrZnodeVersion
+	}
+	return nil
+}
+
+// implements ValueStore of NetServer, watcher registered in any group gets the current value
+func (zs *ZnodeStore) GetValue(key string) ([]byte, bool) {
+	node, ok := zs.Get(key)
+	return node.Value, ok
+}
+
+func (zs *ZnodeStore) SetValue(key string, value []byte) error {
+	_, e := zs.Set(key, value)
+	return e
+}
+
+func (m *Mediator) getZnodeFile() string {
+	return m.Dir + "/mediator.znode"
+}
+
+// get / set / cas / delete ，回包 Command 与请求相同
+func (m *Mediator) addZnodeHandler() {
+
+	reply := func(cmd string, node Znode, e error) Pack {
+		r := Pack{Command: cmd}
+		if e != nil {
+			r.Msg = e.Error()
+			return r
+		}
+		r.Body, e = common.Enc(&node)
+		if e != nil {
+			r.Msg = e.Error()
+			return r
+		}
+		r.Flag = true
+		return r
+	}
+
+	handle := func(cmd string, fn func(op ZnodeOp) (Znode, error)) {
+		m.Server.AddHandler(
+			cmd,
+			func(p Pack, conn net.Conn) Pack {
+				var op ZnodeOp
+				if e := common.DecCompat(p.Body, &op); e != nil {
+					return reply(cmd, Znode{}, e)
+				}
+				node, e := fn(op)
+				return reply(cmd, node, e)
+			},
+		)
+	}
+
+	handle(CMD_ZNODE_GET, func(op ZnodeOp) (Znode, error) {
+		node, ok := m.Znodes.Get(op.Key)
+		if !ok {
+			return node, ErrZnodeNotExist
+		}
+		return node, nil
+	})
+	handle(CMD_ZNODE_SET, func(op ZnodeOp) (Znode, error) {
+		return m.Znodes.Set(op.Key, op.Value)
+	})
+	handle(CMD_ZNODE_CAS, func(op ZnodeOp) (Znode, error) {
+		return m.Znodes.CompareAndSet(op.Key, op.Value, op.Version)
+	})
+	handle(CMD_ZNODE_DELETE, func(op ZnodeOp) (Znode, error) {
+		return Znode{Key: op.Key}, m.Znodes.Delete(op.Key, op.Version)
+	})
+}
@@ -0,0 +1,156 @@
+package mediator
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestZnodeStore(t *testing.T) {
+	dir, e := ioutil.TempDir("", "whisper-znode")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	var changed []string
+	zs := NewZnodeStore(dir+"/mediator.znode", func(key string, value, valueOld []byte) {
+		changed = append(changed, key+"="+string(value)+"<"+string(valueOld))
+	})
+	if e := zs.Load(); e != nil {
+		t.Fatal(e)
+	}
+
+	node, e := zs.Set("a", []byte("1"))
+	if e != nil || node.Version != 1 {
+		t.Fatal("set error", node, e)
+	}
+	if node, e = zs.Set("a", []byte("2")); e != nil || node.Version != 2 {
+		t.Fatal("set again error", node, e)
+	}
+
+	// compare and set
+	if _, e = zs.CompareAndSet("a", []byte("3"), 1); e != ErrZnodeVersion {
+		t.Fatal("cas should fail as version changed", e)
+	}
+	if _, e = zs.CompareAndSet("a", []byte("3"), 0); e != ErrZnodeVersion {
+		t.Fatal("cas should fail as key exists", e)
+	}
+	if node, e = zs.CompareAndSet("a", []byte("3"), 2); e != nil || node.Version != 3 {
+		t.Fatal("cas error", node, e)
+	}
+	if _, e = zs.CompareAndSet("b", []byte("x"), 0); e != nil {
+		t.Fatal("cas create error", e)
+	}
+
+	// delete
+	if e = zs.Delete("b", 5); e != ErrZnodeVersion {
+		t.Fatal("delete should fail as version changed", e)
+	}
+	if e = zs.Delete("c", -1); e != ErrZnodeNotExist {
+		t.Fatal("delete should fail as not exists", e)
+	}
+	zs.Set("c", []byte("y"))
+	if e = zs.Delete("c", -1); e != nil {
+		t.Fatal(e)
+	}
+
+	expect := []string{"a=1<", "a=2<1", "a=3<2", "b=x<", "c=y<", "c=<y"}
+	if len(changed) != len(expect) {
+		t.Fatal("change notify error", changed)
+	}
+	for i := range expect {
+		if changed[i] != expect[i] {
+			t.Fatal("change notify error", changed)
+		}
+	}
+
+	// reload
+	zs2 := NewZnodeStore(dir+"/mediator.znode", nil)
+	if e := zs2.Load(); e != nil {
+		t.Fatal(e)
+	}
+	if keys := zs2.Keys(); len(keys) != 2 {
+		t.Fatal("reload keys error", keys)
+	}
+	if node, ok := zs2.Get("a"); !ok || string(node.Value) != "3" || node.Version != 3 {
+		t.Fatal("reload error", node)
+	}
+	if _, ok := zs2.Get("c"); ok {
+		t.Fatal("deleted key reloaded")
+	}
+}
+
+// watcher 注册时收到当前值，修改时所有 watcher 都收到通知
+func TestZnodeWatch(t *testing.T) {
+	dir, e := ioutil.TempDir("", "whisper-znode")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &NetServer{}
+	zs := NewZnodeStore(dir+"/mediator.znode", func(key string, value, valueOld []byte) {
+		s.TriggerKey(key, value, valueOld)
+	})
+	s.Values = zs
+	if e := s.Start("localhost", 9782); e != nil {
+		t.Fatal(e)
+	}
+	var clients []*NetClient
+	defer func() {
+		// close clients first so that they do not reconnect
+		for _, c := range clients {
+			c.Close()
+		}
+		s.listener.Close()
+		for _, c := range s.conns() {
+			c.Close()
+		}
+	}()
+
+	zs.Set("client-connect-to-center", []byte("center-1"))
+
+	newWatcher := func() chan string {
+		ch := make(chan string, 10)
+		c := &NetClient{}
+		if e := c.Start("localhost:9782"); e != nil {
+			t.Fatal(e)
+		}
+		clients = append(clients, c)
+		c.Watch("client-connect-to-center", func(value, valueOld []byte) {
+			ch <- string(value)
+		})
+		return ch
+	}
+	waitValue := func(ch chan string) string {
+		select {
+		case v := <-ch:
+			return v
+		case <-time.After(5 * time.Second):
+			t.Fatal("watcher not triggered")
+		}
+		return ""
+	}
+
+	ch1 := newWatcher()
+	ch2 := newWatcher()
+	if v1, v2 := waitValue(ch1), waitValue(ch2); v1 != "center-1" || v2 != "center-1" {
+		t.Fatal("current value not pushed on register", v1, v2)
+	}
+
+	// tri in group all is saved then pushed to every watcher
+	s.Tri("", "client-connect-to-center", []byte("center-2"), nil)
+	if v1, v2 := waitValue(ch1), waitValue(ch2); v1 != "center-2" || v2 != "center-2" {
+		t.Fatal("change not pushed to all watchers", v1, v2)
+	}
+	if node, _ := zs.Get("client-connect-to-center"); node.Version != 2 {
+		t.Fatal("tri value not saved", node)
+	}
+
+	ch3 := newWatcher()
+	if v := waitValue(ch3); v != "center-2" {
+		t.Fatal("new watcher should get latest value", v)
+	}
+}
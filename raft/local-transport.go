@@ -0,0 +1,92 @@
+package raft
+
+import (
+	"errors"
+	"sync"
+)
+
+// 进程内的网络，节点直接调用对方的 Handle 方法，用于测试
+//
+// Disconnect 模拟节点与其它节点断开，收发都失败。
+type LocalNetwork struct {
+	mutex sync.Mutex
+	nodes map[string]*Node
+	down  map[string]bool
+}
+
+func NewLocalNetwork() *LocalNetwork {
+	return &LocalNetwork{nodes: make(map[string]*Node), down: make(map[string]bool)}
+}
+
+// 节点 id 使用的 Transport
+func (ln *LocalNetwork) Transport(id string) Transport {
+	return &localTransport{network: ln, from: id}
+}
+
+func (ln *LocalNetwork) Add(node *Node) {
+	ln.mutex.Lock()
+	defer ln.mutex.Unlock()
+	ln.nodes[node.Id] = node
+}
+
+func (ln *LocalNetwork) Disconnect(id string) {
+	ln.mutex.Lock()
+	defer ln.mutex.Unlock()
+	ln.down[id] = true
+}
+
+func (ln *LocalNetwork) Connect(id string) {
+	ln.mutex.Lock()
+	defer ln.mutex.Unlock()
+	delete(ln.down, id)
+}
+
+func (ln *LocalNetwork) get(from, to string) (*Node, error) {
+	ln.mutex.Lock()
+	defer ln.mutex.Unlock()
+
+	if ln.down[from] || ln.down[to] {
+		return nil, errors.New("raft local network disconnected - " + from + " -> " + to)
+	}
+	node, ok := ln.nodes[to]
+	if !ok {
+		return nil, errors.New("raft local network node not found - " + to)
+	}
+
+	node.mutex.Lock()
+	closed := node.isClosed
+	node.mutex.Unlock()
+	if closed {
+		return nil, errors.New("raft local network node stopped - " + to)
+	}
+	return node, nil
+}
+
+type localTransport struct {
+	network *LocalNetwork
+	from    string
+}
+
+func (t *localTransport) RequestVote(peer string, args VoteArgs) (VoteReply, error) {
+	node, e := t.network.get(t.from, peer)
+	if e != nil {
+		return VoteReply{}, e
+	}
+	return node.HandleRequestVote(args), nil
+}
+
+func (t *localTransport) AppendEntries(peer string, args AppendArgs) (AppendReply, error) {
+	node, e := t.network.get(t.from, peer)
+	if e != nil {
+		return AppendReply{}, e
+	}
+	return node.HandleAppendEntries(args), nil
+}
+
+func (t *localTransport) InstallSnapshot(peer string, args SnapshotArgs) (SnapshotReply, error) {
+	node, e := t.network.get(t.from, peer)
+	if e != nil {
+		return SnapshotReply{}, e
+	}
+	return node.HandleInstallSnapshot(args), nil
+}
@@ -0,0 +1,246 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+
+	"github.com/blastbao/whisper/common"
+)
+
+// 持久化
+//
+// raft.state: 序列化的 raftState ，整体写入 tmp 后 rename
+// raft.log:   保留的条目，每条一个 frame [4 字节 payload 长度][4 字节 payload crc32][payload]
+// 追加时 fsync ，截断或压缩时整体重写。崩溃时最后一个 frame 可能不完整，加载时丢弃。
+
+const (
+	STATE_FILE       = "raft.state"
+	LOG_FILE         = "raft.log"
+	LOG_FRAME_HEADER = 8
+)
+
+type raftState struct {
+	Term          int64
+	VotedFor      string
+	LogIndex      int64 // log[0], entries before are discarded
+	LogTerm       int64
+	Peers         []string
+	SnapshotIndex int64 // entries persisted by the fsm, not less than LogIndex
+}
+
+func (n *Node) getStateFile() string {
+	return n.Dir + "/" + STATE_FILE
+}
+
+func (n *Node) getLogFile() string {
+	return n.Dir + "/" + LOG_FILE
+}
+
+// 加载状态及快照之后的日志
+func (n *Node) load() error {
+	if n.Dir == "" {
+		return nil
+	}
+	if e := os.MkdirAll(n.Dir, 0755); e != nil {
+		return e
+	}
+
+	bb, e := ioutil.ReadFile(n.getStateFile())
+	if e != nil && !os.IsNotExist(e) {
+		return e
+	}
+	if e == nil {
+		var state raftState
+		if e := common.DecCompat(bb, &state); e != nil {
+			return e
+		}
+		n.term = state.Term
+		n.votedFor = state.VotedFor
+		n.peers = state.Peers
+		n.log = []Entry{{Index: state.LogIndex, Term: state.LogTerm}}
+		n.snapshotIndex = state.SnapshotIndex
+	}
+
+	bb, e = ioutil.ReadFile(n.getLogFile())
+	if e != nil && !os.IsNotExist(e) {
+		return e
+	}
+	entries, valid, e := decEntries(bb)
+	if e != nil {
+		common.Log.Warning("raft node log truncated at", n.Id, valid, e)
+	}
+	for _, entry := range entries {
+		// 压缩时先写 state 再重写日志，之前的条目已包含在快照中
+		if entry.Index <= n.lastIndex() {
+			continue
+		}
+		if entry.Index != n.lastIndex()+1 {
+			return errors.New("raft log is not continuous")
+		}
+		n.log = append(n.log, entry)
+	}
+
+	common.Log.Info("raft node loaded", n.Id, n.term, n.log[0].Index, n.lastIndex())
+	return n.rewriteLog()
+}
+
+// need lock first
+func (n *Node) persistState() error {
+	if n.Dir == "" {
+		return nil
+	}
+	state := raftState{
+		Term:          n.term,
+		VotedFor:      n.votedFor,
+		LogIndex:      n.log[0].Index,
+		LogTerm:       n.log[0].Term,
+		Peers:         n.peers,
+		SnapshotIndex: n.snapshotIndex,
+	}
+	bb, e := common.Enc(&state)
+	if e != nil {
+		return e
+	}
+	return common.WriteFileSync(bb, n.getStateFile())
+}
+
+// need lock first, 追加并 fsync
+func (n *Node) appendLog(entries []Entry) error {
+	if n.Dir == "" {
+		return nil
+	}
+	bb, e := encEntries(entries)
+	if e != nil {
+		return e
+	}
+
+	if n.logFile == nil {
+		f, e := os.OpenFile(n.getLogFile(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		if e != nil {
+			return e
+		}
+		n.logFile = f
+	}
+	if _, e := n.logFile.Write(bb); e != nil {
+		return e
+	}
+	return n.logFile.Sync()
+}
+
+// need lock first, 以内存中的日志重写
+func (n *Node) rewriteLog() error {
+	if n.Dir == "" {
+		return nil
+	}
+	bb, e := encEntries(n.log[1:])
+	if e != nil {
+		return e
+	}
+
+	n.closeLog()
+	return common.WriteFileSync(bb, n.getLogFile())
+}
+
+// need lock first, 记录快照位置，丢弃 index 及之前的日志
+func (n *Node) compact(snapshotIndex, index int64) error {
+	n.snapshotIndex = snapshotIndex
+	if index <= n.log[0].Index {
+		return n.persistState()
+	}
+	term := n.termAt(index)
+	n.log = append([]Entry{{Index: index, Term: term}}, n.log[index-n.log[0].Index+1:]...)
+
+	if e := n.persistState(); e != nil {
+		return e
+	}
+	return n.rewriteLog()
+}
+
+// need lock first
+func (n *Node) closeLog() {
+	if n.logFile != nil {
+		n.logFile.Close()
+		n.logFile = nil
+	}
+}
+
+// need lock first
+func (n *Node) lastIndex() int64 {
+	return n.log[len(n.log)-1].Index
+}
+
+// need lock first
+func (n *Node) lastTerm() int64 {
+	return n.log[len(n.log)-1].Term
+}
+
+// need lock first, 已丢弃的条目返回 -1
+func (n *Node) termAt(index int64) int64 {
+	base := n.log[0].Index
+	if index < base || index > n.lastIndex() {
+		return -1
+	}
+	return n.log[index-base].Term
+}
+
+// need lock first
+func (n *Node) entryAt(index int64) Entry {
+	return n.log[index-n.log[0].Index]
+}
+
+// need lock first, 从 index 开始最多 limit 条
+func (n *Node) entriesFrom(index int64, limit int) []Entry {
+	from := index - n.log[0].Index
+	to := int64(len(n.log))
+	if to-from > int64(limit) {
+		to = from + int64(limit)
+	}
+	return append([]Entry{}, n.log[from:to]...)
+}
+
+func encEntries(entries []Entry) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	header := make([]byte, LOG_FRAME_HEADER)
+	for _, entry := range entries {
+		payload, e := common.Enc(&entry)
+		if e != nil {
+			return nil, e
+		}
+		binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+		binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload))
+		buf.Write(header)
+		buf.Write(payload)
+	}
+	return buf.Bytes(), nil
+}
+
+// 解码到第一个不完整或校验失败的 frame ，valid 为完整 frames 的长度
+func decEntries(bb []byte) (entries []Entry, valid int, err error) {
+	for valid < len(bb) {
+		if len(bb)-valid < LOG_FRAME_HEADER {
+			return entries, valid, errors.New("raft log frame header torn")
+		}
+		size := int(binary.BigEndian.Uint32(bb[valid : valid+4]))
+		crc := binary.BigEndian.Uint32(bb[valid+4 : valid+8])
+		if size > len(bb)-valid-LOG_FRAME_HEADER {
+			return entries, valid, errors.New("raft log frame torn")
+		}
+
+		payload := bb[valid+LOG_FRAME_HEADER : valid+LOG_FRAME_HEADER+size]
+		if crc32.ChecksumIEEE(payload) != crc {
+			return entries, valid, errors.New("raft log frame crc error")
+		}
+		var entry Entry
+		if e := common.DecCompat(payload, &entry); e != nil {
+			return entries, valid, e
+		}
+
+		entries = append(entries, entry)
+		valid += LOG_FRAME_HEADER + size
+	}
+	return entries, valid, nil
+}
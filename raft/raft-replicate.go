@@ -0,0 +1,445 @@
+package raft
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/blastbao/whisper/common"
+)
+
+// 日志复制及应用
+
+// 向 peer 复制日志，每个 peer 同时只有一个协程发送，发送期间有新条目时继续发送
+func (n *Node) replicate(peer string) {
+	n.mutex.Lock()
+	if n.state != STATE_LEADER || n.isClosed {
+		n.mutex.Unlock()
+		return
+	}
+	if n.replicating[peer] {
+		n.again[peer] = true
+		n.mutex.Unlock()
+		return
+	}
+	n.replicating[peer] = true
+	n.mutex.Unlock()
+
+	go func() {
+		for {
+			ok := n.sendTo(peer)
+
+			n.mutex.Lock()
+			more := ok && n.state == STATE_LEADER && !n.isClosed &&
+				(n.again[peer] || n.nextIndex[peer] <= n.lastIndex())
+			n.again[peer] = false
+			if !more {
+				delete(n.replicating, peer)
+				n.mutex.Unlock()
+				return
+			}
+			n.mutex.Unlock()
+		}
+	}()
+}
+
+// 发送一次 AppendEntries ，需要的日志已丢弃时发送快照，rpc 失败时返回 false
+func (n *Node) sendTo(peer string) bool {
+	n.mutex.Lock()
+	if n.state != STATE_LEADER {
+		n.mutex.Unlock()
+		return false
+	}
+
+	term := n.term
+	next := n.nextIndex[peer]
+	if next <= n.log[0].Index {
+		n.mutex.Unlock()
+		return n.sendSnapshot(peer, term)
+	}
+	if next > n.lastIndex()+1 {
+		next = n.lastIndex() + 1
+	}
+
+	prev := next - 1
+	args := AppendArgs{
+		Term:      term,
+		Leader:    n.Id,
+		PrevIndex: prev,
+		PrevTerm:  n.termAt(prev),
+		Commit:    n.commitIndex,
+		Entries:   n.entriesFrom(next, MaxAppendEntries),
+	}
+	n.mutex.Unlock()
+
+	reply, e := n.trans.AppendEntries(peer, args)
+	if e != nil {
+		common.Log.Debug("raft node append entries error", n.Id, peer, e)
+		return false
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if reply.Term > n.term {
+		n.becomeFollower(reply.Term)
+		return false
+	}
+	if n.state != STATE_LEADER || n.term != term {
+		return false
+	}
+	n.contact[peer] = time.Now()
+
+	if reply.Success {
+		match := prev + int64(len(args.Entries))
+		if match > n.matchIndex[peer] {
+			n.matchIndex[peer] = match
+		}
+		if match+1 > n.nextIndex[peer] {
+			n.nextIndex[peer] = match + 1
+		}
+		n.advanceCommit()
+		return true
+	}
+
+	// 不匹配，从 follower 的最后条目或前一个条目重试
+	next = prev
+	if reply.LastIndex+1 < next {
+		next = reply.LastIndex + 1
+	}
+	if next < 1 {
+		next = 1
+	}
+	n.nextIndex[peer] = next
+	return true
+}
+
+// 分块发送当前状态，follower 恢复后从 lastApplied 之后继续复制
+func (n *Node) sendSnapshot(peer string, term int64) bool {
+	n.applyMutex.Lock()
+	data, e := n.fsm.SnapshotData()
+	n.mutex.Lock()
+	index := n.lastApplied
+	lastTerm := n.termAt(index)
+	n.mutex.Unlock()
+	n.applyMutex.Unlock()
+
+	if e != nil {
+		common.Log.Error("raft node snapshot data error", n.Id, e)
+		return false
+	}
+
+	common.Log.Info("raft node send snapshot", n.Id, peer, index, len(data))
+	for offset := 0; ; {
+		end := offset + SnapshotChunkBytes
+		if end > len(data) {
+			end = len(data)
+		}
+		args := SnapshotArgs{Term: term, Leader: n.Id, LastIndex: index, LastTerm: lastTerm,
+			Offset: int64(offset), Done: end == len(data), Data: data[offset:end]}
+		if !n.sendSnapshotChunk(peer, term, args) {
+			return false
+		}
+		if args.Done {
+			break
+		}
+		offset = end
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.state != STATE_LEADER || n.term != term {
+		return false
+	}
+
+	if index > n.matchIndex[peer] {
+		n.matchIndex[peer] = index
+	}
+	n.nextIndex[peer] = n.matchIndex[peer] + 1
+	n.advanceCommit()
+	return true
+}
+
+func (n *Node) sendSnapshotChunk(peer string, term int64, args SnapshotArgs) bool {
+	reply, e := n.trans.InstallSnapshot(peer, args)
+	if e != nil {
+		common.Log.Error("raft node install snapshot error", n.Id, peer, args.Offset, e)
+		return false
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if reply.Term > n.term {
+		n.becomeFollower(reply.Term)
+		return false
+	}
+	if n.state != STATE_LEADER || n.term != term || !reply.Success {
+		return false
+	}
+	n.contact[peer] = time.Now()
+	return true
+}
+
+// need lock first, 多数节点复制了当前 term 的条目时提交
+func (n *Node) advanceCommit() {
+	if n.state != STATE_LEADER {
+		return
+	}
+
+	peers := n.otherPeers()
+	for i := n.lastIndex(); i > n.commitIndex; i-- {
+		if n.termAt(i) != n.term {
+			break
+		}
+
+		count := 0
+		if n.isVoter() {
+			count++
+		}
+		for _, peer := range peers {
+			if n.matchIndex[peer] >= i {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commitIndex = i
+			n.signalApply()
+			return
+		}
+	}
+}
+
+// 处理 leader 的日志复制及心跳
+func (n *Node) HandleAppendEntries(args AppendArgs) AppendReply {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	reply := AppendReply{Term: n.term, LastIndex: n.lastIndex()}
+	if args.Term < n.term {
+		return reply
+	}
+	if args.Term > n.term || n.state != STATE_FOLLOWER {
+		n.becomeFollower(args.Term)
+	}
+	reply.Term = n.term
+	n.resetElection(time.Now())
+	n.setLeader(args.Leader)
+
+	if args.PrevIndex > n.lastIndex() {
+		return reply
+	}
+	if args.PrevIndex >= n.log[0].Index && n.termAt(args.PrevIndex) != args.PrevTerm {
+		reply.LastIndex = args.PrevIndex - 1
+		return reply
+	}
+
+	// 快照之前的条目已提交，一定相同
+	var appended []Entry
+	truncated := false
+	for _, entry := range args.Entries {
+		if entry.Index <= n.log[0].Index {
+			continue
+		}
+		if entry.Index <= n.lastIndex() {
+			if n.termAt(entry.Index) == entry.Term {
+				continue
+			}
+			// 冲突，删除该条目及之后的条目
+			n.log = n.log[:entry.Index-n.log[0].Index]
+			truncated = true
+		}
+		n.log = append(n.log, entry)
+		appended = append(appended, entry)
+	}
+
+	var e error
+	if truncated {
+		e = n.rewriteLog()
+	} else if len(appended) > 0 {
+		e = n.appendLog(appended)
+	}
+	if e != nil {
+		common.Log.Error("raft node write log error", n.Id, e)
+		reply.LastIndex = args.PrevIndex
+		return reply
+	}
+
+	last := args.PrevIndex + int64(len(args.Entries))
+	if args.Commit > n.commitIndex {
+		commit := args.Commit
+		if last < commit {
+			commit = last
+		}
+		if commit > n.commitIndex {
+			n.commitIndex = commit
+			n.signalApply()
+		}
+	}
+
+	reply.Success = true
+	reply.LastIndex = n.lastIndex()
+	return reply
+}
+
+// 处理 leader 发送的快照，收到最后一块后恢复
+func (n *Node) HandleInstallSnapshot(args SnapshotArgs) SnapshotReply {
+	n.mutex.Lock()
+	reply := SnapshotReply{Term: n.term}
+	if args.Term < n.term {
+		n.mutex.Unlock()
+		return reply
+	}
+	if args.Term > n.term || n.state != STATE_FOLLOWER {
+		n.becomeFollower(args.Term)
+	}
+	reply.Term = n.term
+	n.resetElection(time.Now())
+	n.setLeader(args.Leader)
+
+	if args.Offset == 0 {
+		n.pending = &bytes.Buffer{}
+		n.pendingIndex = args.LastIndex
+	}
+	// 缺少之前的块，leader 重新发送
+	if n.pending == nil || n.pendingIndex != args.LastIndex || int64(n.pending.Len()) != args.Offset {
+		n.mutex.Unlock()
+		return reply
+	}
+	n.pending.Write(args.Data)
+	if !args.Done {
+		n.mutex.Unlock()
+		reply.Success = true
+		return reply
+	}
+	data := n.pending.Bytes()
+	n.pending = nil
+	n.mutex.Unlock()
+
+	n.applyMutex.Lock()
+	defer n.applyMutex.Unlock()
+
+	n.mutex.Lock()
+	applied := n.lastApplied
+	n.mutex.Unlock()
+	if args.LastIndex <= applied {
+		reply.Success = true
+		return reply
+	}
+
+	common.Log.Info("raft node install snapshot", n.Id, args.LastIndex, len(data))
+	if e := n.fsm.Restore(data); e != nil {
+		common.Log.Error("raft node restore snapshot error", n.Id, e)
+		return reply
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	// 保留快照之后仍然匹配的条目
+	if args.LastIndex < n.lastIndex() && n.termAt(args.LastIndex) == args.LastTerm {
+		n.log = append([]Entry{{Index: args.LastIndex, Term: args.LastTerm}}, n.log[args.LastIndex-n.log[0].Index+1:]...)
+	} else {
+		n.log = []Entry{{Index: args.LastIndex, Term: args.LastTerm}}
+	}
+	if args.LastIndex > n.commitIndex {
+		n.commitIndex = args.LastIndex
+	}
+	n.lastApplied = args.LastIndex
+	n.snapshotIndex = args.LastIndex
+
+	if e := n.persistState(); e != nil {
+		common.Log.Error("raft node persist state error", n.Id, e)
+		return reply
+	}
+	if e := n.rewriteLog(); e != nil {
+		common.Log.Error("raft node write log error", n.Id, e)
+		return reply
+	}
+	reply.Success = true
+	return reply
+}
+
+// need lock first
+func (n *Node) signalApply() {
+	select {
+	case n.chApply <- true:
+	default:
+	}
+}
+
+func (n *Node) applyLoop() {
+	defer n.closeWg.Done()
+
+	for {
+		select {
+		case <-n.chClose:
+			return
+		case <-n.chApply:
+		}
+
+		for n.applyOne() {
+		}
+		n.maybeSnapshot()
+	}
+}
+
+// 应用下一个已提交的条目，没有时返回 false
+func (n *Node) applyOne() bool {
+	n.applyMutex.Lock()
+	defer n.applyMutex.Unlock()
+
+	n.mutex.Lock()
+	if n.lastApplied >= n.commitIndex || n.isClosed {
+		n.mutex.Unlock()
+		return false
+	}
+	entry := n.entryAt(n.lastApplied + 1)
+	n.mutex.Unlock()
+
+	var result interface{}
+	if len(entry.Data) > 0 {
+		result = n.fsm.Apply(entry)
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.lastApplied = entry.Index
+	if w, ok := n.waiters[entry.Index]; ok {
+		delete(n.waiters, entry.Index)
+		if w.term == entry.Term {
+			w.ch <- proposeResult{result: result}
+		} else {
+			w.ch <- proposeResult{err: ErrNotLeader}
+		}
+	}
+	return true
+}
+
+// 快照之后应用的条目足够多时快照，并丢弃保留条数之前的日志
+func (n *Node) maybeSnapshot() {
+	n.applyMutex.Lock()
+	defer n.applyMutex.Unlock()
+
+	n.mutex.Lock()
+	applied := n.lastApplied
+	snapshotIndex := n.snapshotIndex
+	n.mutex.Unlock()
+	if applied-snapshotIndex < SnapshotEntries {
+		return
+	}
+
+	if e := n.fsm.Snapshot(); e != nil {
+		common.Log.Error("raft node fsm snapshot error", n.Id, e)
+		return
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if e := n.compact(applied, applied-LogRetainEntries); e != nil {
+		common.Log.Error("raft node compact log error", n.Id, e)
+		return
+	}
+	common.Log.Info("raft node log compacted", n.Id, applied, n.log[0].Index)
+}
@@ -0,0 +1,611 @@
+package raft
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/blastbao/whisper/common"
+)
+
+// Raft 一致性复制
+//
+// 每个 Node 保存一份日志，leader 将 Propose 的命令追加到日志并复制到多数节点后提交，
+// 已提交的条目在每个节点上按相同顺序交给 FSM.Apply 。
+// term/votedFor/peers 及快照位置保存在 raft.state ，日志保存在 raft.log ，回复请求前 fsync 。
+//
+// 条目的 Index 即复制的序号(sequence)，每个节点按序号顺序应用。
+// 快照之后应用的条目超过 SnapshotEntries 时调用 FSM.Snapshot 持久化状态机，
+// 然后丢弃快照之前的日志，保留最后 LogRetainEntries 条，短暂离线的 follower 从日志追赶；
+// 落后到已丢弃部分的 follower 由 leader 分块(SnapshotChunkBytes)发送 FSM.SnapshotData 全量恢复。
+// 重启后从快照位置继续，快照之后的条目会被再次 Apply ，FSM 需要保证重复执行的结果相同。
+//
+// 新 leader 追加一条空条目以提交之前 term 的日志，空条目不交给 FSM 。
+// peers 包含自身，可由 SetPeers 修改，没有实现 joint consensus ，每次只应增减一个节点。
+// peers 不含自身时不发起选举，等待加入集群。
+
+var HeartbeatMs int = 100
+var ElectionTimeoutMs int = 1000 // random in [ElectionTimeoutMs, 2 * ElectionTimeoutMs)
+var TickMs int = 20
+var ProposeTimeoutMs int = 5 * 1000
+var SnapshotEntries int64 = 10 * 1000        // applied entries after the last snapshot to take a new one
+var LogRetainEntries int64 = 10 * 1000       // entries kept in log before the snapshot for lagging followers
+var MaxAppendEntries int = 500               // entries in one AppendEntries
+var SnapshotChunkBytes int = 4 * 1024 * 1024 // data in one InstallSnapshot
+
+const (
+	STATE_FOLLOWER  = 0
+	STATE_CANDIDATE = 1
+	STATE_LEADER    = 2
+)
+
+var ErrNotLeader = errors.New("raft node is not leader")
+var ErrProposeTimeout = errors.New("raft propose timeout")
+var ErrStopped = errors.New("raft node stopped")
+
+type Entry struct {
+	Index int64
+	Term  int64
+	Data  []byte // empty for no-op entries
+}
+
+// 状态机，Apply/Snapshot/SnapshotData/Restore 不会并发调用
+type FSM interface {
+	// 执行已提交的条目，返回值交给 Propose 的调用方
+	Apply(entry Entry) interface{}
+	// 持久化已应用的全部条目，之后丢弃这些日志
+	Snapshot() error
+	// 当前状态，发送给落后的 follower
+	SnapshotData() ([]byte, error)
+	// 以 leader 的状态替换当前状态并持久化
+	Restore(data []byte) error
+}
+
+type VoteArgs struct {
+	Term      int64
+	Candidate string
+	LastIndex int64
+	LastTerm  int64
+}
+
+type VoteReply struct {
+	Term    int64
+	Granted bool
+}
+
+type AppendArgs struct {
+	Term      int64
+	Leader    string
+	PrevIndex int64
+	PrevTerm  int64
+	Commit    int64
+	Entries   []Entry
+}
+
+type AppendReply struct {
+	Term      int64
+	Success   bool
+	LastIndex int64 // last index of follower, leader retries from it when not matched
+}
+
+// 快照分块发送，Offset 为 Data 在快照中的位置，最后一块 Done 为 true
+type SnapshotArgs struct {
+	Term      int64
+	Leader    string
+	LastIndex int64
+	LastTerm  int64
+	Offset    int64
+	Done      bool
+	Data      []byte
+}
+
+type SnapshotReply struct {
+	Term    int64
+	Success bool
+}
+
+// 节点间的 rpc ，peer 为节点 Id
+type Transport interface {
+	RequestVote(peer string, args VoteArgs) (VoteReply, error)
+	AppendEntries(peer string, args AppendArgs) (AppendReply, error)
+	InstallSnapshot(peer string, args SnapshotArgs) (SnapshotReply, error)
+}
+
+type proposeResult struct {
+	result interface{}
+	err    error
+}
+
+// Propose 等待条目 index 应用，term 不同表示条目被新 leader 覆盖
+type waiter struct {
+	term int64
+	ch   chan proposeResult
+}
+
+type Node struct {
+	Id  string // address of this node, used by Transport
+	Dir string // raft.state and raft.log, empty to keep in memory only
+
+	// leader 变化，没有 leader 时为空
+	OnLeaderChange func(leader string)
+
+	fsm   FSM
+	trans Transport
+
+	mutex      sync.Mutex
+	applyMutex sync.Mutex // guards fsm, lock before mutex
+
+	peers    []string
+	state    int
+	term     int64
+	votedFor string
+	leader   string
+
+	log           []Entry // log[0] is the position before the first entry kept, without Data
+	snapshotIndex int64   // entries persisted by FSM.Snapshot or Restore
+	commitIndex   int64
+	lastApplied   int64
+
+	// follower, chunks of the snapshot being received
+	pending      *bytes.Buffer
+	pendingIndex int64
+
+	// leader
+	nextIndex   map[string]int64
+	matchIndex  map[string]int64
+	contact     map[string]time.Time
+	replicating map[string]bool
+	again       map[string]bool
+	leaderSince time.Time
+	waiters     map[int64]waiter
+
+	electionDeadline time.Time
+	lastHeartbeat    time.Time
+
+	logFile  *os.File
+	chApply  chan bool
+	chLeader chan bool
+	chClose  chan bool
+	closeWg  sync.WaitGroup
+	isClosed bool
+}
+
+func NewNode(id, dir string, fsm FSM, trans Transport) *Node {
+	return &Node{Id: id, Dir: dir, fsm: fsm, trans: trans}
+}
+
+// 加载状态及日志后开始运行，peers 非空时替换保存的 peers
+func (n *Node) Start(peers []string) error {
+	n.log = []Entry{{}}
+	n.nextIndex = make(map[string]int64)
+	n.matchIndex = make(map[string]int64)
+	n.contact = make(map[string]time.Time)
+	n.replicating = make(map[string]bool)
+	n.again = make(map[string]bool)
+	n.waiters = make(map[int64]waiter)
+	n.chApply = make(chan bool, 1)
+	n.chLeader = make(chan bool, 1)
+	n.chClose = make(chan bool)
+
+	if e := n.load(); e != nil {
+		return e
+	}
+	if len(peers) > 0 {
+		n.peers = append([]string{}, peers...)
+		if e := n.persistState(); e != nil {
+			return e
+		}
+	}
+	if n.snapshotIndex < n.log[0].Index {
+		n.snapshotIndex = n.log[0].Index
+	}
+	n.commitIndex = n.snapshotIndex
+	n.lastApplied = n.snapshotIndex
+	n.resetElection(time.Now())
+	common.Log.Info("raft node started", n.Id, n.term, n.lastIndex(), n.peers)
+
+	n.closeWg.Add(3)
+	go n.run()
+	go n.applyLoop()
+	go n.leaderLoop()
+	return nil
+}
+
+func (n *Node) Stop() {
+	n.mutex.Lock()
+	if n.isClosed {
+		n.mutex.Unlock()
+		return
+	}
+	n.isClosed = true
+	n.failWaiters(ErrStopped)
+	close(n.chClose)
+	n.mutex.Unlock()
+
+	n.closeWg.Wait()
+
+	n.mutex.Lock()
+	n.closeLog()
+	n.mutex.Unlock()
+	common.Log.Info("raft node stopped", n.Id)
+}
+
+func (n *Node) IsLeader() bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.state == STATE_LEADER
+}
+
+// leader Id ，未知时为空
+func (n *Node) Leader() string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.leader
+}
+
+func (n *Node) Term() int64 {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.term
+}
+
+// 最后应用的条目
+func (n *Node) Applied() int64 {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.lastApplied
+}
+
+func (n *Node) Peers() []string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return append([]string{}, n.peers...)
+}
+
+// 修改集群成员，peers 包含自身
+func (n *Node) SetPeers(peers []string) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if sameStrs(n.peers, peers) {
+		return nil
+	}
+	common.Log.Info("raft node peers changed", n.Id, n.peers, peers)
+	n.peers = append([]string{}, peers...)
+	if e := n.persistState(); e != nil {
+		return e
+	}
+
+	if n.state == STATE_LEADER {
+		if !n.isVoter() {
+			n.becomeFollower(n.term)
+			return nil
+		}
+		for _, peer := range n.otherPeers() {
+			if _, ok := n.nextIndex[peer]; !ok {
+				n.nextIndex[peer] = n.lastIndex() + 1
+				n.matchIndex[peer] = 0
+			}
+		}
+		n.advanceCommit()
+	}
+	return nil
+}
+
+// 追加 data 到日志，提交并应用后返回 FSM.Apply 的结果
+//
+// 返回 ErrProposeTimeout/ErrStopped 时条目仍可能在之后被提交。
+func (n *Node) Propose(data []byte) (interface{}, error) {
+	n.mutex.Lock()
+	if n.isClosed {
+		n.mutex.Unlock()
+		return nil, ErrStopped
+	}
+	if n.state != STATE_LEADER {
+		n.mutex.Unlock()
+		return nil, ErrNotLeader
+	}
+
+	entry := Entry{Index: n.lastIndex() + 1, Term: n.term, Data: data}
+	if e := n.appendLog([]Entry{entry}); e != nil {
+		n.mutex.Unlock()
+		return nil, e
+	}
+	n.log = append(n.log, entry)
+
+	w := waiter{term: entry.Term, ch: make(chan proposeResult, 1)}
+	n.waiters[entry.Index] = w
+	n.advanceCommit()
+	peers := n.otherPeers()
+	n.mutex.Unlock()
+
+	for _, peer := range peers {
+		n.replicate(peer)
+	}
+
+	select {
+	case r := <-w.ch:
+		return r.result, r.err
+	case <-time.After(time.Duration(ProposeTimeoutMs) * time.Millisecond):
+		n.mutex.Lock()
+		delete(n.waiters, entry.Index)
+		n.mutex.Unlock()
+		return nil, ErrProposeTimeout
+	}
+}
+
+func (n *Node) run() {
+	defer n.closeWg.Done()
+
+	ticker := time.NewTicker(time.Duration(TickMs) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.chClose:
+			return
+		case now := <-ticker.C:
+			n.tick(now)
+		}
+	}
+}
+
+// leader 定时发送心跳，联系不到多数节点时退位；follower 超时未收到心跳时发起选举
+func (n *Node) tick(now time.Time) {
+	n.mutex.Lock()
+
+	if n.state == STATE_LEADER {
+		if !n.hasQuorumContact(now) {
+			common.Log.Warning("raft leader step down as quorum lost", n.Id, n.term)
+			n.becomeFollower(n.term)
+			n.mutex.Unlock()
+			return
+		}
+		if now.Sub(n.lastHeartbeat) < time.Duration(HeartbeatMs)*time.Millisecond {
+			n.mutex.Unlock()
+			return
+		}
+		n.lastHeartbeat = now
+		peers := n.otherPeers()
+		n.mutex.Unlock()
+
+		for _, peer := range peers {
+			n.replicate(peer)
+		}
+		return
+	}
+
+	if now.Before(n.electionDeadline) || !n.isVoter() {
+		n.mutex.Unlock()
+		return
+	}
+	n.mutex.Unlock()
+	n.campaign()
+}
+
+// need lock first
+func (n *Node) hasQuorumContact(now time.Time) bool {
+	timeout := time.Duration(ElectionTimeoutMs) * time.Millisecond
+	if now.Sub(n.leaderSince) < timeout {
+		return true
+	}
+
+	count := 1
+	for _, peer := range n.otherPeers() {
+		if now.Sub(n.contact[peer]) < timeout {
+			count++
+		}
+	}
+	return count >= n.quorum()
+}
+
+func (n *Node) campaign() {
+	n.mutex.Lock()
+	if n.state == STATE_LEADER || !n.isVoter() || n.isClosed {
+		n.mutex.Unlock()
+		return
+	}
+
+	n.state = STATE_CANDIDATE
+	n.term++
+	n.votedFor = n.Id
+	n.setLeader("")
+	n.resetElection(time.Now())
+	if e := n.persistState(); e != nil {
+		common.Log.Error("raft node persist state error", n.Id, e)
+		n.mutex.Unlock()
+		return
+	}
+
+	term := n.term
+	args := VoteArgs{Term: term, Candidate: n.Id, LastIndex: n.lastIndex(), LastTerm: n.lastTerm()}
+	peers := n.otherPeers()
+	quorum := n.quorum()
+	common.Log.Info("raft node campaign", n.Id, term)
+
+	votes := 1
+	if votes >= quorum {
+		n.becomeLeader()
+		n.mutex.Unlock()
+		return
+	}
+	n.mutex.Unlock()
+
+	for _, peer := range peers {
+		go func(peer string) {
+			reply, e := n.trans.RequestVote(peer, args)
+			if e != nil {
+				common.Log.Debug("raft node request vote error", n.Id, peer, e)
+				return
+			}
+
+			n.mutex.Lock()
+			defer n.mutex.Unlock()
+
+			if reply.Term > n.term {
+				n.becomeFollower(reply.Term)
+				return
+			}
+			if n.state != STATE_CANDIDATE || n.term != term || !reply.Granted {
+				return
+			}
+			votes++
+			if votes >= quorum {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// 处理投票请求
+func (n *Node) HandleRequestVote(args VoteArgs) VoteReply {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if args.Term > n.term {
+		n.becomeFollower(args.Term)
+	}
+
+	reply := VoteReply{Term: n.term}
+	if args.Term < n.term {
+		return reply
+	}
+
+	upToDate := args.LastTerm > n.lastTerm() || (args.LastTerm == n.lastTerm() && args.LastIndex >= n.lastIndex())
+	if (n.votedFor == "" || n.votedFor == args.Candidate) && upToDate {
+		n.votedFor = args.Candidate
+		if e := n.persistState(); e != nil {
+			common.Log.Error("raft node persist state error", n.Id, e)
+			return reply
+		}
+		n.resetElection(time.Now())
+		reply.Granted = true
+	}
+	return reply
+}
+
+// need lock first
+func (n *Node) becomeLeader() {
+	common.Log.Info("raft node become leader", n.Id, n.term)
+
+	n.state = STATE_LEADER
+	n.setLeader(n.Id)
+	n.leaderSince = time.Now()
+	n.lastHeartbeat = time.Time{}
+	n.nextIndex = make(map[string]int64)
+	n.matchIndex = make(map[string]int64)
+	n.contact = make(map[string]time.Time)
+	for _, peer := range n.otherPeers() {
+		n.nextIndex[peer] = n.lastIndex() + 1
+	}
+
+	// 空条目提交之前 term 的日志
+	entry := Entry{Index: n.lastIndex() + 1, Term: n.term}
+	if e := n.appendLog([]Entry{entry}); e != nil {
+		common.Log.Error("raft node append log error", n.Id, e)
+	} else {
+		n.log = append(n.log, entry)
+	}
+	n.advanceCommit()
+}
+
+// need lock first, term 大于当前 term 时更新
+func (n *Node) becomeFollower(term int64) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		if e := n.persistState(); e != nil {
+			common.Log.Error("raft node persist state error", n.Id, e)
+		}
+	}
+	if n.state == STATE_LEADER {
+		n.failWaiters(ErrNotLeader)
+		n.setLeader("")
+	}
+	n.state = STATE_FOLLOWER
+	n.resetElection(time.Now())
+}
+
+// need lock first
+func (n *Node) failWaiters(err error) {
+	for index, w := range n.waiters {
+		w.ch <- proposeResult{err: err}
+		delete(n.waiters, index)
+	}
+}
+
+// need lock first
+func (n *Node) setLeader(leader string) {
+	if n.leader == leader {
+		return
+	}
+	n.leader = leader
+	select {
+	case n.chLeader <- true:
+	default:
+	}
+}
+
+// 按顺序回调 OnLeaderChange ，回调时不持有锁
+func (n *Node) leaderLoop() {
+	defer n.closeWg.Done()
+
+	notified := ""
+	for {
+		select {
+		case <-n.chClose:
+			return
+		case <-n.chLeader:
+		}
+
+		leader := n.Leader()
+		if leader != notified {
+			notified = leader
+			if n.OnLeaderChange != nil {
+				n.OnLeaderChange(leader)
+			}
+		}
+	}
+}
+
+// need lock first
+func (n *Node) resetElection(now time.Time) {
+	timeout := ElectionTimeoutMs + rand.Intn(ElectionTimeoutMs)
+	n.electionDeadline = now.Add(time.Duration(timeout) * time.Millisecond)
+}
+
+// need lock first
+func (n *Node) isVoter() bool {
+	return common.ContainsStr(n.peers, n.Id)
+}
+
+// need lock first
+func (n *Node) otherPeers() []string {
+	var peers []string
+	for _, peer := range n.peers {
+		if peer != n.Id {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// need lock first
+func (n *Node) quorum() int {
+	return len(n.peers)/2 + 1
+}
+
+func sameStrs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
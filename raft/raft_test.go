@@ -0,0 +1,406 @@
+package raft
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testFSM struct {
+	mutex     sync.Mutex
+	applied   []string
+	snapshots int
+	restored  int
+}
+
+func (f *testFSM) Apply(entry Entry) interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.applied = append(f.applied, string(entry.Data))
+	return len(f.applied)
+}
+
+func (f *testFSM) Snapshot() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.snapshots++
+	return nil
+}
+
+func (f *testFSM) SnapshotData() ([]byte, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return []byte(strings.Join(f.applied, ",")), nil
+}
+
+func (f *testFSM) Restore(data []byte) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.applied = strings.Split(string(data), ",")
+	f.restored++
+	return nil
+}
+
+func (f *testFSM) get() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string{}, f.applied...)
+}
+
+func fastTimers() func() {
+	heartbeat, election, tick, snapshot := HeartbeatMs, ElectionTimeoutMs, TickMs, SnapshotEntries
+	retain, chunk := LogRetainEntries, SnapshotChunkBytes
+	HeartbeatMs, ElectionTimeoutMs, TickMs = 20, 150, 5
+	return func() {
+		HeartbeatMs, ElectionTimeoutMs, TickMs, SnapshotEntries = heartbeat, election, tick, snapshot
+		LogRetainEntries, SnapshotChunkBytes = retain, chunk
+	}
+}
+
+type testCluster struct {
+	t       *testing.T
+	network *LocalNetwork
+	nodes   []*Node
+	fsms    []*testFSM
+}
+
+func newTestCluster(t *testing.T, num int) *testCluster {
+	c := &testCluster{t: t, network: NewLocalNetwork()}
+
+	var peers []string
+	for i := 0; i < num; i++ {
+		peers = append(peers, "node-"+strconv.Itoa(i))
+	}
+	for _, id := range peers {
+		fsm := &testFSM{}
+		node := NewNode(id, "", fsm, c.network.Transport(id))
+		c.network.Add(node)
+		if e := node.Start(peers); e != nil {
+			t.Fatal(e)
+		}
+		c.nodes = append(c.nodes, node)
+		c.fsms = append(c.fsms, fsm)
+	}
+	return c
+}
+
+func (c *testCluster) stop() {
+	for _, node := range c.nodes {
+		node.Stop()
+	}
+}
+
+// 等待除 excluded 之外的节点中选出 leader
+func (c *testCluster) waitLeader(excluded string) *Node {
+	for i := 0; i < 200; i++ {
+		for _, node := range c.nodes {
+			if node.Id != excluded && node.IsLeader() {
+				return node
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatal("no leader elected")
+	return nil
+}
+
+func (c *testCluster) waitApplied(fsm *testFSM, want []string) {
+	for i := 0; i < 200; i++ {
+		if strings.Join(fsm.get(), ",") == strings.Join(want, ",") {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatal("entries not applied", fsm.get(), want)
+}
+
+func TestRaftElection(t *testing.T) {
+	defer fastTimers()()
+
+	c := newTestCluster(t, 3)
+	defer c.stop()
+
+	leader := c.waitLeader("")
+	time.Sleep(100 * time.Millisecond)
+
+	leaders := 0
+	for _, node := range c.nodes {
+		if node.IsLeader() {
+			leaders++
+		}
+		if node.Leader() != leader.Id {
+			t.Fatal("node does not know the leader", node.Id, node.Leader(), leader.Id)
+		}
+	}
+	if leaders != 1 {
+		t.Fatal("leader number error", leaders)
+	}
+}
+
+func TestRaftReplicate(t *testing.T) {
+	defer fastTimers()()
+
+	c := newTestCluster(t, 3)
+	defer c.stop()
+
+	leader := c.waitLeader("")
+	var want []string
+	for i := 0; i < 10; i++ {
+		cmd := "cmd-" + strconv.Itoa(i)
+		r, e := leader.Propose([]byte(cmd))
+		if e != nil {
+			t.Fatal(e)
+		}
+		if r.(int) != i+1 {
+			t.Fatal("apply result error", r)
+		}
+		want = append(want, cmd)
+	}
+	for _, fsm := range c.fsms {
+		c.waitApplied(fsm, want)
+	}
+
+	for _, node := range c.nodes {
+		if node != leader {
+			if _, e := node.Propose([]byte("x")); e != ErrNotLeader {
+				t.Fatal("follower should not accept proposal", e)
+			}
+		}
+	}
+}
+
+func TestRaftFailover(t *testing.T) {
+	defer fastTimers()()
+
+	c := newTestCluster(t, 3)
+	defer c.stop()
+
+	old := c.waitLeader("")
+	if _, e := old.Propose([]byte("a")); e != nil {
+		t.Fatal(e)
+	}
+
+	// old leader is partitioned, its proposal can not commit
+	c.network.Disconnect(old.Id)
+	oldProposeTimeout := ProposeTimeoutMs
+	ProposeTimeoutMs = 200
+	if _, e := old.Propose([]byte("lost")); e == nil {
+		t.Fatal("proposal without quorum should fail")
+	}
+	ProposeTimeoutMs = oldProposeTimeout
+
+	leader := c.waitLeader(old.Id)
+	if _, e := leader.Propose([]byte("b")); e != nil {
+		t.Fatal(e)
+	}
+	if old.IsLeader() {
+		t.Fatal("partitioned leader should step down")
+	}
+
+	// old leader rejoins and drops its uncommitted entry
+	c.network.Connect(old.Id)
+	if _, e := leader.Propose([]byte("c")); e != nil {
+		t.Fatal(e)
+	}
+	for _, fsm := range c.fsms {
+		c.waitApplied(fsm, []string{"a", "b", "c"})
+	}
+	if old.Term() < leader.Term() {
+		t.Fatal("old leader term not updated", old.Term(), leader.Term())
+	}
+}
+
+func TestRaftSnapshot(t *testing.T) {
+	defer fastTimers()()
+	SnapshotEntries, LogRetainEntries = 5, 0
+	SnapshotChunkBytes = 8
+
+	c := newTestCluster(t, 3)
+	defer c.stop()
+
+	leader := c.waitLeader("")
+	var lagging *Node
+	var laggingFsm *testFSM
+	for i, node := range c.nodes {
+		if node != leader {
+			lagging, laggingFsm = node, c.fsms[i]
+			break
+		}
+	}
+	c.network.Disconnect(lagging.Id)
+
+	var want []string
+	for i := 0; i < 20; i++ {
+		cmd := "cmd-" + strconv.Itoa(i)
+		if _, e := leader.Propose([]byte(cmd)); e != nil {
+			t.Fatal(e)
+		}
+		want = append(want, cmd)
+	}
+
+	leader.mutex.Lock()
+	base := leader.log[0].Index
+	leader.mutex.Unlock()
+	if base == 0 {
+		t.Fatal("leader log not compacted")
+	}
+
+	c.network.Connect(lagging.Id)
+	c.waitApplied(laggingFsm, want)
+	if laggingFsm.restored != 1 {
+		t.Fatal("lagging node should be restored from snapshot", laggingFsm.restored)
+	}
+
+	// replicated normally after restore
+	if _, e := leader.Propose([]byte("after")); e != nil {
+		t.Fatal(e)
+	}
+	c.waitApplied(laggingFsm, append(want, "after"))
+}
+
+func TestRaftCatchUpFromLog(t *testing.T) {
+	defer fastTimers()()
+	SnapshotEntries, LogRetainEntries = 5, 50
+
+	c := newTestCluster(t, 3)
+	defer c.stop()
+
+	leader := c.waitLeader("")
+	var lagging *Node
+	var laggingFsm *testFSM
+	var leaderFsm *testFSM
+	for i, node := range c.nodes {
+		if node == leader {
+			leaderFsm = c.fsms[i]
+		} else if lagging == nil {
+			lagging, laggingFsm = node, c.fsms[i]
+		}
+	}
+	c.network.Disconnect(lagging.Id)
+
+	var want []string
+	for i := 0; i < 20; i++ {
+		cmd := "cmd-" + strconv.Itoa(i)
+		if _, e := leader.Propose([]byte(cmd)); e != nil {
+			t.Fatal(e)
+		}
+		want = append(want, cmd)
+	}
+	c.waitApplied(leaderFsm, want)
+	for i := 0; i < 100; i++ {
+		leader.mutex.Lock()
+		done := leader.snapshotIndex > 0
+		leader.mutex.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	leader.mutex.Lock()
+	snapshotIndex, base := leader.snapshotIndex, leader.log[0].Index
+	leader.mutex.Unlock()
+	if snapshotIndex == 0 || base != 0 {
+		t.Fatal("leader should snapshot and keep the log", snapshotIndex, base)
+	}
+
+	// entries after the lagging node's last applied are sent from the log
+	c.network.Connect(lagging.Id)
+	c.waitApplied(laggingFsm, want)
+	if laggingFsm.restored != 0 {
+		t.Fatal("lagging node should catch up from log", laggingFsm.restored)
+	}
+}
+
+func TestRaftRestart(t *testing.T) {
+	defer fastTimers()()
+	SnapshotEntries, LogRetainEntries = 3, 1
+
+	dir, e := ioutil.TempDir("", "whisper-raft")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	network := NewLocalNetwork()
+	fsm := &testFSM{}
+	node := NewNode("node-0", dir, fsm, network.Transport("node-0"))
+	network.Add(node)
+	if e := node.Start([]string{"node-0"}); e != nil {
+		t.Fatal(e)
+	}
+
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 100 && !node.IsLeader(); j++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if _, e := node.Propose([]byte("cmd-" + strconv.Itoa(i))); e != nil {
+			t.Fatal(e)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	term := node.Term()
+	node.Stop()
+
+	node.mutex.Lock()
+	snapshotIndex, base := node.snapshotIndex, node.log[0].Index
+	node.mutex.Unlock()
+	if base == 0 || base >= snapshotIndex || fsm.snapshots == 0 {
+		t.Fatal("log not compacted before restart", base, snapshotIndex)
+	}
+
+	// peers and term are loaded, entries after the snapshot are applied again
+	fsm2 := &testFSM{}
+	node2 := NewNode("node-0", dir, fsm2, network.Transport("node-0"))
+	network.Add(node2)
+	if e := node2.Start(nil); e != nil {
+		t.Fatal(e)
+	}
+	defer node2.Stop()
+
+	if peers := node2.Peers(); len(peers) != 1 || peers[0] != "node-0" {
+		t.Fatal("peers not loaded", peers)
+	}
+	for j := 0; j < 100 && !node2.IsLeader(); j++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if node2.Term() <= term {
+		t.Fatal("term not loaded", node2.Term(), term)
+	}
+	if _, e := node2.Propose([]byte("cmd-5")); e != nil {
+		t.Fatal(e)
+	}
+
+	applied := fsm2.get()
+	if len(applied) == 0 || applied[len(applied)-1] != "cmd-5" {
+		t.Fatal("applied after restart error", applied)
+	}
+	for _, cmd := range applied {
+		// cmd-n is entry n+2 after the no-op of the first leader
+		n, _ := strconv.Atoi(strings.TrimPrefix(cmd, "cmd-"))
+		if int64(n)+2 <= snapshotIndex {
+			t.Fatal("entries in snapshot should not be applied again", applied, snapshotIndex)
+		}
+	}
+}
+
+func TestDecEntriesTorn(t *testing.T) {
+	bb, e := encEntries([]Entry{{Index: 1, Term: 1, Data: []byte("a")}, {Index: 2, Term: 1}})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	entries, valid, e := decEntries(bb)
+	if e != nil || len(entries) != 2 || valid != len(bb) || entries[1].Index != 2 {
+		t.Fatal("dec entries error", entries, valid, e)
+	}
+
+	entries, valid, e = decEntries(bb[:len(bb)-1])
+	if e == nil || len(entries) != 1 || string(entries[0].Data) != "a" {
+		t.Fatal("torn entry should be dropped", entries, valid, e)
+	}
+}